@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Used when the tracker does not provide an interval
+	defaultAnnounceInterval = 30 * time.Minute
+	// Delay before retrying a failed announce
+	announceRetryInterval = time.Minute
+	// Time allowed to send the stopped event to all trackers on shutdown
+	stoppedAnnounceTimeout = 5 * time.Second
+	// Failing trackers are skipped for announceRetryInterval, doubled after
+	// each consecutive failure up to this
+	trackerMaxBackoff = time.Hour
+)
+
+// Time allowed to the trackers to find peers, before the DHT and local
+// service discovery are asked to look up peers right away
+var noPeersWindow = 30 * time.Second
+
+// Returned instead of announcing to a tracker that failed recently
+var errTrackerBackoff = errors.New("tracker backing off")
+
+// Delay before announcing again to a tracker after consecutive failures. The
+// delay requested by the tracker, if any, takes precedence.
+func TrackerBackoff(failures int, err error) time.Duration {
+	var statusError *HttpStatusError
+	if errors.As(err, &statusError) && statusError.RetryAfter > 0 {
+		if statusError.RetryAfter > trackerMaxBackoff {
+			return trackerMaxBackoff
+		}
+		return statusError.RetryAfter
+	}
+	backoff := announceRetryInterval
+	for i := 1; i < failures && backoff < trackerMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > trackerMaxBackoff {
+		backoff = trackerMaxBackoff
+	}
+	return backoff
+}
+
+// The tracker processed the request and rejected it, for instance because the
+// torrent is not registered
+type TrackerFailureError struct {
+	Reason string
+}
+
+func (e *TrackerFailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+type AnnounceResponse struct {
+	Peers       []Peer
+	Interval    time.Duration
+	MinInterval time.Duration
+	// Swarm size according to the tracker, nil when it is not returned
+	Seeders  *int64
+	Leechers *int64
+}
+
+// Time to wait before the next announce. Trackers may ask us to not
+// re-announce more often than the min interval.
+func (r *AnnounceResponse) NextAnnounce() time.Duration {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	if interval < r.MinInterval {
+		interval = r.MinInterval
+	}
+	return interval
+}
+
+// Copy the tiers, shuffling the trackers within each tier
+// http://www.bittorrent.org/beps/bep_0012.html
+func ShuffleTiers(tiers [][]string) [][]string {
+	shuffled := make([][]string, len(tiers))
+	for i, tier := range tiers {
+		shuffled[i] = append([]string(nil), tier...)
+		random.Shuffle(len(shuffled[i]), func(a, b int) {
+			shuffled[i][a], shuffled[i][b] = shuffled[i][b], shuffled[i][a]
+		})
+	}
+	return shuffled
+}
+
+// Look up peers on the DHT and the local network without waiting for the
+// next lookup, when no peer is known once the trackers had noPeersWindow to
+// respond
+func (c *TorrentClient) NoPeersLoop(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(noPeersWindow):
+	}
+	if len(c.Peers()) > 0 || len(c.Conns()) > 0 {
+		return
+	}
+	c.Log.Infof("%s: no peers from the trackers, looking up peers on the DHT and the local network", c.TorrentFilePath)
+	c.LookupPeersNow()
+}
+
+func (c *TorrentClient) LookupPeersNow() {
+	c.lookupOnce.Do(func() {
+		close(c.lookupNow)
+	})
+}
+
+// Order the trackers of each tier by decreasing yield of connectable peers, so
+// that the trackers that found the most peers we could connect to are
+// announced to first and the others only when they fail. The tiers keep the
+// order of the torrent, as required by BEP 12. Trackers that were never
+// announced to come first in their tier, so that each is tried once. Ties keep
+// the current order, with the tracker that last responded at the front.
+// http://www.bittorrent.org/beps/bep_0012.html
+func PrioritizeTiers(tiers [][]string, yield func(announceUrl string) (float64, bool)) [][]string {
+	score := func(announceUrl string) float64 {
+		if value, isKnown := yield(announceUrl); isKnown {
+			return value
+		}
+		return math.Inf(1)
+	}
+	for _, tier := range tiers {
+		sort.SliceStable(tier, func(a, b int) bool {
+			return score(tier[a]) > score(tier[b])
+		})
+	}
+	return tiers
+}
+
+// Try the trackers one after the other, tier by tier, and stop at the first
+// one that responds. The working tracker is moved to the front of its tier so
+// that it is tried first on the next announce.
+func AnnounceToTiers(tiers [][]string, announce func(announceUrl string) (*AnnounceResponse, error)) (*AnnounceResponse, error) {
+	err := errors.New("no tracker")
+	for _, tier := range tiers {
+		for i, announceUrl := range tier {
+			var response *AnnounceResponse
+			if response, err = announce(announceUrl); err == nil {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = announceUrl
+				return response, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// Periodically announce to the trackers until the context is cancelled. The
+// first successful announce to each tracker is sent with the "started" event,
+// subsequent ones with an empty event. The "completed" event is sent once to
+// each tracker that we announced to, when the download finishes. On
+// shutdown, the trackers that we announced to are sent the "stopped" event.
+// http://www.bittorrent.org/beps/bep_0003.html#trackers
+func (c *TorrentClient) AnnounceLoop(ctx context.Context) {
+	tiers := ShuffleTiers(c.AnnounceTiers())
+	if len(tiers) == 0 {
+		return
+	}
+	announced := map[string]bool{}
+	defer c.AnnounceStopped(announced)
+	completed := c.completed
+	// Trackers that were not told about the completion yet, nil once the
+	// completion was announced
+	var pendingCompleted map[string]bool
+	completedSent := false
+	ticker := time.NewTicker(announceRetryInterval)
+	defer ticker.Stop()
+	for {
+		interval := announceRetryInterval
+		tiers = PrioritizeTiers(tiers, c.TrackerYield)
+		response, err := AnnounceToTiers(tiers, func(announceUrl string) (*AnnounceResponse, error) {
+			if c.isBackingOff(announceUrl, time.Now()) {
+				return nil, errTrackerBackoff
+			}
+			event := ""
+			if !announced[announceUrl] {
+				event = "started"
+			} else if pendingCompleted[announceUrl] {
+				event = "completed"
+			}
+			response, err := c.announceTo(ctx, announceUrl, event)
+			if err == nil {
+				announced[announceUrl] = true
+				if event == "completed" {
+					completedSent = true
+					delete(pendingCompleted, announceUrl)
+				} else if event == "started" && pendingCompleted != nil {
+					// The completion was not announced by the previous
+					// run, or no tracker was reachable when it happened
+					pendingCompleted[announceUrl] = true
+				}
+			}
+			return response, err
+		})
+		if err == nil {
+			c.AddPeers(response.Peers)
+			interval = response.NextAnnounce()
+		}
+		if pendingCompleted != nil {
+			if c.AnnounceCompleted(ctx, pendingCompleted) {
+				completedSent = true
+			}
+			if len(pendingCompleted) == 0 && completedSent {
+				pendingCompleted = nil
+				atomic.StoreInt32(&c.completedAnnounced, 1)
+				c.SaveState()
+			}
+		}
+		ticker.Reset(interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-completed:
+			// Announce right away, and only once
+			completed = nil
+			if atomic.LoadInt32(&c.completedAnnounced) == 0 {
+				pendingCompleted = map[string]bool{}
+				for announceUrl := range announced {
+					pendingCompleted[announceUrl] = true
+				}
+			}
+		}
+	}
+}
+
+// Announce to a single tracker and record the outcome. The returned peers are
+// tagged with the tracker.
+func (c *TorrentClient) announceTo(ctx context.Context, announceUrl string, event string) (*AnnounceResponse, error) {
+	response, err := c.GetPeers(ctx, announceUrl, event)
+	if err != nil && ctx.Err() == nil {
+		c.Log.Warnf("announce to %s failed: %v", announceUrl, err)
+	}
+	if ctx.Err() == nil {
+		c.recordAnnounce(announceUrl, response, err)
+	}
+	if err == nil {
+		for i := range response.Peers {
+			response.Peers[i].Tracker = announceUrl
+		}
+	}
+	return response, err
+}
+
+// Send the "completed" event to the pending trackers, which are removed once
+// they got it. Trackers that fail are tried again on the next announce.
+// Returns true when at least one tracker got it.
+func (c *TorrentClient) AnnounceCompleted(ctx context.Context, pending map[string]bool) bool {
+	sent := false
+	for announceUrl := range pending {
+		if c.isBackingOff(announceUrl, time.Now()) {
+			continue
+		}
+		if response, err := c.announceTo(ctx, announceUrl, "completed"); err == nil {
+			c.AddPeers(response.Peers)
+			delete(pending, announceUrl)
+			sent = true
+		}
+	}
+	return sent
+}
+
+// Tell the trackers that we are leaving the swarm. This happens on shutdown,
+// so the requests get their own short timeout.
+func (c *TorrentClient) AnnounceStopped(announced map[string]bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+	for announceUrl := range announced {
+		if _, err := c.GetPeers(ctx, announceUrl, "stopped"); err != nil {
+			c.Log.Debugf("stopped announce to %s failed: %v", announceUrl, err)
+		}
+	}
+}
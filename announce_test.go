@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestReannounceAtInterval(t *testing.T) {
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali1e5:peers6:\x01\x02\x03\x04\x1a\xe1e")
+	info, _ := makeTestInfo(16384, 20000)
+	c, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, announceUrl, info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.AnnounceLoop(ctx)
+		close(done)
+	}()
+	var events []string
+	for _, timeout := range []time.Duration{time.Second, 3 * time.Second} {
+		select {
+		case rawQuery := <-queries:
+			query, _ := url.ParseQuery(rawQuery)
+			events = append(events, query.Get("event"))
+		case <-time.After(timeout):
+			t.Fatal("no announce, events:", events)
+		}
+	}
+	if !reflect.DeepEqual(events, []string{"started", ""}) {
+		t.Fatal(events)
+	}
+	if peers := c.Peers(); len(peers) != 1 || peers[0].Address() != "1.2.3.4:6881" {
+		t.Fatal(peers)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("announce loop still running")
+	}
+	query, _ := url.ParseQuery(<-queries)
+	if query.Get("event") != "stopped" {
+		t.Fatal(query)
+	}
+}
+
+func TestPrioritizeTiersWithinTier(t *testing.T) {
+	yields := map[string]float64{"x": 1, "y": 2, "z": 3}
+	yield := func(announceUrl string) (float64, bool) {
+		value, isKnown := yields[announceUrl]
+		return value, isKnown
+	}
+	got := PrioritizeTiers([][]string{{"x", "new", "y"}, {"z"}}, yield)
+	want := [][]string{{"new", "y", "x"}, {"z"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(got)
+	}
+}
+
+func TestPrioritizeTiersKeepsPromotedTracker(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c"}}
+	_, err := AnnounceToTiers(tiers, func(announceUrl string) (*AnnounceResponse, error) {
+		if announceUrl != "c" {
+			return nil, errTrackerBackoff
+		}
+		return &AnnounceResponse{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := PrioritizeTiers(tiers, func(string) (float64, bool) { return 0, true })
+	if !reflect.DeepEqual(got, [][]string{{"c", "a", "b"}}) {
+		t.Fatal(got)
+	}
+}
+
+func TestShuffleTiers(t *testing.T) {
+	tiers := [][]string{{"a", "b", "c", "d", "e", "f"}, {"g"}}
+	orders := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		shuffled := ShuffleTiers(tiers)
+		if len(shuffled) != 2 || len(shuffled[0]) != 6 || !reflect.DeepEqual(shuffled[1], []string{"g"}) {
+			t.Fatal(shuffled)
+		}
+		seen := map[string]bool{}
+		for _, tracker := range shuffled[0] {
+			seen[tracker] = true
+		}
+		if len(seen) != 6 {
+			t.Fatal(shuffled)
+		}
+		orders[strings.Join(shuffled[0], "")] = true
+	}
+	if len(orders) < 2 {
+		t.Fatal("trackers are not shuffled")
+	}
+	if !reflect.DeepEqual(tiers[0], []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Fatal("tiers modified in place")
+	}
+}
+
+func TestAnnounceToTiersFallback(t *testing.T) {
+	tiers := [][]string{{"a1", "a2"}, {"b1", "b2"}, {"c1"}}
+	var tried []string
+	working := map[string]bool{"b2": true, "c1": true}
+	announce := func(announceUrl string) (*AnnounceResponse, error) {
+		tried = append(tried, announceUrl)
+		if !working[announceUrl] {
+			return nil, errTrackerBackoff
+		}
+		return &AnnounceResponse{}, nil
+	}
+	if _, err := AnnounceToTiers(tiers, announce); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tried, []string{"a1", "a2", "b1", "b2"}) {
+		t.Fatal(tried)
+	}
+	if !reflect.DeepEqual(tiers, [][]string{{"a1", "a2"}, {"b2", "b1"}, {"c1"}}) {
+		t.Fatal(tiers)
+	}
+
+	working = map[string]bool{}
+	if _, err := AnnounceToTiers(tiers, announce); err == nil {
+		t.Fatal("announce succeeded without a working tracker")
+	}
+}
+
+func TestStoppedOnlyToAnnouncedTrackers(t *testing.T) {
+	workingUrl, workingQueries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	backupUrl, backupQueries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	info, _ := makeTestInfo(16384, 20000)
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{
+		"announce":      workingUrl,
+		"announce-list": []interface{}{[]interface{}{workingUrl}, []interface{}{backupUrl}},
+		"info":          info,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.AnnounceLoop(ctx)
+		close(done)
+	}()
+	query, _ := url.ParseQuery(<-workingQueries)
+	if query.Get("event") != "started" {
+		t.Fatal(query)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, status := range c.TrackerStatuses() {
+			if !status.LastAnnounce.IsZero() {
+				return true
+			}
+		}
+		return false
+	})
+	cancel()
+	<-done
+	query, _ = url.ParseQuery(<-workingQueries)
+	if query.Get("event") != "stopped" {
+		t.Fatal(query)
+	}
+	select {
+	case rawQuery := <-backupQueries:
+		t.Fatal("announce to the backup tracker:", rawQuery)
+	default:
+	}
+}
+
+func TestCompletedAnnouncedOnce(t *testing.T) {
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali1e5:peers0:e")
+	info, data := makeTestInfo(16384, 50000)
+	seeder := startTestSeeder(t, info, data)
+	outputDir := t.TempDir()
+	run := func() []string {
+		c, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, announceUrl, info))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.OutputDir = outputDir
+		c.Port = 0
+		c.Encryption = EncryptionDisable
+		c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Run(ctx)
+		}()
+		waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+		// Leave time for the completed announce and a regular one
+		time.Sleep(1500 * time.Millisecond)
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		var events []string
+		for len(queries) > 0 {
+			query, _ := url.ParseQuery(<-queries)
+			events = append(events, query.Get("event"))
+		}
+		return events
+	}
+
+	count := func(events []string, event string) int {
+		n := 0
+		for _, e := range events {
+			if e == event {
+				n++
+			}
+		}
+		return n
+	}
+	if events := run(); count(events, "completed") != 1 || events[0] != "started" {
+		t.Fatal(events)
+	}
+	// The torrent is already complete on restart
+	if events := run(); count(events, "completed") != 0 || events[0] != "started" {
+		t.Fatal(events)
+	}
+}
+
+// A run that completed the download but was stopped before a tracker got the
+// completed event leaves it to the next run
+func TestCompletedAnnouncedAfterRestart(t *testing.T) {
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali1e5:peers0:e")
+	info, data := makeTestInfo(16384, 50000)
+	torrent := encodeTestTorrent(t, announceUrl, info)
+	outputDir := t.TempDir()
+	previous, err := NewTorrentClientFromBytes("test.torrent", torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous.OutputDir = outputDir
+	storage, err := NewFileWriter(outputDir, "", previous.Files(), previous.PieceLength(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	for index := 0; index < previous.PieceCount(); index++ {
+		previous.SetHasPiece(index)
+	}
+	if err := previous.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = outputDir
+	c.Port = 0
+	c.Encryption = EncryptionDisable
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	var events []string
+	for len(events) < 2 {
+		select {
+		case rawQuery := <-queries:
+			query, _ := url.ParseQuery(rawQuery)
+			events = append(events, query.Get("event"))
+		case <-time.After(5 * time.Second):
+			t.Fatal("events:", events)
+		}
+	}
+	if !reflect.DeepEqual(events, []string{"started", "completed"}) {
+		t.Fatal(events)
+	}
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&c.completedAnnounced) == 1 })
+}
+
+// Every tracker that saw us start is told about the completion, not only the
+// one that answers the next announce
+func TestCompletedToAllTrackers(t *testing.T) {
+	firstUrl, firstQueries := startFakeHttpTracker(t, "d8:intervali1e5:peers0:e")
+	secondUrl, secondQueries := startFakeHttpTracker(t, "d8:intervali1e5:peers0:e")
+	info, _ := makeTestInfo(16384, 20000)
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{
+		"announce":      firstUrl,
+		"announce-list": []interface{}{[]interface{}{firstUrl, secondUrl}},
+		"info":          info,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.AnnounceLoop(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// Trackers that were never announced to are tried first in their tier
+	waitEvent := func(queries chan string, event string) {
+		t.Helper()
+		for {
+			select {
+			case rawQuery := <-queries:
+				if query, _ := url.ParseQuery(rawQuery); query.Get("event") == event {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no", event, "announce")
+			}
+		}
+	}
+	waitEvent(firstQueries, "started")
+	waitEvent(secondQueries, "started")
+	c.markComplete()
+	waitEvent(firstQueries, "completed")
+	waitEvent(secondQueries, "completed")
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&c.completedAnnounced) == 1 })
+}
+
+func TestTrackerBackoff(t *testing.T) {
+	err := errors.New("connection refused")
+	for failures, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 4 * time.Minute, 7: trackerMaxBackoff, 20: trackerMaxBackoff} {
+		if backoff := TrackerBackoff(failures, err); backoff != expected {
+			t.Errorf("%d failures: %v", failures, backoff)
+		}
+	}
+	if backoff := TrackerBackoff(3, &HttpStatusError{StatusCode: 429, RetryAfter: 10 * time.Second}); backoff != 10*time.Second {
+		t.Error(backoff)
+	}
+	if backoff := TrackerBackoff(1, &HttpStatusError{StatusCode: 503, RetryAfter: 48 * time.Hour}); backoff != trackerMaxBackoff {
+		t.Error(backoff)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-5":                            0,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if delay := ParseRetryAfter(value, now); delay != expected {
+			t.Errorf("%q: %v", value, delay)
+		}
+	}
+}
+
+func TestTrackerRetryAfter(t *testing.T) {
+	var announces int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&announces, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	info, _ := makeTestInfo(16384, 20000)
+	c, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, server.URL+"/announce", info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Log = &captureLogger{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.AnnounceLoop(ctx)
+		close(done)
+	}()
+	waitFor(t, 5*time.Second, func() bool { return !c.TrackerStatuses()[0].LastAnnounce.IsZero() })
+	cancel()
+	<-done
+	// The 429 is not retried, and no stopped event is sent to a tracker that
+	// was never announced to
+	if count := atomic.LoadInt32(&announces); count != 1 {
+		t.Fatal(count)
+	}
+	status := c.TrackerStatuses()[0]
+	if delay := status.NextAnnounce.Sub(status.LastAnnounce); delay != 2*time.Minute {
+		t.Fatal(delay)
+	}
+	if !c.isBackingOff(status.Url, status.LastAnnounce.Add(time.Minute)) || c.isBackingOff(status.Url, status.NextAnnounce) {
+		t.Fatal("tracker is not skipped until the retry delay expires")
+	}
+
+	// A successful announce resets the backoff
+	c.recordAnnounce(status.Url, &AnnounceResponse{}, nil)
+	if c.isBackingOff(status.Url, time.Now()) || c.TrackerStatuses()[0].Failures != 0 {
+		t.Fatal(c.TrackerStatuses()[0])
+	}
+}
+
+// When the trackers return no peers, the DHT is asked for peers again without
+// waiting for its next lookup
+func TestNoPeersTriggersDHTLookup(t *testing.T) {
+	defer func(nodes []string, window time.Duration) {
+		dhtBootstrapNodes, noPeersWindow = nodes, window
+	}(dhtBootstrapNodes, noPeersWindow)
+	dhtBootstrapNodes, noPeersWindow = nil, 500*time.Millisecond
+	// DHT node that knows itself, and the peer from its second get_peers on
+	node, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	nodeID := strings.Repeat("n", 20)
+	nodeAddr := node.LocalAddr().(*net.UDPAddr)
+	compactNode := nodeID + string(nodeAddr.IP.To4()) + string([]byte{byte(nodeAddr.Port >> 8), byte(nodeAddr.Port)})
+	lookups := make(chan time.Time, 16)
+	go func() {
+		buffer := make([]byte, 1500)
+		getPeersCount := 0
+		for {
+			length, addr, err := node.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			decoded, err := bencode.Decode(bytes.NewReader(buffer[:length]))
+			query, isDict := decoded.(map[string]interface{})
+			if err != nil || !isDict {
+				continue
+			}
+			values := map[string]interface{}{"id": nodeID, "nodes": compactNode, "token": "tok"}
+			if query["q"] == "get_peers" {
+				lookups <- time.Now()
+				getPeersCount++
+				if getPeersCount > 1 {
+					values["values"] = []interface{}{"\x01\x02\x03\x04\x1a\xe1"}
+				}
+			}
+			var response bytes.Buffer
+			bencode.Marshal(&response, map[string]interface{}{"t": query["t"], "y": "r", "r": values})
+			node.WriteToUDP(response.Bytes(), addr)
+		}
+	}()
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	info, _ := makeTestInfo(16384, 20000)
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{
+		"announce": announceUrl,
+		"info":     info,
+		"nodes":    []interface{}{[]interface{}{"127.0.0.1", int64(nodeAddr.Port)}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Port = 0
+	logger := &captureLogger{}
+	c.Log = logger
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+	start := time.Now()
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-lookups:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("get_peers %d not sent", i+1)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < noPeersWindow {
+		t.Fatal("second lookup before the window", elapsed)
+	}
+	if !logger.Contains("INFO", "no peers from the trackers") {
+		t.Fatal(logger.messages)
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		for _, peer := range c.Peers() {
+			if peer.Address() == "1.2.3.4:6881" {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Lists and dictionaries nested deeper than this are rejected
+const maxBencodeDepth = 256
+
+// Return the position right after the bencoded value that starts at pos,
+// without decoding it
+func ScanBencodeValue(data string, pos int) (int, error) {
+	return scanBencodeValue(data, pos, 0)
+}
+
+func scanBencodeValue(data string, pos int, depth int) (int, error) {
+	if pos >= len(data) {
+		return 0, errors.New("bencode: unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := strings.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, errors.New("bencode: unterminated integer")
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		if depth >= maxBencodeDepth {
+			return 0, errors.New("bencode: nesting too deep")
+		}
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			if pos, err = scanBencodeValue(data, pos, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, errors.New("bencode: unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := strings.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, errors.New("bencode: invalid string length")
+		}
+		length, err := strconv.Atoi(data[pos : pos+colon])
+		if err != nil || length < 0 {
+			return 0, errors.New("bencode: invalid string length")
+		}
+		// Compared before adding, so that huge lengths cannot overflow
+		if length > len(data)-pos-colon-1 {
+			return 0, errors.New("bencode: string exceeds data")
+		}
+		return pos + colon + 1 + length, nil
+	}
+	return 0, errors.New("bencode: invalid value at position " + strconv.Itoa(pos))
+}
+
+// Byte range of a bencoded value in the data it was parsed from
+type BencodeSpan struct {
+	Start int
+	End   int
+}
+
+// Record where the value of each key of the dictionary that starts the data is
+// located, so that values can be extracted exactly as they were encoded
+func ScanBencodeDict(data string) (map[string]BencodeSpan, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errors.New("bencode: not a dictionary")
+	}
+	spans := map[string]BencodeSpan{}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyEnd, err := ScanBencodeValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		colon := strings.IndexByte(data[pos:keyEnd], ':')
+		if colon < 0 {
+			return nil, errors.New("bencode: dictionary key is not a string")
+		}
+		valueEnd, err := ScanBencodeValue(data, keyEnd)
+		if err != nil {
+			return nil, err
+		}
+		spans[data[pos+colon+1:keyEnd]] = BencodeSpan{keyEnd, valueEnd}
+		pos = valueEnd
+	}
+	if pos >= len(data) {
+		return nil, errors.New("bencode: unterminated dictionary")
+	}
+	return spans, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The info hash is computed from the bytes of the file, even when the keys
+// are not sorted or are unknown to the decoder
+func TestInfoHashOfUnusualTorrents(t *testing.T) {
+	for torrent, want := range map[string]string{
+		// Unsorted keys, at the top level and in the info dictionary
+		"d4:infod4:name1:f6:lengthi20000e6:pieces40:012345678901234567890123456789012345678912:piece lengthi16384ee8:announce9:http://t/e": "00effe093b9c163f1dbe9c980c5252588ba64ee7",
+		// Non-standard keys that a re-encoding could drop or reorder
+		"d8:announce9:http://t/4:infod6:lengthi20000e4:name1:f12:piece lengthi16384e6:pieces40:01234567890123456789012345678901234567897:privatei0e6:x-misc3:abcee": "e0809527eb0dde669b0314f859b6ea8a6d09e7a1",
+	} {
+		c, err := NewTorrentClientFromBytes("test.torrent", []byte(torrent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if infoHash := hex.EncodeToString([]byte(c.InfoHash())); infoHash != want {
+			t.Errorf("info hash %s, want %s", infoHash, want)
+		}
+	}
+}
+
+func TestScanBencodeDict(t *testing.T) {
+	data := "d1:bli1e3:abce1:ad1:xi-2ee1:c0:e"
+	spans, err := ScanBencodeDict(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"b": "li1e3:abce", "a": "d1:xi-2ee", "c": "0:"} {
+		span, isKnown := spans[key]
+		if !isKnown || data[span.Start:span.End] != want {
+			t.Errorf("%s: %v", key, span)
+		}
+	}
+	for _, invalid := range []string{"", "le", "d1:a", "d1:ai1e", "d1:a5:abce", "di1e1:ae"} {
+		if _, err := ScanBencodeDict(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
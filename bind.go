@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Source address of all connections, selected with -bind; nil to let the
+// system choose
+var bindIP net.IP
+
+// Check that the address belongs to this host before using it as the source
+// of all connections
+func ParseBindAddress(address string) (net.IP, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %s", address)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("address %s is not available: %w", address, err)
+	}
+	listener.Close()
+	return ip, nil
+}
+
+// Host of the listen addresses: empty for all interfaces
+func bindHost() string {
+	if bindIP == nil {
+		return ""
+	}
+	return bindIP.String()
+}
+
+// Local address of outgoing tcp connections. The interface must be nil, rather
+// than a nil *net.TCPAddr, when no address is bound.
+func bindTCPAddr() net.Addr {
+	if bindIP == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: bindIP}
+}
+
+func bindUDPAddr() *net.UDPAddr {
+	if bindIP == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: bindIP}
+}
+
+// Dialer of outgoing tcp connections from the bound address
+func NewBoundDialer() *net.Dialer {
+	return &net.Dialer{LocalAddr: bindTCPAddr()}
+}
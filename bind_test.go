@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Bind all connections to the address until the test ends
+func withBindIP(t *testing.T, ip net.IP) {
+	t.Helper()
+	previous := bindIP
+	bindIP = ip
+	t.Cleanup(func() { bindIP = previous })
+}
+
+func TestParseBindAddress(t *testing.T) {
+	if ip, err := ParseBindAddress("127.0.0.2"); err != nil || !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatal(ip, err)
+	}
+	// A documentation address that no interface has, and a host name
+	for _, address := range []string{"192.0.2.1", "localhost"} {
+		if _, err := ParseBindAddress(address); err == nil {
+			t.Fatal(address)
+		}
+	}
+}
+
+func TestBoundConnections(t *testing.T) {
+	withBindIP(t, net.IPv4(127, 0, 0, 2))
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.listener.Close()
+	if addr := c.listener.Addr().(*net.TCPAddr); !addr.IP.Equal(bindIP) || addr.Port != c.Port {
+		t.Fatal(addr)
+	}
+
+	// Peer connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+	c.Connect(context.Background(), loopbackPeer(listener.Addr().(*net.TCPAddr).Port))
+	if addr := (<-accepted).(*net.TCPAddr); !addr.IP.Equal(bindIP) {
+		t.Fatal(addr)
+	}
+
+	// Tracker requests
+	remoteAddrs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer server.Close()
+	withTrackerHttpClient(t, NewHttpClient(nil))
+	if _, err := c.GetPeers(context.Background(), server.URL+"/announce", "started"); err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(<-remoteAddrs); host != "127.0.0.2" {
+		t.Fatal(host)
+	}
+}
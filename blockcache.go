@@ -0,0 +1,72 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU cache of the blocks served to peers, so that popular pieces are not
+// read from disk for every peer. Pieces never change once they are written,
+// so entries are only evicted to bound the cache size.
+type BlockCache struct {
+	// Maximum total size of the cached blocks in bytes
+	Capacity int64
+
+	size    int64
+	order   *list.List
+	entries map[BlockRequest]*list.Element
+	lock    sync.Mutex
+}
+
+type blockCacheEntry struct {
+	block BlockRequest
+	data  []byte
+}
+
+// Returns nil, which disables caching, when the capacity is not positive
+func NewBlockCache(capacity int64) *BlockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &BlockCache{
+		Capacity: capacity,
+		order:    list.New(),
+		entries:  map[BlockRequest]*list.Element{},
+	}
+}
+
+// The returned data must not be modified
+func (bc *BlockCache) Get(block BlockRequest) ([]byte, bool) {
+	if bc == nil {
+		return nil, false
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	element, isCached := bc.entries[block]
+	if !isCached {
+		return nil, false
+	}
+	bc.order.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).data, true
+}
+
+func (bc *BlockCache) Put(block BlockRequest, data []byte) {
+	if bc == nil || int64(len(data)) > bc.Capacity {
+		return
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if element, isCached := bc.entries[block]; isCached {
+		bc.order.MoveToFront(element)
+		return
+	}
+	bc.entries[block] = bc.order.PushFront(&blockCacheEntry{block, data})
+	bc.size += int64(len(data))
+	for bc.size > bc.Capacity {
+		oldest := bc.order.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		bc.order.Remove(oldest)
+		delete(bc.entries, entry.block)
+		bc.size -= int64(len(entry.data))
+	}
+}
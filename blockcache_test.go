@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// Storage that counts the reads
+type countingStorage struct {
+	*MemoryStorage
+	reads int64
+}
+
+func (s *countingStorage) ReadAt(data []byte, offset int64) error {
+	atomic.AddInt64(&s.reads, 1)
+	return s.MemoryStorage.ReadAt(data, offset)
+}
+
+func TestServeBlockFromCache(t *testing.T) {
+	info, data := makeTestInfo(2*BlockSize, 4*BlockSize)
+	c := newTestClient(t, info)
+	storage := &countingStorage{MemoryStorage: NewMemoryStorage(int64(len(data)))}
+	storage.MemoryStorage.WriteAt(data, 0)
+	c.Storage = storage
+	c.BlockCache = NewBlockCache(1 << 20)
+	for index := 0; index < c.PieceCount(); index++ {
+		c.SetHasPiece(index)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	pc := NewPeerConn(local, loopbackPeer(6881), "", c.PieceCount())
+	pc.AmChoking = false
+	blocks := make(chan []byte, 4)
+	go func() {
+		for {
+			msg, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			_, _, block, _ := ParsePieceMessage(msg)
+			blocks <- block
+		}
+	}()
+
+	for i, want := range []int64{1, 1, 2} {
+		begin := 0
+		if i == 2 {
+			begin = BlockSize
+		}
+		if err := c.HandleRequest(pc, MakeRequestMessage(1, begin, BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+		if block := <-blocks; !bytes.Equal(block, data[2*BlockSize+begin:][:BlockSize]) {
+			t.Fatalf("request %d: wrong block", i)
+		}
+		if reads := atomic.LoadInt64(&storage.reads); reads != want {
+			t.Fatalf("request %d: %d disk reads", i, reads)
+		}
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	bc := NewBlockCache(2 * BlockSize)
+	block := make([]byte, BlockSize)
+	first, second, third := BlockRequest{0, 0, BlockSize}, BlockRequest{0, BlockSize, BlockSize}, BlockRequest{1, 0, BlockSize}
+	bc.Put(first, block)
+	bc.Put(second, block)
+	// The first block is now the most recently used
+	bc.Get(first)
+	bc.Put(third, block)
+	if _, isCached := bc.Get(second); isCached {
+		t.Fatal("least recently used block not evicted")
+	}
+	for _, request := range []BlockRequest{first, third} {
+		if _, isCached := bc.Get(request); !isCached {
+			t.Fatalf("block %v evicted", request)
+		}
+	}
+	// Blocks larger than the cache are not kept
+	bc.Put(BlockRequest{2, 0, 3 * BlockSize}, make([]byte, 3*BlockSize))
+	if _, isCached := bc.Get(BlockRequest{2, 0, 3 * BlockSize}); isCached || bc.size != 2*BlockSize {
+		t.Fatal("oversized block cached")
+	}
+	if NewBlockCache(0) != nil {
+		t.Fatal("zero capacity cache")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Peers in these ranges are neither dialed nor accepted; loaded with
+// -blocklist, nil when there is no blocklist
+var peerBlocklist *Blocklist
+
+// Sorted, non-overlapping ranges of blocked addresses. IPv4 addresses are
+// stored in their 16-byte form, so that all addresses compare alike.
+type Blocklist struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	first net.IP
+	last  net.IP
+}
+
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBlocklist(f)
+}
+
+// Parse one range per line, in the PeerGuardian format
+// ("description:first-last"), as a CIDR or as a single address. Empty lines
+// and lines that start with # are ignored.
+func ParseBlocklist(r io.Reader) (*Blocklist, error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocked, err := parseIPRange(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		ranges = append(ranges, blocked)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].first, ranges[j].first) < 0
+	})
+	b := &Blocklist{}
+	for _, blocked := range ranges {
+		last := len(b.ranges) - 1
+		if last >= 0 && bytes.Compare(blocked.first, b.ranges[last].last) <= 0 {
+			if bytes.Compare(blocked.last, b.ranges[last].last) > 0 {
+				b.ranges[last].last = blocked.last
+			}
+			continue
+		}
+		b.ranges = append(b.ranges, blocked)
+	}
+	return b, nil
+}
+
+func parseIPRange(line string) (ipRange, error) {
+	if _, network, err := net.ParseCIDR(line); err == nil {
+		first := network.IP.To16()
+		last := make(net.IP, len(first))
+		// Mask of the 16-byte form of IPv4 networks
+		ones, bits := network.Mask.Size()
+		mask := net.CIDRMask(ones+8*net.IPv6len-bits, 8*net.IPv6len)
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		return ipRange{first, last}, nil
+	}
+	// Strip the description of the PeerGuardian format, which may contain
+	// colons itself
+	if colon := strings.LastIndex(line, ":"); colon >= 0 && strings.Contains(line[colon:], "-") {
+		line = line[colon+1:]
+	}
+	firstString, lastString := line, line
+	if dash := strings.Index(line, "-"); dash >= 0 {
+		firstString, lastString = line[:dash], line[dash+1:]
+	}
+	first := net.ParseIP(strings.TrimSpace(firstString))
+	last := net.ParseIP(strings.TrimSpace(lastString))
+	if first == nil || last == nil {
+		return ipRange{}, fmt.Errorf("invalid range %s", line)
+	}
+	first, last = first.To16(), last.To16()
+	if bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %s", line)
+	}
+	return ipRange{first, last}, nil
+}
+
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ranges)
+}
+
+// Binary search of the last range that starts at or before the address
+func (b *Blocklist) Blocks(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].first, ip) > 0
+	})
+	return i > 0 && bytes.Compare(ip, b.ranges[i-1].last) <= 0
+}
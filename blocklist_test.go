@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBlocklist = `# comment
+Some org: with colons:1.2.3.0-1.2.3.255
+
+10.0.0.0/8
+10.1.0.0/16
+127.0.0.2
+2001:db8::/32
+`
+
+// Block the ranges of the blocklist until the test ends
+func withBlocklist(t *testing.T, blocklist *Blocklist) {
+	t.Helper()
+	previous := peerBlocklist
+	peerBlocklist = blocklist
+	t.Cleanup(func() { peerBlocklist = previous })
+}
+
+func TestParseBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.p2p")
+	if err := os.WriteFile(path, []byte(testBlocklist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The /16 is merged into the /8
+	if b.Len() != 4 {
+		t.Fatal(b.Len())
+	}
+	for ip, blocked := range map[string]bool{
+		"1.2.3.0":        true,
+		"1.2.3.255":      true,
+		"1.2.4.0":        false,
+		"1.2.2.255":      false,
+		"10.200.1.1":     true,
+		"11.0.0.0":       false,
+		"127.0.0.2":      true,
+		"127.0.0.1":      false,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+		"::ffff:1.2.3.4": true,
+	} {
+		if b.Blocks(net.ParseIP(ip)) != blocked {
+			t.Errorf("%s: blocked %v", ip, !blocked)
+		}
+	}
+	var nilBlocklist *Blocklist
+	if nilBlocklist.Blocks(net.ParseIP("1.2.3.4")) || nilBlocklist.Len() != 0 {
+		t.Fatal("nil blocklist blocks")
+	}
+	for _, invalid := range []string{"1.2.3.4-1.2.3.1", "nope", "a:1.2.3.4-x"} {
+		if _, err := ParseBlocklist(strings.NewReader(invalid)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Error(invalid, err)
+		}
+	}
+}
+
+func TestBlockedPeersDropped(t *testing.T) {
+	b, err := ParseBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withBlocklist(t, b)
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	logger := &captureLogger{}
+	c.Log = logger
+	c.AddPeers([]Peer{
+		{IP: net.ParseIP("1.2.3.4"), Port: 6881},
+		{IP: net.ParseIP("5.6.7.8"), Port: 6881},
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+	})
+	if peers := c.Peers(); len(peers) != 1 || peers[0].Address() != "5.6.7.8:6881" {
+		t.Fatal(peers)
+	}
+
+	// Incoming connections from a blocked address are closed right away
+	startTestListener(t, c)
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, Timeout: 5 * time.Second}
+	conn, err := dialer.Dial("tcp", loopbackPeer(c.Port).Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !logger.Contains("DEBUG", "incoming peer 127.0.0.2") {
+		t.Fatal(logger.messages)
+	}
+}
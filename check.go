@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pieces of the existing files, sorted by state
+type CheckResult struct {
+	Valid   []int
+	Missing []int
+	Corrupt []int
+}
+
+func (r *CheckResult) Percent() float64 {
+	pieceCount := len(r.Valid) + len(r.Missing) + len(r.Corrupt)
+	if pieceCount == 0 {
+		return 100
+	}
+	return 100 * float64(len(r.Valid)) / float64(pieceCount)
+}
+
+// Hash every piece of the files found in the output directory, without
+// creating or modifying them. Pieces that cannot be read entirely, because
+// a file is missing or too short, are missing; pieces that do not match their
+// hash are corrupt. The valid pieces are recorded in the resume state, so
+// that the next run does not download them again.
+func (c *TorrentClient) CheckPieces() (*CheckResult, error) {
+	reader, err := OpenFileReader(c.OutputDir, c.IncompleteDir, c.Files(), c.PieceLength())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	// Keep the transfer counters of the previous runs
+	c.Storage = reader
+	if err := c.LoadState(false); err != nil {
+		c.Log.Warnf("%s: could not load resume state: %v", c.TorrentFilePath, err)
+	}
+	c.piecesLock.Lock()
+	c.HavePieces = make([]bool, c.PieceCount())
+	c.leftValid = false
+	c.piecesLock.Unlock()
+
+	expectedHashes, err := c.PieceHashes()
+	if err != nil {
+		return nil, err
+	}
+	readPiece := func(index int, piece []byte) error {
+		return reader.ReadAt(piece, c.PieceOffset(index))
+	}
+	hashes, errs := HashPiecesConcurrently(c.PieceCount(), *hashWorkers, c.PieceSize, readPiece)
+	result := &CheckResult{}
+	for index := 0; index < c.PieceCount(); index++ {
+		if errs[index] != nil {
+			result.Missing = append(result.Missing, index)
+		} else if !bytes.Equal(hashes[index], expectedHashes[index][:]) {
+			result.Corrupt = append(result.Corrupt, index)
+		} else {
+			result.Valid = append(result.Valid, index)
+			c.SetHasPiece(index)
+		}
+	}
+	if err := c.SaveState(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Check the data of each torrent and print a report. Returns the number of
+// torrents that could not be checked or that are incomplete.
+func CheckTorrents(ctx context.Context, torrentFilePaths []string) int {
+	failedCount := 0
+	logger := DefaultLogger()
+	for _, path := range torrentFilePaths {
+		client, err := LoadClient(ctx, path)
+		if err == nil && !client.HasInfo() {
+			err = errors.New("metadata of magnet links is not known")
+		}
+		if err != nil {
+			logger.Errorf("%s: %v", path, err)
+			failedCount++
+			continue
+		}
+		result, err := client.CheckPieces()
+		if err != nil {
+			logger.Errorf("%s: %v", path, err)
+			failedCount++
+			continue
+		}
+		fmt.Printf("%s: %.1f%% valid, %d valid, %d missing, %d corrupt pieces\n",
+			path, result.Percent(), len(result.Valid), len(result.Missing), len(result.Corrupt))
+		if len(result.Missing) > 0 {
+			fmt.Printf("%s: missing pieces %s\n", path, FormatRanges(result.Missing))
+		}
+		if len(result.Corrupt) > 0 {
+			fmt.Printf("%s: corrupt pieces %s\n", path, FormatRanges(result.Corrupt))
+		}
+		if len(result.Missing)+len(result.Corrupt) > 0 {
+			failedCount++
+		}
+	}
+	return failedCount
+}
+
+// Format sorted indexes as comma-separated ranges, for instance "1-3,7"
+func FormatRanges(indexes []int) string {
+	var ranges []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(indexes[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(indexes[i])+"-"+strconv.Itoa(indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckPiecesFlagsCorruptPiece(t *testing.T) {
+	info, data := makeTestInfo(16384, 5*16384-100)
+	c := newTestClient(t, info)
+	corrupt := append([]byte(nil), data...)
+	corrupt[2*16384+10] ^= 0xff
+	if err := os.WriteFile(filepath.Join(c.OutputDir, "test"), corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.CheckPieces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Valid, []int{0, 1, 3, 4}) || !reflect.DeepEqual(result.Corrupt, []int{2}) || len(result.Missing) != 0 {
+		t.Fatal(result)
+	}
+	if percent := result.Percent(); percent != 80 {
+		t.Fatal(percent)
+	}
+
+	// The next run only downloads the corrupt piece
+	next := newTestClient(t, info)
+	next.OutputDir = c.OutputDir
+	next.Storage, err = NewFileWriter(next.OutputDir, "", next.Files(), next.PieceLength(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Storage.Close()
+	if err := next.LoadState(false); err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < next.PieceCount(); index++ {
+		if next.HasPiece(index) != (index != 2) {
+			t.Fatalf("piece %d: %v", index, next.HasPiece(index))
+		}
+	}
+}
+
+func TestCheckPiecesMissingData(t *testing.T) {
+	info, data := makeTestInfo(16384, 3*16384)
+	c := newTestClient(t, info)
+	if err := os.WriteFile(filepath.Join(c.OutputDir, "test"), data[:16384+100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.CheckPieces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Valid, []int{0}) || !reflect.DeepEqual(result.Missing, []int{1, 2}) || len(result.Corrupt) != 0 {
+		t.Fatal(result)
+	}
+}
+
+func TestFormatRanges(t *testing.T) {
+	for want, indexes := range map[string][]int{
+		"":          nil,
+		"4":         {4},
+		"1-3,7":     {1, 2, 3, 7},
+		"0,2,5-6,9": {0, 2, 5, 6, 9},
+	} {
+		if ranges := FormatRanges(indexes); ranges != want {
+			t.Errorf("%v: %s", indexes, ranges)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Choking algorithm: interested peers that upload to us the fastest are
+// unchoked, plus one random optimistic unchoke to discover better peers.
+// http://www.bittorrent.org/beps/bep_0003.html#peer-protocol
+
+const (
+	// Default number of interested peers that we upload to simultaneously,
+	// including the optimistic unchoke
+	defaultUnchokeSlots = 4
+	rechokeInterval     = 10 * time.Second
+	// The optimistic unchoke rotates every 3 rechokes
+	optimisticUnchokeRounds = 3
+)
+
+// Rechoke every 10 seconds until the context is cancelled
+func (c *TorrentClient) ChokeLoop(ctx context.Context) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for round := 1; ; round++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.chokingLock.Lock()
+		for _, pc := range c.Conns() {
+			pc.updateRates(rechokeInterval)
+		}
+		if round%optimisticUnchokeRounds == 0 {
+			c.optimisticUnchoke = nil
+		}
+		c.chokingLock.Unlock()
+		c.UpdateChoking()
+	}
+}
+
+// Choke and unchoke peers based on their transfer rates over the last
+// rechoke interval
+func (c *TorrentClient) UpdateChoking() {
+	c.chokingLock.Lock()
+	defer c.chokingLock.Unlock()
+	conns := c.Conns()
+	unchoked := c.SelectUnchoked(conns)
+	for _, pc := range conns {
+		if unchoked[pc] && pc.IsChoking() {
+			pc.SendUnchoke()
+		} else if !unchoked[pc] && !pc.IsChoking() {
+			pc.SendChoke()
+		}
+	}
+}
+
+// Pick the peers to unchoke: the fastest interested peers, and one optimistic
+// unchoke that is kept until it is rotated by ChokeLoop. While downloading,
+// peers are ranked by their upload rate to us; once we are seeding, by our
+// upload rate to them. Must be called with chokingLock held.
+func (c *TorrentClient) SelectUnchoked(conns []*PeerConn) map[*PeerConn]bool {
+	slots := c.UnchokeSlots
+	if slots <= 0 {
+		slots = defaultUnchokeSlots
+	}
+	seeding := c.Left() == 0
+	var interested []*PeerConn
+	for _, pc := range conns {
+		if pc.IsPeerInterested() {
+			interested = append(interested, pc)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		if seeding {
+			return interested[i].uploadRate > interested[j].uploadRate
+		}
+		return interested[i].downloadRate > interested[j].downloadRate
+	})
+
+	unchoked := map[*PeerConn]bool{}
+	for _, pc := range interested {
+		if len(unchoked) >= slots-1 {
+			break
+		}
+		unchoked[pc] = true
+	}
+
+	// Keep the current optimistic unchoke if it is still a candidate,
+	// otherwise pick a new one at random
+	var candidates []*PeerConn
+	isCandidate := false
+	for _, pc := range interested {
+		if !unchoked[pc] {
+			candidates = append(candidates, pc)
+			isCandidate = isCandidate || pc == c.optimisticUnchoke
+		}
+	}
+	if !isCandidate {
+		c.optimisticUnchoke = nil
+		if len(candidates) > 0 {
+			c.optimisticUnchoke = candidates[random.Intn(len(candidates))]
+		}
+	}
+	if c.optimisticUnchoke != nil {
+		unchoked[c.optimisticUnchoke] = true
+	}
+	return unchoked
+}
+
+// Compute the transfer rates since the previous call. Must be called with the
+// client chokingLock held.
+func (pc *PeerConn) updateRates(elapsed time.Duration) {
+	downloaded := atomic.LoadInt64(&pc.Downloaded)
+	uploaded := atomic.LoadInt64(&pc.Uploaded)
+	pc.downloadRate = float64(downloaded-pc.lastDownloaded) / elapsed.Seconds()
+	pc.uploadRate = float64(uploaded-pc.lastUploaded) / elapsed.Seconds()
+	pc.lastDownloaded = downloaded
+	pc.lastUploaded = uploaded
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Interested peers that uploaded the given amounts to us over a rechoke
+// interval
+func makeRankedConns(downloaded ...int64) []*PeerConn {
+	var conns []*PeerConn
+	for i, amount := range downloaded {
+		pc := NewPeerConn(nil, loopbackPeer(i+1), "", 1)
+		pc.PeerInterested = true
+		pc.Downloaded = amount
+		pc.updateRates(rechokeInterval)
+		conns = append(conns, pc)
+	}
+	return conns
+}
+
+func TestSelectUnchokedFastestPeers(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.UnchokeSlots = 3
+	conns := makeRankedConns(100, 500, 300, 50, 400, 10)
+	// Not interested peers are never unchoked, however fast they are
+	conns[5].PeerInterested = false
+	conns[5].Downloaded = 1000
+	conns[5].updateRates(time.Second)
+	optimistic := map[*PeerConn]int{}
+	for round := 0; round < 100; round++ {
+		c.optimisticUnchoke = nil
+		unchoked := c.SelectUnchoked(conns)
+		if len(unchoked) != 3 || !unchoked[conns[1]] || !unchoked[conns[4]] || unchoked[conns[5]] {
+			t.Fatal(unchoked)
+		}
+		for pc := range unchoked {
+			if pc != conns[1] && pc != conns[4] {
+				optimistic[pc]++
+			}
+		}
+	}
+	// The optimistic unchoke is any of the other interested peers
+	if len(optimistic) != 3 {
+		t.Fatal(optimistic)
+	}
+}
+
+func TestOptimisticUnchokeIsKept(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.UnchokeSlots = 2
+	conns := makeRankedConns(100, 50, 40, 30)
+	c.SelectUnchoked(conns)
+	optimistic := c.optimisticUnchoke
+	if optimistic == nil || optimistic == conns[0] {
+		t.Fatal("no optimistic unchoke")
+	}
+	for round := 0; round < 10; round++ {
+		if unchoked := c.SelectUnchoked(conns); !unchoked[optimistic] || !unchoked[conns[0]] {
+			t.Fatal(unchoked)
+		}
+	}
+}
+
+func TestSelectUnchokedWhileSeeding(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.SetHasPiece(0)
+	c.SetHasPiece(1)
+	c.UnchokeSlots = 2
+	conns := makeRankedConns(500, 0, 0)
+	conns[2].Uploaded = 100
+	conns[2].updateRates(rechokeInterval)
+	if unchoked := c.SelectUnchoked(conns); len(unchoked) != 2 || !unchoked[conns[2]] {
+		t.Fatal(unchoked)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Number of pieces aimed at when the piece length is selected automatically
+const autoPieceCount = 1500
+
+// Create a .torrent file from a file or a directory. Each tracker is put in its
+// own tier.
+// http://www.bittorrent.org/beps/bep_0003.html#metainfo-files
+func CreateTorrent(inputPath string, outputPath string, pieceLength int64, trackers []string, private bool) error {
+	info, err := MakeInfo(inputPath, pieceLength)
+	if err != nil {
+		return err
+	}
+	if private {
+		// http://www.bittorrent.org/beps/bep_0027.html
+		info["private"] = int64(1)
+	}
+	torrent := map[string]interface{}{
+		"info":          info,
+		"created by":    "slivers",
+		"creation date": time.Now().Unix(),
+	}
+	if len(trackers) > 0 {
+		torrent["announce"] = trackers[0]
+	}
+	if len(trackers) > 1 {
+		var announceList []interface{}
+		for _, tracker := range trackers {
+			announceList = append(announceList, []interface{}{tracker})
+		}
+		torrent["announce-list"] = announceList
+	}
+
+	var buffer bytes.Buffer
+	if err := bencode.Marshal(&buffer, torrent); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputPath, buffer.Bytes(), 0644)
+}
+
+// Build the info dictionary, hashing the content of the file or of all the
+// regular files in the directory. The piece length is selected from the
+// content size when it is 0.
+func MakeInfo(inputPath string, pieceLength int64) (map[string]interface{}, error) {
+	if pieceLength < 0 {
+		return nil, errors.New("piece length must not be negative")
+	}
+	stat, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{
+		"name": filepath.Base(filepath.Clean(inputPath)),
+	}
+
+	var paths []string
+	var totalLength int64
+	if stat.IsDir() {
+		var files []interface{}
+		err := filepath.Walk(inputPath, func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fileInfo.Mode().IsRegular() {
+				return nil
+			}
+			relativePath, err := filepath.Rel(inputPath, path)
+			if err != nil {
+				return err
+			}
+			var pathList []interface{}
+			for _, component := range strings.Split(filepath.ToSlash(relativePath), "/") {
+				pathList = append(pathList, component)
+			}
+			files = append(files, map[string]interface{}{
+				"length": fileInfo.Size(),
+				"path":   pathList,
+			})
+			paths = append(paths, path)
+			totalLength += fileInfo.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("no file to add in " + inputPath)
+		}
+		info["files"] = files
+	} else {
+		info["length"] = stat.Size()
+		paths = append(paths, inputPath)
+		totalLength = stat.Size()
+	}
+	if pieceLength == 0 {
+		pieceLength = AutoPieceLength(totalLength)
+	}
+	info["piece length"] = pieceLength
+
+	pieces, err := HashPieces(paths, pieceLength, *hashWorkers)
+	if err != nil {
+		return nil, err
+	}
+	info["pieces"] = pieces
+	return info, nil
+}
+
+// Smallest power of two piece length that keeps the number of pieces under
+// autoPieceCount, within the lengths accepted by torrent validation. Small
+// content gets 16 KiB pieces, so that it is still split between peers, and
+// the pieces string of very large content stays around 30 KB, at the cost of
+// more data to download again when a piece fails verification.
+func AutoPieceLength(totalLength int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && totalLength > pieceLength*autoPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Concatenated SHA1 hashes of the pieces of the files, laid out one after the
+// other, computed by the given number of workers
+func HashPieces(paths []string, pieceLength int64, workers int) (string, error) {
+	var totalLength int64
+	var readers []io.Reader
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return "", err
+		}
+		totalLength += stat.Size()
+		readers = append(readers, file)
+	}
+	pieceCount := int((totalLength + pieceLength - 1) / pieceLength)
+	pieceSize := func(index int) int64 {
+		if index == pieceCount-1 && totalLength%pieceLength != 0 {
+			return totalLength % pieceLength
+		}
+		return pieceLength
+	}
+	// Pieces are read in order
+	reader := io.MultiReader(readers...)
+	hashes, errs := HashPiecesConcurrently(pieceCount, workers, pieceSize, func(index int, piece []byte) error {
+		_, err := io.ReadFull(reader, piece)
+		return err
+	})
+	var pieces bytes.Buffer
+	for index, hash := range hashes {
+		if errs[index] != nil {
+			return "", errs[index]
+		}
+		pieces.Write(hash)
+	}
+	return pieces.String(), nil
+}
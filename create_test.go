@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateTorrentRoundTrip(t *testing.T) {
+	_, data := makeTestInfo(16384, 50000)
+	dir := filepath.Join(t.TempDir(), "content")
+	files := map[string][]byte{"a": data[:10000], "sub/b": data[10000:], "sub/empty": nil}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	torrentPath := filepath.Join(t.TempDir(), "content.torrent")
+	trackers := []string{"http://a/announce", "udp://b:80"}
+	if err := CreateTorrent(dir, torrentPath, 16384, trackers, true); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewTorrentClient(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsPrivate() || c.TotalLength() != int64(len(data)) || c.PieceCount() != 4 {
+		t.Fatal(c.IsPrivate(), c.TotalLength(), c.PieceCount())
+	}
+	if tiers := c.AnnounceTiers(); !reflect.DeepEqual(tiers, [][]string{{"http://a/announce"}, {"udp://b:80"}}) {
+		t.Fatal(tiers)
+	}
+	var paths [][]string
+	for _, file := range c.Files() {
+		paths = append(paths, file.Path)
+	}
+	if !reflect.DeepEqual(paths, [][]string{{"content", "a"}, {"content", "sub", "b"}, {"content", "sub", "empty"}}) {
+		t.Fatal(paths)
+	}
+	for index := 0; index < c.PieceCount(); index++ {
+		offset := c.PieceOffset(index)
+		if !c.VerifyPiece(index, data[offset:offset+c.PieceSize(index)]) {
+			t.Fatalf("piece %d does not verify", index)
+		}
+	}
+}
+
+func TestCreateSingleFileTorrent(t *testing.T) {
+	_, data := makeTestInfo(16384, 40000)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := MakeInfo(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["name"] != "file.bin" || info["length"] != int64(40000) || info["piece length"] != int64(minPieceLength) {
+		t.Fatal(info)
+	}
+	c := newTestClient(t, info)
+	if !c.VerifyPiece(0, data[:16384]) || !c.VerifyPiece(2, data[32768:]) {
+		t.Fatal("pieces do not verify")
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	for totalLength, want := range map[int64]int64{
+		0:                                 minPieceLength,
+		minPieceLength * autoPieceCount:   minPieceLength,
+		minPieceLength*autoPieceCount + 1: 2 * minPieceLength,
+		1 << 50:                           maxPieceLength,
+	} {
+		if pieceLength := AutoPieceLength(totalLength); pieceLength != want {
+			t.Errorf("%d bytes: piece length %d", totalLength, pieceLength)
+		}
+	}
+}
+
+func TestPieceLengthFromContentSize(t *testing.T) {
+	for totalLength, want := range map[int64]int64{
+		1 << 20:   minPieceLength,
+		100 << 20: 128 << 10,
+		1 << 30:   1 << 20,
+		50 << 30:  maxPieceLength,
+	} {
+		if pieceLength := AutoPieceLength(totalLength); pieceLength != want {
+			t.Errorf("%d bytes: piece length %d", totalLength, pieceLength)
+		}
+	}
+
+	// An explicit piece length is kept
+	_, data := makeTestInfo(16384, 40000)
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := MakeInfo(path, 4*minPieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["piece length"] != int64(4*minPieceLength) || len(info["pieces"].(string)) != 20 {
+		t.Fatal(info["piece length"])
+	}
+}
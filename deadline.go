@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between two checks of the download deadlines
+const deadlineCheckInterval = time.Second
+
+// Stop the download when it takes longer than c.Timeout, or when nothing is
+// downloaded for c.IdleTimeout. Deadlines do not apply once the download is
+// complete.
+func (c *TorrentClient) DeadlineLoop(ctx context.Context) {
+	if c.Timeout <= 0 && c.IdleTimeout <= 0 {
+		return
+	}
+	start := time.Now()
+	lastProgress := start
+	lastDownloaded := atomic.LoadInt64(&c.Downloaded)
+	ticker := time.NewTicker(deadlineCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.completed:
+			return
+		case now := <-ticker.C:
+			if downloaded := atomic.LoadInt64(&c.Downloaded); downloaded != lastDownloaded {
+				lastDownloaded = downloaded
+				lastProgress = now
+			}
+			c.progressLock.Lock()
+			downloaded := lastDownloaded - c.startDownloaded
+			c.progressLock.Unlock()
+			var err error
+			if c.Timeout > 0 && now.Sub(start) >= c.Timeout {
+				err = c.timeoutError("timeout", c.Timeout, downloaded)
+			} else if c.IdleTimeout > 0 && now.Sub(lastProgress) >= c.IdleTimeout {
+				err = c.timeoutError("idle timeout", c.IdleTimeout, downloaded)
+			}
+			if err != nil {
+				c.Stop(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *TorrentClient) timeoutError(kind string, timeout time.Duration, downloaded int64) error {
+	if downloaded == 0 && len(c.Conns()) == 0 {
+		return fmt.Errorf("%s of %s reached with no peers", kind, timeout)
+	}
+	if !c.HasInfo() {
+		return fmt.Errorf("%s of %s reached while fetching metadata", kind, timeout)
+	}
+	return fmt.Errorf("%s of %s reached mid-download, %.1f%% complete", kind, timeout, c.progressEvent(ProgressUpdate, 0).Percent)
+}
+
+// Cancel the run, which then returns the error. Only the first error is kept.
+func (c *TorrentClient) Stop(err error) {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if c.stopErr == nil {
+		c.stopErr = err
+	}
+	if c.cancelRun != nil {
+		c.cancelRun()
+	}
+}
+
+// Error that stopped the run, nil if none did
+func (c *TorrentClient) StopError() error {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	return c.stopErr
+}
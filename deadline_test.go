@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Peer address that refuses connections
+func closedPeer(t *testing.T) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return loopbackPeer(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func runWithDeadline(t *testing.T, c *TorrentClient) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadline did not stop the run")
+		return nil
+	}
+}
+
+func TestIdleTimeoutWithNoPeers(t *testing.T) {
+	info, _ := makeTestInfo(16384, 50000)
+	c := newTestClient(t, info)
+	c.IdleTimeout = time.Second
+	c.AddPeers([]Peer{closedPeer(t)})
+	start := time.Now()
+	err := runWithDeadline(t, c)
+	if err == nil || !strings.Contains(err.Error(), "idle timeout of 1s reached with no peers") {
+		t.Fatalf("error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("stopped after %v", elapsed)
+	}
+	// Progress is saved before stopping
+	if _, err := os.Stat(c.StateFilePath()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeoutMidDownload(t *testing.T) {
+	info, _ := makeTestInfo(16384, 50000)
+	c := newTestClient(t, info)
+	c.Timeout = time.Second
+	// Unchokes us but never sends a block
+	stalled := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+		bitfield := NewBitfield(c.PieceCount())
+		for index := 0; index < c.PieceCount(); index++ {
+			bitfield.Set(index)
+		}
+		conn.Write((&Message{ID: MsgBitfield, Payload: bitfield}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		for {
+			if _, err := ReadMessage(conn); err != nil {
+				return
+			}
+		}
+	})
+	c.AddPeers([]Peer{stalled})
+	err := runWithDeadline(t, c)
+	if err == nil || !strings.Contains(err.Error(), "timeout of 1s reached mid-download, 0.0% complete") {
+		t.Fatalf("error %v", err)
+	}
+}
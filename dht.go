@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Mainline DHT
+// http://www.bittorrent.org/beps/bep_0005.html
+
+const (
+	// Bucket size and lookup concurrency
+	dhtK     = 8
+	dhtAlpha = 3
+
+	dhtQueryTimeout = 5 * time.Second
+	// Lookups stop after this many rounds even if they keep finding closer nodes
+	dhtMaxLookupRounds = 16
+	// Delay between two lookups for the same info hash
+	dhtLookupInterval = 15 * time.Minute
+)
+
+var dhtBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type DHTNode struct {
+	ID   string
+	Addr *net.UDPAddr
+}
+
+// XOR distance between two 20 bytes IDs. Distances can be compared as plain
+// strings.
+func Distance(a string, b string) string {
+	distance := make([]byte, 20)
+	for i := 0; i < 20 && i < len(a) && i < len(b); i++ {
+		distance[i] = a[i] ^ b[i]
+	}
+	return string(distance)
+}
+
+// Routing table of k-buckets. Bucket i holds the nodes whose distance to our
+// own ID has i leading zero bits.
+type RoutingTable struct {
+	ID      string
+	buckets [160][]DHTNode
+	lock    sync.Mutex
+}
+
+func NewRoutingTable(id string) *RoutingTable {
+	return &RoutingTable{ID: id}
+}
+
+func (t *RoutingTable) bucketIndex(id string) int {
+	distance := Distance(t.ID, id)
+	for i := 0; i < len(distance); i++ {
+		if distance[i] != 0 {
+			for bit := 0; bit < 8; bit++ {
+				if distance[i]&(0x80>>uint(bit)) != 0 {
+					return 8*i + bit
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// Add or refresh a node. Full buckets do not accept new nodes: good nodes
+// that have been around for a while are preferred.
+func (t *RoutingTable) Insert(node DHTNode) {
+	if len(node.ID) != 20 {
+		return
+	}
+	index := t.bucketIndex(node.ID)
+	if index < 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	bucket := t.buckets[index]
+	for i, known := range bucket {
+		if known.ID == node.ID {
+			// Move to the tail, the most recently seen position
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return
+		}
+	}
+	if len(bucket) < dhtK {
+		t.buckets[index] = append(bucket, node)
+	}
+}
+
+func (t *RoutingTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// The count nodes that are closest to the target
+func (t *RoutingTable) Closest(target string, count int) []DHTNode {
+	t.lock.Lock()
+	var nodes []DHTNode
+	for _, bucket := range t.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	t.lock.Unlock()
+	SortNodesByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func SortNodesByDistance(nodes []DHTNode, target string) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return Distance(nodes[i].ID, target) < Distance(nodes[j].ID, target)
+	})
+}
+
+// Compact node info: 20 bytes node ID followed by the compact IPv4 address
+func DecodeNodes(encodedNodes string) []DHTNode {
+	var nodes []DHTNode
+	for pos := 0; pos+26 <= len(encodedNodes); pos += 26 {
+		record := encodedNodes[pos : pos+26]
+		nodes = append(nodes, DHTNode{
+			ID: record[0:20],
+			Addr: &net.UDPAddr{
+				IP:   net.IPv4(record[20], record[21], record[22], record[23]),
+				Port: int(binary.BigEndian.Uint16([]byte(record[24:26]))),
+			},
+		})
+	}
+	return nodes
+}
+
+func EncodeNodes(nodes []DHTNode) string {
+	var encodedNodes bytes.Buffer
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil || len(node.ID) != 20 {
+			continue
+		}
+		encodedNodes.WriteString(node.ID)
+		encodedNodes.Write(ip)
+		binary.Write(&encodedNodes, binary.BigEndian, uint16(node.Addr.Port))
+	}
+	return encodedNodes.String()
+}
+
+// KRPC messages are bencoded dictionaries with a transaction ID "t" and a
+// type "y" which is one of "q" (query), "r" (response) or "e" (error).
+func EncodeKRPC(msg map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeKRPC(data []byte) (map[string]interface{}, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	msg, isDict := decoded.(map[string]interface{})
+	if !isDict {
+		return nil, errors.New("krpc: message is not a dictionary")
+	}
+	if _, isString := msg["t"].(string); !isString {
+		return nil, errors.New("krpc: missing transaction ID")
+	}
+	if _, isString := msg["y"].(string); !isString {
+		return nil, errors.New("krpc: missing message type")
+	}
+	return msg, nil
+}
+
+func KRPCError(msg map[string]interface{}) error {
+	if details, isList := msg["e"].([]interface{}); isList && len(details) == 2 {
+		code, _ := details[0].(int64)
+		message, _ := details[1].(string)
+		return fmt.Errorf("krpc: error %d: %s", code, message)
+	}
+	return errors.New("krpc: malformed error")
+}
+
+type DHT struct {
+	ID    string
+	Table *RoutingTable
+	conn  *net.UDPConn
+
+	// Response channels of pending queries, by transaction ID
+	pending       map[string]chan map[string]interface{}
+	transactionID uint16
+	lock          sync.Mutex
+
+	// Used to generate the tokens we hand out in get_peers responses
+	secret string
+}
+
+func NewDHT() (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		return nil, err
+	}
+	id := RandomString(20)
+	return &DHT{
+		ID:      id,
+		Table:   NewRoutingTable(id),
+		conn:    conn,
+		pending: map[string]chan map[string]interface{}{},
+		secret:  RandomString(20),
+	}, nil
+}
+
+func RandomString(length int) string {
+	buf := make([]byte, length)
+	rand.Read(buf)
+	return string(buf)
+}
+
+func (d *DHT) Close() error {
+	return d.conn.Close()
+}
+
+// Process incoming messages until the context is cancelled
+func (d *DHT) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		d.conn.Close()
+	}()
+	buf := make([]byte, 65536)
+	for {
+		length, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		msg, err := DecodeKRPC(buf[:length])
+		if err != nil {
+			continue
+		}
+		switch msg["y"] {
+		case "q":
+			d.handleQuery(addr, msg)
+		case "r", "e":
+			d.lock.Lock()
+			response, isPending := d.pending[msg["t"].(string)]
+			delete(d.pending, msg["t"].(string))
+			d.lock.Unlock()
+			if isPending {
+				response <- msg
+			}
+		}
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	data, err := EncodeKRPC(msg)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+// Send a query and wait for the response arguments
+func (d *DHT) Query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	response := make(chan map[string]interface{}, 1)
+	d.lock.Lock()
+	d.transactionID++
+	transactionID := string([]byte{byte(d.transactionID >> 8), byte(d.transactionID)})
+	d.pending[transactionID] = response
+	d.lock.Unlock()
+	defer func() {
+		d.lock.Lock()
+		delete(d.pending, transactionID)
+		d.lock.Unlock()
+	}()
+
+	args["id"] = d.ID
+	err := d.send(addr, map[string]interface{}{
+		"t": transactionID,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(dhtQueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-response:
+		if msg["y"] == "e" {
+			return nil, KRPCError(msg)
+		}
+		values, isDict := msg["r"].(map[string]interface{})
+		if !isDict {
+			return nil, errors.New("krpc: malformed response")
+		}
+		if id, _ := values["id"].(string); len(id) == 20 {
+			d.Table.Insert(DHTNode{ID: id, Addr: addr})
+		}
+		return values, nil
+	case <-timer.C:
+		return nil, errors.New("krpc: query timed out")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *DHT) token(addr *net.UDPAddr) string {
+	token := sha1.Sum([]byte(d.secret + addr.IP.String()))
+	return string(token[:8])
+}
+
+// Answer queries from other nodes. We do not store peers, so get_peers only
+// returns nodes and announce_peer is simply acknowledged.
+func (d *DHT) handleQuery(addr *net.UDPAddr, msg map[string]interface{}) {
+	args, _ := msg["a"].(map[string]interface{})
+	if id, _ := args["id"].(string); len(id) == 20 {
+		d.Table.Insert(DHTNode{ID: id, Addr: addr})
+	}
+	values := map[string]interface{}{"id": d.ID}
+	switch msg["q"] {
+	case "ping", "announce_peer":
+	case "find_node":
+		target, _ := args["target"].(string)
+		values["nodes"] = EncodeNodes(d.Table.Closest(target, dhtK))
+	case "get_peers":
+		infoHash, _ := args["info_hash"].(string)
+		values["nodes"] = EncodeNodes(d.Table.Closest(infoHash, dhtK))
+		values["token"] = d.token(addr)
+	default:
+		d.send(addr, map[string]interface{}{
+			"t": msg["t"],
+			"y": "e",
+			"e": []interface{}{204, "Method Unknown"},
+		})
+		return
+	}
+	d.send(addr, map[string]interface{}{
+		"t": msg["t"],
+		"y": "r",
+		"r": values,
+	})
+}
+
+// Populate the routing table by looking up our own ID through the bootstrap
+// nodes
+func (d *DHT) Bootstrap(ctx context.Context, bootstrapNodes []string) {
+	var waitGroup sync.WaitGroup
+	for _, hostPort := range bootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", hostPort)
+		if err != nil {
+			continue
+		}
+		waitGroup.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer waitGroup.Done()
+			values, err := d.Query(ctx, addr, "find_node", map[string]interface{}{"target": d.ID})
+			if err != nil {
+				return
+			}
+			nodes, _ := values["nodes"].(string)
+			for _, node := range DecodeNodes(nodes) {
+				d.Table.Insert(node)
+			}
+		}(addr)
+	}
+	waitGroup.Wait()
+}
+
+type getPeersResult struct {
+	node   DHTNode
+	values map[string]interface{}
+}
+
+// Iterative get_peers lookup. Returns the peers that were found, along with
+// the closest nodes that responded and the tokens they issued, for a later
+// announce_peer.
+func (d *DHT) GetPeers(ctx context.Context, infoHash string) ([]Peer, []DHTNode, map[string]string) {
+	var peers []Peer
+	tokens := map[string]string{}
+	var responders []DHTNode
+
+	shortlist := d.Table.Closest(infoHash, dhtK)
+	seen := map[string]bool{}
+	for _, node := range shortlist {
+		seen[node.ID] = true
+	}
+	queried := map[string]bool{}
+	for round := 0; round < dhtMaxLookupRounds && ctx.Err() == nil; round++ {
+		SortNodesByDistance(shortlist, infoHash)
+		var batch []DHTNode
+		for i := 0; i < len(shortlist) && i < dhtK && len(batch) < dhtAlpha; i++ {
+			if !queried[shortlist[i].ID] {
+				queried[shortlist[i].ID] = true
+				batch = append(batch, shortlist[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan getPeersResult, len(batch))
+		for _, node := range batch {
+			go func(node DHTNode) {
+				values, _ := d.Query(ctx, node.Addr, "get_peers", map[string]interface{}{"info_hash": infoHash})
+				results <- getPeersResult{node, values}
+			}(node)
+		}
+		for range batch {
+			result := <-results
+			if result.values == nil {
+				continue
+			}
+			responders = append(responders, result.node)
+			if token, isString := result.values["token"].(string); isString {
+				tokens[result.node.ID] = token
+			}
+			if encodedPeers, isList := result.values["values"].([]interface{}); isList {
+				for _, encodedPeer := range encodedPeers {
+					if encodedPeer, isString := encodedPeer.(string); isString {
+						peers = append(peers, DecodePeers(encodedPeer)...)
+					}
+				}
+			}
+			nodes, _ := result.values["nodes"].(string)
+			for _, node := range DecodeNodes(nodes) {
+				if !seen[node.ID] && node.ID != d.ID {
+					seen[node.ID] = true
+					shortlist = append(shortlist, node)
+				}
+			}
+		}
+	}
+
+	SortNodesByDistance(responders, infoHash)
+	if len(responders) > dhtK {
+		responders = responders[:dhtK]
+	}
+	return peers, responders, tokens
+}
+
+// Tell the closest nodes that we are downloading the torrent on the given port
+func (d *DHT) AnnouncePeer(ctx context.Context, infoHash string, port int, nodes []DHTNode, tokens map[string]string) {
+	for _, node := range nodes {
+		token, hasToken := tokens[node.ID]
+		if !hasToken {
+			continue
+		}
+		go d.Query(ctx, node.Addr, "announce_peer", map[string]interface{}{
+			"info_hash":    infoHash,
+			"implied_port": 0,
+			"port":         port,
+			"token":        token,
+		})
+	}
+}
+
+// Nodes of the nodes key, as host:port addresses. Trackerless torrents list
+// them to bootstrap the DHT.
+// http://www.bittorrent.org/beps/bep_0005.html#torrent-file-extensions
+func (c *TorrentClient) DHTNodes() []string {
+	var nodes []string
+	nodeList, _ := c.Metadata("nodes").([]interface{})
+	for _, nodeValue := range nodeList {
+		pair, isList := nodeValue.([]interface{})
+		if !isList || len(pair) != 2 {
+			continue
+		}
+		host, isString := pair[0].(string)
+		port, isInt := pair[1].(int64)
+		if !isString || !isInt || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return nodes
+}
+
+// Bootstrap from the nodes of the torrent, then from the public routers if
+// that was not enough
+func (c *TorrentClient) BootstrapDHT(ctx context.Context, dht *DHT) {
+	if nodes := c.DHTNodes(); len(nodes) > 0 {
+		dht.Bootstrap(ctx, nodes)
+	}
+	if dht.Table.Len() == 0 {
+		dht.Bootstrap(ctx, dhtBootstrapNodes)
+	}
+}
+
+// Periodically look up peers in the DHT and announce ourselves
+func (c *TorrentClient) DHTLoop(ctx context.Context) error {
+	dht, err := NewDHT()
+	if err != nil {
+		return err
+	}
+	defer dht.Close()
+	go dht.Run(ctx)
+	c.BootstrapDHT(ctx, dht)
+
+	ticker := time.NewTicker(dhtLookupInterval)
+	defer ticker.Stop()
+	lookupNow := c.lookupNow
+	for {
+		peers, nodes, tokens := dht.GetPeers(ctx, c.InfoHash())
+		c.AddPeers(peers)
+		dht.AnnouncePeer(ctx, c.InfoHash(), c.Port, nodes, tokens)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-lookupNow:
+			lookupNow = nil
+		}
+		if dht.Table.Len() == 0 {
+			c.BootstrapDHT(ctx, dht)
+		}
+	}
+}
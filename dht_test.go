@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	a := strings.Repeat("\x00", 19) + "\x0f"
+	b := strings.Repeat("\x00", 19) + "\xf0"
+	if distance := Distance(a, b); distance != strings.Repeat("\x00", 19)+"\xff" {
+		t.Fatalf("%x", distance)
+	}
+	if distance := Distance(a, a); distance != strings.Repeat("\x00", 20) {
+		t.Fatalf("%x", distance)
+	}
+	// 0x80 is further from 0x00 than 0x7f is
+	far := "\x80" + strings.Repeat("\x00", 19)
+	near := "\x7f" + strings.Repeat("\xff", 19)
+	zero := strings.Repeat("\x00", 20)
+	if Distance(zero, near) >= Distance(zero, far) {
+		t.Fatal("distances do not compare as strings")
+	}
+
+	table := NewRoutingTable(zero)
+	if table.bucketIndex(far) != 0 || table.bucketIndex(a) != 156 || table.bucketIndex(zero) != -1 {
+		t.Fatal(table.bucketIndex(far), table.bucketIndex(a))
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	table.Insert(DHTNode{ID: far, Addr: addr})
+	table.Insert(DHTNode{ID: near, Addr: addr})
+	table.Insert(DHTNode{ID: a, Addr: addr})
+	closest := table.Closest(b, 2)
+	if len(closest) != 2 || closest[0].ID != a || closest[1].ID != near {
+		t.Fatal(closest)
+	}
+}
+
+// Examples of BEP 5
+func TestKRPCVectors(t *testing.T) {
+	ping := "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"
+	encoded, err := EncodeKRPC(map[string]interface{}{
+		"t": "aa",
+		"y": "q",
+		"q": "ping",
+		"a": map[string]interface{}{"id": "abcdefghij0123456789"},
+	})
+	if err != nil || string(encoded) != ping {
+		t.Fatalf("%s %v", encoded, err)
+	}
+	msg, err := DecodeKRPC([]byte(ping))
+	if err != nil || msg["q"] != "ping" || msg["a"].(map[string]interface{})["id"] != "abcdefghij0123456789" {
+		t.Fatal(msg, err)
+	}
+
+	msg, err = DecodeKRPC([]byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := KRPCError(msg); err == nil || err.Error() != "krpc: error 201: A Generic Error Ocurred" {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range []string{"le", "d1:y1:qe", "d1:t2:aae", "d1:t"} {
+		if _, err := DecodeKRPC([]byte(invalid)); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []DHTNode{
+		{ID: strings.Repeat("a", 20), Addr: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}},
+		{ID: strings.Repeat("b", 20), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}},
+	}
+	encoded := EncodeNodes(nodes)
+	if encoded != strings.Repeat("a", 20)+"\x01\x02\x03\x04\x1a\xe1" {
+		t.Fatalf("%x", encoded)
+	}
+	decoded := DecodeNodes(encoded)
+	if len(decoded) != 1 || decoded[0].ID != nodes[0].ID || decoded[0].Addr.String() != "1.2.3.4:6881" {
+		t.Fatal(decoded)
+	}
+}
+
+func TestTorrentDHTNodes(t *testing.T) {
+	torrent := "d4:infod6:lengthi20000e4:name1:f12:piece lengthi16384e6:pieces40:0123456789012345678901234567890123456789e" +
+		"5:nodesll10:192.0.2.10i6881eel11:2001:db8::1i80eel18:router.example.orgi6881eel4:hosti0eel3:badeee"
+	c, err := NewTorrentClientFromBytes("trackerless.torrent", []byte(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.10:6881", "[2001:db8::1]:80", "router.example.org:6881"}
+	if nodes := c.DHTNodes(); !reflect.DeepEqual(nodes, want) {
+		t.Fatal(nodes)
+	}
+	if len(c.AnnounceTiers()) != 0 {
+		t.Fatal(c.AnnounceTiers())
+	}
+}
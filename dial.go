@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Happy eyeballs: dual-stack peers are dialed over both families, the second
+// attempt starting after a short delay or as soon as the first one fails
+// https://www.rfc-editor.org/rfc/rfc8305
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// Addresses to dial for the peer, IPv6 first
+func (p Peer) DialAddresses() []string {
+	if p.AltIP == nil || p.AltIP.Equal(p.IP) {
+		return []string{p.Address()}
+	}
+	alternate := net.JoinHostPort(p.AltIP.String(), strconv.Itoa(p.Port))
+	if p.IP.To4() != nil && p.AltIP.To4() == nil {
+		return []string{alternate, p.Address()}
+	}
+	return []string{p.Address(), alternate}
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Dial the addresses in order, each one delay after the previous one or right
+// after it failed, and return the first connection that succeeds. The other
+// attempts are cancelled and their connections closed.
+func DialHappyEyeballs(ctx context.Context, dialer ContextDialer, addresses []string, delay time.Duration) (net.Conn, error) {
+	if len(addresses) == 1 {
+		return dialer.DialContext(ctx, "tcp", addresses[0])
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addresses))
+	dial := func(address string) {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		results <- dialResult{conn, err}
+	}
+	go dial(addresses[0])
+	started, pending := 1, 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 || started < len(addresses) {
+		select {
+		case <-timer.C:
+			if started < len(addresses) {
+				go dial(addresses[started])
+				started++
+				pending++
+				timer.Reset(delay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close the connections of the attempts that are still
+				// running, once they return
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if started < len(addresses) {
+				go dial(addresses[started])
+				started++
+				pending++
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
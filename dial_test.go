@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Dialer that waits before dialing the delayed addresses, and fails to dial
+// the refused ones
+type delayingDialer struct {
+	delays  map[string]time.Duration
+	refused map[string]bool
+}
+
+func (d *delayingDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if d.refused[address] {
+		return nil, errors.New("connection refused")
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(d.delays[address]):
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+// Listeners on the same port of the IPv4 and IPv6 loopback addresses, which
+// send the family of the address that accepted each connection
+func startDualStackListener(t *testing.T) (int, chan string) {
+	t.Helper()
+	listener6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	t.Cleanup(func() { listener6.Close() })
+	port := listener6.Addr().(*net.TCPAddr).Port
+	listener4, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skip("port taken over IPv4:", err)
+	}
+	t.Cleanup(func() { listener4.Close() })
+	accepted := make(chan string, 4)
+	for family, listener := range map[string]net.Listener{"ipv4": listener4, "ipv6": listener6} {
+		go func(family string, listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- family
+				conn.Close()
+			}
+		}(family, listener)
+	}
+	return port, accepted
+}
+
+func TestDialAddresses(t *testing.T) {
+	peer := Peer{IP: net.ParseIP("192.0.2.1"), Port: 6881}
+	if addresses := peer.DialAddresses(); !reflect.DeepEqual(addresses, []string{"192.0.2.1:6881"}) {
+		t.Fatal(addresses)
+	}
+	peer.AltIP = net.ParseIP("2001:db8::1")
+	if addresses := peer.DialAddresses(); !reflect.DeepEqual(addresses, []string{"[2001:db8::1]:6881", "192.0.2.1:6881"}) {
+		t.Fatal(addresses)
+	}
+	peer.IP, peer.AltIP = peer.AltIP, peer.IP
+	if addresses := peer.DialAddresses(); !reflect.DeepEqual(addresses, []string{"[2001:db8::1]:6881", "192.0.2.1:6881"}) {
+		t.Fatal(addresses)
+	}
+}
+
+func TestHappyEyeballsFasterFamilyWins(t *testing.T) {
+	port, accepted := startDualStackListener(t)
+	peer := Peer{IP: net.ParseIP("127.0.0.1"), AltIP: net.ParseIP("::1"), Port: port}
+	addresses := peer.DialAddresses()
+	for _, test := range []struct {
+		slow     string
+		expected string
+	}{
+		{addresses[0], "127.0.0.1"},
+		{addresses[1], "::1"},
+	} {
+		dialer := &delayingDialer{delays: map[string]time.Duration{test.slow: 2 * time.Second}}
+		start := time.Now()
+		conn, err := DialHappyEyeballs(context.Background(), dialer, addresses, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP.String(); ip != test.expected {
+			t.Fatal(ip)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatal("waited for the slow attempt", elapsed)
+		}
+		<-accepted
+	}
+	// The slow attempt of the first dial was cancelled, and the one of the
+	// second dial is not started
+	select {
+	case family := <-accepted:
+		t.Fatal("late connection over", family)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	port, accepted := startDualStackListener(t)
+	peer := Peer{IP: net.ParseIP("127.0.0.1"), AltIP: net.ParseIP("::1"), Port: port}
+	addresses := peer.DialAddresses()
+	// The second address is dialed right away when the first one fails
+	dialer := &delayingDialer{refused: map[string]bool{addresses[0]: true}}
+	start := time.Now()
+	conn, err := DialHappyEyeballs(context.Background(), dialer, addresses, time.Minute)
+	if err != nil || time.Since(start) > time.Second {
+		t.Fatal(err, time.Since(start))
+	}
+	conn.Close()
+	if family := <-accepted; family != "ipv4" {
+		t.Fatal(family)
+	}
+
+	dialer.refused[addresses[1]] = true
+	if _, err := DialHappyEyeballs(context.Background(), dialer, addresses, time.Minute); err == nil || err.Error() != "connection refused" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Pieces are requested by blocks of 16 KiB
+	BlockSize = 16384
+	// Endgame mode starts when fewer blocks than this remain to be downloaded
+	// and all missing pieces are already being downloaded: the missing pieces
+	// are then requested from all the peers that have them.
+	endgameBlockThreshold = 20
+)
+
+// Returned when the piece was downloaded from another peer in endgame mode
+var errPieceCompleted = errors.New("piece completed by another peer")
+
+// Returned when the peer rejected one of our requests for the piece, which
+// should then be downloaded from another peer
+var errPieceRejected = errors.New("piece request rejected by peer")
+
+// Returned when the piece cannot be queued because the request queue is full
+var errQueueFull = errors.New("request queue is full")
+
+// Returned when the peer choked us before the piece was complete: the blocks
+// received so far are kept, and the other blocks may be requested from
+// another peer
+var errPieceChoked = errors.New("choked by peer")
+
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Download a full piece from the peer and verify it against its hash. Blocks
+// are handed out by the request queue, and in endgame mode the piece may be
+// completed with blocks received from other peers.
+func (c *TorrentClient) DownloadPiece(pc *PeerConn, index int) ([]byte, error) {
+	if !pc.HasPiece(index) {
+		return nil, fmt.Errorf("peer does not have piece %d", index)
+	}
+	if !pc.IsInterested() {
+		if err := pc.SendInterested(); err != nil {
+			return nil, err
+		}
+	}
+
+	size := int(c.PieceSize(index))
+	if !c.Requests.Add(index, size) {
+		return nil, errQueueFull
+	}
+	// Blocks that were not received are handed out to other peers
+	defer c.Requests.ReleasePeer(pc)
+	// Blocks of previous pieces that are still in flight were cancelled
+	pipeline := pc.Pipeline()
+	pipeline.DropAll()
+	for {
+		if !pc.IsChoked() || pc.IsAllowedFast(index) {
+			shared := c.IsSharedPiece(index)
+			for pipeline.CanRequest() {
+				request, ok := c.Requests.Next(pc, index, shared)
+				if !ok {
+					break
+				}
+				if !WaitRateLimiters(pc.Done(), request.Length, c.DownloadLimiter, pc.DownloadLimiter) {
+					return nil, errors.New("connection closed")
+				}
+				if err := pc.SendMessage(MakeRequestMessage(request.Index, request.Begin, request.Length)); err != nil {
+					return nil, err
+				}
+				pc.addPendingRequest(request)
+				pipeline.Sent(request, time.Now())
+			}
+		}
+
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if c.HasPiece(index) || c.Requests.IsDone(index) {
+			// Endgame: another peer was faster
+			pc.CancelPiece(index)
+			return nil, errPieceCompleted
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case MsgChoke:
+			if pc.IsAllowedFast(index) {
+				// Requests for allowed fast pieces are still served
+				continue
+			}
+			// Pending requests are dropped by the peer when it chokes us,
+			// without cancels. With the fast extension they are rejected
+			// next, which is not a refusal to serve the piece.
+			c.Requests.ReleasePeer(pc)
+			pipeline.DropAll()
+			pc.clearPendingRequests()
+			return nil, errPieceChoked
+		case MsgRejectRequest:
+			if !pc.SupportsFast() {
+				return nil, errors.New("reject request from a peer that does not support the fast extension")
+			}
+			rejectedIndex, begin, length, err := ParseRequestMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			rejected := BlockRequest{rejectedIndex, begin, length}
+			pc.removePendingRequest(rejected)
+			pipeline.Drop(rejected)
+			c.Requests.Drop(pc, rejected)
+			if rejectedIndex == index {
+				if pc.IsChoked() && !pc.IsAllowedFast(index) {
+					// Rejected because the peer choked us
+					c.Requests.ReleasePeer(pc)
+					pipeline.DropAll()
+					pc.clearPendingRequests()
+					return nil, errPieceChoked
+				}
+				pc.setRejected(index)
+				pc.CancelPiece(index)
+				return nil, errPieceRejected
+			}
+		case MsgPiece:
+			pieceIndex, begin, data, err := ParsePieceMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			if pieceIndex != index {
+				// Block of a piece that was cancelled, in endgame mode or
+				// after a reject, and was already in flight
+				pc.removePendingRequest(BlockRequest{pieceIndex, begin, len(data)})
+				continue
+			}
+			if begin%BlockSize != 0 || begin >= size || len(data) != BlockLength(size, begin) {
+				return nil, fmt.Errorf("unexpected block %d:%d from peer", pieceIndex, begin)
+			}
+			received := BlockRequest{index, begin, len(data)}
+			pipeline.Received(received, time.Now())
+			pc.removePendingRequest(received)
+			if c.ResumeBlocks {
+				// Blocks are on disk before they are recorded as received,
+				// so that the resume state never lists missing blocks
+				if err := c.Storage.WriteAt(data, c.PieceOffset(index)+int64(begin)); err != nil {
+					return nil, err
+				}
+			}
+			isNew, piece := c.Requests.Receive(index, begin, data)
+			if !isNew {
+				continue
+			}
+			atomic.AddInt64(&c.Downloaded, int64(len(data)))
+			atomic.AddInt64(&pc.Downloaded, int64(len(data)))
+			if piece != nil {
+				if !c.VerifyPiece(index, piece) {
+					c.Requests.Remove(index)
+					return nil, fmt.Errorf("piece %d failed hash check", index)
+				}
+				return piece, nil
+			}
+		}
+	}
+}
+
+// Length of the block starting at the given offset: the last block of a piece
+// may be shorter than the others.
+func BlockLength(pieceSize int, begin int) int {
+	if pieceSize-begin < BlockSize {
+		return pieceSize - begin
+	}
+	return BlockSize
+}
+
+// Delay between two scans of the peer set for new peers to connect to
+const connectInterval = 5 * time.Second
+
+// Connect to every newly discovered peer and download pieces from it. Peers
+// are queued while all connection slots are taken.
+func (c *TorrentClient) ConnectLoop(ctx context.Context) {
+	queued := map[string]bool{}
+	var queue []Peer
+	slotFreed := make(chan struct{}, 1)
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range c.Peers() {
+			if queued[peer.Address()] {
+				continue
+			}
+			queued[peer.Address()] = true
+			queue = append(queue, peer)
+		}
+		for len(queue) > 0 && c.AcquireConnSlot() {
+			peer := queue[0]
+			queue = queue[1:]
+			go func(peer Peer) {
+				defer func() {
+					c.ReleaseConnSlot()
+					select {
+					case slotFreed <- struct{}{}:
+					default:
+					}
+				}()
+				if err := c.DownloadFromPeer(ctx, peer); err != nil {
+					c.Log.Debugf("peer %s: %v", peer.Address(), err)
+				}
+			}(peer)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-slotFreed:
+		}
+	}
+}
+
+// Reserve a connection slot, if one is free
+func (c *TorrentClient) AcquireConnSlot() bool {
+	select {
+	case c.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *TorrentClient) ReleaseConnSlot() {
+	<-c.connSlots
+}
+
+// Download all the pieces we need from the peer, until we have all pieces or
+// the connection fails
+func (c *TorrentClient) DownloadFromPeer(ctx context.Context, peer Peer) error {
+	pc, err := c.Connect(ctx, peer)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	defer pc.WatchContext(ctx)()
+	if err := c.AddConn(pc); err != nil {
+		return err
+	}
+	defer c.RemoveConn(pc)
+	if err := c.StartConn(ctx, pc); err != nil {
+		return err
+	}
+
+	if err := pc.SendInterested(); err != nil {
+		return err
+	}
+	for c.Left() > 0 {
+		if !pc.IsChoked() || pc.HasAllowedFast() {
+			if index, ok := c.ClaimPiece(pc); ok {
+				err := c.DownloadAndWritePiece(pc, index)
+				c.ReleasePiece(index)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		// Wait for the peer to unchoke us or to advertise new pieces
+		if _, err := pc.ReadMessage(); err != nil {
+			return err
+		}
+	}
+
+	// Keep serving the peer once we have everything
+	if err := pc.SendNotInterested(); err != nil {
+		return err
+	}
+	return pc.ReadLoop(ctx)
+}
+
+// Send the messages that follow the handshake on a new connection: our
+// bitfield, allowed fast set and extended handshake
+func (c *TorrentClient) StartConn(ctx context.Context, pc *PeerConn) error {
+	go pc.KeepAliveLoop(ctx)
+	// Our pieces must be advertised first
+	if haveMessage := c.MakeHaveMessage(pc); haveMessage != nil {
+		if err := pc.SendMessage(haveMessage); err != nil {
+			return err
+		}
+	}
+	if err := c.SendAllowedFast(pc); err != nil {
+		return err
+	}
+	if pc.SupportsExtensions() {
+		handshake, err := c.MakeExtendedHandshakeMessage()
+		if err != nil {
+			return err
+		}
+		if err := pc.SendMessage(handshake); err != nil {
+			return err
+		}
+		if !c.IsPrivate() {
+			go c.PexLoop(ctx, pc)
+		}
+	}
+	return nil
+}
+
+func (c *TorrentClient) DownloadAndWritePiece(pc *PeerConn, index int) error {
+	piece, err := c.DownloadPiece(pc, index)
+	if err == errPieceCompleted || err == errPieceRejected || err == errPieceChoked || err == errQueueFull {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if c.HasPiece(index) {
+		return nil
+	}
+	if err := c.StorePiece(pc, index, piece); err != nil {
+		return err
+	}
+	c.Log.Debugf("piece %d downloaded from %s", index, pc.Peer.Address())
+	return nil
+}
+
+// Write a verified piece and advertise it. Pending requests for the piece are
+// cancelled on all connections but the one it was downloaded from, which is
+// nil for web seeds.
+func (c *TorrentClient) StorePiece(pc *PeerConn, index int, piece []byte) error {
+	// The piece is downloaded again from scratch if it cannot be written
+	c.Requests.Remove(index)
+	if err := c.Storage.WriteAt(piece, c.PieceOffset(index)); err != nil {
+		return err
+	}
+	c.SetHasPiece(index)
+	c.FinishFiles(index)
+	for _, conn := range c.Conns() {
+		if conn != pc {
+			conn.CancelPiece(index)
+		}
+	}
+	if err := c.SaveState(); err != nil {
+		c.Log.Warnf("could not save resume state: %v", err)
+	}
+	for _, conn := range c.Conns() {
+		conn.SendHave(index)
+	}
+	c.emitProgress(ProgressPiece, index)
+	if c.Left() == 0 {
+		if err := c.CheckFileSizes(); err != nil {
+			c.Log.Errorf("%s: %v", c.TorrentFilePath, err)
+			c.Stop(err)
+			return err
+		}
+		c.markComplete()
+		c.emitProgress(ProgressSeeding, index)
+	}
+	return nil
+}
+
+// Pick the rarest piece that the peer has and that we still need, and that is
+// not currently being downloaded from another peer, and add it to the request
+// queue. When the queue is full, only the pieces that are already queued may
+// be picked, unless a queued piece is stalled: nobody downloads it and no
+// connected peer lets us request it, typically because its peers went away.
+// The stalled piece is then evicted to make room. In endgame mode, pieces
+// that are already being downloaded may be picked again.
+func (c *TorrentClient) ClaimPiece(pc *PeerConn) (int, bool) {
+	// The connection locks are not taken with piecesLock held
+	var available Bitfield
+	if c.Requests.IsFull() {
+		available = c.ConnsRequestablePieces()
+	}
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	requestable := pc.RequestablePieces()
+	if c.Requests.IsFull() {
+		queued := c.Requests.Queued(requestable)
+		isStalled := func(index int) bool {
+			return available != nil && c.downloadingPieces[index] == 0 && !available.Has(index)
+		}
+		if _, ok := c.Picker.NextIn(queued, pc.PieceCount); ok || !c.Requests.Evict(isStalled) {
+			requestable = queued
+		}
+	}
+	index, ok := c.Picker.NextIn(requestable, pc.PieceCount)
+	if !ok && c.isEndgame() {
+		index, ok = c.endgamePiece(pc)
+	}
+	if !ok || !c.Requests.Add(index, int(c.PieceSize(index))) {
+		return 0, false
+	}
+	c.downloadingPieces[index]++
+	return index, true
+}
+
+// Pieces that at least one connected peer lets us request
+func (c *TorrentClient) ConnsRequestablePieces() Bitfield {
+	available := NewBitfield(c.PieceCount())
+	for _, conn := range c.Conns() {
+		requestable := conn.RequestablePieces()
+		for index := 0; index < c.PieceCount(); index++ {
+			if requestable.Has(index) {
+				available.Set(index)
+			}
+		}
+	}
+	return available
+}
+
+// Must be called with piecesLock held
+func (c *TorrentClient) hasPiece(index int) bool {
+	return index < len(c.HavePieces) && c.HavePieces[index]
+}
+
+// Must be called with piecesLock held
+func (c *TorrentClient) pieceNeeded(index int) bool {
+	return !c.hasPiece(index) && c.downloadingPieces[index] == 0 && c.pieceWanted(index)
+}
+
+// Must be called with piecesLock held
+func (c *TorrentClient) isEndgame() bool {
+	blocks := 0
+	for index := 0; index < c.PieceCount(); index++ {
+		if !c.hasPiece(index) && c.pieceWanted(index) {
+			if c.downloadingPieces[index] == 0 {
+				return false
+			}
+			blocks += int((c.PieceSize(index) + BlockSize - 1) / BlockSize)
+		}
+	}
+	return blocks > 0 && blocks < endgameBlockThreshold
+}
+
+// Missing piece that the peer has, and that is downloaded by the fewest peers.
+// Must be called with piecesLock held.
+func (c *TorrentClient) endgamePiece(pc *PeerConn) (int, bool) {
+	best := -1
+	requestable := pc.RequestablePieces()
+	for index := 0; index < c.PieceCount(); index++ {
+		if c.hasPiece(index) || !c.pieceWanted(index) || !requestable.Has(index) {
+			continue
+		}
+		if best < 0 || c.downloadingPieces[index] < c.downloadingPieces[best] {
+			best = index
+		}
+	}
+	return best, best >= 0
+}
+
+// Reports whether the piece is downloaded from several peers, in endgame mode
+func (c *TorrentClient) IsSharedPiece(index int) bool {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	return c.downloadingPieces[index] > 1
+}
+
+func (c *TorrentClient) ReleasePiece(index int) {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	if c.downloadingPieces[index]--; c.downloadingPieces[index] <= 0 {
+		delete(c.downloadingPieces, index)
+	}
+}
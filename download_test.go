@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadPiece(t *testing.T) {
+	// The last piece ends with a block shorter than BlockSize
+	info, data := makeTestInfo(2*BlockSize, 2*BlockSize+BlockSize+1000)
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	pc, err := c.Connect(context.Background(), loopbackPeer(seeder.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for !pc.HasPiece(c.PieceCount() - 1) {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := 0; index < c.PieceCount(); index++ {
+		piece, err := c.DownloadPiece(pc, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := c.PieceOffset(index)
+		if !bytes.Equal(piece, data[offset:offset+c.PieceSize(index)]) {
+			t.Fatalf("piece %d differs", index)
+		}
+		c.Requests.Remove(index)
+	}
+	if c.Downloaded != int64(len(data)) {
+		t.Fatalf("%d bytes downloaded", c.Downloaded)
+	}
+}
+
+func TestBlockLength(t *testing.T) {
+	for _, test := range []struct{ size, begin, length int }{
+		{2 * BlockSize, 0, BlockSize},
+		{2 * BlockSize, BlockSize, BlockSize},
+		{BlockSize + 1000, BlockSize, 1000},
+		{1000, 0, 1000},
+	} {
+		if length := BlockLength(test.size, test.begin); length != test.length {
+			t.Errorf("BlockLength(%d, %d) = %d", test.size, test.begin, length)
+		}
+	}
+}
+
+func TestConnectLoopLimitsConnections(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.connSlots = make(chan struct{}, 2)
+	var connected, active, maxActive int64
+	release := make(chan struct{})
+	var peers []Peer
+	for i := 0; i < 5; i++ {
+		peers = append(peers, startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+			atomic.AddInt64(&connected, 1)
+			current := atomic.AddInt64(&active, 1)
+			for {
+				previous := atomic.LoadInt64(&maxActive)
+				if current <= previous || atomic.CompareAndSwapInt64(&maxActive, previous, current) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt64(&active, -1)
+		}))
+	}
+	// Duplicates are not dialed twice
+	c.AddPeers(append(peers, peers[0]))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ConnectLoop(ctx)
+
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt64(&connected) == 2 })
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&connected); n != 2 {
+		t.Fatalf("%d peers connected", n)
+	}
+	// Queued peers are dialed as slots free up
+	release <- struct{}{}
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt64(&connected) == 3 })
+	close(release)
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt64(&connected) == 5 })
+	if n := atomic.LoadInt64(&maxActive); n > 2 {
+		t.Fatalf("%d simultaneous connections", n)
+	}
+}
+
+// Pieces downloaded from several peers at once are buffered at most
+// MaxPieces at a time
+func TestQueuedPiecesBoundMemory(t *testing.T) {
+	pieceLength, pieceCount := 2*BlockSize, 24
+	info, data := makeTestInfo(pieceLength, pieceLength*pieceCount)
+	c := newTestClient(t, info)
+	c.Requests = NewRequestQueue(2)
+	c.Storage = NewMemoryStorage(int64(len(data)))
+	for i := 0; i < 3; i++ {
+		seeder := startTestSeeder(t, info, data)
+		c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.ConnectLoop(ctx)
+	waitFor(t, 20*time.Second, func() bool { return c.Left() == 0 })
+	stats := c.Requests.Stats()
+	if stats.PeakBytes == 0 || stats.PeakBytes > int64(2*pieceLength) {
+		t.Fatal(stats)
+	}
+	if stats.Pieces != 0 || stats.Bytes != 0 {
+		t.Fatal(stats)
+	}
+	got := make([]byte, len(data))
+	if err := c.Storage.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("corrupt download", err)
+	}
+}
+
+// A piece left in the full queue by a peer that went away does not keep the
+// other peers from claiming pieces
+func TestClaimPieceEvictsStalledPieces(t *testing.T) {
+	info, data := makeTestInfo(2*BlockSize, 4*2*BlockSize)
+	c := newTestClient(t, info)
+	c.Requests = NewRequestQueue(1)
+	newPeer := func(port int, index int) *PeerConn {
+		pc := NewPeerConn(nil, loopbackPeer(port), strings.Repeat(strconv.Itoa(index), 20), c.PieceCount())
+		pc.PeerChoking = false
+		pc.Bitfield.Set(index)
+		if err := c.AddConn(pc); err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+	gone := newPeer(6881, 0)
+	if index, ok := c.ClaimPiece(gone); !ok || index != 0 {
+		t.Fatal(index, ok)
+	}
+	c.Requests.Next(gone, 0, false)
+	c.Requests.Receive(0, 0, data[:BlockSize])
+	c.Requests.ReleasePeer(gone)
+	c.ReleasePiece(0)
+
+	// The piece is kept while a connected peer may request it
+	other := newPeer(6882, 1)
+	if index, ok := c.ClaimPiece(other); ok {
+		t.Fatal("claimed", index, "while the queue is full")
+	}
+	c.RemoveConn(gone)
+	if index, ok := c.ClaimPiece(other); !ok || index != 1 {
+		t.Fatal(index, ok)
+	}
+	if stats := c.Requests.Stats(); stats.Pieces != 1 || stats.Received != 0 {
+		t.Fatal(stats)
+	}
+}
+
+// Requests are dropped by a peer without the fast extension when it chokes
+// us: their blocks are handed out again, without sending cancels
+func TestChokeReleasesRequests(t *testing.T) {
+	info, _ := makeTestInfo(2*BlockSize, 2*BlockSize)
+	c := newTestClient(t, info)
+	afterChoke := make(chan []uint8, 1)
+	peer := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+		conn.Write((&Message{ID: MsgBitfield, Payload: []byte{0x80}}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == MsgRequest {
+				break
+			}
+		}
+		conn.Write((&Message{ID: MsgChoke}).Serialize())
+		var ids []uint8
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				afterChoke <- ids
+				return
+			}
+			if msg != nil {
+				ids = append(ids, msg.ID)
+			}
+		}
+	})
+	pc, err := c.Connect(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the fast extension, the peer does not reject the requests
+	pc.Reserved[reservedFastByte] &^= reservedFastMask
+	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for !pc.HasPiece(0) {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.DownloadPiece(pc, 0); err != errPieceChoked {
+		t.Fatal(err)
+	}
+	pc.Close()
+	for _, id := range <-afterChoke {
+		if id == MsgCancel {
+			t.Fatal("cancel sent after choke")
+		}
+	}
+	if stats := c.Requests.Stats(); stats.Unrequested != 2 || stats.Requested != 0 {
+		t.Fatal(stats)
+	}
+	other := &PeerConn{}
+	for _, begin := range []int{0, BlockSize} {
+		if request, ok := c.Requests.Next(other, 0, false); !ok || request.Begin != begin {
+			t.Fatal(request, ok)
+		}
+	}
+}
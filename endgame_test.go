@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndgameCancelsDuplicateRequests(t *testing.T) {
+	info, data := makeTestInfo(BlockSize, BlockSize)
+	c := newTestClient(t, info)
+	var delivered int32
+	cancels := make(chan BlockRequest, 2)
+	// Both peers have the single piece and answer late, so that both are
+	// asked for it; only the first answer is sent
+	serve := func(conn net.Conn) {
+		conn.Write((&Message{ID: MsgBitfield, Payload: []byte{0x80}}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			switch msg.ID {
+			case MsgRequest:
+				go func() {
+					time.Sleep(500 * time.Millisecond)
+					if atomic.CompareAndSwapInt32(&delivered, 0, 1) {
+						conn.Write(MakePieceMessage(0, 0, data).Serialize())
+					}
+				}()
+			case MsgCancel:
+				index, begin, length, _ := ParseRequestMessage(msg)
+				cancels <- BlockRequest{index, begin, length}
+			}
+		}
+	}
+	c.AddPeers([]Peer{startFakePeer(t, c.InfoHash(), serve), startFakePeer(t, c.InfoHash(), serve)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	select {
+	case request := <-cancels:
+		if request != (BlockRequest{0, 0, BlockSize}) {
+			t.Fatal(request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no cancel sent to the other peer")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Extension protocol
+// http://www.bittorrent.org/beps/bep_0010.html
+
+const (
+	MsgExtended = 20
+
+	extendedHandshakeID = 0
+)
+
+// Extension message IDs that we advertise in our extended handshake. Peers
+// send us extension messages with these IDs.
+const (
+	utMetadataID = 1
+	utPexID      = 2
+)
+
+// Number of outstanding requests that we accept from a peer, advertised as
+// reqq
+const extendedRequestQueue = 250
+
+type ExtendedHandshake struct {
+	// Extension message IDs advertised by the peer
+	M            map[string]int
+	MetadataSize int
+	// Listen port, client name and version, and number of outstanding
+	// requests that the peer accepts; zero values when not advertised
+	Port         int
+	Version      string
+	RequestQueue int
+	// Addresses of the peer, when it has interfaces of both families
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// Extension that we advertise in our extended handshake
+type Extension struct {
+	Name string
+	// Message ID that the peer uses to send us messages of the extension
+	ID byte
+	// Whether the extension is advertised to the peers of the torrent, nil to
+	// always advertise it
+	Enabled func(c *TorrentClient) bool
+	// Handle a message of the extension received by the read loop, nil when
+	// the messages are read elsewhere
+	Handle func(pc *PeerConn, dict map[string]interface{}, data []byte) error
+}
+
+type ExtensionRegistry struct {
+	extensions []Extension
+}
+
+// Registry of the extensions that we support: metadata exchange and peer
+// exchange
+func NewExtensionRegistry() *ExtensionRegistry {
+	r := &ExtensionRegistry{}
+	r.Register(Extension{Name: "ut_metadata", ID: utMetadataID, Handle: handleMetadataMessage})
+	r.Register(Extension{
+		Name: "ut_pex",
+		ID:   utPexID,
+		Enabled: func(c *TorrentClient) bool {
+			return !c.IsPrivate()
+		},
+		Handle: handlePexMessage,
+	})
+	return r
+}
+
+// Names and IDs must be unique, and ID 0 is the handshake
+func (r *ExtensionRegistry) Register(extension Extension) error {
+	if extension.ID == extendedHandshakeID {
+		return fmt.Errorf("extension %s: message id %d is reserved", extension.Name, extendedHandshakeID)
+	}
+	for _, known := range r.extensions {
+		if known.Name == extension.Name || known.ID == extension.ID {
+			return fmt.Errorf("extension %s: conflicts with %s", extension.Name, known.Name)
+		}
+	}
+	r.extensions = append(r.extensions, extension)
+	return nil
+}
+
+// Enabled extension with the message ID, nil if there is none
+func (r *ExtensionRegistry) Lookup(c *TorrentClient, id byte) *Extension {
+	for i, extension := range r.extensions {
+		if extension.ID == id && (extension.Enabled == nil || extension.Enabled(c)) {
+			return &r.extensions[i]
+		}
+	}
+	return nil
+}
+
+// The m dictionary of the extended handshake
+func (r *ExtensionRegistry) handshakeM(c *TorrentClient) map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, extension := range r.extensions {
+		if extension.Enabled == nil || extension.Enabled(c) {
+			m[extension.Name] = int(extension.ID)
+		}
+	}
+	return m
+}
+
+func MakeExtendedMessage(extensionID byte, dict interface{}, data []byte) (*Message, error) {
+	var payload bytes.Buffer
+	payload.WriteByte(extensionID)
+	if err := bencode.Marshal(&payload, dict); err != nil {
+		return nil, err
+	}
+	payload.Write(data)
+	return &Message{ID: MsgExtended, Payload: payload.Bytes()}, nil
+}
+
+// Return the extension ID, the bencoded dictionary and the raw data that may
+// follow the dictionary
+func ParseExtendedMessage(msg *Message) (byte, map[string]interface{}, []byte, error) {
+	if msg.ID != MsgExtended || len(msg.Payload) < 1 {
+		return 0, nil, nil, errors.New("malformed extended message")
+	}
+	payload := string(msg.Payload[1:])
+	end, err := ScanBencodeValue(payload, 0)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	decoded, err := bencode.Decode(strings.NewReader(payload[:end]))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	dict, isDict := decoded.(map[string]interface{})
+	if !isDict {
+		return 0, nil, nil, errors.New("extended message is not a dictionary")
+	}
+	return msg.Payload[0], dict, msg.Payload[1+end:], nil
+}
+
+func (c *TorrentClient) MakeExtendedHandshakeMessage() (*Message, error) {
+	dict := map[string]interface{}{
+		"m":    c.Extensions.handshakeM(c),
+		"p":    c.Port,
+		"v":    defaultUserAgent,
+		"reqq": extendedRequestQueue,
+	}
+	if c.HasInfo() {
+		dict["metadata_size"] = len(c.RawInfo())
+	}
+	return MakeExtendedMessage(extendedHandshakeID, dict, nil)
+}
+
+func ParseExtendedHandshake(dict map[string]interface{}) *ExtendedHandshake {
+	handshake := &ExtendedHandshake{
+		M: map[string]int{},
+	}
+	if m, isDict := dict["m"].(map[string]interface{}); isDict {
+		for name, id := range m {
+			if id, isInt := id.(int64); isInt && id > 0 {
+				handshake.M[name] = int(id)
+			}
+		}
+	}
+	if metadataSize, isInt := dict["metadata_size"].(int64); isInt {
+		handshake.MetadataSize = int(metadataSize)
+	}
+	if port, isInt := dict["p"].(int64); isInt && port > 0 && port <= 65535 {
+		handshake.Port = int(port)
+	}
+	handshake.Version, _ = dict["v"].(string)
+	if requestQueue, isInt := dict["reqq"].(int64); isInt && requestQueue > 0 {
+		handshake.RequestQueue = int(requestQueue)
+	}
+	if ipv4, isString := dict["ipv4"].(string); isString && len(ipv4) == net.IPv4len {
+		handshake.IPv4 = net.IP(ipv4)
+	}
+	if ipv6, isString := dict["ipv6"].(string); isString && len(ipv6) == net.IPv6len {
+		handshake.IPv6 = net.IP(ipv6)
+	}
+	return handshake
+}
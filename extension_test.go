@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.Port = 51413
+	c.Extensions = &ExtensionRegistry{}
+	for _, extension := range []Extension{
+		{Name: "ut_metadata", ID: 3},
+		{Name: "lt_donthave", ID: 7, Enabled: func(c *TorrentClient) bool { return c.HasInfo() }},
+		{Name: "disabled", ID: 8, Enabled: func(c *TorrentClient) bool { return false }},
+	} {
+		if err := c.Extensions.Register(extension); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := c.MakeExtendedHandshakeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ReadMessage(bytes.NewReader(msg.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, dict, data, err := ParseExtendedMessage(decoded)
+	if err != nil || id != extendedHandshakeID || len(data) != 0 {
+		t.Fatal(id, data, err)
+	}
+	handshake := ParseExtendedHandshake(dict)
+	if !reflect.DeepEqual(handshake.M, map[string]int{"ut_metadata": 3, "lt_donthave": 7}) {
+		t.Fatal(handshake.M)
+	}
+	if handshake.Port != 51413 || handshake.Version != defaultUserAgent || handshake.RequestQueue != extendedRequestQueue {
+		t.Fatalf("%+v", handshake)
+	}
+	if handshake.MetadataSize != len(c.RawInfo()) {
+		t.Fatal(handshake.MetadataSize)
+	}
+	if extension := c.Extensions.Lookup(c, 7); extension == nil || extension.Name != "lt_donthave" {
+		t.Fatal(extension)
+	}
+	if c.Extensions.Lookup(c, 8) != nil || c.Extensions.Lookup(c, 9) != nil {
+		t.Fatal("disabled or unknown extension found")
+	}
+}
+
+func TestRegisterExtension(t *testing.T) {
+	r := NewExtensionRegistry()
+	for _, extension := range []Extension{
+		{Name: "handshake", ID: extendedHandshakeID},
+		{Name: "ut_metadata", ID: 9},
+		{Name: "other", ID: utPexID},
+	} {
+		if err := r.Register(extension); err == nil {
+			t.Error(extension.Name, "registered")
+		}
+	}
+	if err := r.Register(Extension{Name: "other", ID: 9}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseExtendedMessage(t *testing.T) {
+	msg, err := MakeExtendedMessage(utMetadataID, map[string]interface{}{"msg_type": 1, "piece": 0}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, dict, data, err := ParseExtendedMessage(msg)
+	if err != nil || id != utMetadataID || dict["piece"] != int64(0) || string(data) != "data" {
+		t.Fatal(id, dict, data, err)
+	}
+	for _, payload := range [][]byte{nil, []byte("\x01i1e"), []byte("\x01d1:a")} {
+		if _, _, _, err := ParseExtendedMessage(&Message{ID: MsgExtended, Payload: payload}); err == nil {
+			t.Errorf("%q parsed", payload)
+		}
+	}
+
+	// Support is advertised in the reserved bytes of the handshake
+	handshake, err := ReadHandshake(bytes.NewReader(MakeHandshake(string(make([]byte, 20)), MakePeerID())))
+	if err != nil || !handshake.SupportsExtensions() {
+		t.Fatal(handshake, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Fast extension
+// http://www.bittorrent.org/beps/bep_0006.html
+
+const (
+	MsgSuggestPiece  = 13
+	MsgHaveAll       = 14
+	MsgHaveNone      = 15
+	MsgRejectRequest = 16
+	MsgAllowedFast   = 17
+)
+
+// Size of the allowed fast set that we send to peers
+const allowedFastCount = 10
+
+func MakeRejectRequestMessage(index int, begin int, length int) *Message {
+	msg := MakeRequestMessage(index, begin, length)
+	msg.ID = MsgRejectRequest
+	return msg
+}
+
+// Suggest piece, have and allowed fast messages share the same payload
+func ParsePieceIndexMessage(msg *Message) (int, error) {
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("malformed message %d", msg.ID)
+	}
+	return ParseHaveMessage(&Message{ID: MsgHave, Payload: msg.Payload})
+}
+
+// Canonical allowed fast set of k pieces for a peer, derived from its /24
+// network and the info hash. Returns nil for IPv6 peers, for which the
+// algorithm is not defined.
+func AllowedFastSet(ip net.IP, infoHash string, pieceCount int, k int) []int {
+	ip = ip.To4()
+	if ip == nil || pieceCount == 0 {
+		return nil
+	}
+	if k > pieceCount {
+		k = pieceCount
+	}
+	x := append([]byte{ip[0], ip[1], ip[2], 0}, infoHash...)
+	var set []int
+	known := map[int]bool{}
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[4*i:]) % uint32(pieceCount))
+			if !known[index] {
+				known[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// Send our allowed fast set, which the peer may request while we choke it
+func (c *TorrentClient) SendAllowedFast(pc *PeerConn) error {
+	if !pc.SupportsFast() {
+		return nil
+	}
+	set := AllowedFastSet(pc.Peer.IP, c.InfoHash(), c.PieceCount(), allowedFastCount)
+	pc.stateLock.Lock()
+	pc.servedFast = map[int]bool{}
+	for _, index := range set {
+		pc.servedFast[index] = true
+	}
+	pc.stateLock.Unlock()
+	for _, index := range set {
+		msg := MakeHaveMessage(index)
+		msg.ID = MsgAllowedFast
+		if err := pc.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether we serve requests of the peer for the piece: all pieces
+// while we unchoke it, only our allowed fast set otherwise
+func (pc *PeerConn) CanRequestFromUs(index int) bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return !pc.AmChoking || pc.servedFast[index]
+}
+
+func (pc *PeerConn) SupportsFast() bool {
+	return pc.Reserved[reservedFastByte]&reservedFastMask != 0
+}
+
+// Pieces that we may request from the peer in its current state: all the
+// pieces it has when it unchokes us, only the allowed fast ones otherwise
+func (pc *PeerConn) RequestablePieces() Bitfield {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	requestable := NewBitfield(pc.PieceCount)
+	for index := 0; index < pc.PieceCount; index++ {
+		if !pc.Bitfield.Has(index) || pc.rejectedPieces[index] {
+			continue
+		}
+		if !pc.PeerChoking || pc.allowedFast[index] {
+			requestable.Set(index)
+		}
+	}
+	return requestable
+}
+
+func (pc *PeerConn) IsAllowedFast(index int) bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.allowedFast[index]
+}
+
+func (pc *PeerConn) HasAllowedFast() bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return len(pc.allowedFast) > 0
+}
+
+// Do not request the piece from this peer again, after it rejected one of
+// our requests, until it unchokes us
+func (pc *PeerConn) setRejected(index int) {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	if pc.rejectedPieces == nil {
+		pc.rejectedPieces = map[int]bool{}
+	}
+	pc.rejectedPieces[index] = true
+}
+
+// Message that advertises our pieces: have all and have none are used with
+// peers that support the fast extension. Returns nil when there is nothing
+// to send.
+func (c *TorrentClient) MakeHaveMessage(pc *PeerConn) *Message {
+	haveCount := c.HaveCount()
+	if pc.SupportsFast() {
+		if haveCount == c.PieceCount() {
+			return &Message{ID: MsgHaveAll}
+		} else if haveCount == 0 {
+			return &Message{ID: MsgHaveNone}
+		}
+	} else if haveCount == 0 {
+		return nil
+	}
+	return c.MakeBitfieldMessage()
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replay connection with a peer that supports the fast extension
+func newFastReplayConn(t *testing.T, pieceCount int, raw []byte) *PeerConn {
+	t.Helper()
+	pc := newReplayConn(t, pieceCount, raw)
+	pc.Reserved[reservedFastByte] |= reservedFastMask
+	return pc
+}
+
+func readAllMessages(t *testing.T, pc *PeerConn) {
+	t.Helper()
+	for {
+		if _, err := pc.ReadMessage(); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHaveAllAndHaveNone(t *testing.T) {
+	pc := newFastReplayConn(t, 10, []byte{0, 0, 0, 1, MsgHaveAll})
+	readAllMessages(t, pc)
+	for index := 0; index < 10; index++ {
+		if !pc.HasPiece(index) {
+			t.Fatalf("piece %d missing after have all", index)
+		}
+	}
+
+	pc = newFastReplayConn(t, 10, []byte{
+		0, 0, 0, 1, MsgHaveAll,
+		0, 0, 0, 1, MsgHaveNone,
+	})
+	readAllMessages(t, pc)
+	for index := 0; index < 10; index++ {
+		if pc.HasPiece(index) {
+			t.Fatalf("piece %d present after have none", index)
+		}
+	}
+
+	// Peers that did not negotiate the extension may not send its messages
+	for _, id := range []byte{MsgHaveAll, MsgHaveNone} {
+		pc = newReplayConn(t, 10, []byte{0, 0, 0, 1, id})
+		if _, err := pc.ReadMessage(); err == nil || err == io.EOF {
+			t.Errorf("message %d: %v", id, err)
+		}
+	}
+}
+
+func TestAllowedFastAndSuggestPiece(t *testing.T) {
+	pc := newFastReplayConn(t, 10, []byte{
+		0, 0, 0, 1, MsgHaveAll,
+		0, 0, 0, 5, MsgAllowedFast, 0, 0, 0, 3,
+		// Out of range allowed fast pieces are ignored
+		0, 0, 0, 5, MsgAllowedFast, 0, 0, 0, 42,
+		0, 0, 0, 5, MsgSuggestPiece, 0, 0, 0, 7,
+	})
+	readAllMessages(t, pc)
+	if !pc.IsChoked() || !pc.HasAllowedFast() || !pc.IsAllowedFast(3) || pc.IsAllowedFast(4) {
+		t.Fatal("unexpected allowed fast set")
+	}
+	requestable := pc.RequestablePieces()
+	for index := 0; index < 10; index++ {
+		if requestable.Has(index) != (index == 3) {
+			t.Fatalf("piece %d requestable while choked: %v", index, requestable.Has(index))
+		}
+	}
+	if !pc.suggested[7] || len(pc.suggested) != 1 {
+		t.Fatal(pc.suggested)
+	}
+
+	pc = newReplayConn(t, 10, []byte{0, 0, 0, 5, MsgAllowedFast, 0, 0, 0, 3})
+	if _, err := pc.ReadMessage(); err == nil || err == io.EOF {
+		t.Fatalf("allowed fast without the extension: %v", err)
+	}
+}
+
+// Blocks rejected by a peer are handed out to the other peers
+func TestRejectRequestRequeues(t *testing.T) {
+	info, _ := makeTestInfo(2*BlockSize, 4*BlockSize)
+	c := newTestClient(t, info)
+	// Pipes are synchronous: both ends would block writing requests and
+	// rejects at the same time
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	remote, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := NewPeerConn(local, loopbackPeer(6881), "", c.PieceCount())
+	pc.Reserved[reservedFastByte] |= reservedFastMask
+	go func() {
+		defer remote.Close()
+		remote.Write((&Message{ID: MsgHaveAll}).Serialize())
+		remote.Write((&Message{ID: MsgAllowedFast, Payload: []byte{0, 0, 0, 0}}).Serialize())
+		for {
+			msg, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == MsgRequest {
+				index, begin, length, _ := ParseRequestMessage(msg)
+				remote.Write(MakeRejectRequestMessage(index, begin, length).Serialize())
+			}
+		}
+	}()
+	for !pc.IsAllowedFast(0) {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.DownloadPiece(pc, 0); err != errPieceRejected {
+		t.Fatalf("error %v for a rejected request", err)
+	}
+	if pc.RequestablePieces().Has(0) {
+		t.Fatal("rejected piece is still requested from the peer")
+	}
+	other := NewPeerConn(nil, loopbackPeer(6882), "", c.PieceCount())
+	if request, ok := c.Requests.Next(other, 0, false); !ok || request.Begin != 0 {
+		t.Fatal("rejected block is not requeued", request, ok)
+	}
+}
+
+// Requests rejected because the peer choked us do not prevent requesting the
+// piece once it unchokes us again
+func TestChokeRejectsDoNotBlacklist(t *testing.T) {
+	info, _ := makeTestInfo(2*BlockSize, 2*BlockSize)
+	c := newTestClient(t, info)
+	peer := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+		conn.Write((&Message{ID: MsgHaveAll}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		rechoked := false
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgRequest {
+				continue
+			}
+			if !rechoked {
+				conn.Write((&Message{ID: MsgChoke}).Serialize())
+			}
+			index, begin, length, _ := ParseRequestMessage(msg)
+			conn.Write(MakeRejectRequestMessage(index, begin, length).Serialize())
+			if !rechoked {
+				conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+				rechoked = true
+			}
+		}
+	})
+	pc, err := c.Connect(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if !pc.SupportsFast() {
+		t.Fatal("fast extension not negotiated")
+	}
+	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for !pc.HasPiece(0) || pc.IsChoked() {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.DownloadPiece(pc, 0); err != errPieceChoked {
+		t.Fatal(err)
+	}
+	for pc.IsChoked() {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !pc.RequestablePieces().Has(0) {
+		t.Fatal("piece is not requestable after unchoke")
+	}
+	if stats := c.Requests.Stats(); stats.Requested != 0 {
+		t.Fatal(stats)
+	}
+
+	// Pieces rejected while choked may be requested after an unchoke
+	pc = newFastReplayConn(t, 1, []byte{
+		0, 0, 0, 1, MsgHaveAll,
+		0, 0, 0, 1, MsgUnchoke,
+	})
+	pc.setRejected(0)
+	readAllMessages(t, pc)
+	if !pc.RequestablePieces().Has(0) {
+		t.Fatal("rejected piece is not requestable after unchoke")
+	}
+}
+
+// Blocks of a rejected piece that were already in flight are ignored by the
+// download of the next piece
+func TestBlocksInFlightAfterReject(t *testing.T) {
+	info, data := makeTestInfo(2*BlockSize, 4*BlockSize)
+	c := newTestClient(t, info)
+	peer := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+		conn.Write((&Message{ID: MsgHaveAll}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		rejected := false
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgRequest {
+				continue
+			}
+			index, begin, length, _ := ParseRequestMessage(msg)
+			offset := int(c.PieceOffset(index)) + begin
+			if index == 0 && !rejected {
+				// The second block of the piece was already sent
+				conn.Write(MakeRejectRequestMessage(index, begin, length).Serialize())
+				conn.Write(MakePieceMessage(0, BlockSize, data[BlockSize:2*BlockSize]).Serialize())
+				rejected = true
+			} else if index != 0 {
+				conn.Write(MakePieceMessage(index, begin, data[offset:offset+length]).Serialize())
+			}
+		}
+	})
+	pc, err := c.Connect(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for !pc.HasPiece(1) || pc.IsChoked() {
+		if _, err := pc.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.DownloadPiece(pc, 0); err != errPieceRejected {
+		t.Fatal(err)
+	}
+	piece, err := c.DownloadPiece(pc, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piece, data[2*BlockSize:]) {
+		t.Fatal("piece 1 differs")
+	}
+}
+
+// Example of BEP 6: http://www.bittorrent.org/beps/bep_0006.html
+func TestAllowedFastSetVector(t *testing.T) {
+	infoHash := strings.Repeat("\xaa", 20)
+	ip := net.ParseIP("80.4.4.200")
+	if set := AllowedFastSet(ip, infoHash, 1313, 7); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188}) {
+		t.Fatal(set)
+	}
+	if set := AllowedFastSet(ip, infoHash, 1313, 9); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}) {
+		t.Fatal(set)
+	}
+	// Only the /24 network counts
+	if set := AllowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 7); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188}) {
+		t.Fatal(set)
+	}
+	if set := AllowedFastSet(ip, infoHash, 3, 7); len(set) != 3 {
+		t.Fatal(set)
+	}
+	if set := AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 7); set != nil {
+		t.Fatal(set)
+	}
+}
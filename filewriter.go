@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Files that are being downloaded have this suffix until they are complete
+const partSuffix = ".part"
+
+// Suffix of the file that keeps the parts of pieces that overlap files that
+// are not selected
+const partsSuffix = ".parts"
+
+// Storage backed by the files of the torrent on disk. Pieces are laid out
+// contiguously over the concatenation of all files, in order.
+type FileWriter struct {
+	Files       []File
+	PieceLength int64
+
+	rootDir string
+	files   []*os.File
+	// Paths of the files that are not complete yet, empty once they are
+	// renamed to their final path
+	partPaths []string
+	locks     []sync.Mutex
+	// Files that are not selected are neither created nor written, nil when
+	// all files are selected
+	wanted []bool
+	// Pieces that overlap both selected and unselected files keep the parts
+	// in the unselected files here, one piece length per piece, so that they
+	// can be verified again and uploaded. Slots are indexed by piece.
+	parts      *os.File
+	partsSlots map[int]int64
+}
+
+// Open or create the wanted files under the root directory, with their final
+// size; wanted is nil when all files are. Files that do not exist yet are
+// written with the .part suffix, in the incomplete directory if it is set,
+// until FinishFile moves them to the root directory. The parts of the pieces
+// that overlap files that are not wanted are written to a hidden .parts file
+// in the incomplete directory, when the pieces also overlap wanted files, and
+// dropped otherwise.
+func NewFileWriter(rootDir string, incompleteDir string, files []File, pieceLength int64, wanted []bool) (*FileWriter, error) {
+	w := &FileWriter{
+		Files:       files,
+		PieceLength: pieceLength,
+		rootDir:     rootDir,
+		files:       make([]*os.File, len(files)),
+		partPaths:   make([]string, len(files)),
+		locks:       make([]sync.Mutex, len(files)),
+		wanted:      wanted,
+	}
+	if incompleteDir == "" {
+		incompleteDir = rootDir
+	}
+	for i, file := range files {
+		if !w.isWanted(i) {
+			continue
+		}
+		path, err := FilePath(rootDir, file)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) && file.Length > 0 {
+			if path, err = PartFilePath(incompleteDir, file); err != nil {
+				w.Close()
+				return nil, err
+			}
+			w.partPaths[i] = path
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			w.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files[i] = f
+		if stat, err := f.Stat(); err != nil || stat.Size() != file.Length {
+			if err := f.Truncate(file.Length); err != nil {
+				w.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := w.openParts(incompleteDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Open the .parts file when some pieces overlap both wanted and unwanted
+// files. Its content is only valid for the same selection, which is fine
+// since pieces are verified before they are trusted.
+func (w *FileWriter) openParts(dir string) error {
+	pieces := BoundaryPieces(w.Files, w.PieceLength, w.wanted)
+	if len(pieces) == 0 {
+		return nil
+	}
+	path, err := PartsFilePath(dir, w.Files)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w.parts = f
+	w.partsSlots = map[int]int64{}
+	for slot, index := range pieces {
+		w.partsSlots[index] = int64(slot) * w.PieceLength
+	}
+	return f.Truncate(int64(len(pieces)) * w.PieceLength)
+}
+
+// Pieces that overlap both a wanted and an unwanted file, in increasing order.
+// Empty files overlap no piece.
+func BoundaryPieces(files []File, pieceLength int64, wanted []bool) []int {
+	if wanted == nil {
+		return nil
+	}
+	wantedPieces := map[int]bool{}
+	for i, file := range files {
+		if !wanted[i] || file.Length == 0 {
+			continue
+		}
+		first := int(file.Offset / pieceLength)
+		last := int((file.Offset + file.Length - 1) / pieceLength)
+		for index := first; index <= last; index++ {
+			wantedPieces[index] = true
+		}
+	}
+	boundary := map[int]bool{}
+	var pieces []int
+	for i, file := range files {
+		if wanted[i] || file.Length == 0 {
+			continue
+		}
+		// Pieces inside the file do not overlap any other file
+		first := int(file.Offset / pieceLength)
+		last := int((file.Offset + file.Length - 1) / pieceLength)
+		for _, index := range []int{first, last} {
+			if wantedPieces[index] && !boundary[index] {
+				boundary[index] = true
+				pieces = append(pieces, index)
+			}
+		}
+	}
+	sort.Ints(pieces)
+	return pieces
+}
+
+func (w *FileWriter) isWanted(index int) bool {
+	return w.wanted == nil || w.wanted[index]
+}
+
+// Open the existing files under the root directory for reading only, or their
+// .part files when they are not complete. Files that do not exist are left
+// closed, so that reading pieces that overlap them fails.
+func OpenFileReader(rootDir string, incompleteDir string, files []File, pieceLength int64) (*FileWriter, error) {
+	w := &FileWriter{
+		Files:       files,
+		PieceLength: pieceLength,
+		files:       make([]*os.File, len(files)),
+		locks:       make([]sync.Mutex, len(files)),
+	}
+	for i, file := range files {
+		path, err := FilePath(rootDir, file)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			if incompleteDir == "" {
+				incompleteDir = rootDir
+			}
+			if path, err = PartFilePath(incompleteDir, file); err != nil {
+				w.Close()
+				return nil, err
+			}
+			f, err = os.Open(path)
+		}
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files[i] = f
+	}
+	return w, nil
+}
+
+// Create the directory if needed, and check that files can be created in it
+func CheckWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".slivers")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Path of the file on disk. Path components that would escape the root
+// directory are rejected.
+func FilePath(rootDir string, file File) (string, error) {
+	for _, component := range file.Path {
+		if component == "" || component == "." || component == ".." || strings.ContainsAny(component, `/\`) {
+			return "", errors.New("invalid file path component: " + component)
+		}
+	}
+	return filepath.Join(append([]string{rootDir}, file.Path...)...), nil
+}
+
+// Path of the file while it is being downloaded
+func PartFilePath(dir string, file File) (string, error) {
+	path, err := FilePath(dir, file)
+	return path + partSuffix, err
+}
+
+// Path of the hidden file that keeps the parts of the boundary pieces in the
+// unwanted files, named after the torrent
+func PartsFilePath(dir string, files []File) (string, error) {
+	return FilePath(dir, File{Path: []string{"." + files[0].Path[0] + partsSuffix}})
+}
+
+// Move a complete .part file to its final path. Returns the final path, or an
+// empty string if the file was already complete.
+func (w *FileWriter) FinishFile(index int) (string, error) {
+	w.locks[index].Lock()
+	defer w.locks[index].Unlock()
+	partPath := w.partPaths[index]
+	if partPath == "" || !w.isWanted(index) {
+		return "", nil
+	}
+	path, err := FilePath(w.rootDir, w.Files[index])
+	if err != nil {
+		return "", err
+	}
+	if err := w.files[index].Close(); err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = moveFile(partPath, path)
+	}
+	if err != nil {
+		// Keep writing to the .part file
+		w.files[index], _ = os.OpenFile(partPath, os.O_RDWR, 0644)
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return "", err
+	}
+	w.files[index] = f
+	w.partPaths[index] = ""
+	return path, nil
+}
+
+// Rename the file, or copy it when the destination is on another filesystem
+func moveFile(from string, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destination, source); err != nil {
+		destination.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Write data at the given offset in the concatenated piece space, splitting
+// it over file boundaries
+func (w *FileWriter) WriteAt(data []byte, offset int64) error {
+	return w.each(data, offset, func(i int, chunk []byte, fileOffset int64) error {
+		if !w.isWanted(i) {
+			return w.eachPart(chunk, w.Files[i].Offset+fileOffset, func(part []byte, partsOffset int64, isKept bool) error {
+				if !isKept {
+					return nil
+				}
+				_, err := w.parts.WriteAt(part, partsOffset)
+				return err
+			})
+		}
+		_, err := w.files[i].WriteAt(chunk, fileOffset)
+		return err
+	})
+}
+
+// Reading pieces that overlap files that are not wanted fails, unless they
+// are boundary pieces
+func (w *FileWriter) ReadAt(data []byte, offset int64) error {
+	return w.each(data, offset, func(i int, chunk []byte, fileOffset int64) error {
+		if !w.isWanted(i) {
+			return w.eachPart(chunk, w.Files[i].Offset+fileOffset, func(part []byte, partsOffset int64, isKept bool) error {
+				if !isKept {
+					return errors.New(strings.Join(w.Files[i].Path, "/") + " is not selected")
+				}
+				_, err := w.parts.ReadAt(part, partsOffset)
+				return err
+			})
+		}
+		_, err := w.files[i].ReadAt(chunk, fileOffset)
+		return err
+	})
+}
+
+// Split data at the given offset in the concatenated piece space by piece,
+// and apply the operation to each part with its offset in the .parts file.
+// isKept is false for the pieces that are not boundary pieces.
+func (w *FileWriter) eachPart(data []byte, offset int64, operation func([]byte, int64, bool) error) error {
+	for len(data) > 0 {
+		index := int(offset / w.PieceLength)
+		pieceOffset := offset % w.PieceLength
+		length := w.PieceLength - pieceOffset
+		if length > int64(len(data)) {
+			length = int64(len(data))
+		}
+		slot, isKept := w.partsSlots[index]
+		if err := operation(data[:length], slot+pieceOffset, isKept); err != nil {
+			return err
+		}
+		data = data[length:]
+		offset += length
+	}
+	return nil
+}
+
+func (w *FileWriter) Verify(offset int64, length int64, hash [20]byte) (bool, error) {
+	return verifyStorage(w, offset, length, hash)
+}
+
+// Apply the operation to each file that overlaps [offset, offset+len(data)),
+// while holding the file lock
+func (w *FileWriter) each(data []byte, offset int64, operation func(int, []byte, int64) error) error {
+	end := offset + int64(len(data))
+	for i, file := range w.Files {
+		fileEnd := file.Offset + file.Length
+		if fileEnd <= offset || file.Offset >= end {
+			continue
+		}
+		start := offset
+		if start < file.Offset {
+			start = file.Offset
+		}
+		stop := end
+		if stop > fileEnd {
+			stop = fileEnd
+		}
+		w.locks[i].Lock()
+		err := operation(i, data[start-offset:stop-offset], start-file.Offset)
+		w.locks[i].Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compare the size of each file on disk with its length in the torrent, to
+// catch files that were truncated or replaced while we were writing them
+func (w *FileWriter) CheckSizes() error {
+	for i, file := range w.Files {
+		if !w.isWanted(i) {
+			continue
+		}
+		w.locks[i].Lock()
+		f := w.files[i]
+		var stat os.FileInfo
+		err := errors.New("file is not open")
+		if f != nil {
+			stat, err = f.Stat()
+		}
+		w.locks[i].Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(file.Path, "/"), err)
+		}
+		if stat.Size() != file.Length {
+			return fmt.Errorf("%s has %d bytes instead of %d", strings.Join(file.Path, "/"), stat.Size(), file.Length)
+		}
+	}
+	return nil
+}
+
+func (w *FileWriter) Close() error {
+	var firstErr error
+	for _, f := range append(w.files, w.parts) {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Move the files that overlap the piece to their final path once all their
+// pieces are downloaded, or all files when index is negative
+func (c *TorrentClient) FinishFiles(index int) {
+	w, isFileWriter := c.Storage.(*FileWriter)
+	if !isFileWriter {
+		return
+	}
+	pieceStart, pieceEnd := int64(0), c.TotalLength()
+	if index >= 0 {
+		pieceStart = c.PieceOffset(index)
+		pieceEnd = pieceStart + c.PieceSize(index)
+	}
+	for i, file := range w.Files {
+		if file.Offset+file.Length <= pieceStart || file.Offset >= pieceEnd || !c.hasFile(file) {
+			continue
+		}
+		path, err := w.FinishFile(i)
+		if err != nil {
+			c.Log.Errorf("could not move %s to its final path: %v", strings.Join(file.Path, "/"), err)
+		} else if path != "" {
+			c.Log.Debugf("%s complete", path)
+		}
+	}
+}
+
+// Check the size of the files on disk, once all pieces are verified
+func (c *TorrentClient) CheckFileSizes() error {
+	if w, isFileWriter := c.Storage.(*FileWriter); isFileWriter {
+		return w.CheckSizes()
+	}
+	return nil
+}
+
+// Reports whether all the pieces of the file are downloaded
+func (c *TorrentClient) hasFile(file File) bool {
+	if file.Length == 0 {
+		return true
+	}
+	first := int(file.Offset / c.PieceLength())
+	last := int((file.Offset + file.Length - 1) / c.PieceLength())
+	for index := first; index <= last; index++ {
+		if !c.HasPiece(index) {
+			return false
+		}
+	}
+	return true
+}
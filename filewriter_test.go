@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Files of the info dictionary as they are expected on disk
+func checkDownloadedFiles(t *testing.T, dir string, c *TorrentClient, data []byte) {
+	t.Helper()
+	for _, file := range c.Files() {
+		path, _ := FilePath(dir, file)
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data[file.Offset:file.Offset+file.Length]) {
+			t.Fatalf("%s differs", path)
+		}
+	}
+}
+
+func TestDownloadMultiFileTorrent(t *testing.T) {
+	info, data := makeTestInfo(16384, 10000, 0, 30000, 5)
+	files := info["files"].([]interface{})
+	files[2].(map[string]interface{})["path"] = []interface{}{"sub", "dir", "file2"}
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFiles(t, c.OutputDir, c, data)
+	if _, err := os.Stat(filepath.Join(c.OutputDir, "test", "sub", "dir", "file2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAcrossFiles(t *testing.T) {
+	info, data := makeTestInfo(16384, 100, 200, 300)
+	c := newTestClient(t, info)
+	w, err := NewFileWriter(c.OutputDir, "", c.Files(), c.PieceLength(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, file := range c.Files() {
+		path, _ := PartFilePath(c.OutputDir, file)
+		if stat, err := os.Stat(path); err != nil || stat.Size() != file.Length {
+			t.Fatalf("%s not preallocated: %v", path, err)
+		}
+	}
+	if err := w.WriteAt(data[50:550], 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteAt(data[:50], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteAt(data[550:], 550); err != nil {
+		t.Fatal(err)
+	}
+	read := make([]byte, 400)
+	if err := w.ReadAt(read, 80); err != nil || !bytes.Equal(read, data[80:480]) {
+		t.Fatal("read across files", err)
+	}
+	for i := range c.Files() {
+		if _, err := w.FinishFile(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDownloadedFiles(t, c.OutputDir, c, data)
+}
+
+// Files are written with the .part suffix in the incomplete directory, and
+// moved to the output directory once complete, including across a restart
+func TestPartFilesMovedWhenComplete(t *testing.T) {
+	info, data := makeTestInfo(16384, 16384, 20000)
+	outputDir, incompleteDir := t.TempDir(), t.TempDir()
+	newClient := func() *TorrentClient {
+		c := newTestClient(t, info)
+		c.OutputDir, c.IncompleteDir = outputDir, incompleteDir
+		return c
+	}
+	c := newClient()
+	files := c.Files()
+	finalPath := func(i int) string {
+		path, _ := FilePath(outputDir, files[i])
+		return path
+	}
+	partPath := func(i int) string {
+		path, _ := PartFilePath(incompleteDir, files[i])
+		return path
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// The seeder has the first file and the first piece of the second one
+	partial := newTestClient(t, info)
+	storage := NewMemoryStorage(int64(len(data)))
+	storage.WriteAt(data, 0)
+	partial.Storage = storage
+	partial.SetHasPiece(0)
+	partial.SetHasPiece(1)
+	startTestListener(t, partial)
+	c.AddPeers([]Peer{loopbackPeer(partial.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.HasPiece(0) && c.HasPiece(1) })
+	waitFor(t, 5*time.Second, func() bool { return exists(finalPath(0)) })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if exists(partPath(0)) || exists(finalPath(1)) || !exists(partPath(1)) {
+		t.Fatal("incomplete file moved")
+	}
+
+	// The download resumes from the .part file
+	resumed := newClient()
+	seeder := startTestSeeder(t, info, data)
+	resumed.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		done <- resumed.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return resumed.Left() == 0 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if downloaded := atomic.LoadInt64(&resumed.Downloaded) - c.Downloaded; downloaded != 20000-16384 {
+		t.Fatal("downloaded again", downloaded)
+	}
+	checkDownloadedFiles(t, outputDir, resumed, data)
+	if exists(partPath(1)) {
+		t.Fatal(partPath(1))
+	}
+}
+
+func TestDownloadToOutputDir(t *testing.T) {
+	withTestFlags(t)
+	*outputDir = filepath.Join(*outputDir, "downloads")
+	if err := CheckWritableDir(*outputDir); err != nil {
+		t.Fatal(err)
+	}
+	info, data := makeTestInfo(16384, 10000, 30000)
+	seeder := startTestSeeder(t, info, data)
+	c := newTorrentClient()
+	c.SetInfo(info, nil)
+	c.Encryption = EncryptionDisable
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	runUntilComplete(t, c)
+	for i, file := range []string{"file0", "file1"} {
+		got, err := os.ReadFile(filepath.Join(*outputDir, "test", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset := c.Files()[i].Offset; !bytes.Equal(got, data[offset:offset+c.Files()[i].Length]) {
+			t.Fatal(file, "differs")
+		}
+	}
+
+	// A file is in the way of the directory
+	blocked := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckWritableDir(filepath.Join(blocked, "downloads")); err == nil {
+		t.Fatal("output directory under a file")
+	}
+}
+
+// A file truncated behind the client's back fails the size check of a
+// complete download
+func TestTruncatedFileFailsSizeCheck(t *testing.T) {
+	info, data := makeTestInfo(16384, 10000, 30000)
+	c := newTestClient(t, info)
+	w, err := NewFileWriter(c.OutputDir, "", c.Files(), c.PieceLength(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	c.Storage = w
+	if err := w.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.Files() {
+		if _, err := w.FinishFile(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.CheckFileSizes(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(c.OutputDir, "test", "file1")
+	if err := os.Truncate(path, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckFileSizes(); err == nil || err.Error() != "test/file1 has 100 bytes instead of 30000" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha1"
+	"sync"
+)
+
+// Hash pieces on several goroutines. Pieces are read one after the other, in
+// order, by the read function, so that files are read sequentially, and are
+// then hashed by the workers. At most two pieces per worker are held in
+// memory. Pieces that could not be read have a nil hash and their read error.
+func HashPiecesConcurrently(pieceCount int, workers int, pieceSize func(index int) int64, read func(index int, piece []byte) error) ([][]byte, []error) {
+	if workers < 1 {
+		workers = 1
+	}
+	hashes := make([][]byte, pieceCount)
+	errs := make([]error, pieceCount)
+
+	type hashJob struct {
+		index int
+		piece []byte
+	}
+	jobs := make(chan hashJob, workers)
+	// Buffers are allocated on first use and recycled
+	buffers := make(chan []byte, 2*workers)
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- nil
+	}
+	var workerWaitGroup sync.WaitGroup
+	workerWaitGroup.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workerWaitGroup.Done()
+			for job := range jobs {
+				hash := sha1.Sum(job.piece)
+				hashes[job.index] = hash[:]
+				buffers <- job.piece
+			}
+		}()
+	}
+
+	for index := 0; index < pieceCount; index++ {
+		buffer := <-buffers
+		size := pieceSize(index)
+		if int64(cap(buffer)) < size {
+			buffer = make([]byte, size)
+		}
+		buffer = buffer[:size]
+		if err := read(index, buffer); err != nil {
+			errs[index] = err
+			buffers <- buffer
+			continue
+		}
+		jobs <- hashJob{index, buffer}
+	}
+	close(jobs)
+	workerWaitGroup.Wait()
+	return hashes, errs
+}
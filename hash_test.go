@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Synthetic torrent data: each piece is filled with its index, and the last
+// piece is shorter
+func syntheticPieceSize(pieceCount int, pieceLength int64) func(index int) int64 {
+	return func(index int) int64 {
+		if index == pieceCount-1 {
+			return pieceLength / 3
+		}
+		return pieceLength
+	}
+}
+
+func readSyntheticPiece(index int, piece []byte) error {
+	for offset := range piece {
+		piece[offset] = byte(index*7919 + offset*offset)
+	}
+	return nil
+}
+
+func TestHashPiecesConcurrently(t *testing.T) {
+	// Many pieces, so that the workers and buffers are reused many times
+	const pieceCount = 1024
+	const pieceLength = 16384
+	pieceSize := syntheticPieceSize(pieceCount, pieceLength)
+	sequential, _ := HashPiecesConcurrently(pieceCount, 1, pieceSize, readSyntheticPiece)
+	parallel, errs := HashPiecesConcurrently(pieceCount, 8, pieceSize, readSyntheticPiece)
+	for index := 0; index < pieceCount; index++ {
+		piece := make([]byte, pieceSize(index))
+		readSyntheticPiece(index, piece)
+		want := sha1.Sum(piece)
+		if errs[index] != nil || !bytes.Equal(sequential[index], want[:]) || !bytes.Equal(parallel[index], want[:]) {
+			t.Fatalf("piece %d: %x %x %v", index, sequential[index], parallel[index], errs[index])
+		}
+	}
+}
+
+func TestHashPiecesReadErrors(t *testing.T) {
+	errMissing := errors.New("missing")
+	read := func(index int, piece []byte) error {
+		if index%3 == 1 {
+			return errMissing
+		}
+		return readSyntheticPiece(index, piece)
+	}
+	hashes, errs := HashPiecesConcurrently(10, 4, syntheticPieceSize(10, 1024), read)
+	for index := 0; index < 10; index++ {
+		if failed := index%3 == 1; (errs[index] == errMissing) != failed || (hashes[index] == nil) != failed {
+			t.Fatalf("piece %d: %x %v", index, hashes[index], errs[index])
+		}
+	}
+}
+
+func BenchmarkHashPieces(b *testing.B) {
+	const pieceCount = 256
+	const pieceLength = 1 << 20
+	pieceSize := syntheticPieceSize(pieceCount, pieceLength)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			b.SetBytes(pieceCount * pieceLength)
+			for i := 0; i < b.N; i++ {
+				// Reads are free, only the hashing is measured
+				HashPiecesConcurrently(pieceCount, workers, pieceSize, func(index int, piece []byte) error { return nil })
+			}
+		})
+	}
+}
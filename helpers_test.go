@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Info dictionary of random content split into files of the given lengths,
+// and the content. A single length makes a single-file torrent.
+func makeTestInfo(pieceLength int, lengths ...int) (map[string]interface{}, []byte) {
+	total := 0
+	for _, length := range lengths {
+		total += length
+	}
+	data := make([]byte, total)
+	rand.New(rand.NewSource(int64(total))).Read(data)
+	var pieces bytes.Buffer
+	for offset := 0; offset < total; offset += pieceLength {
+		end := offset + pieceLength
+		if end > total {
+			end = total
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces.Write(hash[:])
+	}
+	info := map[string]interface{}{
+		"name":         "test",
+		"piece length": int64(pieceLength),
+		"pieces":       pieces.String(),
+	}
+	if len(lengths) == 1 {
+		info["length"] = int64(total)
+		return info, data
+	}
+	var files []interface{}
+	for i, length := range lengths {
+		files = append(files, map[string]interface{}{
+			"length": int64(length),
+			"path":   []interface{}{fmt.Sprintf("file%d", i)},
+		})
+	}
+	info["files"] = files
+	return info, data
+}
+
+// Bencoded torrent of the info dictionary
+func encodeTestTorrent(t *testing.T, announceUrl string, info map[string]interface{}) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := bencode.Marshal(&buffer, map[string]interface{}{"announce": announceUrl, "info": info}); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// Client of the torrent that keeps its files and state in a temporary
+// directory and listens on a free port
+func newTestClient(t *testing.T, info map[string]interface{}) *TorrentClient {
+	t.Helper()
+	c := newTorrentClient()
+	if info != nil {
+		c.SetInfo(info, nil)
+	}
+	c.OutputDir = t.TempDir()
+	c.Port = 0
+	c.Encryption = EncryptionDisable
+	return c
+}
+
+// Client that has all pieces of the data in memory and accepts peers until
+// the test ends
+func startTestSeeder(t *testing.T, info map[string]interface{}, data []byte) *TorrentClient {
+	t.Helper()
+	seeder := newTestClient(t, info)
+	storage := NewMemoryStorage(int64(len(data)))
+	storage.WriteAt(data, 0)
+	seeder.Storage = storage
+	for index := 0; index < seeder.PieceCount(); index++ {
+		seeder.SetHasPiece(index)
+	}
+	startTestListener(t, seeder)
+	return seeder
+}
+
+func startTestListener(t *testing.T, c *TorrentClient) {
+	t.Helper()
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go c.ListenLoop(ctx)
+}
+
+func loopbackPeer(port int) Peer {
+	return Peer{IP: net.ParseIP("127.0.0.1"), Port: port}
+}
+
+// Wait until the condition holds, failing the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Accept a single peer connection and complete the BitTorrent handshake. The
+// connection is passed to serve, which runs until it returns.
+func startFakePeer(t *testing.T, infoHash string, serve func(conn net.Conn)) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := ReadHandshake(conn); err != nil {
+			return
+		}
+		if _, err := conn.Write(MakeHandshake(infoHash, MakePeerID())); err != nil {
+			return
+		}
+		serve(conn)
+	}()
+	return loopbackPeer(listener.Addr().(*net.TCPAddr).Port)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Leveled logger used by the torrent clients. Embedding programs may provide
+// their own implementation to redirect or silence the output.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+	// Discard all messages
+	LogSilent
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "DEBUG",
+	LogInfo:  "INFO",
+	LogWarn:  "WARN",
+	LogError: "ERROR",
+}
+
+// Logger that writes messages at or above a minimum level to a standard
+// library logger
+type StdLogger struct {
+	Logger *log.Logger
+	Level  LogLevel
+}
+
+func NewStdLogger(level LogLevel) *StdLogger {
+	return &StdLogger{
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
+		Level:  level,
+	}
+}
+
+// Logger configured from the command line flags
+func DefaultLogger() Logger {
+	if *verbose {
+		return NewStdLogger(LogDebug)
+	} else if *quiet {
+		return NewStdLogger(LogError)
+	}
+	return NewStdLogger(LogInfo)
+}
+
+func (l *StdLogger) logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.Level {
+		return
+	}
+	l.Logger.Output(3, logLevelNames[level]+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(LogDebug, format, args...)
+}
+
+func (l *StdLogger) Infof(format string, args ...interface{}) {
+	l.logf(LogInfo, format, args...)
+}
+
+func (l *StdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(LogWarn, format, args...)
+}
+
+func (l *StdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(LogError, format, args...)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Logger that records the messages, prefixed with their level
+type captureLogger struct {
+	messages []string
+	lock     sync.Mutex
+}
+
+func (l *captureLogger) record(level string, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) {
+	l.record("DEBUG", format, args...)
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.record("INFO", format, args...)
+}
+
+func (l *captureLogger) Warnf(format string, args ...interface{}) {
+	l.record("WARN", format, args...)
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.record("ERROR", format, args...)
+}
+
+// Reports whether a message of the level contains the text
+func (l *captureLogger) Contains(level string, text string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, level+" ") && strings.Contains(message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAnnounceFailureLogged(t *testing.T) {
+	announceUrl, _ := startFakeHttpTracker(t, "d14:failure reason12:unregisterede")
+	info, _ := makeTestInfo(16384, 20000)
+	c, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, announceUrl, info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &captureLogger{}
+	c.Log = logger
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.AnnounceLoop(ctx)
+	waitFor(t, 5*time.Second, func() bool { return logger.Contains("WARN", "unregistered") })
+}
+
+func TestStdLoggerLevel(t *testing.T) {
+	var output bytes.Buffer
+	logger := &StdLogger{Logger: log.New(&output, "", 0), Level: LogWarn}
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn %d", 1)
+	logger.Errorf("error")
+	if output.String() != "WARN warn 1\nERROR error\n" {
+		t.Fatalf("%q", output.String())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local service discovery
+// http://www.bittorrent.org/beps/bep_0014.html
+
+const (
+	lsdAddressIPv4 = "239.192.152.143:6771"
+	lsdAddressIPv6 = "[ff15::efc0:988f]:6771"
+
+	lsdAnnounceInterval = 5 * time.Minute
+)
+
+func MakeLSDAnnounce(host string, port int, infoHashes []string, cookie string) []byte {
+	var announce bytes.Buffer
+	announce.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&announce, "Host: %s\r\n", host)
+	fmt.Fprintf(&announce, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&announce, "Infohash: %s\r\n", hex.EncodeToString([]byte(infoHash)))
+	}
+	if cookie != "" {
+		fmt.Fprintf(&announce, "cookie: %s\r\n", cookie)
+	}
+	announce.WriteString("\r\n")
+	return announce.Bytes()
+}
+
+// Return the advertised port, the raw info hashes and the cookie
+func ParseLSDAnnounce(data []byte) (int, []string, string, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if request.Method != "BT-SEARCH" {
+		return 0, nil, "", errors.New("lsd: unexpected method " + request.Method)
+	}
+	port, err := strconv.Atoi(request.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, "", errors.New("lsd: invalid port")
+	}
+	var infoHashes []string
+	for _, encodedInfoHash := range request.Header["Infohash"] {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(encodedInfoHash))
+		if err != nil || len(infoHash) != 20 {
+			continue
+		}
+		infoHashes = append(infoHashes, string(infoHash))
+	}
+	return port, infoHashes, request.Header.Get("Cookie"), nil
+}
+
+// Periodically announce the torrent on the local network and listen for
+// announces from other peers
+func (c *TorrentClient) LSDLoop(ctx context.Context) {
+	cookie := hex.EncodeToString([]byte(RandomString(8)))
+	for _, address := range []string{lsdAddressIPv4, lsdAddressIPv6} {
+		network := "udp4"
+		if address == lsdAddressIPv6 {
+			network = "udp6"
+		}
+		groupAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			continue
+		}
+		listener, err := net.ListenMulticastUDP(network, nil, groupAddr)
+		if err != nil {
+			continue
+		}
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go c.lsdListen(listener, cookie)
+
+		go func(network string, address string, groupAddr *net.UDPAddr) {
+			conn, err := net.DialUDP(network, bindUDPAddr(), groupAddr)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			ticker := time.NewTicker(lsdAnnounceInterval)
+			defer ticker.Stop()
+			lookupNow := c.lookupNow
+			for {
+				conn.Write(MakeLSDAnnounce(address, c.Port, []string{c.InfoHash()}, cookie))
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-lookupNow:
+					lookupNow = nil
+				}
+			}
+		}(network, address, groupAddr)
+	}
+	<-ctx.Done()
+}
+
+func (c *TorrentClient) lsdListen(listener *net.UDPConn, cookie string) {
+	buf := make([]byte, 1500)
+	for {
+		length, addr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		port, infoHashes, remoteCookie, err := ParseLSDAnnounce(buf[:length])
+		if err != nil || remoteCookie == cookie {
+			continue
+		}
+		for _, infoHash := range infoHashes {
+			if infoHash == c.InfoHash() {
+				c.AddPeers([]Peer{{IP: addr.IP, Port: port}})
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	infoHashes := []string{string(bytes.Repeat([]byte{0xab}, 20)), string(bytes.Repeat([]byte{0x01}, 20))}
+	announce := MakeLSDAnnounce(lsdAddressIPv4, 6881, infoHashes, "abc")
+	if !bytes.HasSuffix(announce, []byte("cookie: abc\r\n\r\n")) || bytes.HasSuffix(announce, []byte("\r\n\r\n\r\n")) {
+		t.Fatalf("%q", announce)
+	}
+	port, parsedHashes, cookie, err := ParseLSDAnnounce(announce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 6881 || cookie != "abc" || len(parsedHashes) != 2 || parsedHashes[0] != infoHashes[0] || parsedHashes[1] != infoHashes[1] {
+		t.Fatal(port, parsedHashes, cookie)
+	}
+}
+
+func TestLSDListen(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go c.lsdListen(listener, "self")
+	conn, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(MakeLSDAnnounce(lsdAddressIPv4, 1001, []string{c.InfoHash()}, "self"))
+	conn.Write(MakeLSDAnnounce(lsdAddressIPv4, 1002, []string{strings.Repeat("x", 20)}, "other"))
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.Write(MakeLSDAnnounce(lsdAddressIPv4, 1003, []string{strings.Repeat("x", 20), c.InfoHash()}, "other"))
+	waitFor(t, 5*time.Second, func() bool { return len(c.Peers()) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if peers := c.Peers(); len(peers) != 1 || peers[0].Address() != "127.0.0.1:1003" {
+		t.Fatal(peers)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet links
+// http://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format
+
+type Magnet struct {
+	InfoHash    string
+	DisplayName string
+	Trackers    []string
+	// Peer addresses (x.pe), as host:port, and web seeds (ws)
+	Peers    []string
+	WebSeeds []string
+}
+
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, errors.New("magnet: invalid scheme " + u.Scheme)
+	}
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	magnet := &Magnet{
+		DisplayName: params.Get("dn"),
+		Trackers:    params["tr"],
+		WebSeeds:    params["ws"],
+	}
+	for _, address := range params["x.pe"] {
+		if _, _, err := SplitPeerAddress(address); err == nil {
+			magnet.Peers = append(magnet.Peers, address)
+		}
+	}
+	for _, exactTopic := range params["xt"] {
+		if !strings.HasPrefix(exactTopic, "urn:btih:") {
+			continue
+		}
+		infoHash, err := DecodeMagnetInfoHash(strings.TrimPrefix(exactTopic, "urn:btih:"))
+		if err != nil {
+			return nil, err
+		}
+		magnet.InfoHash = infoHash
+	}
+	if magnet.InfoHash == "" {
+		return nil, errors.New("magnet: missing urn:btih exact topic")
+	}
+	return magnet, nil
+}
+
+// Info hashes are either hex (40 characters) or base32 (32 characters) encoded
+func DecodeMagnetInfoHash(encoded string) (string, error) {
+	var infoHash []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		infoHash, err = hex.DecodeString(encoded)
+	case 32:
+		infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = errors.New("magnet: invalid info hash length")
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(infoHash), nil
+}
+
+// Split a host:port peer address, where the host is a hostname or an IP
+// address and IPv6 addresses are in brackets
+func SplitPeerAddress(address string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.New("invalid port in peer address " + address)
+	}
+	if host == "" {
+		return "", 0, errors.New("missing host in peer address " + address)
+	}
+	return host, port, nil
+}
+
+// Create a client that announces to the magnet trackers. Each tracker is
+// placed in its own tier. The peers of the magnet are dialed right away, and
+// its web seeds are used once the metadata is fetched.
+func NewTorrentClientFromMagnet(uri string) (*TorrentClient, error) {
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	c := newTorrentClient()
+	c.TorrentFilePath = uri
+	c.Magnet = magnet
+	c.infoHash = magnet.InfoHash
+	var announceList []interface{}
+	for _, tracker := range magnet.Trackers {
+		announceList = append(announceList, []interface{}{tracker})
+	}
+	if len(announceList) > 0 {
+		c.SetMetadata("announce-list", announceList)
+	}
+	if len(magnet.WebSeeds) > 0 {
+		var urlList []interface{}
+		for _, webSeed := range magnet.WebSeeds {
+			urlList = append(urlList, webSeed)
+		}
+		c.SetMetadata("url-list", urlList)
+	}
+	c.AddPeers(c.resolvePeerAddresses(magnet.Peers))
+	return c, nil
+}
+
+// Peers at the addresses; hostnames are resolved, and the addresses that
+// cannot be are skipped. Through a proxy, hostnames are kept so that they are
+// resolved by the proxy instead of leaking to the local resolver.
+func (c *TorrentClient) resolvePeerAddresses(addresses []string) []Peer {
+	var peers []Peer
+	for _, address := range addresses {
+		host, port, err := SplitPeerAddress(address)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			peers = append(peers, Peer{IP: ip, Port: port})
+			continue
+		}
+		if proxyDialer != nil {
+			peers = append(peers, Peer{Host: host, Port: port})
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			c.Log.Debugf("peer %s: %v", address, err)
+			continue
+		}
+		for _, ip := range ips {
+			peers = append(peers, Peer{IP: ip, Port: port})
+		}
+	}
+	return peers
+}
+
+// Format the magnet link, with the hex encoded info hash
+func (m *Magnet) String() string {
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(m.InfoHash))
+	if m.DisplayName != "" {
+		link += "&dn=" + url.QueryEscape(m.DisplayName)
+	}
+	for _, tracker := range m.Trackers {
+		link += "&tr=" + url.QueryEscape(tracker)
+	}
+	for _, webSeed := range m.WebSeeds {
+		link += "&ws=" + url.QueryEscape(webSeed)
+	}
+	for _, address := range m.Peers {
+		link += "&x.pe=" + url.QueryEscape(address)
+	}
+	return link
+}
+
+// Magnet link to share the torrent
+func (c *TorrentClient) MagnetLink() string {
+	magnet := &Magnet{
+		InfoHash: c.InfoHash(),
+		Trackers: c.AnnounceUrls(),
+		WebSeeds: c.WebSeeds(),
+	}
+	if name, isString := c.BdecodedInfo()["name"].(string); isString {
+		magnet.DisplayName = name
+	} else if c.Magnet != nil {
+		magnet.DisplayName = c.Magnet.DisplayName
+	}
+	return magnet.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func TestParseMagnet(t *testing.T) {
+	const hexHash = "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+	infoHash, _ := hex.DecodeString(hexHash)
+	magnet, err := ParseMagnet("magnet:?xt=urn:btih:" + hexHash + "&dn=ubuntu+22.04&tr=udp%3A%2F%2Ftracker.example.org%3A6969&tr=http%3A%2F%2Ftracker.example.com%2Fannounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != string(infoHash) || magnet.DisplayName != "ubuntu 22.04" {
+		t.Fatal(magnet)
+	}
+	if !reflect.DeepEqual(magnet.Trackers, []string{"udp://tracker.example.org:6969", "http://tracker.example.com/announce"}) {
+		t.Fatal(magnet.Trackers)
+	}
+
+	// Base32 info hash, without a name or trackers
+	magnet, err = ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != string(infoHash) || magnet.DisplayName != "" || len(magnet.Trackers) != 0 {
+		t.Fatal(magnet)
+	}
+
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:" + hexHash,
+		"magnet:?dn=missing",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s accepted", uri)
+		}
+	}
+}
+
+func TestMagnetTrackerTiers(t *testing.T) {
+	c, err := NewTorrentClientFromMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&tr=http%3A%2F%2Fa%2Fannounce&tr=udp%3A%2F%2Fb%3A80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tiers := c.AnnounceTiers(); !reflect.DeepEqual(tiers, [][]string{{"http://a/announce"}, {"udp://b:80"}}) {
+		t.Fatal(tiers)
+	}
+	if c.HasInfo() {
+		t.Fatal("magnet client has the info dictionary")
+	}
+}
+
+func TestMagnetLinkRoundTrip(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	info["name"] = "two words & more"
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	torrent := map[string]interface{}{
+		"announce":      "http://a/announce?key=1&x=2",
+		"announce-list": []interface{}{[]interface{}{"http://a/announce?key=1&x=2"}, []interface{}{"udp://b:80"}},
+		"info":          info,
+	}
+	var buffer bytes.Buffer
+	if err := bencode.Marshal(&buffer, torrent); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := c.MagnetLink()
+	if !strings.HasPrefix(link, "magnet:?xt=urn:btih:"+hex.EncodeToString([]byte(c.InfoHash()))) {
+		t.Fatal(link)
+	}
+	magnet, err := ParseMagnet(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != c.InfoHash() || magnet.DisplayName != "two words & more" {
+		t.Fatal(magnet)
+	}
+	if !reflect.DeepEqual(magnet.Trackers, []string{"http://a/announce?key=1&x=2", "udp://b:80"}) {
+		t.Fatal(magnet.Trackers)
+	}
+}
+
+func TestMagnetPeersAndWebSeeds(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a" +
+		"&x.pe=192.0.2.1%3A6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413&x.pe=192.0.2.2&x.pe=192.0.2.3%3A99999" +
+		"&ws=http%3A%2F%2Fseed.example.com%2Ffiles%2F"
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(magnet.Peers, []string{"192.0.2.1:6881", "[2001:db8::1]:51413"}) {
+		t.Fatal(magnet.Peers)
+	}
+	if !reflect.DeepEqual(magnet.WebSeeds, []string{"http://seed.example.com/files/"}) {
+		t.Fatal(magnet.WebSeeds)
+	}
+
+	c, err := NewTorrentClientFromMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, peer := range c.Peers() {
+		addresses = append(addresses, peer.Address())
+	}
+	// Known peers are kept in a map
+	sort.Strings(addresses)
+	if !reflect.DeepEqual(addresses, []string{"192.0.2.1:6881", "[2001:db8::1]:51413"}) {
+		t.Fatal(addresses)
+	}
+	if webSeeds := c.WebSeeds(); !reflect.DeepEqual(webSeeds, []string{"http://seed.example.com/files/"}) {
+		t.Fatal(webSeeds)
+	}
+	magnet, err = ParseMagnet(c.Magnet.String())
+	if err != nil || len(magnet.Peers) != 2 || len(magnet.WebSeeds) != 1 {
+		t.Fatal(magnet, err)
+	}
+}
+
+func TestMagnetPeerHostsThroughProxy(t *testing.T) {
+	proxyAddress, targets := startFakeSocksProxy(t, "user", "secret")
+	dialer, err := NewSOCKS5Dialer("socks5://user:secret@" + proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous *SOCKS5Dialer) { proxyDialer = previous }(proxyDialer)
+	proxyDialer = dialer
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	c, err := NewTorrentClientFromMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&x.pe=localhost%3A" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host name is not resolved locally but by the proxy
+	peers := c.Peers()
+	if len(peers) != 1 || peers[0].IP != nil || peers[0].Address() != "localhost:"+port {
+		t.Fatal(peers)
+	}
+	conn, err := DialHappyEyeballs(context.Background(), proxyDialer, peers[0].DialAddresses(), happyEyeballsDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if target := <-targets; target != "localhost:"+port {
+		t.Fatal(target)
+	}
+}
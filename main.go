@@ -2,40 +2,333 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
+var listenPort = flag.Int("port", 6881, "first port to try to listen on for incoming peer connections")
+var verbose = flag.Bool("verbose", false, "log debug messages")
+var quiet = flag.Bool("quiet", false, "only print errors")
+var progressFormat = flag.String("progress", "", "set to json to print the progress of each torrent as a json object per line")
+var maxDownloadRate = flag.Int64("maxdown", 0, "maximum download rate in KiB/s, 0 for unlimited")
+var maxUploadRate = flag.Int64("maxup", 0, "maximum upload rate in KiB/s, 0 for unlimited")
+var numWant = flag.Int("numwant", 50, "number of peers requested from the trackers in each announce")
+var maxQueuedPieces = flag.Int("maxpieces", 64, "maximum number of pieces downloaded at once, which bounds memory use to this many piece lengths; 0 for unlimited")
+var maxPeers = flag.Int("maxpeers", 50, "maximum number of simultaneous peer connections per torrent")
+var peerTimeout = flag.Duration("peertimeout", 3*time.Minute, "drop peers that send nothing for this long, including keepalives")
+var downloadTimeout = flag.Duration("timeout", 0, "give up downloading a torrent after this long, 0 to wait forever")
+var idleTimeout = flag.Duration("idle-timeout", 0, "give up downloading a torrent when nothing is downloaded for this long, 0 to wait forever")
+var rateHalfLife = flag.Duration("rate-halflife", 5*time.Second, "half-life of the moving average of the transfer rates that are reported")
+var maxTorrentSize = flag.Int64("max-torrent-size", 8, "largest torrent file that is loaded, in MiB")
+var cacheSize = flag.Int64("cache", 16, "size of the cache of blocks served to peers in MiB, 0 to disable")
+var outputDir = flag.String("out", ".", "directory of the downloaded files and resume state; multi-file torrents are stored in a subdirectory named after the torrent")
+var incompleteDir = flag.String("incomplete-dir", "", "directory of the .part files being downloaded, which are moved to the output directory once complete; the output directory by default")
+var resumeBlocks = flag.Bool("resume-blocks", false, "write blocks to disk as they are received and record them in the resume state, so that interrupted pieces are not downloaded again from scratch")
+var verifyState = flag.Bool("verify", false, "re-hash the pieces recorded in the resume state on startup")
+
+var blocklistPath = flag.String("blocklist", "", "file of ip ranges, in PeerGuardian or CIDR format, whose peers are neither dialed nor accepted")
+var bindAddress = flag.String("bind", "", "source ip address of all peer and tracker connections, also used to listen for incoming peers")
+var proxyUrl = flag.String("proxy", "", "socks5://host:port proxy for all tracker and peer connections; disables udp trackers, DHT and local service discovery")
+var encryptionMode = flag.String("encryption", "prefer", "peer connection encryption: require, prefer (with plaintext fallback) or disable")
+var natEnabled = flag.Bool("nat", false, "forward the listen port on the gateway with NAT-PMP or UPnP")
+var selectFiles = flag.String("select", "", "comma-separated indexes, paths or globs of the files to download, all files by default")
+var statusAddress = flag.String("http", "", "address of the status http server, for instance :8080; disabled by default")
+var recursiveDirs = flag.Bool("recursive", false, "also run the torrent files of the subdirectories of directory arguments")
+var checkOnly = flag.Bool("check", false, "verify the existing files of each torrent and record the valid pieces instead of downloading")
+var hashWorkers = flag.Int("hashworkers", runtime.NumCPU(), "number of goroutines that hash pieces when creating or checking torrents")
+var printInfo = flag.Bool("info", false, "print a json summary of each torrent instead of downloading")
+var userAgent = flag.String("user-agent", defaultUserAgent, "user agent of the http requests to trackers and web seeds")
+var httpTimeout = flag.Duration("httptimeout", 30*time.Second, "timeout of http tracker requests")
+var tlsInsecure = flag.Bool("tls-insecure", false, "do not verify the certificates of https trackers")
+var tlsRootCAs = flag.String("tls-ca", "", "pem file of root certificates used to verify https trackers, instead of the system ones")
+
+// Torrent creation
+var createPath = flag.String("create", "", "create a torrent from this file or directory instead of downloading")
+var createOutput = flag.String("output", "", "path of the created torrent, defaults to the input name with a .torrent extension")
+var createTrackers = flag.String("trackers", "", "comma-separated tracker urls of the created torrent")
+var createPieceLength = flag.Int64("piecelength", 0, "piece length of the created torrent in KiB, 0 to select it from the content size")
+var createPrivate = flag.Int("private", 0, "set to 1 to create a private torrent")
+
 func main() {
+	flag.Var(&extraTrackers, "tracker", "extra tracker `url` announced to in addition to the trackers of the torrents, may be repeated")
+	flag.Var(&extraHttpHeaders, "header", "extra `name: value` header of the http requests to trackers and web seeds, may be repeated")
 	flag.Parse()
+	if *verbose && (*quiet || *progressFormat != "") {
+		DefaultLogger().Errorf("-verbose cannot be combined with -quiet or -progress")
+		os.Exit(1)
+	}
+	if *progressFormat != "" && *progressFormat != "json" {
+		DefaultLogger().Errorf("-progress: unknown format %s", *progressFormat)
+		os.Exit(1)
+	}
+	var err error
+	if encryptionPolicy, err = ParseEncryptionPolicy(*encryptionMode); err != nil {
+		DefaultLogger().Errorf("-encryption: %v", err)
+		os.Exit(1)
+	}
+	if *bindAddress != "" {
+		if bindIP, err = ParseBindAddress(*bindAddress); err != nil {
+			DefaultLogger().Errorf("-bind: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *blocklistPath != "" {
+		if peerBlocklist, err = LoadBlocklist(*blocklistPath); err != nil {
+			DefaultLogger().Errorf("-blocklist %s: %v", *blocklistPath, err)
+			os.Exit(1)
+		}
+		DefaultLogger().Infof("%d blocked ip ranges", peerBlocklist.Len())
+	}
+	if *proxyUrl != "" {
+		if proxyDialer, err = NewSOCKS5Dialer(*proxyUrl); err != nil {
+			DefaultLogger().Errorf("-proxy %s: %v", *proxyUrl, err)
+			os.Exit(1)
+		}
+		DefaultLogger().Warnf("udp cannot be proxied through socks5: udp trackers, DHT and local service discovery are disabled")
+	}
+	if *createPath != "" {
+		outputPath := *createOutput
+		if outputPath == "" {
+			outputPath = filepath.Base(filepath.Clean(*createPath)) + ".torrent"
+		}
+		trackers := SplitList(*createTrackers)
+		if err := CreateTorrent(*createPath, outputPath, *createPieceLength*1024, trackers, *createPrivate == 1); err != nil {
+			DefaultLogger().Errorf("%s: %v", *createPath, err)
+			os.Exit(1)
+		}
+		return
+	}
 	if len(flag.Args()) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
-	RunClients(flag.Args())
+
+	// Stop the downloads of torrent urls and all clients on interrupt
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		cancel()
+	}()
+
+	if *printInfo {
+		if failedCount := PrintSummaries(ctx, flag.Args()); failedCount > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := CheckWritableDir(*outputDir); err != nil {
+		DefaultLogger().Errorf("-out: %v", err)
+		os.Exit(1)
+	}
+	if *incompleteDir != "" {
+		if err := CheckWritableDir(*incompleteDir); err != nil {
+			DefaultLogger().Errorf("-incomplete-dir: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *checkOnly {
+		if failedCount := CheckTorrents(ctx, flag.Args()); failedCount > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	report, failedCount := RunClients(ctx, flag.Args())
+	PrintReport(report)
+	if failedCount > 0 {
+		os.Exit(1)
+	}
+}
+
+// Split a comma-separated flag value; empty values give an empty list
+func SplitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Create a client from a magnet link, a torrent url, "-" for a torrent read
+// from stdin, or a torrent file path. The context cancels the download of a
+// torrent url.
+func LoadClient(ctx context.Context, path string) (*TorrentClient, error) {
+	switch {
+	case strings.HasPrefix(path, "magnet:"):
+		return NewTorrentClientFromMagnet(path)
+	case strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://"):
+		return NewTorrentClientFromUrl(ctx, path)
+	case path == "-":
+		return NewTorrentClientFromReader("stdin", os.Stdin)
+	}
+	return NewTorrentClient(path)
+}
+
+// Torrent files of the directory, in lexical order, including the ones of its
+// subdirectories when recursive is set
+func TorrentFilesInDir(dir string, recursive bool) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fileInfo.Mode().IsRegular() && strings.HasSuffix(path, ".torrent") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
 }
 
-func RunClients(torrentFilePaths []string) {
+// Run a client for each torrent file and return the number of torrents that
+// could not be loaded or run. Directories are replaced by the torrent files
+// they contain. A torrent that fails does not prevent the other ones from
+// running. Clients run until the context is cancelled or their
+// download times out; the report of the run is printed once all downloads are
+// complete, and returned.
+func RunClients(ctx context.Context, paths []string) (RunReport, int) {
+	var failedCount int32
+	startTime := time.Now()
+	logger := DefaultLogger()
+	var torrentFilePaths []string
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err != nil || !stat.IsDir() {
+			torrentFilePaths = append(torrentFilePaths, path)
+			continue
+		}
+		dirPaths, err := TorrentFilesInDir(path, *recursiveDirs)
+		if err != nil {
+			logger.Errorf("%s: %v", path, err)
+			failedCount++
+			continue
+		}
+		logger.Infof("%s: %d torrent files", path, len(dirPaths))
+		torrentFilePaths = append(torrentFilePaths, dirPaths...)
+	}
 	var torrentClientWaitGroup sync.WaitGroup
-	for _, path := range torrentFilePaths {
-		go func() {
+	var clients []*TorrentClient
+	// Client and error of each torrent, in the order of the arguments.
+	// torrentErrors is guarded by errorsLock.
+	torrentClients := make([]*TorrentClient, len(torrentFilePaths))
+	torrentErrors := make([]error, len(torrentFilePaths))
+	var errorsLock sync.Mutex
+	// Closed when the client stops
+	var clientsDone []chan struct{}
+	for i, path := range torrentFilePaths {
+		client, err := LoadClient(ctx, path)
+		if err != nil {
+			logger.Errorf("%s: %v", path, err)
+			atomic.AddInt32(&failedCount, 1)
+			torrentErrors[i] = err
+			continue
+		}
+		clients = append(clients, client)
+		if *progressFormat == "json" {
+			client.SetProgressHandler(stdoutProgressPrinter.Handler(client))
+		}
+		torrentClients[i] = client
+		done := make(chan struct{})
+		clientsDone = append(clientsDone, done)
+		torrentClientWaitGroup.Add(1)
+		go func(i int, client *TorrentClient) {
 			defer torrentClientWaitGroup.Done()
-			NewTorrentClient(path).Run()
+			defer close(done)
+			if err := client.Run(ctx); err != nil {
+				client.Log.Errorf("%s: %v", client.TorrentFilePath, err)
+				atomic.AddInt32(&failedCount, 1)
+				errorsLock.Lock()
+				torrentErrors[i] = err
+				errorsLock.Unlock()
+			}
+		}(i, client)
+	}
+	makeReport := func() RunReport {
+		report := RunReport{Elapsed: time.Since(startTime)}
+		errorsLock.Lock()
+		defer errorsLock.Unlock()
+		for i, path := range torrentFilePaths {
+			torrentReport := TorrentReport{Name: path}
+			if torrentClients[i] != nil {
+				torrentReport = torrentClients[i].Report()
+			}
+			if torrentErrors[i] != nil {
+				torrentReport.Error = torrentErrors[i].Error()
+			}
+			report.Add(torrentReport)
+		}
+		return report
+	}
+	// Closed when all clients stopped
+	allStopped := make(chan struct{})
+	// Report as soon as there is nothing left to download, before the final
+	// report
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for i, client := range clients {
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.completed:
+			case <-clientsDone[i]:
+			}
+		}
+		select {
+		case <-allStopped:
+			// The final report follows
+			return
+		default:
+		}
+		logger.Infof("all downloads are complete, seeding until interrupted")
+		PrintReport(makeReport())
+	}()
+	// The status server stops with the last client
+	serverCtx, stopServer := context.WithCancel(ctx)
+	var serverWaitGroup sync.WaitGroup
+	if *statusAddress != "" {
+		serverWaitGroup.Add(1)
+		go func() {
+			defer serverWaitGroup.Done()
+			if err := RunStatusServer(serverCtx, *statusAddress, clients); err != nil {
+				logger.Errorf("status server: %v", err)
+			}
 		}()
-		torrentClientWaitGroup.Add(1)
 	}
 	torrentClientWaitGroup.Wait()
+	close(allStopped)
+	<-reported
+	stopServer()
+	serverWaitGroup.Wait()
+	return makeReport(), int(failedCount)
 }
 
 // Notable extensions to the bittorrent protocol are listed here
@@ -45,121 +338,790 @@ type TorrentClient struct {
 	TorrentFilePath string
 	PeerID          string
 	Bencoded        string
-	Bdecoded        map[string]interface{}
-	Port            int
+	// Decoded torrent file, read with Metadata and BdecodedInfo since the info
+	// dictionary of magnet links is set while the client runs
+	bdecoded map[string]interface{}
+	infoHash string
+	// Computed on first use
+	announceTiers      [][]string
+	announceUrls       []string
+	announceTiersKnown bool
+
+	// Info dictionary as it was encoded in the torrent file or metadata
+	rawInfo []byte
+	// Parsed on first use, reset with the info dictionary
+	pieceHashes [][20]byte
+	// Computed when the info dictionary is set
+	totalLength int64
+	pieceCount  int
+	infoLock    sync.RWMutex
+	Port        int
+	listener    net.Listener
+	DialTimeout time.Duration
+	// Peers that send nothing for this long are dropped
+	PeerTimeout time.Duration
+	// Sent to trackers so that they recognize us when our address changes
+	TrackerKey uint32
+	// Number of peers requested in each announce
+	NumWant int
+	// Trackers added to the ones of the torrent, see AnnounceTiers. Must be
+	// set before the trackers are first listed.
+	ExtraTrackers []string
+	// Limits on the download, 0 when unlimited
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	Encryption  EncryptionPolicy
+	Log         Logger
+	// Downloaded files and resume state are stored in this directory
+	OutputDir string
+	// Incomplete files are stored in this directory instead of the output
+	// directory when it is set
+	IncompleteDir string
+	// Write blocks to the storage as they are received and record them in
+	// the resume state, so that pieces are resumed where they stopped
+	ResumeBlocks bool
+
+	// Only set for clients created from a magnet link, which have no info
+	// dictionary until the metadata is fetched from peers
+	Magnet *Magnet
+
+	// Transfer state; counters must be accessed atomically
+	Uploaded          int64
+	Downloaded        int64
+	HavePieces        []bool
+	downloadingPieces map[int]int
+	// Bytes of the wanted pieces that we do not have, kept up to date by
+	// SetHasPiece and recomputed when the pieces or the selection change
+	left      int64
+	leftValid bool
+	// Blocks of the pieces being downloaded
+	Requests   *RequestQueue
+	piecesLock sync.Mutex
+	Picker     *PiecePicker
+	// Patterns of the files to download, see SelectFiles
+	Selection []string
+	// Pieces that overlap the selected files, and the selected files; nil
+	// when all files are selected
+	wantedPieces []bool
+	wantedFiles  []bool
+
+	// Rate limits shared by all peers, nil when unlimited
+	DownloadLimiter *RateLimiter
+	UploadLimiter   *RateLimiter
+	// Per-peer rate limits in bytes per second, 0 when unlimited
+	PeerDownloadRate int64
+	PeerUploadRate   int64
+	// Smoothed transfer rates, sampled while running
+	DownloadMeter *RateMeter
+	UploadMeter   *RateMeter
+
+	// Files in the output directory, unless another backend is set before
+	// running the client
+	Storage       Storage
+	BlockCache    *BlockCache
+	stateFileLock sync.Mutex
+
+	// Extensions advertised in our extended handshakes
+	Extensions *ExtensionRegistry
+
+	// Set by Stop, see StopError
+	stopErr   error
+	cancelRun context.CancelFunc
+	stopLock  sync.Mutex
+
+	// Peers discovered so far and established connections, indexed by
+	// address
+	peers     map[string]Peer
+	conns     map[string]*PeerConn
+	peersLock sync.Mutex
+	// Semaphore that limits the number of peer connections
+	connSlots chan struct{}
+
+	// Number of peers that we upload to simultaneously
+	UnchokeSlots      int
+	optimisticUnchoke *PeerConn
+	chokingLock       sync.Mutex
+
+	// Closed when all pieces are downloaded
+	completed    chan struct{}
+	completeOnce sync.Once
+	// Closed to make the DHT and local service discovery look up peers right
+	// away
+	lookupNow  chan struct{}
+	lookupOnce sync.Once
+	// Set to 1 once the completed event was sent to the trackers; must be
+	// accessed atomically
+	completedAnnounced int32
+	// Set when a resume state was loaded, which then tells whether the
+	// completed event was sent
+	stateLoaded bool
+
+	// Result of the last announce to each tracker
+	trackerStatus map[string]TrackerStatus
+	// Tracker ids returned by the trackers, echoed in the next announces
+	trackerIDs   map[string]string
+	trackersLock sync.Mutex
+
+	// Start of the run and end of the download, guarded by progressLock
+	startTime       time.Time
+	finishTime      time.Time
+	startDownloaded int64
+	startUploaded   int64
+
+	progressHandler func(ProgressEvent)
+	lastProgress    time.Time
+	seeding         bool
+	progressLock    sync.Mutex
 }
 
-func NewTorrentClient(torrentFilePath string) *TorrentClient {
-	bencoded, err := ioutil.ReadFile(torrentFilePath)
-	check(err)
+// The file size is checked before the file is read
+func NewTorrentClient(torrentFilePath string) (*TorrentClient, error) {
+	f, err := os.Open(torrentFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTorrentSize(stat.Size()); err != nil {
+		return nil, err
+	}
+	return NewTorrentClientFromReader(torrentFilePath, f)
+}
+
+// Largest torrent file that is loaded, from -max-torrent-size
+func maxTorrentFileSize() int64 {
+	return *maxTorrentSize << 20
+}
+
+func checkTorrentSize(size int64) error {
+	if size > maxTorrentFileSize() {
+		return fmt.Errorf("torrent file of %d bytes exceeds the maximum of %d bytes", size, maxTorrentFileSize())
+	}
+	return nil
+}
+
+// Read a torrent from a pipe or any other stream; the name is used in logs
+func NewTorrentClientFromReader(name string, r io.Reader) (*TorrentClient, error) {
+	bencoded, err := ioutil.ReadAll(io.LimitReader(r, maxTorrentFileSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTorrentSize(int64(len(bencoded))); err != nil {
+		return nil, err
+	}
+	return NewTorrentClientFromBytes(name, bencoded)
+}
+
+// Download a torrent file over http or https
+func NewTorrentClientFromUrl(ctx context.Context, torrentUrl string) (*TorrentClient, error) {
+	bencoded, err := HttpGetLimit(ctx, torrentUrl, nil, maxTorrentFileSize())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTorrentSize(int64(len(bencoded))); err != nil {
+		return nil, err
+	}
+	return NewTorrentClientFromBytes(torrentUrl, []byte(bencoded))
+}
+
+// Decode a torrent file. The raw bytes are kept to compute the info hash.
+func NewTorrentClientFromBytes(torrentFilePath string, bencoded []byte) (*TorrentClient, error) {
+	// Scanning first bounds the decoder: string lengths are checked against
+	// the data and nesting is limited before anything is allocated
+	spans, err := ScanBencodeDict(string(bencoded))
+	if err != nil {
+		return nil, err
+	}
 	bdecoded, err := bencode.Decode(strings.NewReader(string(bencoded)))
-	check(err)
+	if err != nil {
+		return nil, err
+	}
+	bdecodedDict, isDict := bdecoded.(map[string]interface{})
+	if !isDict {
+		return nil, errors.New("torrent file is not a bencoded dictionary")
+	}
 
-	return &TorrentClient{
-		TorrentFilePath: torrentFilePath,
+	c := newTorrentClient()
+	c.TorrentFilePath = torrentFilePath
+	c.Bencoded = string(bencoded)
+	c.bdecoded = bdecodedDict
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	span := spans["info"]
+	c.SetInfo(bdecodedDict["info"].(map[string]interface{}), bencoded[span.Start:span.End])
+	return c, nil
+}
+
+func newTorrentClient() *TorrentClient {
+	c := &TorrentClient{
 		PeerID:          MakePeerID(),
-		Bencoded:        string(bencoded),
-		Bdecoded:        bdecoded.(map[string]interface{}),
-		Port:            6881, // TODO set sensible value here
+		bdecoded:        map[string]interface{}{},
+		Port:            *listenPort,
+		DialTimeout:     10 * time.Second,
+		PeerTimeout:     *peerTimeout,
+		TrackerKey:      uint32(random.Int63()),
+		NumWant:         *numWant,
+		ExtraTrackers:   extraTrackers,
+		Timeout:         *downloadTimeout,
+		IdleTimeout:     *idleTimeout,
+		Encryption:      encryptionPolicy,
+		Log:             DefaultLogger(),
+		OutputDir:       *outputDir,
+		IncompleteDir:   *incompleteDir,
+		ResumeBlocks:    *resumeBlocks,
+		Selection:       SplitList(*selectFiles),
+		UnchokeSlots:    defaultUnchokeSlots,
+		DownloadLimiter: NewRateLimiter(*maxDownloadRate * 1024),
+		UploadLimiter:   NewRateLimiter(*maxUploadRate * 1024),
+		DownloadMeter:   NewRateMeter(*rateHalfLife),
+		UploadMeter:     NewRateMeter(*rateHalfLife),
+		BlockCache:      NewBlockCache(*cacheSize * 1024 * 1024),
+		Extensions:      NewExtensionRegistry(),
+		peers:           map[string]Peer{},
+		conns:           map[string]*PeerConn{},
+
+		connSlots: make(chan struct{}, *maxPeers),
+		completed: make(chan struct{}),
+		lookupNow: make(chan struct{}),
+
+		downloadingPieces: map[int]int{},
+		Requests:          NewRequestQueue(*maxQueuedPieces),
 	}
+	c.Picker = NewPiecePicker(c.pieceNeeded)
+	return c
 }
 
-func (c *TorrentClient) Run() {
+func (c *TorrentClient) Run(ctx context.Context) error {
+	// The listen port must be known before we announce
+	if err := c.Listen(); err != nil {
+		return err
+	}
+	defer c.listener.Close()
+
+	// Announce loops are stopped and waited for when we return
+	ctx, cancel := context.WithCancel(ctx)
 	var peerWaitGroup sync.WaitGroup
-	for _, announceUrl := range c.AnnounceUrls() {
-		go func(announceUrl string) {
+	defer peerWaitGroup.Wait()
+	defer cancel()
+	c.stopLock.Lock()
+	c.cancelRun = cancel
+	c.stopLock.Unlock()
+	peerWaitGroup.Add(1)
+	go func() {
+		defer peerWaitGroup.Done()
+		c.DeadlineLoop(ctx)
+	}()
+	if *natEnabled {
+		peerWaitGroup.Add(1)
+		go func() {
+			defer peerWaitGroup.Done()
+			c.NATLoop(ctx)
+		}()
+	}
+	peerWaitGroup.Add(1)
+	go func() {
+		defer peerWaitGroup.Done()
+		c.AnnounceLoop(ctx)
+	}()
+	// Peer discovery outside of the trackers, which private torrents must
+	// not use
+	discoveryCtx, stopDiscovery := context.WithCancel(ctx)
+	defer stopDiscovery()
+	if proxyDialer == nil && !c.IsPrivate() {
+		peerWaitGroup.Add(3)
+		go func() {
 			defer peerWaitGroup.Done()
-			c.GetPeers(announceUrl)
-		}(announceUrl)
+			if err := c.DHTLoop(discoveryCtx); err != nil {
+				c.Log.Warnf("dht: %v", err)
+			}
+		}()
+		go func() {
+			defer peerWaitGroup.Done()
+			c.LSDLoop(discoveryCtx)
+		}()
+		go func() {
+			defer peerWaitGroup.Done()
+			c.NoPeersLoop(discoveryCtx)
+		}()
+	}
+
+	// Magnet links: wait for metadata before downloading
+	if !c.HasInfo() {
+		if err := c.FetchMetadata(ctx); err != nil {
+			if ctx.Err() != nil {
+				return c.StopError()
+			}
+			return err
+		}
+	}
+	if c.IsPrivate() {
+		c.Log.Infof("%s: private torrent, DHT, PEX and local service discovery are disabled", c.TorrentFilePath)
+		stopDiscovery()
+	}
+
+	if err := c.SelectFiles(c.Selection); err != nil {
+		return err
+	}
+	if c.Storage == nil {
+		storage, err := NewFileWriter(c.OutputDir, c.IncompleteDir, c.Files(), c.PieceLength(), c.WantedFiles())
+		if err != nil {
+			return err
+		}
+		c.Storage = storage
+	}
+	defer c.Storage.Close()
+	if err := c.LoadState(*verifyState); err != nil {
+		c.Log.Warnf("%s: could not load resume state: %v", c.TorrentFilePath, err)
+	}
+	defer c.SaveState()
+	// Files may have been completed by a run that stopped before moving them
+	c.FinishFiles(-1)
+
+	c.progressLock.Lock()
+	c.startTime = time.Now()
+	c.startDownloaded = atomic.LoadInt64(&c.Downloaded)
+	c.startUploaded = atomic.LoadInt64(&c.Uploaded)
+	c.progressLock.Unlock()
+	if c.Left() == 0 {
+		if err := c.CheckFileSizes(); err != nil {
+			return err
+		}
+		// Already complete: without a resume state, the trackers never saw
+		// the download. Otherwise the state tells whether they were told.
+		if !c.stateLoaded {
+			atomic.StoreInt32(&c.completedAnnounced, 1)
+		}
+		c.markComplete()
+		c.emitProgress(ProgressSeeding, 0)
+	}
+	for _, webSeed := range c.WebSeeds() {
+		peerWaitGroup.Add(1)
+		go func(webSeed string) {
+			defer peerWaitGroup.Done()
+			c.WebSeedLoop(ctx, webSeed)
+		}(webSeed)
+	}
+	if c.ResumeBlocks {
 		peerWaitGroup.Add(1)
+		go func() {
+			defer peerWaitGroup.Done()
+			c.SaveStateLoop(ctx)
+		}()
 	}
-	peerWaitGroup.Wait()
+	peerWaitGroup.Add(4)
+	go func() {
+		defer peerWaitGroup.Done()
+		c.RateLoop(ctx)
+	}()
+	go func() {
+		defer peerWaitGroup.Done()
+		c.ProgressLoop(ctx)
+	}()
+	go func() {
+		defer peerWaitGroup.Done()
+		c.ChokeLoop(ctx)
+	}()
+	go func() {
+		defer peerWaitGroup.Done()
+		if err := c.ListenLoop(ctx); err != nil {
+			c.Log.Errorf("%s: %v", c.TorrentFilePath, err)
+		}
+	}()
+	c.ConnectLoop(ctx)
+	return c.StopError()
+}
+
+// No peers are needed when we leave the swarm
+func (c *TorrentClient) numWant(event string) int {
+	if event == "stopped" {
+		return 0
+	}
+	return c.NumWant
 }
 
 func (c *TorrentClient) AnnounceUrl() string {
 	return c.AnnounceUrls()[0]
 }
 
+// The returned slice must not be modified
 func (c *TorrentClient) AnnounceUrls() []string {
-	// http://www.bittorrent.org/beps/bep_0012.html
-	// Note that we do not implement the full specification : all trackers will
-	// be shuffled and queried.
-	var urls []string
-
-	if announceUrlsValue, isPresent := c.Bdecoded["announce-list"]; isPresent {
-		for _, announceUrlsArr := range announceUrlsValue.([]interface{}) {
-			for _, announceUrls := range announceUrlsArr.([]interface{}) {
-				urls = append(urls, announceUrls.(string))
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	c.loadAnnounceTiers()
+	return c.announceUrls
+}
+
+// Trackers grouped by tier, in the order of the torrent file. When there is no
+// announce-list, the announce url is the single tier. Extra trackers that the
+// torrent does not list follow, each in its own tier like magnet trackers. The
+// returned slices must not be modified.
+// http://www.bittorrent.org/beps/bep_0012.html
+func (c *TorrentClient) AnnounceTiers() [][]string {
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	c.loadAnnounceTiers()
+	return c.announceTiers
+}
+
+// Must be called with infoLock held
+func (c *TorrentClient) loadAnnounceTiers() {
+	if c.announceTiersKnown {
+		return
+	}
+	c.announceTiers = c.makeAnnounceTiers()
+	c.announceUrls = nil
+	for _, tier := range c.announceTiers {
+		c.announceUrls = append(c.announceUrls, tier...)
+	}
+	c.announceTiersKnown = true
+}
+
+func (c *TorrentClient) makeAnnounceTiers() [][]string {
+	var tiers [][]string
+	if announceList, isList := c.bdecoded["announce-list"].([]interface{}); isList {
+		for _, tierValue := range announceList {
+			tierList, isList := tierValue.([]interface{})
+			if !isList {
+				continue
+			}
+			var tier []string
+			for _, announceUrl := range tierList {
+				if announceUrl, isString := announceUrl.(string); isString {
+					tier = append(tier, announceUrl)
+				}
+			}
+			if len(tier) > 0 {
+				tiers = append(tiers, tier)
 			}
 		}
-	} else if announceUrl, isPresent := c.Bdecoded["announce"]; isPresent {
-		urls = append(urls, announceUrl.(string))
 	}
-	return urls
+	if len(tiers) == 0 {
+		if announceUrl, isString := c.bdecoded["announce"].(string); isString {
+			tiers = append(tiers, []string{announceUrl})
+		}
+	}
+	known := map[string]bool{}
+	for _, tier := range tiers {
+		for _, announceUrl := range tier {
+			known[announceUrl] = true
+		}
+	}
+	for _, announceUrl := range c.ExtraTrackers {
+		if !known[announceUrl] {
+			known[announceUrl] = true
+			tiers = append(tiers, []string{announceUrl})
+		}
+	}
+	return tiers
+}
+
+func (c *TorrentClient) HasInfo() bool {
+	return c.BdecodedInfo() != nil
 }
 
+// The info dictionary, or nil if we don't have the metadata yet
 func (c *TorrentClient) BdecodedInfo() map[string]interface{} {
-	return c.Bdecoded["info"].(map[string]interface{})
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	info, _ := c.bdecoded["info"].(map[string]interface{})
+	return info
 }
 
-func (c *TorrentClient) InfoHash() string {
+// Value of a key of the torrent file, nil if it is missing
+func (c *TorrentClient) Metadata(key string) interface{} {
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	return c.bdecoded[key]
+}
+
+func (c *TorrentClient) SetMetadata(key string, value interface{}) {
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	c.bdecoded[key] = value
+	c.announceTiersKnown = false
+}
+
+// Private torrents only get peers from their trackers
+// http://www.bittorrent.org/beps/bep_0027.html
+func (c *TorrentClient) IsPrivate() bool {
+	private, _ := c.BdecodedInfo()["private"].(int64)
+	return private == 1
+}
+
+// Set the info dictionary fetched from peers, along with its encoding, which
+// is computed when rawInfo is nil
+func (c *TorrentClient) SetInfo(info map[string]interface{}, rawInfo []byte) {
+	c.setInfo(info, rawInfo)
+	c.invalidateLeft()
+}
+
+func (c *TorrentClient) setInfo(info map[string]interface{}, rawInfo []byte) {
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	c.bdecoded["info"] = info
+	c.rawInfo = rawInfo
+	c.pieceHashes = nil
+	c.totalLength = infoTotalLength(info)
+	c.pieceCount = 0
+	if pieceLength, _ := info["piece length"].(int64); pieceLength > 0 {
+		c.pieceCount = int(ceilDiv(c.totalLength, pieceLength))
+	}
+	if c.Magnet == nil {
+		infoHash := sha1.Sum(c.rawInfoLocked())
+		c.infoHash = string(infoHash[:])
+	}
+}
+
+// Bencoded info dictionary. The info hash is computed over these bytes, so
+// they must be exactly the original ones: bencode.Marshal sorts dictionary
+// keys, but torrents that are not canonically encoded would not survive a
+// decode and re-encode round trip. Re-encoding is only used for info
+// dictionaries that were built in memory.
+func (c *TorrentClient) RawInfo() []byte {
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	return c.rawInfoLocked()
+}
+
+// Must be called with infoLock held
+func (c *TorrentClient) rawInfoLocked() []byte {
+	if c.rawInfo != nil {
+		return c.rawInfo
+	}
+	info, _ := c.bdecoded["info"].(map[string]interface{})
 	var infoBuffer bytes.Buffer
-	bencode.Marshal(&infoBuffer, c.BdecodedInfo())
-	var infohash [20]byte = sha1.Sum(infoBuffer.Bytes())
-	return string(infohash[:])
+	bencode.Marshal(&infoBuffer, info)
+	return infoBuffer.Bytes()
 }
 
-func (c *TorrentClient) GetPeers(announceUrl string) []Peer {
-	var peers []Peer
+// Computed when the torrent is loaded, or taken from the magnet link
+func (c *TorrentClient) InfoHash() string {
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	return c.infoHash
+}
+
+type File struct {
+	Path   []string
+	Length int64
+	Offset int64
+}
+
+// Files laid out in the concatenated piece space. For multi-file torrents,
+// paths are prefixed by the torrent name, which is the root directory.
+func (c *TorrentClient) Files() []File {
+	if !c.HasInfo() {
+		return nil
+	}
+	info := c.BdecodedInfo()
+	name, _ := info["name"].(string)
+	var files []File
+	if filesValue, isMultiFile := info["files"]; isMultiFile {
+		var offset int64
+		for _, fileValue := range filesValue.([]interface{}) {
+			fileDict := fileValue.(map[string]interface{})
+			path := []string{name}
+			for _, pathComponent := range fileDict["path"].([]interface{}) {
+				path = append(path, pathComponent.(string))
+			}
+			length := fileDict["length"].(int64)
+			files = append(files, File{
+				Path:   path,
+				Length: length,
+				Offset: offset,
+			})
+			offset += length
+		}
+	} else {
+		files = append(files, File{
+			Path:   []string{name},
+			Length: info["length"].(int64),
+			Offset: 0,
+		})
+	}
+	return files
+}
+
+func (c *TorrentClient) TotalLength() int64 {
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	return c.totalLength
+}
+
+// Sum of the file lengths of the info dictionary
+func infoTotalLength(info map[string]interface{}) int64 {
+	files, isMultiFile := info["files"].([]interface{})
+	if !isMultiFile {
+		length, _ := info["length"].(int64)
+		return length
+	}
+	var totalLength int64
+	for _, fileValue := range files {
+		fileDict, _ := fileValue.(map[string]interface{})
+		length, _ := fileDict["length"].(int64)
+		totalLength += length
+	}
+	return totalLength
+}
+
+// Announce to the tracker and collect peers. The event is one of "started",
+// "completed", "stopped" or empty for regular re-announces.
+func (c *TorrentClient) GetPeers(ctx context.Context, announceUrl string, event string) (*AnnounceResponse, error) {
 	if strings.HasPrefix(announceUrl, "udp") {
+		if proxyDialer != nil {
+			return nil, errUdpProxied
+		}
+		return c.GetUdpPeers(ctx, announceUrl, event)
 	} else if strings.HasPrefix(announceUrl, "http") {
 		params := url.Values{}
 		params.Set("info_hash", c.InfoHash())
 		params.Set("peer_id", c.PeerID)
 		params.Set("port", strconv.Itoa(c.Port))
-		params.Set("uploaded", "0")    // TODO
-		params.Set("downloaded", "0")  // TODO
-		params.Set("left", "0")        // TODO
-		params.Set("event", "started") // TODO
-		response, err := HttpGetBdecoded(announceUrl, &params)
+		params.Set("uploaded", strconv.FormatInt(atomic.LoadInt64(&c.Uploaded), 10))
+		params.Set("downloaded", strconv.FormatInt(atomic.LoadInt64(&c.Downloaded), 10))
+		params.Set("left", strconv.FormatInt(c.Left(), 10))
+		params.Set("event", event)
+		params.Set("compact", "1")
+		params.Set("no_peer_id", "1")
+		params.Set("numwant", strconv.Itoa(c.numWant(event)))
+		params.Set("key", strconv.FormatUint(uint64(c.TrackerKey), 16))
+		if trackerID := c.TrackerID(announceUrl); trackerID != "" {
+			params.Set("trackerid", trackerID)
+		}
+		response, err := HttpGetBdecoded(ctx, announceUrl, &params)
+		var redirectErr *RedirectSchemeError
+		if errors.As(err, &redirectErr) && redirectErr.Url.Scheme == "udp" {
+			c.Log.Debugf("%s: %v", announceUrl, err)
+			return c.GetPeers(ctx, redirectErr.Url.String(), event)
+		}
 		if err != nil {
-			//fmt.Println("###############", u.String(), err)
-			return peers
-		} else {
-			if _, requestFailed := response["failure reason"]; requestFailed {
-				// Failure reason is present in response[failure reason]
-				//fmt.Println("***************", failureReason)
-			} else {
-				// TODO Compact representation?
-				// http://www.bittorrent.org/beps/bep_0023.html
-				//fmt.Println("---------------", len(body), string(body))
-				encodedPeers := response["peers"].(string)
-				peers := DecodePeers(encodedPeers)
-				fmt.Println("+++++++++++++++", peers)
-			}
+			return nil, err
+		}
+		if failureReason, requestFailed := response["failure reason"]; requestFailed {
+			reason, _ := failureReason.(string)
+			return nil, &TrackerFailureError{Reason: reason}
+		}
+		if trackerID, isString := response["tracker id"].(string); isString && trackerID != "" {
+			c.setTrackerID(announceUrl, trackerID)
+		}
+		if warningMessage, isString := response["warning message"].(string); isString {
+			c.Log.Warnf("%s: tracker warning: %s", announceUrl, warningMessage)
+		}
+
+		announceResponse := &AnnounceResponse{}
+		// Trackers may ignore the compact flag and return the
+		// original dictionary model
+		// http://www.bittorrent.org/beps/bep_0023.html
+		switch encodedPeers := response["peers"].(type) {
+		case string:
+			announceResponse.Peers = DecodePeers(encodedPeers)
+		case []interface{}:
+			announceResponse.Peers = DecodePeerDicts(encodedPeers)
+		}
+		// http://www.bittorrent.org/beps/bep_0007.html
+		if encodedPeers6, isPresent := response["peers6"].(string); isPresent {
+			announceResponse.Peers = append(announceResponse.Peers, DecodePeers6(encodedPeers6)...)
+		}
+		if interval, isPresent := response["interval"].(int64); isPresent {
+			announceResponse.Interval = time.Duration(interval) * time.Second
+		}
+		if minInterval, isPresent := response["min interval"].(int64); isPresent {
+			announceResponse.MinInterval = time.Duration(minInterval) * time.Second
+		}
+		if complete, isInteger := response["complete"].(int64); isInteger {
+			announceResponse.Seeders = &complete
 		}
+		if incomplete, isInteger := response["incomplete"].(int64); isInteger {
+			announceResponse.Leechers = &incomplete
+		}
+		c.Log.Debugf("%s: received %d peers", announceUrl, len(announceResponse.Peers))
+		return announceResponse, nil
 	}
-	return peers
+	return nil, errors.New("unsupported tracker protocol: " + announceUrl)
 }
 
+// Compact peers are 6 bytes records: a 4 bytes IPv4 address and a 2 bytes port
 func DecodePeers(encodedPeers string) []Peer {
+	return DecodeCompactPeers(encodedPeers, net.IPv4len)
+}
+
+// IPv6 compact peers are 18 bytes records
+// http://www.bittorrent.org/beps/bep_0007.html
+func DecodePeers6(encodedPeers string) []Peer {
+	return DecodeCompactPeers(encodedPeers, net.IPv6len)
+}
+
+func DecodeCompactPeers(encodedPeers string, ipLength int) []Peer {
+	var peers []Peer
+	recordLength := ipLength + 2
+	for pos := 0; pos+recordLength <= len(encodedPeers); pos += recordLength {
+		record := []byte(encodedPeers[pos : pos+recordLength])
+		peers = append(peers, Peer{
+			IP:   net.IP(record[:ipLength]),
+			Port: int(binary.BigEndian.Uint16(record[ipLength:])),
+		})
+	}
+	return peers
+}
+
+func EncodePeers(peers []Peer) string {
+	var encodedPeers bytes.Buffer
+	for _, peer := range peers {
+		ip := peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		encodedPeers.Write(ip)
+		encodedPeers.WriteByte(byte(peer.Port >> 8))
+		encodedPeers.WriteByte(byte(peer.Port))
+	}
+	return encodedPeers.String()
+}
+
+// Encode the IPv6 peers as 18 bytes records, skipping the IPv4 ones
+func EncodePeers6(peers []Peer) string {
+	var encodedPeers bytes.Buffer
+	for _, peer := range peers {
+		if peer.IP.To4() != nil || len(peer.IP) != net.IPv6len {
+			continue
+		}
+		encodedPeers.Write(peer.IP)
+		encodedPeers.WriteByte(byte(peer.Port >> 8))
+		encodedPeers.WriteByte(byte(peer.Port))
+	}
+	return encodedPeers.String()
+}
+
+// Decode the non-compact list of {"peer id", "ip", "port"} dictionaries
+func DecodePeerDicts(encodedPeers []interface{}) []Peer {
 	var peers []Peer
-	for pos := 0; pos < len(encodedPeers); pos += 6 {
-		ip := encodedPeers[pos : pos+4]
-		port := encodedPeers[pos+4 : pos+6]
+	for _, encodedPeer := range encodedPeers {
+		peerDict, isDict := encodedPeer.(map[string]interface{})
+		if !isDict {
+			continue
+		}
+		ip, _ := peerDict["ip"].(string)
+		port, _ := peerDict["port"].(int64)
+		peerID, _ := peerDict["peer id"].(string)
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			continue
+		}
 		peers = append(peers, Peer{
-			IP: strconv.Itoa(int(ip[0])) + "." +
-				strconv.Itoa(int(ip[1])) + "." +
-				strconv.Itoa(int(ip[2])) + "." +
-				strconv.Itoa(int(ip[3])),
-			Port: int(port[0])*255 + int(port[1]),
+			PeerID: peerID,
+			IP:     parsedIP,
+			Port:   int(port),
 		})
 	}
 	return peers
 }
 
-func HttpGetBdecoded(uri string, params *url.Values) (map[string]interface{}, error) {
-	response, err := HttpGet(uri, params)
+func HttpGetBdecoded(ctx context.Context, uri string, params *url.Values) (map[string]interface{}, error) {
+	response, err := HttpGet(ctx, uri, params)
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
@@ -167,47 +1129,266 @@ func HttpGetBdecoded(uri string, params *url.Values) (map[string]interface{}, er
 	if err != nil {
 		return map[string]interface{}{}, err
 	}
-	return bdecodedResponseRaw.(map[string]interface{}), nil
+	bdecodedResponse, isDict := bdecodedResponseRaw.(map[string]interface{})
+	if !isDict {
+		return map[string]interface{}{}, errors.New("tracker response is not a bencoded dictionary")
+	}
+	return bdecodedResponse, nil
+}
+
+// Attempts of a tracker request that fails with a transient error
+const httpMaxAttempts = 3
+
+// Delay before the first retry, doubled after each attempt
+var httpRetryDelay = time.Second
+
+// Returned for non-2xx http responses
+type HttpStatusError struct {
+	StatusCode int
+	// Delay requested by the Retry-After header, 0 when absent
+	RetryAfter time.Duration
+}
+
+func (e *HttpStatusError) Error() string {
+	return "http status " + strconv.Itoa(e.StatusCode)
+}
+
+// Network errors and server errors may go away on retry; client errors and
+// malformed responses will not
+func isTransientHttpError(err error) bool {
+	var statusError *HttpStatusError
+	if errors.As(err, &statusError) {
+		// Servers that ask to be left alone are not retried right away
+		return statusError.StatusCode >= 500 && statusError.RetryAfter == 0
+	}
+	// url.Error implements net.Error whatever the underlying error, such as
+	// a certificate verification failure
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Retry-After is either a number of seconds or an http date
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// Get the url, retrying with backoff on transient errors
+func HttpGet(ctx context.Context, uri string, params *url.Values) (string, error) {
+	return HttpGetLimit(ctx, uri, params, 0)
+}
+
+// Get the url, reading at most maxSize+1 bytes of the body so that callers can
+// tell larger bodies apart; 0 for no limit
+func HttpGetLimit(ctx context.Context, uri string, params *url.Values, maxSize int64) (string, error) {
+	delay := httpRetryDelay
+	for attempt := 1; ; attempt++ {
+		body, err := httpGetOnce(ctx, uri, params, maxSize)
+		if err == nil || attempt >= httpMaxAttempts || !isTransientHttpError(err) || ctx.Err() != nil {
+			return body, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Values of a repeatable flag
+type StringList []string
+
+var extraTrackers StringList
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Headers added to the http requests, repeatable with -header
+type HttpHeaders http.Header
+
+var extraHttpHeaders = HttpHeaders{}
+
+func (h HttpHeaders) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, ", ")
 }
 
-func HttpGet(uri string, params *url.Values) (string, error) {
+func (h HttpHeaders) Set(header string) error {
+	colon := strings.Index(header, ":")
+	if colon <= 0 {
+		return errors.New("header must be formatted as name: value")
+	}
+	http.Header(h).Add(strings.TrimSpace(header[:colon]), strings.TrimSpace(header[colon+1:]))
+	return nil
+}
+
+// Set the user agent and the extra headers of the request
+func SetHttpHeaders(request *http.Request) {
+	request.Header.Set("User-Agent", *userAgent)
+	for name, values := range extraHttpHeaders {
+		// Extra headers replace the default ones
+		request.Header.Del(name)
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+}
+
+func httpGetOnce(ctx context.Context, uri string, params *url.Values, maxSize int64) (string, error) {
 	// Build full url
 	urlFull, err := url.Parse(uri)
 	if err != nil {
 		return "", err
 	}
-	urlFull.RawQuery = params.Encode()
+	// Parameters are appended to the query of the url, if any
+	if params != nil {
+		if query := EncodeQuery(params); urlFull.RawQuery == "" {
+			urlFull.RawQuery = query
+		} else if query != "" {
+			urlFull.RawQuery += "&" + query
+		}
+	}
 
 	// Make query
-	response, err := http.Get(urlFull.String())
+	request, err := http.NewRequestWithContext(ctx, "GET", urlFull.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	SetHttpHeaders(request)
+	response, err := TrackerHttpClient().Do(request)
 	if err != nil {
 		return "", err
 	}
 
 	// Parse response
 	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", &HttpStatusError{
+			StatusCode: response.StatusCode,
+			RetryAfter: ParseRetryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	var reader io.Reader = response.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(response.Body, maxSize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
 	return string(body), err
 }
 
+// Binary query parameters are escaped byte by byte. url.Values.Encode would
+// escape 0x20 as "+", which some trackers fail to decode.
+var binaryQueryParams = map[string]bool{
+	"info_hash": true,
+	"peer_id":   true,
+}
+
+// Encode query parameters sorted by key, like url.Values.Encode
+func EncodeQuery(params *url.Values) string {
+	var keys []string
+	for key := range *params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var query strings.Builder
+	for _, key := range keys {
+		for _, value := range (*params)[key] {
+			if query.Len() > 0 {
+				query.WriteByte('&')
+			}
+			query.WriteString(url.QueryEscape(key))
+			query.WriteByte('=')
+			if binaryQueryParams[key] {
+				query.WriteString(EscapeBytes(value))
+			} else {
+				query.WriteString(url.QueryEscape(value))
+			}
+		}
+	}
+	return query.String()
+}
+
+// Percent-encode every byte as %XX
+func EscapeBytes(value string) string {
+	const hexDigits = "0123456789ABCDEF"
+	escaped := make([]byte, 3*len(value))
+	for i := 0; i < len(value); i++ {
+		escaped[3*i] = '%'
+		escaped[3*i+1] = hexDigits[value[i]>>4]
+		escaped[3*i+2] = hexDigits[value[i]&0x0f]
+	}
+	return string(escaped)
+}
+
 type Peer struct {
 	PeerID string
-	IP     string
+	IP     net.IP
 	Port   int
+	// Address of the other family of a dual-stack peer, nil when unknown
+	AltIP net.IP
+	// Host name of a peer dialed through the proxy, which resolves it; IP is
+	// nil then
+	Host string
+	// Announce url of the tracker that returned the peer, if any
+	Tracker string
 }
 
+const (
+	// Client identification in Azureus-style peer IDs
+	clientID      = "SL"
+	clientVersion = "0001"
+	peerIDPrefix  = "-" + clientID + clientVersion + "-"
+
+	defaultUserAgent = "slivers/" + clientVersion
+)
+
+// Azureus-style peer ID: -SL0001- followed by 12 random characters, drawn
+// from crypto/rand so that peer IDs are unpredictable
 func MakePeerID() string {
 	letters := "abcdefghijklmnopqrstuvwxyz0123456789"
-	var peerID [20]byte
-	for i := 0; i < 20; i++ {
-		peerID[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(peerID[:])
-}
-
-func check(err error) {
-	if err != nil {
-		fmt.Println("## ERROR ", err)
-		panic(err)
+	// Bytes above the largest multiple of the number of letters are dropped,
+	// so that all letters are equally likely
+	limit := 256 - 256%len(letters)
+	peerID := []byte(peerIDPrefix)
+	randomBytes := make([]byte, 20-len(peerIDPrefix))
+	for len(peerID) < 20 {
+		if _, err := rand.Read(randomBytes); err != nil {
+			panic(err)
+		}
+		for _, b := range randomBytes {
+			if int(b) < limit && len(peerID) < 20 {
+				peerID = append(peerID, letters[int(b)%len(letters)])
+			}
+		}
 	}
+	return string(peerID)
 }
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Single-file torrent with two fake piece hashes
+const testTorrent = "d8:announce9:http://t/4:infod6:lengthi20000e4:name1:f12:piece lengthi16384e6:pieces40:0123456789012345678901234567890123456789ee"
+
+// Multi-file torrent with a nested file and three fake piece hashes
+const testMultiFileTorrent = "d8:announce9:http://t/4:infod5:filesld6:lengthi10000e4:pathl1:aeed6:lengthi0e4:pathl5:emptyeed6:lengthi30000e4:pathl3:sub1:beee4:name3:dir12:piece lengthi16384e6:pieces60:012345678901234567890123456789012345678901234567890123456789ee"
+
+// Run the test with a maximum torrent size of 1 MiB
+func withSmallTorrentLimit(t *testing.T) {
+	previous := *maxTorrentSize
+	*maxTorrentSize = 1
+	t.Cleanup(func() { *maxTorrentSize = previous })
+}
+
+func TestRejectOversizedTorrentFile(t *testing.T) {
+	withSmallTorrentLimit(t)
+	path := filepath.Join(t.TempDir(), "large.torrent")
+	if err := os.WriteFile(path, []byte(testTorrent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTorrentClient(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 1<<20+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTorrentClient(path); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("error %v for an oversized file", err)
+	}
+}
+
+func TestRejectOversizedTorrentStream(t *testing.T) {
+	withSmallTorrentLimit(t)
+	large := strings.Repeat("x", 1<<20+1)
+	if _, err := NewTorrentClientFromReader("stdin", strings.NewReader(large)); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("error %v for an oversized stream", err)
+	}
+
+	written := make(chan int64, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Endless body: the client must stop reading at the limit
+		chunk := []byte(strings.Repeat("x", 1<<16))
+		var total int64
+		for total < 64<<20 {
+			n, err := w.Write(chunk)
+			total += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		written <- total
+	}))
+	defer server.Close()
+	if _, err := NewTorrentClientFromUrl(context.Background(), server.URL); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("error %v for an oversized download", err)
+	}
+	server.CloseClientConnections()
+	if total := <-written; total >= 64<<20 {
+		t.Fatal("the whole body was read")
+	}
+}
+
+func TestRejectBencodeBombs(t *testing.T) {
+	bombs := []string{
+		"d9223372036854775807:",
+		"d4:info999999999:xe",
+		"d1:a" + strings.Repeat("l", 10000) + strings.Repeat("e", 10001),
+	}
+	for _, bomb := range bombs {
+		if _, err := NewTorrentClientFromBytes("bomb", []byte(bomb)); err == nil {
+			t.Errorf("%.30q accepted", bomb)
+		}
+	}
+}
+
+func TestDecodeCompactPeerRecords(t *testing.T) {
+	peers := DecodeCompactPeers("\x0a\x00\x00\x01\x1a\xe1", net.IPv4len)
+	if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP("10.0.0.1")) || peers[0].IP.To4() == nil || peers[0].Port != 6881 {
+		t.Fatal(peers)
+	}
+	peers = DecodePeers6("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5")
+	if len(peers) != 1 || !peers[0].IP.Equal(net.ParseIP("2001:db8::1")) || peers[0].Port != 51413 {
+		t.Fatal(peers)
+	}
+	if peers[0].Address() != "[2001:db8::1]:51413" {
+		t.Fatal(peers[0].Address())
+	}
+	// Truncated trailing records are ignored
+	if peers := DecodePeers("\x0a\x00\x00\x01\x1a\xe1\x0a\x00"); len(peers) != 1 {
+		t.Fatal(peers)
+	}
+}
+
+func TestDecodePeers(t *testing.T) {
+	peers := DecodePeers("\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x01\x00")
+	if len(peers) != 2 {
+		t.Fatal(peers)
+	}
+	if !peers[0].IP.Equal(net.IPv4(1, 2, 3, 4)) || peers[0].Port != 6881 {
+		t.Fatal(peers[0])
+	}
+	// Ports with a nonzero high byte
+	if !peers[1].IP.Equal(net.IPv4(5, 6, 7, 8)) || peers[1].Port != 256 {
+		t.Fatal(peers[1])
+	}
+}
+
+// HTTP tracker that answers announces with the bencoded response, and records
+// the raw query of each announce
+func startFakeHttpTracker(t *testing.T, response string) (string, chan string) {
+	t.Helper()
+	queries := make(chan string, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case queries <- r.URL.RawQuery:
+		default:
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce", queries
+}
+
+func TestHttpAnnounceCompactPeers(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers12:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x01\x00e")
+	response, err := c.GetPeers(context.Background(), announceUrl, "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 2 || response.Peers[0].Address() != "1.2.3.4:6881" || response.Peers[1].Address() != "5.6.7.8:256" {
+		t.Fatal(response.Peers)
+	}
+	query, _ := url.ParseQuery(<-queries)
+	if query.Get("compact") != "1" {
+		t.Fatal(query)
+	}
+}
+
+// Trackers that ignore the compact flag return a list of dictionaries
+func TestHttpAnnouncePeerDicts(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID := strings.Repeat("p", 20)
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peersld2:ip7:1.2.3.47:peer id20:"+peerID+"4:porti6881eed2:ip11:2001:db8::14:porti256eed2:ip7:invalid4:porti1eeee")
+	response, err := c.GetPeers(context.Background(), announceUrl, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 2 {
+		t.Fatal(response.Peers)
+	}
+	if response.Peers[0].Address() != "1.2.3.4:6881" || response.Peers[0].PeerID != peerID {
+		t.Fatal(response.Peers[0])
+	}
+	if response.Peers[1].Address() != "[2001:db8::1]:256" || response.Peers[1].PeerID != "" {
+		t.Fatal(response.Peers[1])
+	}
+}
+
+func TestFiles(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := c.Files(); !reflect.DeepEqual(files, []File{{Path: []string{"f"}, Length: 20000}}) {
+		t.Fatal(files)
+	}
+
+	c, err = NewTorrentClientFromBytes("test.torrent", []byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []File{
+		{Path: []string{"dir", "a"}, Length: 10000, Offset: 0},
+		{Path: []string{"dir", "empty"}, Length: 0, Offset: 10000},
+		{Path: []string{"dir", "sub", "b"}, Length: 30000, Offset: 10000},
+	}
+	if files := c.Files(); !reflect.DeepEqual(files, want) {
+		t.Fatal(files)
+	}
+	if c.TotalLength() != 40000 || c.PieceCount() != 3 || c.PieceSize(2) != 40000-2*16384 {
+		t.Fatal(c.TotalLength(), c.PieceCount(), c.PieceSize(2))
+	}
+}
+
+// Write a torrent of the info dictionary, announced to a tracker that refuses
+// connections, and return its path
+func writeTestTorrent(t *testing.T, dir string, name string, info map[string]interface{}) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, encodeTestTorrent(t, "http://127.0.0.1:1/announce", info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Run the test with the downloads stored in a temporary directory and a free
+// listen port
+func withTestFlags(t *testing.T) {
+	previousDir, previousPort, previousQuiet := *outputDir, *listenPort, *quiet
+	*outputDir, *listenPort, *quiet = t.TempDir(), 0, true
+	t.Cleanup(func() { *outputDir, *listenPort, *quiet = previousDir, previousPort, previousQuiet })
+}
+
+func TestRunClientsSkipsCorruptTorrents(t *testing.T) {
+	withTestFlags(t)
+	dir := t.TempDir()
+	info, _ := makeTestInfo(16384, 20000)
+	valid := writeTestTorrent(t, dir, "valid.torrent", info)
+	corrupt := filepath.Join(dir, "corrupt.torrent")
+	if err := os.WriteFile(corrupt, []byte("d8:announce"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, failedCount := RunClients(ctx, []string{corrupt, valid, filepath.Join(dir, "missing.torrent")})
+	if failedCount != 2 || len(report.Torrents) != 3 {
+		t.Fatal(failedCount, report.Torrents)
+	}
+	if report.Torrents[0].Error == "" || report.Torrents[2].Error == "" {
+		t.Fatal(report.Torrents)
+	}
+	if report.Torrents[1].Error != "" || report.Torrents[1].Name != "test" {
+		t.Fatal(report.Torrents[1])
+	}
+	if _, err := os.Stat(filepath.Join(*outputDir, "test.part")); err != nil {
+		t.Fatal("the valid torrent did not run:", err)
+	}
+}
+
+func TestAnnounceTransferCounters(t *testing.T) {
+	info, _ := makeTestInfo(16384, 40000)
+	c := newTestClient(t, info)
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	if _, err := c.GetPeers(context.Background(), announceUrl, "started"); err != nil {
+		t.Fatal(err)
+	}
+	query, _ := url.ParseQuery(<-queries)
+	if query.Get("left") != "40000" || query.Get("downloaded") != "0" || query.Get("uploaded") != "0" {
+		t.Fatal(query)
+	}
+
+	for index := 0; index < c.PieceCount(); index++ {
+		c.SetHasPiece(index)
+	}
+	c.Downloaded, c.Uploaded = 40000, 1234
+	if _, err := c.GetPeers(context.Background(), announceUrl, "completed"); err != nil {
+		t.Fatal(err)
+	}
+	query, _ = url.ParseQuery(<-queries)
+	if query.Get("left") != "0" || query.Get("downloaded") != "40000" || query.Get("uploaded") != "1234" || query.Get("event") != "completed" {
+		t.Fatal(query)
+	}
+}
+
+func TestRunClientsRunsEveryTorrent(t *testing.T) {
+	withTestFlags(t)
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 4; i++ {
+		info, _ := makeTestInfo(16384, 20000+i)
+		info["name"] = "test" + strconv.Itoa(i)
+		paths = append(paths, writeTestTorrent(t, dir, strconv.Itoa(i)+".torrent", info))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, failedCount := RunClients(ctx, paths)
+	if failedCount != 0 || len(report.Torrents) != len(paths) {
+		t.Fatal(failedCount, report.Torrents)
+	}
+	for i, torrentReport := range report.Torrents {
+		name := "test" + strconv.Itoa(i)
+		if torrentReport.Name != name {
+			t.Fatal(torrentReport)
+		}
+		if _, err := os.Stat(filepath.Join(*outputDir, name+".part")); err != nil {
+			t.Fatalf("%s did not run: %v", name, err)
+		}
+	}
+}
+
+func TestRunClientsOfDirectory(t *testing.T) {
+	withTestFlags(t)
+	dir := t.TempDir()
+	for i, name := range []string{"a.torrent", "b.torrent", filepath.Join("sub", "c.torrent")} {
+		info, _ := makeTestInfo(16384, 20000+i)
+		info["name"] = "test" + strconv.Itoa(i)
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		writeTestTorrent(t, dir, name, info)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a torrent"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	report, failedCount := RunClients(ctx, []string{dir})
+	if failedCount != 0 || len(report.Torrents) != 2 || report.Torrents[0].Name != "test0" || report.Torrents[1].Name != "test1" {
+		t.Fatal(failedCount, report.Torrents)
+	}
+	if _, err := os.Stat(filepath.Join(*outputDir, "test2.part")); !os.IsNotExist(err) {
+		t.Fatal("the torrent of the subdirectory ran")
+	}
+
+	paths, err := TorrentFilesInDir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "a.torrent"), filepath.Join(dir, "b.torrent"), filepath.Join(dir, "sub", "c.torrent")}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatal(paths)
+	}
+}
+
+func TestEncodeInfoHash(t *testing.T) {
+	infoHash := "\x20\x25\xff\x00abcdefghijklmnop"
+	params := url.Values{}
+	params.Set("info_hash", infoHash)
+	params.Set("port", "6881")
+	want := "info_hash=%20%25%FF%00%61%62%63%64%65%66%67%68%69%6A%6B%6C%6D%6E%6F%70&port=6881"
+	if query := EncodeQuery(&params); query != want {
+		t.Fatal(query)
+	}
+
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPeers(context.Background(), announceUrl, ""); err != nil {
+		t.Fatal(err)
+	}
+	query, _ := url.ParseQuery(<-queries)
+	if query.Get("info_hash") != c.InfoHash() || query.Get("peer_id") != c.PeerID {
+		t.Fatal(query)
+	}
+}
+
+func TestRunCancelledMidAnnounce(t *testing.T) {
+	announcing := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case announcing <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	info, _ := makeTestInfo(16384, 20000)
+	c, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, server.URL+"/announce", info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Port = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	select {
+	case <-announcing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func TestHttpAnnouncePeers6(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2e")
+	response, err := c.GetPeers(context.Background(), announceUrl, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 2 || response.Peers[0].Address() != "1.2.3.4:6881" || response.Peers[1].Address() != "[2001:db8::1]:6882" {
+		t.Fatal(response.Peers)
+	}
+}
+
+func TestPeerIDPrefix(t *testing.T) {
+	peerID := MakePeerID()
+	if len(peerID) != 20 || !strings.HasPrefix(peerID, "-SL"+clientVersion+"-") || len(peerIDPrefix) != 8 {
+		t.Fatalf("peer ID %q", peerID)
+	}
+	for _, b := range []byte(peerID[len(peerIDPrefix):]) {
+		if !('a' <= b && b <= 'z' || '0' <= b && b <= '9') {
+			t.Fatalf("peer ID %q", peerID)
+		}
+	}
+}
+
+func TestDistinctPeerIDs(t *testing.T) {
+	first, second := newTorrentClient(), newTorrentClient()
+	if first.PeerID == second.PeerID {
+		t.Fatalf("both clients have the peer ID %q", first.PeerID)
+	}
+}
+
+func TestHttpAnnounceRetriesTransientErrors(t *testing.T) {
+	defer func(delay time.Duration) { httpRetryDelay = delay }(httpRetryDelay)
+	httpRetryDelay = time.Millisecond
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe1e"))
+	}))
+	defer server.Close()
+	response, err := c.GetPeers(context.Background(), server.URL+"/announce", "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Address() != "1.2.3.4:6881" || atomic.LoadInt64(&requests) != 3 {
+		t.Fatal(response.Peers, atomic.LoadInt64(&requests))
+	}
+
+	// Client errors are permanent
+	atomic.StoreInt64(&requests, 0)
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notFound.Close()
+	if _, err := c.GetPeers(context.Background(), notFound.URL+"/announce", "started"); err == nil || atomic.LoadInt64(&requests) != 1 {
+		t.Fatal(err, atomic.LoadInt64(&requests))
+	}
+}
+
+func TestHttpAnnounceFailureReason(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	announceUrl, _ := startFakeHttpTracker(t, "d14:failure reason22:torrent not registerede")
+	_, err = c.GetPeers(context.Background(), announceUrl, "started")
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "torrent not registered" {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestHttpAnnounceWarningMessage(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &captureLogger{}
+	c.Log = logger
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe115:warning message14:tracker is olde")
+	response, err := c.GetPeers(context.Background(), announceUrl, "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || !logger.Contains("WARN", "tracker is old") {
+		t.Fatal(response.Peers, logger.messages)
+	}
+}
+
+// Info hashes computed with another implementation from the raw bytes
+func TestKnownInfoHashes(t *testing.T) {
+	for torrent, want := range map[string]string{
+		testTorrent:          "0e44a3d16cfb53c22e63d6d4e13ef67a1cf8d6da",
+		testMultiFileTorrent: "fe6de71fc136ed0fa40188fd7afdc641b1d8acef",
+	} {
+		c, err := NewTorrentClientFromBytes("test.torrent", []byte(torrent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if infoHash := hex.EncodeToString([]byte(c.InfoHash())); infoHash != want {
+			t.Errorf("info hash %s, want %s", infoHash, want)
+		}
+	}
+}
+
+func TestLoadTorrentFromReaderAndUrl(t *testing.T) {
+	fromReader, err := NewTorrentClientFromReader("stdin", strings.NewReader(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "5" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testTorrent))
+	}))
+	defer server.Close()
+	fromUrl, err := LoadClient(context.Background(), server.URL+"/download?id=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawInfo := testTorrent[strings.Index(testTorrent, "4:info")+6 : len(testTorrent)-1]
+	for _, c := range []*TorrentClient{fromReader, fromUrl} {
+		if string(c.RawInfo()) != rawInfo || c.PieceCount() != 2 {
+			t.Fatalf("%s: raw info %q", c.TorrentFilePath, c.RawInfo())
+		}
+	}
+	if fromReader.InfoHash() != fromUrl.InfoHash() {
+		t.Fatal("info hashes differ")
+	}
+	if _, err := LoadClient(context.Background(), server.URL+"/download?id=6"); err == nil {
+		t.Fatal("missing torrent loaded")
+	}
+}
+
+// Private torrents announce to their trackers but do not contact the DHT
+// nodes of the torrent, nor exchange peers
+func TestPrivateTorrentSkipsDHTAndPex(t *testing.T) {
+	defer func(nodes []string) { dhtBootstrapNodes = nodes }(dhtBootstrapNodes)
+	dhtBootstrapNodes = nil
+	for _, private := range []int64{0, 1} {
+		node, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+		info, _ := makeTestInfo(16384, 20000)
+		info["private"] = private
+		var torrent bytes.Buffer
+		if err := bencode.Marshal(&torrent, map[string]interface{}{
+			"announce": announceUrl,
+			"info":     info,
+			"nodes":    []interface{}{[]interface{}{"127.0.0.1", int64(node.LocalAddr().(*net.UDPAddr).Port)}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.OutputDir = t.TempDir()
+		c.Port = 0
+		logger := &captureLogger{}
+		c.Log = logger
+		if c.IsPrivate() != (private == 1) {
+			t.Fatal("private flag not read")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Run(ctx)
+		}()
+
+		select {
+		case <-queries:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no announce to the tracker")
+		}
+		node.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, _, err = node.ReadFrom(make([]byte, 1500))
+		if contacted := err == nil; contacted == (private == 1) {
+			t.Fatalf("private %d: dht node contacted: %v", private, contacted)
+		}
+		hasPex := c.Extensions.Lookup(c, utPexID) != nil
+		if hasPex == (private == 1) {
+			t.Fatalf("private %d: pex enabled: %v", private, hasPex)
+		}
+		if private == 1 && !logger.Contains("INFO", "private torrent") {
+			t.Fatal(logger.messages)
+		}
+		cancel()
+		<-done
+	}
+}
+
+func TestHttpAnnounceHeaders(t *testing.T) {
+	defer func(previous string) { *userAgent = previous }(*userAgent)
+	*userAgent = "custom-agent/1.0"
+	defer func(previous HttpHeaders) { extraHttpHeaders = previous }(extraHttpHeaders)
+	extraHttpHeaders = HttpHeaders{}
+	if err := extraHttpHeaders.Set("X-Api-Key: secret"); err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer server.Close()
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetPeers(context.Background(), server.URL+"/announce", "started"); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	if request.UserAgent() != "custom-agent/1.0" || request.Header.Get("X-Api-Key") != "secret" {
+		t.Fatal(request.Header)
+	}
+	if key := request.URL.Query().Get("key"); key != strconv.FormatUint(uint64(c.TrackerKey), 16) {
+		t.Fatal(key)
+	}
+	if !strings.HasPrefix(defaultUserAgent, "slivers/") {
+		t.Fatal(defaultUserAgent)
+	}
+}
+
+func TestHttpAnnounceKeyAndTrackerID(t *testing.T) {
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:10:tracker id6:abc123e")
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var announces []url.Values
+	for _, event := range []string{"started", ""} {
+		if _, err := c.GetPeers(context.Background(), announceUrl, event); err != nil {
+			t.Fatal(err)
+		}
+		query, _ := url.ParseQuery(<-queries)
+		announces = append(announces, query)
+	}
+	if announces[0].Get("key") == "" || announces[0].Get("key") != announces[1].Get("key") {
+		t.Fatal("key changed", announces[0].Get("key"), announces[1].Get("key"))
+	}
+	if _, hasTrackerID := announces[0]["trackerid"]; hasTrackerID || announces[1].Get("trackerid") != "abc123" {
+		t.Fatal(announces)
+	}
+	if c.TrackerID(announceUrl) != "abc123" || c.TrackerID("http://other/announce") != "" {
+		t.Fatal("tracker id is not stored per tracker")
+	}
+}
+
+func TestHttpAnnounceNumWant(t *testing.T) {
+	announceUrl, queries := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NumWant = 25
+	for event, expected := range map[string]string{"started": "25", "": "25", "stopped": "0"} {
+		if _, err := c.GetPeers(context.Background(), announceUrl, event); err != nil {
+			t.Fatal(err)
+		}
+		query, _ := url.ParseQuery(<-queries)
+		if query.Get("numwant") != expected {
+			t.Fatal(event, query.Get("numwant"))
+		}
+	}
+}
+
+func TestExtraTrackers(t *testing.T) {
+	previous := extraTrackers
+	defer func() { extraTrackers = previous }()
+	extraTrackers = nil
+	for _, announceUrl := range []string{"http://b/announce", "udp://c:6969"} {
+		if err := extraTrackers.Set(announceUrl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, _ := makeTestInfo(16384, 20000)
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{
+		"announce":      "http://a/announce",
+		"announce-list": []interface{}{[]interface{}{"http://a/announce", "http://b/announce"}},
+		"info":          info,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"http://a/announce", "http://b/announce", "udp://c:6969"}
+	if announceUrls := c.AnnounceUrls(); strings.Join(announceUrls, " ") != strings.Join(expected, " ") {
+		t.Fatal(announceUrls)
+	}
+	extraTrackers = nil
+	original, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.AnnounceUrls()) != 2 || original.InfoHash() != c.InfoHash() {
+		t.Fatal(original.AnnounceUrls())
+	}
+}
+
+func TestQuietRunPrintsNothing(t *testing.T) {
+	info, data := makeTestInfo(16384, 40000)
+	seeder := startTestSeeder(t, info, data)
+	peers := string(net.IPv4(127, 0, 0, 1).To4()) + string([]byte{byte(seeder.Port >> 8), byte(seeder.Port)})
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers6:"+peers+"e")
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, encodeTestTorrent(t, announceUrl, info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withTestFlags(t)
+	output := filepath.Join(t.TempDir(), "output")
+	outputFile, err := os.Create(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outputFile.Close()
+	previousStdout, previousStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outputFile, outputFile
+	defer func() { os.Stdout, os.Stderr = previousStdout, previousStderr }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan RunReport)
+	go func() {
+		report, _ := RunClients(ctx, []string{path})
+		done <- report
+	}()
+	waitFor(t, 20*time.Second, func() bool {
+		content, _ := os.ReadFile(filepath.Join(*outputDir, "test"))
+		return bytes.Equal(content, data)
+	})
+	cancel()
+	PrintReport(<-done)
+	if printed, _ := os.ReadFile(output); len(printed) > 0 {
+		t.Fatalf("%q", printed)
+	}
+}
+
+// Run with -race: the accessors are called from the goroutines of a client
+// while the metadata of a magnet link arrives
+func TestConcurrentMetadataAccess(t *testing.T) {
+	info, _ := makeTestInfo(16384, 100000)
+	var rawInfo bytes.Buffer
+	if err := bencode.Marshal(&rawInfo, info); err != nil {
+		t.Fatal(err)
+	}
+	infoHash := sha1.Sum(rawInfo.Bytes())
+	c, err := NewTorrentClientFromMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash[:]) + "&tr=http%3A%2F%2Fa%2Fannounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wait sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			<-start
+			for j := 0; j < 100; j++ {
+				if c.InfoHash() != string(infoHash[:]) {
+					t.Error("info hash changed")
+					return
+				}
+				c.AnnounceUrls()
+				c.AnnounceTiers()
+				c.Files()
+				c.PieceCount()
+				c.TotalLength()
+				c.PieceHashes()
+				c.RawInfo()
+				c.IsPrivate()
+				c.Metadata("comment")
+			}
+		}()
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		<-start
+		c.SetInfo(info, nil)
+		c.SetMetadata("comment", "arrived")
+	}()
+	close(start)
+	wait.Wait()
+	if c.PieceCount() != 7 || c.Comment() != "arrived" || len(c.AnnounceUrls()) != 1 {
+		t.Fatal(c.PieceCount(), c.Comment(), c.AnnounceUrls())
+	}
+}
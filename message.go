@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Peer wire messages
+// http://www.bittorrent.org/beps/bep_0003.html#peer-messages
+
+const (
+	MsgChoke         = 0
+	MsgUnchoke       = 1
+	MsgInterested    = 2
+	MsgNotInterested = 3
+	MsgHave          = 4
+	MsgBitfield      = 5
+	MsgRequest       = 6
+	MsgPiece         = 7
+	MsgCancel        = 8
+)
+
+// Messages longer than this are considered a protocol violation
+const maxMessageLength = 1 << 20
+
+// A nil message is a keep-alive
+type Message struct {
+	ID      byte
+	Payload []byte
+}
+
+// Serialize the message as <length prefix><message ID><payload>
+func (m *Message) Serialize() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+	buf := make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(m.Payload)))
+	buf[4] = m.ID
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+func ReadMessage(r io.Reader) (*Message, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageLength {
+		return nil, errors.New("message too long")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:      buf[0],
+		Payload: buf[1:],
+	}, nil
+}
+
+func MakeHaveMessage(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: MsgHave, Payload: payload}
+}
+
+func ParseHaveMessage(msg *Message) (int, error) {
+	if msg.ID != MsgHave || len(msg.Payload) != 4 {
+		return 0, errors.New("malformed have message")
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// Pieces owned by a peer, high bit of the first byte being piece 0
+type Bitfield []byte
+
+func NewBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount+7)/8)
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]>>(7-uint(index%8))&1 != 0
+}
+
+func (b Bitfield) Set(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] |= 1 << (7 - uint(index%8))
+}
+
+// Check a bitfield received for the given number of pieces: the bits that
+// follow the last piece must be cleared
+func (b Bitfield) Validate(pieceCount int) error {
+	if expected := (pieceCount + 7) / 8; len(b) != expected {
+		return fmt.Errorf("bitfield of %d bytes instead of %d", len(b), expected)
+	}
+	if spareBits := uint(len(b)*8 - pieceCount); spareBits > 0 && b[len(b)-1]&(1<<spareBits-1) != 0 {
+		return errors.New("bitfield with spare bits set")
+	}
+	return nil
+}
+
+func MakeRequestMessage(index int, begin int, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgRequest, Payload: payload}
+}
+
+func MakeCancelMessage(index int, begin int, length int) *Message {
+	msg := MakeRequestMessage(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+func ParseRequestMessage(msg *Message) (index int, begin int, length int, err error) {
+	if (msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgRejectRequest) || len(msg.Payload) != 12 {
+		return 0, 0, 0, errors.New("malformed request message")
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+func MakePieceMessage(index int, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+func ParsePieceMessage(msg *Message) (index int, begin int, block []byte, err error) {
+	if msg.ID != MsgPiece || len(msg.Payload) < 8 {
+		return 0, 0, nil, errors.New("malformed piece message")
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
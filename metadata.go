@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Metadata exchange
+// http://www.bittorrent.org/beps/bep_0009.html
+
+const (
+	metadataPieceSize = 16384
+	// Refuse to download metadata larger than this
+	maxMetadataSize = 8 << 20
+	// Give up on peers that take longer than this to send the metadata
+	metadataTimeout = time.Minute
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// Fetch the info dictionary from the known peers, one after the other, until
+// one of them sends valid metadata
+func (c *TorrentClient) FetchMetadata(ctx context.Context) error {
+	tried := map[string]bool{}
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range c.Peers() {
+			if tried[peer.Address()] {
+				continue
+			}
+			tried[peer.Address()] = true
+			info, rawInfo, err := c.FetchMetadataFromPeer(ctx, peer)
+			if err != nil {
+				c.Log.Debugf("metadata from %s: %v", peer.Address(), err)
+				continue
+			}
+			c.SetInfo(info, rawInfo)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the decoded info dictionary and the metadata it was decoded from
+func (c *TorrentClient) FetchMetadataFromPeer(ctx context.Context, peer Peer) (map[string]interface{}, []byte, error) {
+	pc, err := c.Connect(ctx, peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pc.Close()
+	defer pc.WatchContext(ctx)()
+	// The whole exchange has a single deadline
+	pc.ReadTimeout = 0
+	pc.Conn.SetDeadline(time.Now().Add(metadataTimeout))
+
+	if !pc.SupportsExtensions() {
+		return nil, nil, errors.New("metadata: peer does not support extensions")
+	}
+	handshakeMessage, err := c.MakeExtendedHandshakeMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pc.SendMessage(handshakeMessage); err != nil {
+		return nil, nil, err
+	}
+
+	var pieces [][]byte
+	metadataSize := 0
+	received := 0
+	for pieces == nil || received < len(pieces) {
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return nil, nil, err
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+		extensionID, dict, data, err := ParseExtendedMessage(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if extensionID == extendedHandshakeID {
+			handshake := ParseExtendedHandshake(dict)
+			remoteID, isSupported := handshake.M["ut_metadata"]
+			if !isSupported {
+				return nil, nil, errors.New("metadata: peer does not support ut_metadata")
+			}
+			metadataSize = handshake.MetadataSize
+			if metadataSize <= 0 || metadataSize > maxMetadataSize {
+				return nil, nil, fmt.Errorf("metadata: invalid size %d", metadataSize)
+			}
+			pieces = make([][]byte, (metadataSize+metadataPieceSize-1)/metadataPieceSize)
+			for index := range pieces {
+				request, err := MakeExtendedMessage(byte(remoteID), map[string]interface{}{
+					"msg_type": metadataRequest,
+					"piece":    index,
+				}, nil)
+				if err != nil {
+					return nil, nil, err
+				}
+				if err := pc.SendMessage(request); err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+		if extensionID != utMetadataID || pieces == nil {
+			continue
+		}
+
+		msgType, _ := dict["msg_type"].(int64)
+		index, _ := dict["piece"].(int64)
+		switch msgType {
+		case metadataReject:
+			return nil, nil, fmt.Errorf("metadata: peer rejected request for piece %d", index)
+		case metadataData:
+			if index < 0 || int(index) >= len(pieces) {
+				return nil, nil, fmt.Errorf("metadata: invalid piece %d", index)
+			}
+			expectedLength := metadataPieceSize
+			if int(index) == len(pieces)-1 {
+				expectedLength = metadataSize - int(index)*metadataPieceSize
+			}
+			if len(data) != expectedLength {
+				return nil, nil, fmt.Errorf("metadata: invalid length for piece %d", index)
+			}
+			if pieces[index] == nil {
+				received++
+			}
+			pieces[index] = data
+		}
+	}
+
+	metadata := bytes.Join(pieces, nil)
+	if infoHash := sha1.Sum(metadata); string(infoHash[:]) != c.InfoHash() {
+		return nil, nil, errors.New("metadata: info hash mismatch")
+	}
+	if _, err := ScanBencodeDict(string(metadata)); err != nil {
+		return nil, nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(metadata))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, isDict := decoded.(map[string]interface{})
+	if !isDict {
+		return nil, nil, errors.New("metadata: info is not a dictionary")
+	}
+	if err := ValidateInfo(info); err != nil {
+		return nil, nil, err
+	}
+	return info, metadata, nil
+}
+
+// Answer the metadata requests of a peer with pieces of our info dictionary,
+// or reject them while we do not have it. Data and reject messages are read by
+// FetchMetadataFromPeer.
+func handleMetadataMessage(pc *PeerConn, dict map[string]interface{}, data []byte) error {
+	if msgType, _ := dict["msg_type"].(int64); msgType != metadataRequest {
+		return nil
+	}
+	remoteID := pc.ExtensionID("ut_metadata")
+	if remoteID == 0 {
+		return nil
+	}
+	index, isInt := dict["piece"].(int64)
+	var rawInfo []byte
+	if pc.client.HasInfo() {
+		rawInfo = pc.client.RawInfo()
+	}
+	if !isInt || index < 0 || index >= int64(len(rawInfo)+metadataPieceSize-1)/metadataPieceSize {
+		reject, err := MakeExtendedMessage(byte(remoteID), map[string]interface{}{
+			"msg_type": metadataReject,
+			"piece":    index,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		return pc.SendMessage(reject)
+	}
+	start := int(index) * metadataPieceSize
+	end := start + metadataPieceSize
+	if end > len(rawInfo) {
+		end = len(rawInfo)
+	}
+	piece, err := MakeExtendedMessage(byte(remoteID), map[string]interface{}{
+		"msg_type":   metadataData,
+		"piece":      index,
+		"total_size": len(rawInfo),
+	}, rawInfo[start:end])
+	if err != nil {
+		return err
+	}
+	return pc.SendMessage(piece)
+}
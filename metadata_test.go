@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Info dictionary whose encoding takes two metadata pieces
+func makeTwoPieceInfo(t *testing.T) (map[string]interface{}, []byte) {
+	info := map[string]interface{}{
+		"name":         "metadata",
+		"piece length": int64(16384),
+		"length":       int64(1000 * 16384),
+		"pieces":       strings.Repeat("01234567890123456789", 1000),
+	}
+	var rawInfo bytes.Buffer
+	if err := bencode.Marshal(&rawInfo, info); err != nil {
+		t.Fatal(err)
+	}
+	if rawInfo.Len() <= metadataPieceSize || rawInfo.Len() > 2*metadataPieceSize {
+		t.Fatalf("metadata of %d bytes", rawInfo.Len())
+	}
+	return info, rawInfo.Bytes()
+}
+
+func newMagnetClient(t *testing.T, infoHash string) *TorrentClient {
+	c, err := NewTorrentClientFromMagnet("magnet:?xt=urn:btih:" + hex.EncodeToString([]byte(infoHash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Encryption = EncryptionDisable
+	return c
+}
+
+// Serve the metadata with the ut_metadata extension, or reject all requests
+func serveFakeMetadata(rawInfo []byte, reject bool) func(conn net.Conn) {
+	const fakeMetadataID = 3
+	return func(conn net.Conn) {
+		handshake, _ := MakeExtendedMessage(extendedHandshakeID, map[string]interface{}{
+			"m":             map[string]interface{}{"ut_metadata": fakeMetadataID},
+			"metadata_size": len(rawInfo),
+		}, nil)
+		conn.Write(handshake.Serialize())
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgExtended {
+				continue
+			}
+			extensionID, dict, _, err := ParseExtendedMessage(msg)
+			if err != nil || extensionID != fakeMetadataID {
+				continue
+			}
+			index, _ := dict["piece"].(int64)
+			response := map[string]interface{}{"msg_type": metadataReject, "piece": index}
+			var data []byte
+			if !reject {
+				start := int(index) * metadataPieceSize
+				end := start + metadataPieceSize
+				if end > len(rawInfo) {
+					end = len(rawInfo)
+				}
+				response = map[string]interface{}{"msg_type": metadataData, "piece": index, "total_size": len(rawInfo)}
+				data = rawInfo[start:end]
+			}
+			reply, _ := MakeExtendedMessage(utMetadataID, response, data)
+			conn.Write(reply.Serialize())
+		}
+	}
+}
+
+func TestFetchMetadataInTwoPieces(t *testing.T) {
+	_, rawInfo := makeTwoPieceInfo(t)
+	infoHash := sha1.Sum(rawInfo)
+	c := newMagnetClient(t, string(infoHash[:]))
+	// The first peer rejects our requests: the second one is tried
+	c.AddPeers([]Peer{startFakePeer(t, string(infoHash[:]), serveFakeMetadata(rawInfo, true))})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		c.AddPeers([]Peer{startFakePeer(t, string(infoHash[:]), serveFakeMetadata(rawInfo, false))})
+	}()
+	if err := c.FetchMetadata(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasInfo() || !bytes.Equal(c.RawInfo(), rawInfo) {
+		t.Fatal("metadata was not reconstructed")
+	}
+	if reconstructed := sha1.Sum(c.RawInfo()); reconstructed != infoHash {
+		t.Fatalf("info hash %x instead of %x", reconstructed, infoHash)
+	}
+	if c.PieceCount() != 1000 {
+		t.Fatalf("%d pieces", c.PieceCount())
+	}
+}
+
+func TestServeMetadata(t *testing.T) {
+	info, rawInfo := makeTwoPieceInfo(t)
+	seeder := newTestClient(t, info)
+	seeder.Storage = NewMemoryStorage(seeder.TotalLength())
+	startTestListener(t, seeder)
+
+	c := newMagnetClient(t, seeder.InfoHash())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fetched, fetchedRaw, err := c.FetchMetadataFromPeer(ctx, loopbackPeer(seeder.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetchedRaw, rawInfo) || fetched["name"] != "metadata" {
+		t.Fatal("served metadata differs")
+	}
+}
+
+// Request a metadata piece from the client and return the type of its answer
+func requestMetadataPiece(t *testing.T, c *TorrentClient, index int) int64 {
+	const requesterMetadataID = 5
+	conn, err := net.Dial("tcp", loopbackPeer(c.Port).Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(MakeHandshake(c.InfoHash(), MakePeerID()))
+	if _, err := ReadHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	handshake, _ := MakeExtendedMessage(extendedHandshakeID, map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": requesterMetadataID},
+	}, nil)
+	request, _ := MakeExtendedMessage(utMetadataID, map[string]interface{}{
+		"msg_type": metadataRequest,
+		"piece":    index,
+	}, nil)
+	conn.Write(append(handshake.Serialize(), request.Serialize()...))
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || msg.ID != MsgExtended {
+			continue
+		}
+		if extensionID, dict, _, err := ParseExtendedMessage(msg); err == nil && extensionID == requesterMetadataID {
+			msgType, _ := dict["msg_type"].(int64)
+			return msgType
+		}
+	}
+}
+
+func TestRejectMetadataRequests(t *testing.T) {
+	info, rawInfo := makeTwoPieceInfo(t)
+	seeder := newTestClient(t, info)
+	seeder.Storage = NewMemoryStorage(seeder.TotalLength())
+	startTestListener(t, seeder)
+	if msgType := requestMetadataPiece(t, seeder, 1); msgType != metadataData {
+		t.Fatalf("piece 1: message type %d", msgType)
+	}
+	if msgType := requestMetadataPiece(t, seeder, 2); msgType != metadataReject {
+		t.Fatalf("piece 2: message type %d", msgType)
+	}
+
+	// A client that is itself fetching the metadata has none to serve
+	infoHash := sha1.Sum(rawInfo)
+	fetching := newMagnetClient(t, string(infoHash[:]))
+	fetching.Port = 0
+	startTestListener(t, fetching)
+	if msgType := requestMetadataPiece(t, fetching, 0); msgType != metadataReject {
+		t.Fatalf("without info: message type %d", msgType)
+	}
+}
+
+func TestParseExtendedMessageHugeLength(t *testing.T) {
+	for _, payload := range []string{"9223372036854775807:", "d1:a9223372036854775807:xe", "99999999999999999999:"} {
+		msg := &Message{ID: MsgExtended, Payload: append([]byte{utPexID}, payload...)}
+		if _, _, _, err := ParseExtendedMessage(msg); err == nil {
+			t.Errorf("%q accepted", payload)
+		}
+	}
+}
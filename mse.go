@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Message stream encryption
+// http://wiki.vuze.com/w/Message_Stream_Encryption
+
+type EncryptionPolicy int
+
+const (
+	// Plaintext connections only
+	EncryptionDisable EncryptionPolicy = iota
+	// Encrypted connections, with plaintext fallback
+	EncryptionPrefer
+	// Encrypted connections only
+	EncryptionRequire
+)
+
+// Policy selected with -encryption
+var encryptionPolicy = EncryptionPrefer
+
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch s {
+	case "disable":
+		return EncryptionDisable, nil
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	}
+	return 0, errors.New("unknown encryption policy " + s)
+}
+
+const (
+	msePlaintext = 0x01
+	mseRC4       = 0x02
+	mseKeyLength = 96
+	mseMaxPad    = 512
+	// Keystream bytes dropped after the rc4 key setup
+	mseDiscard = 1024
+)
+
+var msePrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var mseGenerator = big.NewInt(2)
+
+// Verification constant
+var mseVC = make([]byte, 8)
+
+type MSEKeyPair struct {
+	private *big.Int
+	Public  []byte
+}
+
+func NewMSEKeyPair() (*MSEKeyPair, error) {
+	// 160 bits of secret are enough, as per the spec
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	private := new(big.Int).SetBytes(secret)
+	public := new(big.Int).Exp(mseGenerator, private, msePrime)
+	return &MSEKeyPair{private: private, Public: msePad(public.Bytes())}, nil
+}
+
+// Shared secret computed from the public key of the other side
+func (k *MSEKeyPair) Secret(otherPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(otherPublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(msePrime) >= 0 {
+		return nil, errors.New("mse: invalid public key")
+	}
+	return msePad(new(big.Int).Exp(y, k.private, msePrime).Bytes()), nil
+}
+
+// Left-pad a big integer to the key length
+func msePad(b []byte) []byte {
+	padded := make([]byte, mseKeyLength)
+	copy(padded[mseKeyLength-len(b):], b)
+	return padded
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+	return hash.Sum(nil)
+}
+
+// Cipher that encrypts the stream sent by the initiator ("keyA") or by the
+// receiver ("keyB")
+func mseCipher(name string, secret []byte, skey []byte) *rc4.Cipher {
+	stream, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	discard := make([]byte, mseDiscard)
+	stream.XORKeyStream(discard, discard)
+	return stream
+}
+
+func mseRandomPad() ([]byte, error) {
+	var length [2]byte
+	if _, err := rand.Read(length[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(mseMaxPad+1))
+	_, err := rand.Read(pad)
+	return pad, err
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+// Read until the pattern is found, reading at most maxSkip bytes before it
+func mseSync(r *bufio.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, len(pattern))
+	for read := 0; read < maxSkip+len(pattern); read++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("mse: synchronisation failed")
+}
+
+// Connection that reads from a buffered reader, which may decrypt the stream,
+// and optionally encrypts what it writes
+type mseConn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher
+}
+
+func (m *mseConn) Read(b []byte) (int, error) {
+	return m.reader.Read(b)
+}
+
+func (m *mseConn) Write(b []byte) (int, error) {
+	if m.encrypt == nil {
+		return m.Conn.Write(b)
+	}
+	encrypted := make([]byte, len(b))
+	m.encrypt.XORKeyStream(encrypted, b)
+	return m.Conn.Write(encrypted)
+}
+
+func (policy EncryptionPolicy) cryptoProvide() uint32 {
+	if policy == EncryptionRequire {
+		return mseRC4
+	}
+	return mseRC4 | msePlaintext
+}
+
+// Encrypt an outgoing connection; skey is the info hash of the torrent. The
+// returned connection must be used for the BitTorrent handshake and all the
+// following messages.
+func MSEInitiate(conn net.Conn, skey string, policy EncryptionPolicy) (net.Conn, error) {
+	keys, err := NewMSEKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := mseRandomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.Public, padA...)); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	publicB := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, publicB); err != nil {
+		return nil, err
+	}
+	secret, err := keys.Secret(publicB)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := mseCipher("keyA", secret, []byte(skey))
+	decrypt := mseCipher("keyB", secret, []byte(skey))
+	padC, err := mseRandomPad()
+	if err != nil {
+		return nil, err
+	}
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, policy.cryptoProvide())
+	binary.Write(plain, binary.BigEndian, uint16(len(padC)))
+	plain.Write(padC)
+	// No initial payload: the BitTorrent handshake follows
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+
+	request := mseHash([]byte("req1"), secret)
+	request = append(request, xorBytes(mseHash([]byte("req2"), []byte(skey)), mseHash([]byte("req3"), secret))...)
+	request = append(request, encrypted...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// The encrypted verification constant follows padB
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+	if err := mseSync(reader, encryptedVC, mseMaxPad); err != nil {
+		return nil, err
+	}
+	decrypted := &mseConn{Conn: conn, reader: cipher.StreamReader{S: decrypt, R: reader}}
+	var header struct {
+		CryptoSelect uint32
+		PadLength    uint16
+	}
+	if err := binary.Read(decrypted, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.PadLength > mseMaxPad {
+		return nil, errors.New("mse: invalid padding length")
+	}
+	if _, err := io.ReadFull(decrypted, make([]byte, header.PadLength)); err != nil {
+		return nil, err
+	}
+	switch header.CryptoSelect {
+	case mseRC4:
+		decrypted.encrypt = encrypt
+		return decrypted, nil
+	case msePlaintext:
+		if policy == EncryptionRequire {
+			return nil, errors.New("mse: peer selected plaintext")
+		}
+		return &mseConn{Conn: conn, reader: reader}, nil
+	}
+	return nil, errors.New("mse: invalid crypto method selected")
+}
+
+// Accept an encrypted incoming connection. The reader must be positioned at
+// the start of the stream.
+func MSEReceive(conn net.Conn, reader *bufio.Reader, skey string, policy EncryptionPolicy) (net.Conn, error) {
+	publicA := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(reader, publicA); err != nil {
+		return nil, err
+	}
+	keys, err := NewMSEKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := keys.Secret(publicA)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := mseRandomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.Public, padB...)); err != nil {
+		return nil, err
+	}
+
+	if err := mseSync(reader, mseHash([]byte("req1"), secret), mseMaxPad); err != nil {
+		return nil, err
+	}
+	skeyHash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, skeyHash); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(skeyHash, xorBytes(mseHash([]byte("req2"), []byte(skey)), mseHash([]byte("req3"), secret))) {
+		return nil, errors.New("mse: unknown info hash")
+	}
+
+	encrypt := mseCipher("keyB", secret, []byte(skey))
+	decrypt := mseCipher("keyA", secret, []byte(skey))
+	decryptedReader := cipher.StreamReader{S: decrypt, R: reader}
+	var header struct {
+		VC            [8]byte
+		CryptoProvide uint32
+		PadLength     uint16
+	}
+	if err := binary.Read(decryptedReader, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header.VC[:], mseVC) {
+		return nil, errors.New("mse: invalid verification constant")
+	}
+	if header.PadLength > mseMaxPad {
+		return nil, errors.New("mse: invalid padding length")
+	}
+	if _, err := io.ReadFull(decryptedReader, make([]byte, header.PadLength)); err != nil {
+		return nil, err
+	}
+	var initialPayloadLength uint16
+	if err := binary.Read(decryptedReader, binary.BigEndian, &initialPayloadLength); err != nil {
+		return nil, err
+	}
+	initialPayload := make([]byte, initialPayloadLength)
+	if _, err := io.ReadFull(decryptedReader, initialPayload); err != nil {
+		return nil, err
+	}
+
+	var cryptoSelect uint32
+	if header.CryptoProvide&mseRC4 != 0 {
+		cryptoSelect = mseRC4
+	} else if header.CryptoProvide&msePlaintext != 0 && policy != EncryptionRequire {
+		cryptoSelect = msePlaintext
+	} else {
+		return nil, errors.New("mse: no acceptable crypto method")
+	}
+	padD, err := mseRandomPad()
+	if err != nil {
+		return nil, err
+	}
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, cryptoSelect)
+	binary.Write(plain, binary.BigEndian, uint16(len(padD)))
+	plain.Write(padD)
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	if _, err := conn.Write(encrypted); err != nil {
+		return nil, err
+	}
+
+	// The initial payload is read before the rest of the stream
+	if cryptoSelect == mseRC4 {
+		return &mseConn{
+			Conn:    conn,
+			reader:  io.MultiReader(bytes.NewReader(initialPayload), decryptedReader),
+			encrypt: encrypt,
+		}, nil
+	}
+	return &mseConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initialPayload), reader)}, nil
+}
+
+// Returns true when the incoming stream starts with a plaintext BitTorrent
+// handshake
+func IsPlaintextHandshake(reader *bufio.Reader) (bool, error) {
+	prefix, err := reader.Peek(1 + len(protocolIdentifier))
+	if err != nil {
+		return false, err
+	}
+	return int(prefix[0]) == len(protocolIdentifier) && string(prefix[1:]) == protocolIdentifier, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMSEKeyExchange(t *testing.T) {
+	a, err := NewMSEKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewMSEKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Public) != mseKeyLength || bytes.Equal(a.Public, b.Public) {
+		t.Fatal("invalid public keys")
+	}
+	secretA, err := a.Secret(b.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretB, err := b.Secret(a.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secretA, secretB) || len(secretA) != mseKeyLength {
+		t.Fatal("shared secrets differ")
+	}
+	for _, public := range [][]byte{msePad(nil), msePad([]byte{1}), msePad(msePrime.Bytes())} {
+		if _, err := a.Secret(public); err == nil {
+			t.Errorf("public key %x accepted", public)
+		}
+	}
+}
+
+// Connected tcp pair; pipes are synchronous and would deadlock the key
+// exchange, where both sides write before they read
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	return local, remote
+}
+
+func TestMSEHandshake(t *testing.T) {
+	infoHash := string(bytes.Repeat([]byte{0xab}, 20))
+	handshake := MakeHandshake(infoHash, MakePeerID())
+	for _, policy := range []EncryptionPolicy{EncryptionPrefer, EncryptionRequire} {
+		local, remote := tcpPair(t)
+		// Record the bytes sent by the initiator
+		var wire bytes.Buffer
+		received := make(chan []byte, 1)
+		go func() {
+			reader := bufio.NewReader(io.TeeReader(remote, &wire))
+			if isPlaintext, err := IsPlaintextHandshake(reader); err != nil || isPlaintext {
+				received <- nil
+				return
+			}
+			conn, err := MSEReceive(remote, reader, infoHash, policy)
+			if err != nil {
+				received <- nil
+				return
+			}
+			data := make([]byte, len(handshake))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				received <- nil
+				return
+			}
+			conn.Write([]byte("reply"))
+			received <- data
+		}()
+		conn, err := MSEInitiate(local, infoHash, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(handshake); err != nil {
+			t.Fatal(err)
+		}
+		if data := <-received; !bytes.Equal(data, handshake) {
+			t.Fatalf("policy %d: handshake %x", policy, data)
+		}
+		reply := make([]byte, 5)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "reply" {
+			t.Fatal(string(reply), err)
+		}
+		if bytes.Contains(wire.Bytes(), []byte(protocolIdentifier)) || bytes.Contains(wire.Bytes(), []byte(infoHash)) {
+			t.Fatalf("policy %d: plaintext handshake on the wire", policy)
+		}
+	}
+}
+
+func TestEncryptedDownload(t *testing.T) {
+	info, data := makeTestInfo(16384, 50000)
+	seeder := newTestClient(t, info)
+	storage := NewMemoryStorage(int64(len(data)))
+	storage.WriteAt(data, 0)
+	seeder.Storage = storage
+	for index := 0; index < seeder.PieceCount(); index++ {
+		seeder.SetHasPiece(index)
+	}
+	seeder.Encryption = EncryptionRequire
+	startTestListener(t, seeder)
+
+	c := newTestClient(t, info)
+	c.Encryption = EncryptionRequire
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkDownloadedFiles(t, c.OutputDir, c, data)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port mapping on the home gateway, so that peers can reach our listen port
+// through the NAT. NAT-PMP is tried first, then UPnP IGD.
+
+const (
+	// Mappings are requested for this duration and renewed halfway
+	natMappingLifetime = 2 * time.Hour
+	// Time allowed to find a gateway that supports either protocol
+	natDiscoveryTimeout = 6 * time.Second
+	// Part of the discovery time given to NAT-PMP before trying UPnP
+	natPMPProbeTimeout = 2 * time.Second
+	// Time allowed to remove the mapping on shutdown
+	natUnmapTimeout = 5 * time.Second
+)
+
+type PortMapper interface {
+	// Forward the external tcp port to the same local port, and return the
+	// external port that was actually mapped
+	AddPortMapping(ctx context.Context, port int, lifetime time.Duration) (int, error)
+	DeletePortMapping(ctx context.Context, port int) error
+	ExternalIP(ctx context.Context) (net.IP, error)
+}
+
+// Map the listen port until the context is cancelled, then remove the mapping
+func (c *TorrentClient) NATLoop(ctx context.Context) {
+	discoveryCtx, cancel := context.WithTimeout(ctx, natDiscoveryTimeout)
+	mapper, err := DiscoverPortMapper(discoveryCtx)
+	cancel()
+	if err != nil {
+		c.Log.Warnf("nat: no gateway supports port mapping: %v", err)
+		return
+	}
+	for {
+		externalPort, err := mapper.AddPortMapping(ctx, c.Port, natMappingLifetime)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.Log.Warnf("nat: port mapping failed: %v", err)
+			}
+			return
+		}
+		if externalIP, err := mapper.ExternalIP(ctx); err == nil {
+			c.Log.Infof("nat: listening on %s", net.JoinHostPort(externalIP.String(), strconv.Itoa(externalPort)))
+		}
+		select {
+		case <-ctx.Done():
+			unmapCtx, cancel := context.WithTimeout(context.Background(), natUnmapTimeout)
+			defer cancel()
+			if err := mapper.DeletePortMapping(unmapCtx, c.Port); err != nil {
+				c.Log.Debugf("nat: could not remove port mapping: %v", err)
+			}
+			return
+		case <-time.After(natMappingLifetime / 2):
+		}
+	}
+}
+
+func DiscoverPortMapper(ctx context.Context) (PortMapper, error) {
+	gateway, err := DefaultGateway()
+	if err == nil {
+		natPMP := &NATPMPGateway{Gateway: gateway}
+		probeCtx, cancel := context.WithTimeout(ctx, natPMPProbeTimeout)
+		_, err := natPMP.ExternalIP(probeCtx)
+		cancel()
+		if err == nil {
+			return natPMP, nil
+		}
+	}
+	upnp, err := DiscoverUPnPGateway(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return upnp, nil
+}
+
+// Gateway of the default route, read from the kernel routing table on Linux.
+// Elsewhere, we guess that the gateway is the first address of the local
+// network.
+func DefaultGateway() (net.IP, error) {
+	if routes, err := os.Open("/proc/net/route"); err == nil {
+		defer routes.Close()
+		scanner := bufio.NewScanner(routes)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// Iface Destination Gateway ...
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			gateway, err := hex.DecodeString(fields[2])
+			if err != nil || len(gateway) != 4 {
+				continue
+			}
+			// Addresses are in host byte order, which is little endian on
+			// all the platforms we care about
+			return net.IPv4(gateway[3], gateway[2], gateway[1], gateway[0]), nil
+		}
+	}
+	localIP, err := LocalIP()
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(localIP[0], localIP[1], localIP[2], 1), nil
+}
+
+// IPv4 address of the interface used to reach the internet. No packet is sent.
+func LocalIP() (net.IP, error) {
+	if bindIP != nil && bindIP.To4() != nil {
+		return bindIP.To4(), nil
+	}
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if localIP == nil {
+		return nil, errors.New("no local IPv4 address")
+	}
+	return localIP, nil
+}
+
+// NAT-PMP
+// https://www.rfc-editor.org/rfc/rfc6886
+
+const (
+	natPMPPort             = 5351
+	natPMPVersion          = 0
+	natPMPOpExternalIP     = 0
+	natPMPOpMapTCP         = 2
+	natPMPResponseOpOffset = 128
+	// Requests are retransmitted after 250ms, doubling the delay each time
+	natPMPBaseTimeout = 250 * time.Millisecond
+	natPMPMaxRetries  = 4
+)
+
+type NATPMPGateway struct {
+	Gateway net.IP
+}
+
+func MakeNATPMPExternalIPRequest() []byte {
+	return []byte{natPMPVersion, natPMPOpExternalIP}
+}
+
+func ParseNATPMPExternalIPResponse(response []byte) (net.IP, error) {
+	if err := checkNATPMPResponse(response, natPMPOpExternalIP, 12); err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), response[8:12]...)), nil
+}
+
+// A zero lifetime and external port delete the mapping
+func MakeNATPMPMappingRequest(internalPort int, externalPort int, lifetime time.Duration) []byte {
+	request := make([]byte, 12)
+	request[0] = natPMPVersion
+	request[1] = natPMPOpMapTCP
+	binary.BigEndian.PutUint16(request[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+	return request
+}
+
+// Return the mapped external port and the granted lifetime
+func ParseNATPMPMappingResponse(response []byte) (int, time.Duration, error) {
+	if err := checkNATPMPResponse(response, natPMPOpMapTCP, 16); err != nil {
+		return 0, 0, err
+	}
+	externalPort := int(binary.BigEndian.Uint16(response[10:12]))
+	lifetime := time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+	return externalPort, lifetime, nil
+}
+
+func checkNATPMPResponse(response []byte, op byte, length int) error {
+	if len(response) < length {
+		return errors.New("nat-pmp: response too short")
+	}
+	if response[0] != natPMPVersion || response[1] != natPMPResponseOpOffset+op {
+		return errors.New("nat-pmp: unexpected response")
+	}
+	if result := binary.BigEndian.Uint16(response[2:4]); result != 0 {
+		return fmt.Errorf("nat-pmp: request failed with result code %d", result)
+	}
+	return nil
+}
+
+func (g *NATPMPGateway) transaction(ctx context.Context, request []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: g.Gateway, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer WatchContext(ctx, conn)()
+	response := make([]byte, 16)
+	for n := uint(0); n <= natPMPMaxRetries; n++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(natPMPBaseTimeout << n))
+		length, err := conn.Read(response)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		return response[:length], nil
+	}
+	return nil, errors.New("nat-pmp: no response")
+}
+
+func (g *NATPMPGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	response, err := g.transaction(ctx, MakeNATPMPExternalIPRequest())
+	if err != nil {
+		return nil, err
+	}
+	return ParseNATPMPExternalIPResponse(response)
+}
+
+func (g *NATPMPGateway) AddPortMapping(ctx context.Context, port int, lifetime time.Duration) (int, error) {
+	response, err := g.transaction(ctx, MakeNATPMPMappingRequest(port, port, lifetime))
+	if err != nil {
+		return 0, err
+	}
+	externalPort, _, err := ParseNATPMPMappingResponse(response)
+	return externalPort, err
+}
+
+func (g *NATPMPGateway) DeletePortMapping(ctx context.Context, port int) error {
+	response, err := g.transaction(ctx, MakeNATPMPMappingRequest(port, 0, 0))
+	if err != nil {
+		return err
+	}
+	_, _, err = ParseNATPMPMappingResponse(response)
+	return err
+}
+
+// UPnP Internet Gateway Device
+// http://upnp.org/specs/gw/UPnP-gw-WANIPConnection-v1-Service.pdf
+
+const (
+	ssdpAddress      = "239.255.255.250:1900"
+	upnpDeviceType   = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpSearchWait   = 2
+	upnpHttpTimeout  = 5 * time.Second
+	upnpMappingLabel = "slivers"
+)
+
+// Services that provide port mappings
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type UPnPGateway struct {
+	ControlUrl  string
+	ServiceType string
+	// Local address that the gateway forwards to
+	LocalIP net.IP
+}
+
+// SSDP search request, sent over multicast udp
+func MakeSSDPSearch(searchTarget string) string {
+	return "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"ST: " + searchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(upnpSearchWait) + "\r\n" +
+		"\r\n"
+}
+
+// Device description url from a search response
+func ParseSSDPResponse(response []byte) (string, error) {
+	httpResponse, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		return "", err
+	}
+	httpResponse.Body.Close()
+	location := httpResponse.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("ssdp: missing location")
+	}
+	return location, nil
+}
+
+func DiscoverUPnPGateway(ctx context.Context) (*UPnPGateway, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer WatchContext(ctx, conn)()
+	if _, err := conn.WriteTo([]byte(MakeSSDPSearch(upnpDeviceType)), groupAddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Duration(upnpSearchWait+1) * time.Second))
+	response := make([]byte, 2048)
+	for {
+		length, _, err := conn.ReadFrom(response)
+		if err != nil {
+			return nil, errors.New("upnp: no internet gateway device found")
+		}
+		location, err := ParseSSDPResponse(response[:length])
+		if err != nil {
+			continue
+		}
+		if gateway, err := NewUPnPGateway(ctx, location); err == nil {
+			return gateway, nil
+		}
+	}
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlUrl  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpDescription struct {
+	UrlBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// Find the port mapping service in the device description
+func ParseUPnPDescription(description []byte, location string) (controlUrl string, serviceType string, err error) {
+	var root upnpDescription
+	if err := xml.Unmarshal(description, &root); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.UrlBase != "" {
+		if base, err = url.Parse(root.UrlBase); err != nil {
+			return "", "", err
+		}
+	}
+	devices := []upnpDevice{root.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+		for _, service := range device.Services {
+			for _, serviceType := range upnpServiceTypes {
+				if service.ServiceType != serviceType {
+					continue
+				}
+				control, err := base.Parse(service.ControlUrl)
+				if err != nil {
+					return "", "", err
+				}
+				return control.String(), serviceType, nil
+			}
+		}
+	}
+	return "", "", errors.New("upnp: no port mapping service")
+}
+
+func NewUPnPGateway(ctx context.Context, location string) (*UPnPGateway, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: upnpHttpTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	description, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	controlUrl, serviceType, err := ParseUPnPDescription(description, location)
+	if err != nil {
+		return nil, err
+	}
+
+	// The local address that reaches the gateway is the one to forward to
+	u, err := url.Parse(controlUrl)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp4", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return &UPnPGateway{
+		ControlUrl:  controlUrl,
+		ServiceType: serviceType,
+		LocalIP:     conn.LocalAddr().(*net.UDPAddr).IP,
+	}, nil
+}
+
+// Call a SOAP action and return the response body
+func (g *UPnPGateway) soapRequest(ctx context.Context, action string, arguments string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + g.ServiceType + `">` + arguments + `</u:` + action + `></s:Body>` +
+		`</s:Envelope>`
+	request, err := http.NewRequestWithContext(ctx, "POST", g.ControlUrl, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+g.ServiceType+"#"+action+`"`)
+	client := &http.Client{Timeout: upnpHttpTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s failed with http status %d", action, response.StatusCode)
+	}
+	return responseBody, nil
+}
+
+func (g *UPnPGateway) AddPortMapping(ctx context.Context, port int, lifetime time.Duration) (int, error) {
+	arguments := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(port) + "</NewExternalPort>" +
+		"<NewProtocol>TCP</NewProtocol>" +
+		"<NewInternalPort>" + strconv.Itoa(port) + "</NewInternalPort>" +
+		"<NewInternalClient>" + g.LocalIP.String() + "</NewInternalClient>" +
+		"<NewEnabled>1</NewEnabled>" +
+		"<NewPortMappingDescription>" + upnpMappingLabel + "</NewPortMappingDescription>" +
+		"<NewLeaseDuration>" + strconv.Itoa(int(lifetime/time.Second)) + "</NewLeaseDuration>"
+	if _, err := g.soapRequest(ctx, "AddPortMapping", arguments); err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+func (g *UPnPGateway) DeletePortMapping(ctx context.Context, port int) error {
+	arguments := "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.Itoa(port) + "</NewExternalPort>" +
+		"<NewProtocol>TCP</NewProtocol>"
+	_, err := g.soapRequest(ctx, "DeletePortMapping", arguments)
+	return err
+}
+
+func (g *UPnPGateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	response, err := g.soapRequest(ctx, "GetExternalIPAddress", "")
+	if err != nil {
+		return nil, err
+	}
+	var envelope struct {
+		ExternalIP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(response, &envelope); err != nil {
+		return nil, err
+	}
+	externalIP := net.ParseIP(envelope.ExternalIP)
+	if externalIP == nil {
+		return nil, errors.New("upnp: invalid external address " + envelope.ExternalIP)
+	}
+	return externalIP, nil
+}
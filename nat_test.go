@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSDPSearch(t *testing.T) {
+	search := MakeSSDPSearch(upnpDeviceType)
+	request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(search)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Method != "M-SEARCH" || request.Host != ssdpAddress || request.Header.Get("ST") != upnpDeviceType || request.Header.Get("MAN") != `"ssdp:discover"` || request.Header.Get("MX") != "2" {
+		t.Fatalf("%q", search)
+	}
+	if !strings.HasSuffix(search, "\r\n\r\n") {
+		t.Fatalf("%q", search)
+	}
+}
+
+func TestParseSSDPResponse(t *testing.T) {
+	location, err := ParseSSDPResponse([]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: " + upnpDeviceType + "\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n"))
+	if err != nil || location != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Fatal(location, err)
+	}
+	if _, err := ParseSSDPResponse([]byte("HTTP/1.1 200 OK\r\nST: " + upnpDeviceType + "\r\n\r\n")); err == nil {
+		t.Fatal("response without a location accepted")
+	}
+}
+
+func TestParseUPnPDescription(t *testing.T) {
+	description := `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device><deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`
+	controlUrl, serviceType, err := ParseUPnPDescription([]byte(description), "http://192.168.1.1:5000/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controlUrl != "http://192.168.1.1:5000/ctl/IPConn" || serviceType != upnpServiceTypes[0] {
+		t.Fatal(controlUrl, serviceType)
+	}
+}
+
+func TestNATPMPMessages(t *testing.T) {
+	if request := MakeNATPMPExternalIPRequest(); !bytes.Equal(request, []byte{0, 0}) {
+		t.Fatal(request)
+	}
+	ip, err := ParseNATPMPExternalIPResponse([]byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7})
+	if err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Fatal(ip, err)
+	}
+
+	request := MakeNATPMPMappingRequest(6881, 6881, time.Hour)
+	if !bytes.Equal(request, []byte{0, 2, 0, 0, 0x1a, 0xe1, 0x1a, 0xe1, 0, 0, 0x0e, 0x10}) {
+		t.Fatal(request)
+	}
+	externalPort, lifetime, err := ParseNATPMPMappingResponse([]byte{0, 130, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1, 0x1a, 0xe2, 0, 0, 0x0e, 0x10})
+	if err != nil || externalPort != 6882 || lifetime != time.Hour {
+		t.Fatal(externalPort, lifetime, err)
+	}
+
+	for _, response := range [][]byte{
+		// Too short
+		{0, 130, 0, 0},
+		// Wrong opcode
+		{0, 128, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1, 0x1a, 0xe2, 0, 0, 0x0e, 0x10},
+		// Not authorized
+		{0, 130, 0, 2, 0, 0, 0, 1, 0x1a, 0xe1, 0x1a, 0xe2, 0, 0, 0x0e, 0x10},
+	} {
+		if _, _, err := ParseNATPMPMappingResponse(response); err == nil {
+			t.Errorf("response %v accepted", response)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Peer wire protocol
+// http://www.bittorrent.org/beps/bep_0003.html#peer-protocol
+
+const protocolIdentifier = "BitTorrent protocol"
+
+func (p Peer) Address() string {
+	if p.IP == nil && p.Host != "" {
+		return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	}
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// Reserved handshake bits, as byte index and mask
+const (
+	// http://www.bittorrent.org/beps/bep_0010.html
+	reservedExtensionByte = 5
+	reservedExtensionMask = 0x10
+	// http://www.bittorrent.org/beps/bep_0006.html
+	reservedFastByte = 7
+	reservedFastMask = 0x04
+)
+
+type HandshakeMessage struct {
+	Reserved [8]byte
+	InfoHash string
+	PeerID   string
+}
+
+func (h *HandshakeMessage) SupportsExtensions() bool {
+	return h.Reserved[reservedExtensionByte]&reservedExtensionMask != 0
+}
+
+// Connect to the peer and exchange handshakes. The returned peer ID is the
+// one advertised by the remote peer.
+func (c *TorrentClient) Handshake(ctx context.Context, peer Peer) (net.Conn, string, error) {
+	conn, handshake, err := c.dialPeer(ctx, peer)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, handshake.PeerID, nil
+}
+
+func (c *TorrentClient) dialPeer(ctx context.Context, peer Peer) (net.Conn, *HandshakeMessage, error) {
+	conn, handshake, err := c.dialPeerWith(ctx, peer, c.Encryption != EncryptionDisable)
+	if err == errHandshakeFailed && c.Encryption == EncryptionPrefer && ctx.Err() == nil {
+		// The peer may not support encryption
+		conn, handshake, err = c.dialPeerWith(ctx, peer, false)
+	}
+	return conn, handshake, err
+}
+
+// Returned by dialPeerWith when the connection was established but the
+// encryption or BitTorrent handshake did not succeed
+var errHandshakeFailed = errors.New("handshake failed")
+
+func (c *TorrentClient) dialPeerWith(ctx context.Context, peer Peer, encrypted bool) (net.Conn, *HandshakeMessage, error) {
+	var dialer ContextDialer = NewBoundDialer()
+	if proxyDialer != nil {
+		dialer = proxyDialer
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, c.DialTimeout)
+	defer cancel()
+	conn, err := DialHappyEyeballs(dialCtx, dialer, peer.DialAddresses(), happyEyeballsDelay)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer WatchContext(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(c.DialTimeout))
+	infoHash := c.InfoHash()
+	if encrypted {
+		encryptedConn, err := MSEInitiate(conn, infoHash, c.Encryption)
+		if err != nil {
+			conn.Close()
+			c.Log.Debugf("%s: encryption handshake: %v", peer.Address(), err)
+			return nil, nil, errHandshakeFailed
+		}
+		conn = encryptedConn
+	}
+	if _, err := conn.Write(MakeHandshake(infoHash, c.PeerID)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	handshake, err := ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		c.Log.Debugf("%s: handshake: %v", peer.Address(), err)
+		return nil, nil, errHandshakeFailed
+	}
+	if handshake.InfoHash != infoHash {
+		conn.Close()
+		return nil, nil, errors.New("handshake: info hash mismatch")
+	}
+	if handshake.PeerID == c.PeerID {
+		// Do not try this address again
+		conn.Close()
+		c.RemovePeers([]Peer{peer})
+		return nil, nil, errSelfConnection
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, handshake, nil
+}
+
+// Interrupt pending I/O on the connection when the context is cancelled. The
+// returned function must be called to release the watcher.
+func WatchContext(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// Build the 68 bytes handshake message:
+// <pstrlen><pstr><reserved><info_hash><peer_id>
+func MakeHandshake(infoHash string, peerID string) []byte {
+	var reserved [8]byte
+	reserved[reservedExtensionByte] |= reservedExtensionMask
+	reserved[reservedFastByte] |= reservedFastMask
+	var handshake bytes.Buffer
+	handshake.WriteByte(byte(len(protocolIdentifier)))
+	handshake.WriteString(protocolIdentifier)
+	handshake.Write(reserved[:])
+	handshake.WriteString(infoHash)
+	handshake.WriteString(peerID)
+	return handshake.Bytes()
+}
+
+func ReadHandshake(r io.Reader) (*HandshakeMessage, error) {
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if int(buf[0]) != len(protocolIdentifier) || string(buf[1:20]) != protocolIdentifier {
+		return nil, errors.New("handshake: unknown protocol")
+	}
+	handshake := &HandshakeMessage{
+		InfoHash: string(buf[28:48]),
+		PeerID:   string(buf[48:68]),
+	}
+	copy(handshake.Reserved[:], buf[20:28])
+	return handshake, nil
+}
+
+// Merge newly discovered peers into the set of known peers, indexed by
+// address. Trackers, DHT, PEX and LSD all feed into this set, so that each peer
+// is dialed once. The peer ID is kept if any source provided it.
+func (c *TorrentClient) AddPeers(peers []Peer) {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	for _, peer := range peers {
+		if peerBlocklist.Blocks(peer.IP) || c.addAltIP(peer) {
+			continue
+		}
+		known, isKnown := c.peers[peer.Address()]
+		if !isKnown || (known.PeerID == "" && peer.PeerID != "") {
+			c.peers[peer.Address()] = peer
+		}
+	}
+}
+
+// A peer ID announced at addresses of both families is a dual-stack peer,
+// dialed over both. Must be called with peersLock held.
+func (c *TorrentClient) addAltIP(peer Peer) bool {
+	if peer.PeerID == "" {
+		return false
+	}
+	isIPv4 := peer.IP.To4() != nil
+	for address, known := range c.peers {
+		if known.PeerID == peer.PeerID && known.Port == peer.Port && (known.IP.To4() != nil) != isIPv4 {
+			known.AltIP = peer.IP
+			c.peers[address] = known
+			return true
+		}
+	}
+	return false
+}
+
+// Record the address of the other family that a connected peer advertised in
+// its extended handshake
+func (c *TorrentClient) SetAltIP(peer Peer, altIP net.IP) {
+	if altIP == nil || (peer.IP.To4() != nil) == (altIP.To4() != nil) || peerBlocklist.Blocks(altIP) {
+		return
+	}
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	if known, isKnown := c.peers[peer.Address()]; isKnown {
+		known.AltIP = altIP
+		c.peers[peer.Address()] = known
+	}
+}
+
+func (c *TorrentClient) RemovePeers(peers []Peer) {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	for _, peer := range peers {
+		delete(c.peers, peer.Address())
+	}
+}
+
+func (c *TorrentClient) Peers() []Peer {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	peers := make([]Peer, 0, len(c.peers))
+	for _, peer := range c.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+var errSelfConnection = errors.New("connected to ourselves")
+var errDuplicateConnection = errors.New("already connected to this peer")
+
+// Register an established connection. Connections to ourselves and second
+// connections to a peer, identified by its address or its peer ID, are
+// refused and must be closed.
+func (c *TorrentClient) AddConn(pc *PeerConn) error {
+	if pc.PeerID == c.PeerID {
+		return errSelfConnection
+	}
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	if _, isConnected := c.conns[pc.Peer.Address()]; isConnected {
+		return errDuplicateConnection
+	}
+	for _, conn := range c.conns {
+		if conn.PeerID == pc.PeerID {
+			return errDuplicateConnection
+		}
+	}
+	c.conns[pc.Peer.Address()] = pc
+	if pc.Peer.Tracker != "" {
+		c.recordConnectable(pc.Peer.Tracker)
+	}
+	return nil
+}
+
+func (c *TorrentClient) RemoveConn(pc *PeerConn) {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	if c.conns[pc.Peer.Address()] == pc {
+		delete(c.conns, pc.Peer.Address())
+	}
+	c.Picker.RemoveBitfield(pc.BitfieldCopy(), pc.PieceCount)
+	// Free the upload slot
+	go c.UpdateChoking()
+}
+
+// Peers we are currently connected to
+func (c *TorrentClient) Conns() []*PeerConn {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+	conns := make([]*PeerConn, 0, len(c.conns))
+	for _, pc := range c.conns {
+		conns = append(conns, pc)
+	}
+	return conns
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Peer that reads the handshake and sends back the given bytes
+func startReplayPeer(t *testing.T, reply []byte) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := ReadHandshake(conn); err != nil {
+			return
+		}
+		conn.Write(reply)
+		time.Sleep(time.Second)
+	}()
+	return loopbackPeer(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHandshake(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Encryption = EncryptionDisable
+	remoteID := strings.Repeat("r", 20)
+	conn, peerID, err := c.Handshake(context.Background(), startReplayPeer(t, MakeHandshake(c.InfoHash(), remoteID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if peerID != remoteID {
+		t.Fatalf("peer ID %q", peerID)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Encryption = EncryptionDisable
+	c.DialTimeout = 200 * time.Millisecond
+	replies := map[string][]byte{
+		"info hash": MakeHandshake(strings.Repeat("x", 20), strings.Repeat("r", 20)),
+		"protocol":  append([]byte("\x13BitTorrent protocoX"), make([]byte, 48)...),
+		"short":     MakeHandshake(c.InfoHash(), strings.Repeat("r", 20))[:40],
+		"self":      MakeHandshake(c.InfoHash(), c.PeerID),
+		"silent":    nil,
+	}
+	for name, reply := range replies {
+		start := time.Now()
+		if conn, _, err := c.Handshake(context.Background(), startReplayPeer(t, reply)); err == nil {
+			conn.Close()
+			t.Errorf("%s: handshake accepted", name)
+		}
+		if time.Since(start) > 5*c.DialTimeout {
+			t.Errorf("%s: handshake took %v", name, time.Since(start))
+		}
+	}
+}
+
+func TestHandshakeIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer listener.Close()
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Encryption = EncryptionDisable
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ReadHandshake(conn)
+		conn.Write(MakeHandshake(c.InfoHash(), strings.Repeat("r", 20)))
+		time.Sleep(time.Second)
+	}()
+	peer := Peer{IP: net.ParseIP("::1"), Port: listener.Addr().(*net.TCPAddr).Port}
+	conn, _, err := c.Handshake(context.Background(), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestAddPeersMergesTrackers(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID := strings.Repeat("p", 20)
+	compactUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers12:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x01\x00e")
+	dictUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peersld2:ip7:1.2.3.47:peer id20:"+peerID+"4:porti6881eeee")
+	for _, announceUrl := range []string{compactUrl, dictUrl} {
+		response, err := c.GetPeers(context.Background(), announceUrl, "started")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.AddPeers(response.Peers)
+	}
+	peers := map[string]Peer{}
+	for _, peer := range c.Peers() {
+		peers[peer.Address()] = peer
+	}
+	if len(c.Peers()) != 2 || peers["1.2.3.4:6881"].PeerID != peerID {
+		t.Fatal(c.Peers())
+	}
+	// A later source without the peer ID does not drop it
+	c.AddPeers([]Peer{{IP: net.ParseIP("1.2.3.4"), Port: 6881}})
+	for _, peer := range c.Peers() {
+		if peer.Address() == "1.2.3.4:6881" && peer.PeerID != peerID {
+			t.Fatal(peer)
+		}
+	}
+}
+
+func TestRefuseSelfConnection(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	peer := startReplayPeer(t, MakeHandshake(c.InfoHash(), c.PeerID))
+	c.AddPeers([]Peer{peer})
+	if _, err := c.Connect(context.Background(), peer); err != errSelfConnection {
+		t.Fatalf("error %v for our own peer ID", err)
+	}
+	if peers := c.Peers(); len(peers) != 0 {
+		t.Fatal("our own address is still dialed", peers)
+	}
+
+	// Incoming connections from ourselves are refused too
+	startTestListener(t, c)
+	if _, err := c.Connect(context.Background(), loopbackPeer(c.Port)); err == nil {
+		t.Fatal("connected to ourselves")
+	}
+}
+
+func TestRefuseDuplicateConnection(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	first := NewPeerConn(nil, loopbackPeer(6881), strings.Repeat("a", 20), c.PieceCount())
+	if err := c.AddConn(first); err != nil {
+		t.Fatal(err)
+	}
+	for _, pc := range []*PeerConn{
+		// Same address
+		NewPeerConn(nil, loopbackPeer(6881), strings.Repeat("b", 20), c.PieceCount()),
+		// Same peer ID
+		NewPeerConn(nil, loopbackPeer(6882), strings.Repeat("a", 20), c.PieceCount()),
+	} {
+		if err := c.AddConn(pc); err != errDuplicateConnection {
+			t.Fatalf("error %v for a second connection", err)
+		}
+	}
+	c.RemoveConn(first)
+	if err := c.AddConn(NewPeerConn(nil, loopbackPeer(6881), strings.Repeat("b", 20), c.PieceCount())); err != nil {
+		t.Fatal(err)
+	}
+}
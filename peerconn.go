@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keepalives are sent when we did not send anything for this long
+const keepAliveInterval = 2 * time.Minute
+
+// An established connection to a peer, along with the choke and interest
+// state in both directions
+type PeerConn struct {
+	Conn       net.Conn
+	Peer       Peer
+	PeerID     string
+	Reserved   [8]byte
+	PieceCount int
+
+	Bitfield       Bitfield
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+
+	// Set once the peer has sent its extended handshake
+	Extensions *ExtendedHandshake
+	// Set when the peer connected to us: the port of Peer is then its source
+	// port, not the one it listens on
+	Incoming bool
+
+	// Bytes transferred with this peer; counters must be accessed atomically
+	Uploaded   int64
+	Downloaded int64
+	// Rates in bytes per second over the last rechoke interval, guarded by
+	// the client chokingLock
+	downloadRate   float64
+	uploadRate     float64
+	lastDownloaded int64
+	lastUploaded   int64
+
+	// Blocks that we requested and did not receive yet
+	pendingRequests map[BlockRequest]bool
+	// Requests of the peer waiting to be sent by the upload goroutine, which
+	// is started on the first request
+	uploadQueue []BlockRequest
+	uploadReady chan struct{}
+	uploadOnce  sync.Once
+	// Depth of the request pipeline, created on first use
+	pipeline *Pipeline
+	// Fast extension state: allowedFast are the pieces that the peer allows
+	// us to request, servedFast the ones that we allow it to request
+	allowedFast    map[int]bool
+	servedFast     map[int]bool
+	suggested      map[int]bool
+	rejectedPieces map[int]bool
+
+	// Per-peer rate limits, nil when unlimited
+	DownloadLimiter *RateLimiter
+	UploadLimiter   *RateLimiter
+
+	// The connection is dropped when the peer sends nothing for this long,
+	// 0 to wait forever
+	ReadTimeout time.Duration
+	// Time of the last message we sent, in unix nanoseconds; must be
+	// accessed atomically
+	lastSent int64
+
+	client    *TorrentClient
+	closed    chan struct{}
+	closeOnce sync.Once
+	stateLock sync.Mutex
+	writeLock sync.Mutex
+}
+
+// Connections start out choked and not interested on both sides
+func NewPeerConn(conn net.Conn, peer Peer, peerID string, pieceCount int) *PeerConn {
+	return &PeerConn{
+		Conn:        conn,
+		Peer:        peer,
+		PeerID:      peerID,
+		PieceCount:  pieceCount,
+		Bitfield:    NewBitfield(pieceCount),
+		AmChoking:   true,
+		PeerChoking: true,
+		uploadReady: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (c *TorrentClient) Connect(ctx context.Context, peer Peer) (*PeerConn, error) {
+	conn, handshake, err := c.dialPeer(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	return c.newPeerConn(conn, peer, handshake), nil
+}
+
+// Connection that is managed by the client, after the handshakes were
+// exchanged
+func (c *TorrentClient) newPeerConn(conn net.Conn, peer Peer, handshake *HandshakeMessage) *PeerConn {
+	pc := NewPeerConn(conn, peer, handshake.PeerID, c.PieceCount())
+	pc.Reserved = handshake.Reserved
+	pc.DownloadLimiter = NewRateLimiter(c.PeerDownloadRate)
+	pc.UploadLimiter = NewRateLimiter(c.PeerUploadRate)
+	pc.ReadTimeout = c.PeerTimeout
+	pc.client = c
+	return pc
+}
+
+func (pc *PeerConn) SupportsExtensions() bool {
+	return pc.Reserved[reservedExtensionByte]&reservedExtensionMask != 0
+}
+
+func (pc *PeerConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+	})
+	return pc.Conn.Close()
+}
+
+// Closed when the connection is closed
+func (pc *PeerConn) Done() <-chan struct{} {
+	return pc.closed
+}
+
+// Close the connection when the context is cancelled. Unlike WatchContext,
+// this also interrupts reads that set their own deadline. The returned
+// function must be called to release the watcher.
+func (pc *PeerConn) WatchContext(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// A nil message is a keepalive
+func (pc *PeerConn) SendMessage(msg *Message) error {
+	pc.writeLock.Lock()
+	defer pc.writeLock.Unlock()
+	atomic.StoreInt64(&pc.lastSent, time.Now().UnixNano())
+	_, err := pc.Conn.Write(msg.Serialize())
+	return err
+}
+
+// Send keepalives so that the peer does not drop idle connections
+func (pc *PeerConn) KeepAliveLoop(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pc.Done():
+			return
+		case <-ticker.C:
+		}
+		lastSent := time.Unix(0, atomic.LoadInt64(&pc.lastSent))
+		if time.Since(lastSent) >= keepAliveInterval {
+			if err := pc.SendMessage(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (pc *PeerConn) SendChoke() error {
+	pc.stateLock.Lock()
+	pc.AmChoking = true
+	pc.stateLock.Unlock()
+	return pc.SendMessage(&Message{ID: MsgChoke})
+}
+
+func (pc *PeerConn) SendUnchoke() error {
+	pc.stateLock.Lock()
+	pc.AmChoking = false
+	pc.stateLock.Unlock()
+	return pc.SendMessage(&Message{ID: MsgUnchoke})
+}
+
+func (pc *PeerConn) SendInterested() error {
+	pc.stateLock.Lock()
+	pc.AmInterested = true
+	pc.stateLock.Unlock()
+	return pc.SendMessage(&Message{ID: MsgInterested})
+}
+
+func (pc *PeerConn) SendNotInterested() error {
+	pc.stateLock.Lock()
+	pc.AmInterested = false
+	pc.stateLock.Unlock()
+	return pc.SendMessage(&Message{ID: MsgNotInterested})
+}
+
+func (pc *PeerConn) SendHave(index int) error {
+	return pc.SendMessage(MakeHaveMessage(index))
+}
+
+func (pc *PeerConn) HasPiece(index int) bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.Bitfield.Has(index)
+}
+
+// Replace the pieces of the peer. Must be called with stateLock held.
+func (pc *PeerConn) setBitfield(bitfield Bitfield) {
+	if pc.client != nil {
+		pc.client.Picker.RemoveBitfield(pc.Bitfield, pc.PieceCount)
+		pc.client.Picker.AddBitfield(bitfield, pc.PieceCount)
+	}
+	copy(pc.Bitfield, bitfield)
+}
+
+func (pc *PeerConn) BitfieldCopy() Bitfield {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return append(Bitfield(nil), pc.Bitfield...)
+}
+
+// Only used by the goroutine that downloads from the peer
+func (pc *PeerConn) Pipeline() *Pipeline {
+	if pc.pipeline == nil {
+		pc.pipeline = NewPipeline()
+	}
+	return pc.pipeline
+}
+
+func (pc *PeerConn) addPendingRequest(request BlockRequest) {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	if pc.pendingRequests == nil {
+		pc.pendingRequests = map[BlockRequest]bool{}
+	}
+	pc.pendingRequests[request] = true
+}
+
+func (pc *PeerConn) removePendingRequest(request BlockRequest) {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	delete(pc.pendingRequests, request)
+}
+
+func (pc *PeerConn) clearPendingRequests() {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	pc.pendingRequests = nil
+}
+
+// Cancel the pending requests for blocks of the piece
+func (pc *PeerConn) CancelPiece(index int) {
+	pc.stateLock.Lock()
+	var cancelled []BlockRequest
+	for request := range pc.pendingRequests {
+		if request.Index == index {
+			cancelled = append(cancelled, request)
+			delete(pc.pendingRequests, request)
+		}
+	}
+	pc.stateLock.Unlock()
+	for _, request := range cancelled {
+		pc.SendMessage(MakeCancelMessage(request.Index, request.Begin, request.Length))
+	}
+}
+
+func (pc *PeerConn) IsInterested() bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.AmInterested
+}
+
+func (pc *PeerConn) IsPeerInterested() bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.PeerInterested
+}
+
+func (pc *PeerConn) IsChoking() bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.AmChoking
+}
+
+func (pc *PeerConn) IsChoked() bool {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	return pc.PeerChoking
+}
+
+// Read the next message from the peer and update the connection state
+// accordingly. Keep-alives are returned as nil messages.
+func (pc *PeerConn) ReadMessage() (*Message, error) {
+	if pc.ReadTimeout > 0 {
+		pc.Conn.SetReadDeadline(time.Now().Add(pc.ReadTimeout))
+	}
+	msg, err := ReadMessage(pc.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := pc.HandleMessage(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (pc *PeerConn) HandleMessage(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+	if err := pc.updateState(msg); err != nil {
+		return err
+	}
+	switch msg.ID {
+	case MsgExtended:
+		return pc.handleExtendedMessage(msg)
+	case MsgRequest:
+		if pc.client != nil {
+			return pc.client.HandleRequest(pc, msg)
+		}
+	case MsgCancel:
+		index, begin, length, err := ParseRequestMessage(msg)
+		if err != nil {
+			return err
+		}
+		pc.cancelUpload(BlockRequest{index, begin, length})
+	case MsgInterested, MsgNotInterested:
+		if pc.client != nil {
+			pc.client.UpdateChoking()
+		}
+	}
+	return nil
+}
+
+func (pc *PeerConn) updateState(msg *Message) error {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	switch msg.ID {
+	case MsgChoke:
+		pc.PeerChoking = true
+	case MsgUnchoke:
+		pc.PeerChoking = false
+		// Pieces rejected before were possibly rejected for being choked
+		pc.rejectedPieces = nil
+	case MsgInterested:
+		pc.PeerInterested = true
+	case MsgNotInterested:
+		pc.PeerInterested = false
+	case MsgHave:
+		if pc.PieceCount == 0 {
+			// Metadata is not known yet
+			return nil
+		}
+		index, err := ParseHaveMessage(msg)
+		if err != nil {
+			return err
+		}
+		if index >= pc.PieceCount {
+			return fmt.Errorf("have message: piece index %d out of range", index)
+		}
+		if !pc.Bitfield.Has(index) && pc.client != nil {
+			pc.client.Picker.AddPiece(index)
+		}
+		pc.Bitfield.Set(index)
+	case MsgBitfield:
+		if pc.PieceCount == 0 {
+			return nil
+		}
+		if err := Bitfield(msg.Payload).Validate(pc.PieceCount); err != nil {
+			return err
+		}
+		pc.setBitfield(Bitfield(msg.Payload))
+	case MsgHaveAll, MsgHaveNone:
+		if !pc.SupportsFast() {
+			return errors.New("fast extension message from a peer that does not support it")
+		}
+		if pc.PieceCount == 0 {
+			return nil
+		}
+		bitfield := NewBitfield(pc.PieceCount)
+		if msg.ID == MsgHaveAll {
+			for index := 0; index < pc.PieceCount; index++ {
+				bitfield.Set(index)
+			}
+		}
+		pc.setBitfield(bitfield)
+	case MsgSuggestPiece, MsgAllowedFast:
+		if !pc.SupportsFast() {
+			return errors.New("fast extension message from a peer that does not support it")
+		}
+		if pc.PieceCount == 0 {
+			return nil
+		}
+		index, err := ParsePieceIndexMessage(msg)
+		if err != nil {
+			return err
+		}
+		if index >= pc.PieceCount {
+			// Allowed fast sets may be computed for a larger piece count:
+			// ignore
+			return nil
+		}
+		if msg.ID == MsgAllowedFast {
+			if pc.allowedFast == nil {
+				pc.allowedFast = map[int]bool{}
+			}
+			pc.allowedFast[index] = true
+		} else {
+			if pc.suggested == nil {
+				pc.suggested = map[int]bool{}
+			}
+			pc.suggested[index] = true
+		}
+	}
+	return nil
+}
+
+func (pc *PeerConn) handleExtendedMessage(msg *Message) error {
+	if !pc.SupportsExtensions() {
+		return errors.New("extended message from a peer that does not support extensions")
+	}
+	extensionID, dict, data, err := ParseExtendedMessage(msg)
+	if err != nil {
+		return err
+	}
+	if extensionID == extendedHandshakeID {
+		handshake := ParseExtendedHandshake(dict)
+		pc.stateLock.Lock()
+		pc.Extensions = handshake
+		pc.stateLock.Unlock()
+		if pc.client != nil {
+			if pc.Peer.IP.To4() != nil {
+				pc.client.SetAltIP(pc.Peer, handshake.IPv6)
+			} else {
+				pc.client.SetAltIP(pc.Peer, handshake.IPv4)
+			}
+		}
+		return nil
+	}
+	if pc.client == nil {
+		return nil
+	}
+	if extension := pc.client.Extensions.Lookup(pc.client, extensionID); extension != nil && extension.Handle != nil {
+		return extension.Handle(pc, dict, data)
+	}
+	return nil
+}
+
+// Address that other peers may connect to: incoming peers are only reachable
+// on the listen port of their extended handshake. Returns false when it is
+// unknown.
+func (pc *PeerConn) ListenPeer() (Peer, bool) {
+	if !pc.Incoming {
+		return pc.Peer, true
+	}
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	if pc.Extensions == nil || pc.Extensions.Port <= 0 || pc.Extensions.Port > 65535 {
+		return Peer{}, false
+	}
+	peer := pc.Peer
+	peer.Port = pc.Extensions.Port
+	return peer, true
+}
+
+// Extension message ID advertised by the peer, or 0 when unsupported
+func (pc *PeerConn) ExtensionID(name string) int {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	if pc.Extensions == nil {
+		return 0
+	}
+	return pc.Extensions.M[name]
+}
+
+// Process incoming messages until the connection fails or the context is
+// cancelled
+func (pc *PeerConn) ReadLoop(ctx context.Context) error {
+	defer pc.WatchContext(ctx)()
+	for {
+		if _, err := pc.ReadMessage(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection whose messages are read from the raw bytes
+func newReplayConn(t *testing.T, pieceCount int, raw []byte) *PeerConn {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close() })
+	go func() {
+		remote.Write(raw)
+		remote.Close()
+	}()
+	return NewPeerConn(local, loopbackPeer(6881), "", pieceCount)
+}
+
+func TestReadStateMessages(t *testing.T) {
+	raw := []byte{
+		0, 0, 0, 3, MsgBitfield, 0x81, 0x00,
+		0, 0, 0, 5, MsgHave, 0, 0, 0, 9,
+		0, 0, 0, 0,
+		0, 0, 0, 1, MsgUnchoke,
+		0, 0, 0, 1, MsgInterested,
+	}
+	pc := newReplayConn(t, 10, raw)
+	for {
+		if _, err := pc.ReadMessage(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := 0; index < 10; index++ {
+		if pc.HasPiece(index) != (index == 0 || index == 7 || index == 9) {
+			t.Fatalf("piece %d: %v", index, pc.HasPiece(index))
+		}
+	}
+	if pc.IsChoked() || !pc.IsPeerInterested() || !pc.IsChoking() || pc.IsInterested() {
+		t.Fatal("unexpected choking state")
+	}
+}
+
+func TestRejectInvalidStateMessages(t *testing.T) {
+	invalid := map[string][]byte{
+		"short bitfield": {0, 0, 0, 2, MsgBitfield, 0xff},
+		"long bitfield":  {0, 0, 0, 4, MsgBitfield, 0xff, 0xc0, 0},
+		"spare bits":     {0, 0, 0, 3, MsgBitfield, 0xff, 0xe0},
+		"have range":     {0, 0, 0, 5, MsgHave, 0, 0, 0, 10},
+		"have length":    {0, 0, 0, 3, MsgHave, 0, 1},
+	}
+	for name, raw := range invalid {
+		pc := newReplayConn(t, 10, raw)
+		if _, err := pc.ReadMessage(); err == nil || err == io.EOF {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestSendStateMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	pc := NewPeerConn(local, loopbackPeer(6881), "", 10)
+	received := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 10)
+		io.ReadFull(remote, data)
+		received <- data
+		remote.Close()
+	}()
+	if err := pc.SendInterested(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SendUnchoke(); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; !bytes.Equal(data, []byte{0, 0, 0, 1, MsgInterested, 0, 0, 0, 1, MsgUnchoke}) {
+		t.Fatalf("%x", data)
+	}
+	if !pc.IsInterested() || pc.IsChoking() {
+		t.Fatal("state not updated")
+	}
+}
+
+// A peer that unchokes us and then stays silent is dropped after the timeout,
+// and its pieces are downloaded from another peer
+func TestSilentPeerTimesOut(t *testing.T) {
+	info, data := makeTestInfo(16384, 40000)
+	c := newTestClient(t, info)
+	c.PeerTimeout = 300 * time.Millisecond
+	requested := make(chan struct{}, 1)
+	disconnected := make(chan time.Time, 1)
+	silent := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+		bitfield := NewBitfield(c.PieceCount())
+		for index := 0; index < c.PieceCount(); index++ {
+			bitfield.Set(index)
+		}
+		conn.Write((&Message{ID: MsgBitfield, Payload: bitfield}).Serialize())
+		conn.Write((&Message{ID: MsgUnchoke}).Serialize())
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				disconnected <- time.Now()
+				return
+			}
+			if msg != nil && msg.ID == MsgRequest {
+				select {
+				case requested <- struct{}{}:
+				default:
+				}
+			}
+		}
+	})
+	c.AddPeers([]Peer{silent})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request to the silent peer")
+	}
+	start := time.Now()
+	select {
+	case at := <-disconnected:
+		if elapsed := at.Sub(start); elapsed > 5*time.Second {
+			t.Fatalf("disconnected after %v", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer is still connected")
+	}
+
+	seeder := startTestSeeder(t, info, data)
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+}
+
+// A peer whose bitfield does not match the piece count is disconnected, and
+// the reason is logged
+func TestDropPeerWithInvalidBitfield(t *testing.T) {
+	info, _ := makeTestInfo(16384, 10*16384-100)
+	invalid := map[string][]byte{
+		"bitfield of 3 bytes instead of 2": {0xff, 0xc0, 0},
+		"bitfield with spare bits set":     {0xff, 0xe0},
+	}
+	for reason, bitfield := range invalid {
+		c := newTestClient(t, info)
+		logger := &captureLogger{}
+		c.Log = logger
+		closed := make(chan struct{})
+		peer := startFakePeer(t, c.InfoHash(), func(conn net.Conn) {
+			conn.Write((&Message{ID: MsgBitfield, Payload: bitfield}).Serialize())
+			io.Copy(io.Discard, conn)
+			close(closed)
+		})
+		c.AddPeers([]Peer{peer})
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.ConnectLoop(ctx)
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal(reason, "peer not dropped")
+		}
+		waitFor(t, 5*time.Second, func() bool { return logger.Contains("DEBUG", reason) })
+		cancel()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Peer exchange
+// http://www.bittorrent.org/beps/bep_0011.html
+
+const (
+	// Peers should not send more than one PEX message per minute
+	pexInterval = time.Minute
+	// Peers added or dropped by a single message, over both address families.
+	// Extra peers of incoming messages are ignored.
+	maxPexPeers = 50
+)
+
+// Return the peers that were added and dropped since the peer's last message,
+// IPv4 peers first
+func ParsePexMessage(dict map[string]interface{}) ([]Peer, []Peer) {
+	added, _ := dict["added"].(string)
+	added6, _ := dict["added6"].(string)
+	dropped, _ := dict["dropped"].(string)
+	dropped6, _ := dict["dropped6"].(string)
+	return limitPexPeers(append(DecodePeers(added), DecodePeers6(added6)...)),
+		limitPexPeers(append(DecodePeers(dropped), DecodePeers6(dropped6)...))
+}
+
+func limitPexPeers(peers []Peer) []Peer {
+	if len(peers) > maxPexPeers {
+		return peers[:maxPexPeers]
+	}
+	return peers
+}
+
+func handlePexMessage(pc *PeerConn, dict map[string]interface{}, data []byte) error {
+	added, dropped := ParsePexMessage(dict)
+	pc.client.AddPeers(added)
+	pc.client.RemovePeers(dropped)
+	return nil
+}
+
+func MakePexMessage(extensionID int, added []Peer, dropped []Peer) (*Message, error) {
+	added4, added6 := EncodePeers(added), EncodePeers6(added)
+	return MakeExtendedMessage(byte(extensionID), map[string]interface{}{
+		"added":    added4,
+		"added.f":  string(make([]byte, len(added4)/6)),
+		"added6":   added6,
+		"added6.f": string(make([]byte, len(added6)/18)),
+		"dropped":  EncodePeers(dropped),
+		"dropped6": EncodePeers6(dropped),
+	}, nil)
+}
+
+// Periodically tell the peer about the peers we connected to or disconnected
+// from since the last message
+func (c *TorrentClient) PexLoop(ctx context.Context, pc *PeerConn) {
+	sent := map[string]Peer{}
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pc.Done():
+			return
+		case <-ticker.C:
+		}
+		extensionID := pc.ExtensionID("ut_pex")
+		if extensionID == 0 {
+			continue
+		}
+
+		current := c.PexPeers(pc)
+		var added, dropped []Peer
+		for address, peer := range current {
+			if _, wasSent := sent[address]; !wasSent {
+				added = append(added, peer)
+			}
+		}
+		for address, peer := range sent {
+			if _, isCurrent := current[address]; !isCurrent {
+				dropped = append(dropped, peer)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+		// The peers left out are sent with the next messages
+		added, dropped = limitPexPeers(added), limitPexPeers(dropped)
+		msg, err := MakePexMessage(extensionID, added, dropped)
+		if err != nil {
+			continue
+		}
+		if err := pc.SendMessage(msg); err != nil {
+			return
+		}
+		for _, peer := range added {
+			sent[peer.Address()] = peer
+		}
+		for _, peer := range dropped {
+			delete(sent, peer.Address())
+		}
+	}
+}
+
+// Peers that we are connected to, except the given one, by address. Incoming
+// peers that did not tell their listen port are left out.
+func (c *TorrentClient) PexPeers(pc *PeerConn) map[string]Peer {
+	peers := map[string]Peer{}
+	for _, conn := range c.Conns() {
+		if conn == pc {
+			continue
+		}
+		if peer, ok := conn.ListenPeer(); ok {
+			peers[peer.Address()] = peer
+		}
+	}
+	return peers
+}
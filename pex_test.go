@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	added := []Peer{
+		{IP: net.ParseIP("1.2.3.4"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+	}
+	dropped := []Peer{{IP: net.ParseIP("2001:db8::2"), Port: 6883}}
+	msg, err := MakePexMessage(1, added, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dict, _, err := ParseExtendedMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := dict["added6.f"].(string); len(flags) != 1 {
+		t.Fatalf("added6.f: %q", flags)
+	}
+	parsedAdded, parsedDropped := ParsePexMessage(dict)
+	if len(parsedAdded) != 2 || parsedAdded[0].Address() != added[0].Address() || parsedAdded[1].Address() != added[1].Address() {
+		t.Fatal(parsedAdded)
+	}
+	if len(parsedDropped) != 1 || parsedDropped[0].Address() != dropped[0].Address() {
+		t.Fatal(parsedDropped)
+	}
+}
+
+func TestPexMessagePeerLimit(t *testing.T) {
+	var peers []Peer
+	for i := 0; i < 3*maxPexPeers; i++ {
+		peers = append(peers, Peer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 6881})
+	}
+	dict := map[string]interface{}{"added": EncodePeers(peers), "added6": EncodePeers6([]Peer{{IP: net.ParseIP("::1"), Port: 1}})}
+	added, _ := ParsePexMessage(dict)
+	if len(added) != maxPexPeers {
+		t.Fatalf("%d peers accepted", len(added))
+	}
+}
+
+func TestHandlePexMessage(t *testing.T) {
+	c := newTestClient(t, nil)
+	c.AddPeers([]Peer{loopbackPeer(1), loopbackPeer(2)})
+	// Sample ut_pex payload: 1.2.3.4:6881 added, 127.0.0.1:1 dropped
+	_, dict, _, err := ParseExtendedMessage(&Message{
+		ID:      MsgExtended,
+		Payload: []byte("\x01d5:added6:\x01\x02\x03\x04\x1a\xe17:added.f1:\x007:dropped6:\x7f\x00\x00\x01\x00\x01e"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handlePexMessage(&PeerConn{client: c}, dict, nil); err != nil {
+		t.Fatal(err)
+	}
+	addresses := map[string]bool{}
+	for _, peer := range c.Peers() {
+		addresses[peer.Address()] = true
+	}
+	if len(addresses) != 2 || !addresses["1.2.3.4:6881"] || !addresses["127.0.0.1:2"] {
+		t.Fatal(addresses)
+	}
+}
+
+// Incoming peers are advertised with their listen port, not their source port
+func TestPexPeersListenPorts(t *testing.T) {
+	c := newTestClient(t, nil)
+	outgoing := NewPeerConn(nil, loopbackPeer(6881), strings.Repeat("a", 20), 0)
+	incoming := NewPeerConn(nil, loopbackPeer(50001), strings.Repeat("b", 20), 0)
+	incoming.Incoming = true
+	incoming.Extensions = &ExtendedHandshake{Port: 6882}
+	unknown := NewPeerConn(nil, loopbackPeer(50002), strings.Repeat("c", 20), 0)
+	unknown.Incoming = true
+	unknown.Extensions = &ExtendedHandshake{}
+	for _, pc := range []*PeerConn{outgoing, incoming, unknown} {
+		if err := c.AddConn(pc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peers := c.PexPeers(outgoing)
+	if len(peers) != 1 || peers["127.0.0.1:6882"].Port != 6882 {
+		t.Fatal(peers)
+	}
+	if peers := c.PexPeers(unknown); len(peers) != 2 || peers["127.0.0.1:6881"].Port != 6881 {
+		t.Fatal(peers)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+)
+
+// Rarest first piece selection: the availability of each piece is counted
+// over the bitfields of the connected peers, and the pieces that the fewest
+// peers have are downloaded first.
+type PiecePicker struct {
+	availability []int
+	// Reports whether the piece still needs to be downloaded
+	needed func(index int) bool
+	lock   sync.Mutex
+}
+
+func NewPiecePicker(needed func(index int) bool) *PiecePicker {
+	return &PiecePicker{needed: needed}
+}
+
+func (p *PiecePicker) add(index int, delta int) {
+	for index >= len(p.availability) {
+		p.availability = append(p.availability, 0)
+	}
+	p.availability[index] += delta
+}
+
+func (p *PiecePicker) AddPiece(index int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(index, 1)
+}
+
+func (p *PiecePicker) AddBitfield(bitfield Bitfield, pieceCount int) {
+	p.updateBitfield(bitfield, pieceCount, 1)
+}
+
+// Forget the pieces of a peer that disconnected
+func (p *PiecePicker) RemoveBitfield(bitfield Bitfield, pieceCount int) {
+	p.updateBitfield(bitfield, pieceCount, -1)
+}
+
+func (p *PiecePicker) updateBitfield(bitfield Bitfield, pieceCount int, delta int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for index := 0; index < pieceCount; index++ {
+		if bitfield.Has(index) {
+			p.add(index, delta)
+		}
+	}
+}
+
+// Number of connected peers that have the piece
+func (p *PiecePicker) Availability(index int) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if index < 0 || index >= len(p.availability) {
+		return 0
+	}
+	return p.availability[index]
+}
+
+// Pick the rarest piece that the peer has and that we still need, breaking
+// ties at random
+func (p *PiecePicker) Next(peer *PeerConn) (int, bool) {
+	return p.NextIn(peer.RequestablePieces(), peer.PieceCount)
+}
+
+// Pick the rarest piece of the bitfield that we still need
+func (p *PiecePicker) NextIn(bitfield Bitfield, pieceCount int) (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	best, bestAvailability, ties := -1, 0, 0
+	for index := 0; index < pieceCount; index++ {
+		if !bitfield.Has(index) || !p.needed(index) {
+			continue
+		}
+		availability := 0
+		if index < len(p.availability) {
+			availability = p.availability[index]
+		}
+		if best < 0 || availability < bestAvailability {
+			best, bestAvailability, ties = index, availability, 1
+		} else if availability == bestAvailability {
+			// Reservoir sampling gives an equal chance to all ties
+			ties++
+			if random.Intn(ties) == 0 {
+				best = index
+			}
+		}
+	}
+	return best, best >= 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+// Bitfield of the pieces
+func makeBitfield(pieceCount int, indexes ...int) Bitfield {
+	bitfield := NewBitfield(pieceCount)
+	for _, index := range indexes {
+		bitfield.Set(index)
+	}
+	return bitfield
+}
+
+func TestPickRarestPiece(t *testing.T) {
+	have := map[int]bool{3: true}
+	picker := NewPiecePicker(func(index int) bool { return !have[index] })
+	picker.AddBitfield(makeBitfield(6, 0, 1, 2, 3, 4, 5), 6)
+	picker.AddBitfield(makeBitfield(6, 0, 1, 3, 4), 6)
+	picker.AddBitfield(makeBitfield(6, 0, 3), 6)
+	picker.AddPiece(5)
+	// Availability: 3 2 1 3 2 2
+	peer := makeBitfield(6, 0, 1, 2, 3, 4, 5)
+	if index, ok := picker.NextIn(peer, 6); !ok || index != 2 {
+		t.Fatal(index, ok)
+	}
+	// Piece 3 is the rarest of the peer, but we have it
+	if index, ok := picker.NextIn(makeBitfield(6, 0, 3), 6); !ok || index != 0 {
+		t.Fatal(index, ok)
+	}
+	if _, ok := picker.NextIn(makeBitfield(6, 3), 6); ok {
+		t.Fatal("picked a piece we have")
+	}
+
+	// Ties between 1, 4 and 5 are broken at random
+	have[2] = true
+	picked := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		index, _ := picker.NextIn(peer, 6)
+		picked[index] = true
+	}
+	if len(picked) != 3 || !picked[1] || !picked[4] || !picked[5] {
+		t.Fatal(picked)
+	}
+
+	picker.RemoveBitfield(makeBitfield(6, 0, 1, 3, 4), 6)
+	if picker.Availability(1) != 1 || picker.Availability(4) != 1 || picker.Availability(5) != 2 {
+		t.Fatal(picker.Availability(1), picker.Availability(4), picker.Availability(5))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+)
+
+func (c *TorrentClient) PieceLength() int64 {
+	pieceLength, _ := c.BdecodedInfo()["piece length"].(int64)
+	return pieceLength
+}
+
+// Number of pieces expected from the total length and the piece length
+func (c *TorrentClient) PieceCount() int {
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	return c.pieceCount
+}
+
+// Size of a given piece: all pieces have the nominal piece length, except for
+// the last one which may be shorter.
+func (c *TorrentClient) PieceSize(index int) int64 {
+	pieceLength := c.PieceLength()
+	c.infoLock.RLock()
+	defer c.infoLock.RUnlock()
+	if index == c.pieceCount-1 {
+		if lastPieceLength := c.totalLength % pieceLength; lastPieceLength != 0 {
+			return lastPieceLength
+		}
+	}
+	return pieceLength
+}
+
+// Offset of the piece in the concatenation of all files
+func (c *TorrentClient) PieceOffset(index int) int64 {
+	return int64(index) * c.PieceLength()
+}
+
+// The returned slice must not be modified
+func (c *TorrentClient) PieceHashes() ([][20]byte, error) {
+	c.infoLock.RLock()
+	hashes := c.pieceHashes
+	c.infoLock.RUnlock()
+	if hashes != nil {
+		return hashes, nil
+	}
+	hashes, err := c.parsePieceHashes()
+	if err != nil {
+		return nil, err
+	}
+	c.infoLock.Lock()
+	c.pieceHashes = hashes
+	c.infoLock.Unlock()
+	return hashes, nil
+}
+
+func (c *TorrentClient) parsePieceHashes() ([][20]byte, error) {
+	pieces, isString := c.BdecodedInfo()["pieces"].(string)
+	if !isString {
+		return nil, errors.New("pieces: missing or invalid")
+	}
+	if len(pieces)%20 != 0 {
+		return nil, fmt.Errorf("pieces: length %d is not a multiple of 20", len(pieces))
+	}
+	if pieceCount := c.PieceCount(); len(pieces)/20 != pieceCount {
+		return nil, fmt.Errorf("pieces: got %d hashes, expected %d", len(pieces)/20, pieceCount)
+	}
+	hashes := make([][20]byte, len(pieces)/20)
+	for i := range hashes {
+		copy(hashes[i][:], pieces[20*i:20*(i+1)])
+	}
+	return hashes, nil
+}
+
+func (c *TorrentClient) VerifyPiece(index int, data []byte) bool {
+	hashes, err := c.PieceHashes()
+	if err != nil || index < 0 || index >= len(hashes) {
+		return false
+	}
+	return sha1.Sum(data) == hashes[index]
+}
+
+func (c *TorrentClient) HasPiece(index int) bool {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	return index >= 0 && index < len(c.HavePieces) && c.HavePieces[index]
+}
+
+// Record that a piece was downloaded and verified
+func (c *TorrentClient) SetHasPiece(index int) {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	if len(c.HavePieces) != c.PieceCount() {
+		c.HavePieces = make([]bool, c.PieceCount())
+		c.leftValid = false
+	}
+	if c.leftValid && !c.HavePieces[index] && c.pieceWanted(index) {
+		c.left -= c.PieceSize(index)
+	}
+	c.HavePieces[index] = true
+}
+
+// Number of bytes of the wanted pieces that remain to be downloaded and
+// verified
+func (c *TorrentClient) Left() int64 {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	if !c.leftValid {
+		c.left = 0
+		for index := 0; index < c.PieceCount(); index++ {
+			if !c.hasPiece(index) && c.pieceWanted(index) {
+				c.left += c.PieceSize(index)
+			}
+		}
+		c.leftValid = true
+	}
+	return c.left
+}
+
+// Recompute Left on its next call, after the pieces or the wanted pieces were
+// replaced
+func (c *TorrentClient) invalidateLeft() {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	c.leftValid = false
+}
+
+// Number of pieces that we have
+func (c *TorrentClient) HaveCount() int {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	count := 0
+	for _, have := range c.HavePieces {
+		if have {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestVerifyPiece(t *testing.T) {
+	info, data := makeTestInfo(16384, 40000)
+	c := newTestClient(t, info)
+	if !c.VerifyPiece(0, data[:16384]) || !c.VerifyPiece(2, data[32768:]) {
+		t.Fatal("valid piece rejected")
+	}
+	if c.VerifyPiece(1, data[:16384]) || c.VerifyPiece(3, data[:16384]) || c.VerifyPiece(-1, nil) {
+		t.Fatal("invalid piece accepted")
+	}
+}
+
+func TestPieceHashesParsedOnce(t *testing.T) {
+	info, data := makeTestInfo(16384, 40000)
+	c := newTestClient(t, info)
+	first, err := c.PieceHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := c.PieceHashes()
+	if &first[0] != &second[0] {
+		t.Fatal("piece hashes parsed again")
+	}
+
+	otherInfo, otherData := makeTestInfo(16384, 50000)
+	c.SetInfo(otherInfo, nil)
+	if hashes, _ := c.PieceHashes(); len(hashes) != 4 {
+		t.Fatalf("%d hashes after SetInfo", len(hashes))
+	}
+	if c.VerifyPiece(0, data[:16384]) || !c.VerifyPiece(0, otherData[:16384]) {
+		t.Fatal("stale piece hashes")
+	}
+}
+
+func TestMalformedPieceHashes(t *testing.T) {
+	for _, pieces := range []interface{}{nil, int64(1), "0123456789012345678", "0123456789012345678901234567890123456789", "012345678901234567890123456789012345678901234567890123456789012345678901234567890123456789"} {
+		info, _ := makeTestInfo(16384, 40000)
+		if pieces == nil {
+			delete(info, "pieces")
+		} else {
+			info["pieces"] = pieces
+		}
+		c := newTestClient(t, info)
+		if _, err := c.PieceHashes(); err == nil {
+			t.Errorf("pieces %q accepted", pieces)
+		}
+	}
+}
+
+func TestPieceCountSetWithInfo(t *testing.T) {
+	c := newTestClient(t, nil)
+	if c.TotalLength() != 0 || c.PieceCount() != 0 || c.Left() != 0 {
+		t.Fatal(c.TotalLength(), c.PieceCount(), c.Left())
+	}
+	info, _ := makeTestInfo(16384, 10000, 0, 30000)
+	c.SetInfo(info, nil)
+	if c.TotalLength() != 40000 || c.PieceCount() != 3 || c.PieceSize(1) != 16384 || c.PieceSize(2) != 40000-2*16384 {
+		t.Fatal(c.TotalLength(), c.PieceCount(), c.PieceSize(1), c.PieceSize(2))
+	}
+	otherInfo, _ := makeTestInfo(16384, 16384)
+	c.SetInfo(otherInfo, nil)
+	if c.TotalLength() != 16384 || c.PieceCount() != 1 || c.PieceSize(0) != 16384 {
+		t.Fatal(c.TotalLength(), c.PieceCount(), c.PieceSize(0))
+	}
+}
+
+func TestLeftFollowsPiecesAndSelection(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000, 20000, 20000)
+	c := newTestClient(t, info)
+	if c.Left() != 60000 {
+		t.Fatal(c.Left())
+	}
+	c.SetHasPiece(1)
+	c.SetHasPiece(1)
+	if c.Left() != 60000-16384 {
+		t.Fatal(c.Left())
+	}
+	// Pieces 1 and 2 overlap file1
+	if err := c.SelectFiles([]string{"file1"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Left() != 16384 {
+		t.Fatal(c.Left())
+	}
+	c.SetHasPiece(3)
+	c.SetHasPiece(2)
+	if c.Left() != 0 {
+		t.Fatal(c.Left())
+	}
+}
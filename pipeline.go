@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Bounds of the number of block requests sent ahead to a peer
+	pipelineMinDepth     = 2
+	pipelineInitialDepth = 5
+	pipelineMaxDepth     = 128
+	// Requests queued at the peer should keep it busy for this long on top of
+	// the round trip, to absorb disk and scheduling delays on its side
+	pipelineQueueTime = time.Second
+	// Throughput is sampled over at least this interval
+	pipelineSampleInterval = 500 * time.Millisecond
+	// Weight of a new throughput sample in the moving average
+	pipelineRateWeight = 0.25
+)
+
+// Block requests in flight to a peer. The depth of the pipeline follows the
+// bandwidth-delay product of the peer: its throughput times the smallest
+// round-trip time, which is not inflated by the queue of requests, plus some
+// queue time. A pipeline is only used by the goroutine that downloads from
+// the peer.
+type Pipeline struct {
+	depth    int
+	inFlight map[BlockRequest]time.Time
+	// Smallest round-trip time measured so far
+	minRTT time.Duration
+	// Moving average of the throughput, in bytes per second
+	rate        float64
+	sampleBytes int
+	sampleStart time.Time
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{
+		depth:    pipelineInitialDepth,
+		inFlight: map[BlockRequest]time.Time{},
+	}
+}
+
+// Number of requests that may be in flight
+func (p *Pipeline) Depth() int {
+	return p.depth
+}
+
+func (p *Pipeline) InFlight() int {
+	return len(p.inFlight)
+}
+
+func (p *Pipeline) CanRequest() bool {
+	return len(p.inFlight) < p.depth
+}
+
+// Throughput in bytes per second and smallest round-trip time
+func (p *Pipeline) Measures() (float64, time.Duration) {
+	return p.rate, p.minRTT
+}
+
+func (p *Pipeline) Sent(request BlockRequest, now time.Time) {
+	if len(p.inFlight) == 0 {
+		// The peer was idle: that time does not count in the throughput
+		p.sampleBytes = 0
+		p.sampleStart = now
+	}
+	p.inFlight[request] = now
+}
+
+// Record the block received for the request. Returns false when the request
+// is not in flight, for instance because it was dropped.
+func (p *Pipeline) Received(request BlockRequest, now time.Time) bool {
+	sent, isInFlight := p.inFlight[request]
+	if !isInFlight {
+		return false
+	}
+	delete(p.inFlight, request)
+	if rtt := now.Sub(sent); rtt > 0 && (p.minRTT == 0 || rtt < p.minRTT) {
+		p.minRTT = rtt
+	}
+	p.sampleBytes += request.Length
+	if elapsed := now.Sub(p.sampleStart); elapsed >= pipelineSampleInterval {
+		sample := float64(p.sampleBytes) / elapsed.Seconds()
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate += pipelineRateWeight * (sample - p.rate)
+		}
+		p.sampleBytes = 0
+		p.sampleStart = now
+		p.resize()
+	}
+	return true
+}
+
+func (p *Pipeline) resize() {
+	bytes := p.rate * (p.minRTT + pipelineQueueTime).Seconds()
+	depth := int(math.Ceil(bytes / BlockSize))
+	if depth < pipelineMinDepth {
+		depth = pipelineMinDepth
+	} else if depth > pipelineMaxDepth {
+		depth = pipelineMaxDepth
+	}
+	p.depth = depth
+}
+
+// Forget a request that will not be answered
+func (p *Pipeline) Drop(request BlockRequest) {
+	delete(p.inFlight, request)
+}
+
+// Forget all the requests in flight, keeping the measures
+func (p *Pipeline) DropAll() {
+	p.inFlight = map[BlockRequest]time.Time{}
+}
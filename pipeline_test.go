@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Keep the pipeline full for the duration, with a peer that answers each
+// request after the round-trip time and sends a block every blockInterval
+func simulatePeer(p *Pipeline, rtt time.Duration, blockInterval time.Duration, duration time.Duration) {
+	type sentRequest struct {
+		request BlockRequest
+		sent    time.Time
+	}
+	now := time.Unix(0, 0)
+	end := now.Add(duration)
+	var queue []sentRequest
+	next := 0
+	lastArrival := now
+	for now.Before(end) {
+		for p.CanRequest() {
+			request := BlockRequest{next / 16, next % 16 * BlockSize, BlockSize}
+			next++
+			p.Sent(request, now)
+			queue = append(queue, sentRequest{request, now})
+		}
+		arrival := queue[0].sent.Add(rtt)
+		if lastArrival.Add(blockInterval).After(arrival) {
+			arrival = lastArrival.Add(blockInterval)
+		}
+		lastArrival, now = arrival, arrival
+		p.Received(queue[0].request, now)
+		queue = queue[1:]
+	}
+}
+
+func TestPipelineDepthFollowsPeerSpeed(t *testing.T) {
+	fast, slow := NewPipeline(), NewPipeline()
+	// 8 MB/s with a 20ms round trip, and 16 KiB/s with a 500ms round trip
+	simulatePeer(fast, 20*time.Millisecond, 2*time.Millisecond, 10*time.Second)
+	simulatePeer(slow, 500*time.Millisecond, time.Second, 30*time.Second)
+	if fast.Depth() <= pipelineInitialDepth || fast.Depth() > pipelineMaxDepth {
+		t.Fatalf("fast peer depth %d", fast.Depth())
+	}
+	if slow.Depth() != pipelineMinDepth {
+		t.Fatalf("slow peer depth %d", slow.Depth())
+	}
+	if rate, minRTT := fast.Measures(); rate < 4e6 || minRTT != 20*time.Millisecond {
+		t.Fatal(rate, minRTT)
+	}
+}
+
+func TestPipelineDrop(t *testing.T) {
+	p := NewPipeline()
+	now := time.Now()
+	first, second := BlockRequest{0, 0, BlockSize}, BlockRequest{0, BlockSize, BlockSize}
+	p.Sent(first, now)
+	p.Sent(second, now)
+	p.Drop(first)
+	if p.Received(first, now.Add(time.Millisecond)) || p.InFlight() != 1 {
+		t.Fatal("dropped request still in flight")
+	}
+	p.DropAll()
+	if p.Received(second, now.Add(time.Millisecond)) || p.InFlight() != 0 {
+		t.Fatal("requests still in flight")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Piece events are dropped when they follow the previous event too
+	// closely
+	progressPieceInterval = 250 * time.Millisecond
+	// Periodic updates of the transfer counters and connected peers
+	progressUpdateInterval = time.Second
+)
+
+type ProgressEventType int
+
+const (
+	// A piece was downloaded and verified
+	ProgressPiece ProgressEventType = iota
+	// Periodic update
+	ProgressUpdate
+	// All pieces were downloaded and verified: we are now seeding
+	ProgressSeeding
+)
+
+var progressEventNames = map[ProgressEventType]string{
+	ProgressPiece:   "piece",
+	ProgressUpdate:  "update",
+	ProgressSeeding: "seeding",
+}
+
+func (t ProgressEventType) String() string {
+	return progressEventNames[t]
+}
+
+type ProgressEvent struct {
+	Type ProgressEventType `json:"-"`
+	// Index of the completed piece, for ProgressPiece events
+	Piece      int   `json:"-"`
+	Downloaded int64 `json:"downloaded"`
+	Uploaded   int64 `json:"uploaded"`
+	Peers      int   `json:"peers"`
+	// Between 0 and 100
+	Percent float64 `json:"percent"`
+	// Smoothed rates in bytes per second, see RateMeter, and their highest
+	// values
+	DownloadRate     float64 `json:"download_rate"`
+	UploadRate       float64 `json:"upload_rate"`
+	PeakDownloadRate float64 `json:"peak_download_rate"`
+	PeakUploadRate   float64 `json:"peak_upload_rate"`
+	// Bytes transferred since the client was started, while Downloaded and
+	// Uploaded include previous runs
+	SessionDownloaded int64 `json:"session_downloaded"`
+	SessionUploaded   int64 `json:"session_uploaded"`
+}
+
+// Register a callback that receives progress events. It must be set before the
+// client is started and it should not block.
+func (c *TorrentClient) SetProgressHandler(handler func(ProgressEvent)) {
+	c.progressHandler = handler
+}
+
+func (c *TorrentClient) emitProgress(eventType ProgressEventType, piece int) {
+	if c.progressHandler == nil {
+		return
+	}
+	c.progressLock.Lock()
+	now := time.Now()
+	switch eventType {
+	case ProgressPiece:
+		if now.Sub(c.lastProgress) < progressPieceInterval {
+			c.progressLock.Unlock()
+			return
+		}
+	case ProgressSeeding:
+		if c.seeding {
+			c.progressLock.Unlock()
+			return
+		}
+		c.seeding = true
+	}
+	c.lastProgress = now
+	c.progressLock.Unlock()
+	c.progressHandler(c.progressEvent(eventType, piece))
+}
+
+func (c *TorrentClient) progressEvent(eventType ProgressEventType, piece int) ProgressEvent {
+	event := ProgressEvent{
+		Type:       eventType,
+		Piece:      piece,
+		Downloaded: atomic.LoadInt64(&c.Downloaded),
+		Uploaded:   atomic.LoadInt64(&c.Uploaded),
+		Peers:      len(c.Conns()),
+		Percent:    100,
+
+		DownloadRate:     c.DownloadMeter.Rate(),
+		UploadRate:       c.UploadMeter.Rate(),
+		PeakDownloadRate: c.DownloadMeter.Peak(),
+		PeakUploadRate:   c.UploadMeter.Peak(),
+	}
+	c.progressLock.Lock()
+	if !c.startTime.IsZero() {
+		event.SessionDownloaded = event.Downloaded - c.startDownloaded
+		event.SessionUploaded = event.Uploaded - c.startUploaded
+	}
+	c.progressLock.Unlock()
+	// Relative to the selected files only
+	if wantedLength := c.WantedLength(); wantedLength > 0 {
+		event.Percent = 100 * float64(wantedLength-c.Left()) / float64(wantedLength)
+	}
+	return event
+}
+
+// Emit periodic progress updates until the context is cancelled
+func (c *TorrentClient) ProgressLoop(ctx context.Context) {
+	if c.progressHandler == nil {
+		return
+	}
+	ticker := time.NewTicker(progressUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.emitProgress(ProgressUpdate, 0)
+		}
+	}
+}
+
+// Progress events of several clients, written as json objects, one per line
+type JsonProgressPrinter struct {
+	encoder *json.Encoder
+	lock    sync.Mutex
+}
+
+type jsonProgressLine struct {
+	Event    string `json:"event"`
+	Torrent  string `json:"torrent"`
+	InfoHash string `json:"info_hash"`
+	Piece    *int   `json:"piece,omitempty"`
+	ProgressEvent
+}
+
+func NewJsonProgressPrinter(w io.Writer) *JsonProgressPrinter {
+	return &JsonProgressPrinter{encoder: json.NewEncoder(w)}
+}
+
+// Printer of -progress json
+var stdoutProgressPrinter = NewJsonProgressPrinter(os.Stdout)
+
+// Progress handler of the client
+func (p *JsonProgressPrinter) Handler(c *TorrentClient) func(ProgressEvent) {
+	return func(event ProgressEvent) {
+		line := jsonProgressLine{
+			Event:         event.Type.String(),
+			Torrent:       c.TorrentFilePath,
+			InfoHash:      hex.EncodeToString([]byte(c.InfoHash())),
+			ProgressEvent: event,
+		}
+		if event.Type == ProgressPiece {
+			line.Piece = &event.Piece
+		}
+		p.Print(line)
+	}
+}
+
+func (p *JsonProgressPrinter) Print(value interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.encoder.Encode(value)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressSeedingEvent(t *testing.T) {
+	info, data := makeTestInfo(16384, 200000)
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	var events []ProgressEvent
+	var pieceTimes []time.Time
+	var lock sync.Mutex
+	c.SetProgressHandler(func(event ProgressEvent) {
+		lock.Lock()
+		events = append(events, event)
+		if event.Type == ProgressPiece {
+			pieceTimes = append(pieceTimes, time.Now())
+		}
+		lock.Unlock()
+	})
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	var seeding []ProgressEvent
+	waitFor(t, 10*time.Second, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		seeding = nil
+		for _, event := range events {
+			if event.Type == ProgressSeeding {
+				seeding = append(seeding, event)
+			}
+		}
+		return len(seeding) > 0
+	})
+	if len(seeding) != 1 || seeding[0].Percent != 100 || seeding[0].Downloaded != int64(len(data)) {
+		t.Fatal(seeding)
+	}
+	// Piece events are throttled
+	lock.Lock()
+	defer lock.Unlock()
+	for i := 1; i < len(pieceTimes); i++ {
+		if pieceTimes[i].Sub(pieceTimes[i-1]) < progressPieceInterval/2 {
+			t.Fatalf("piece events %v apart", pieceTimes[i].Sub(pieceTimes[i-1]))
+		}
+	}
+}
+
+func TestProgressPercentOfSelectedFiles(t *testing.T) {
+	info, _ := makeTestInfo(16384, 16384, 3*16384)
+	c := newTestClient(t, info)
+	if err := c.SelectFiles([]string{"file1"}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetHasPiece(1)
+	if event := c.progressEvent(ProgressUpdate, 0); event.Percent < 33 || event.Percent > 34 {
+		t.Fatal(event.Percent)
+	}
+}
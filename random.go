@@ -0,0 +1,39 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Pseudo-random generator used for shuffling and sampling, seeded from
+// crypto/rand so that separate processes do not make the same choices
+var random = rand.New(&lockedSource{source: rand.NewSource(randomSeed())})
+
+func randomSeed() int64 {
+	var seed [8]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(seed[:]))
+}
+
+// rand.Rand is not safe for concurrent use, unless its source is
+type lockedSource struct {
+	source rand.Source
+	lock   sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.source.Seed(seed)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket limiting a transfer rate in bytes per second. Transfers larger
+// than the available tokens are allowed but put the bucket in debt, which
+// delays the next ones. A nil limiter does not limit anything.
+type RateLimiter struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Limiter of the given rate in bytes per second, or nil if the rate is not
+// positive
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		Rate:   float64(bytesPerSecond),
+		Burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Consume n tokens and return how long the caller must wait before proceeding
+func (l *RateLimiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.Rate
+	if l.tokens > l.Burst {
+		l.tokens = l.Burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.Rate * float64(time.Second))
+}
+
+// Wait until n bytes may be transferred through all the limiters. Returns false
+// if cancel is closed first.
+func WaitRateLimiters(cancel <-chan struct{}, n int, limiters ...*RateLimiter) bool {
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if limiterDelay := limiter.Reserve(n); limiterDelay > delay {
+			delay = limiterDelay
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-cancel:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterCapsTransfer(t *testing.T) {
+	const rate = 64 * 1024
+	global, peer := NewRateLimiter(4*rate), NewRateLimiter(rate)
+	start := time.Now()
+	// The first second of transfer is the burst
+	for transferred := 0; transferred < 2*rate; transferred += BlockSize {
+		if !WaitRateLimiters(nil, BlockSize, global, peer) {
+			t.Fatal("wait cancelled")
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 700*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("2 seconds of transfer at the limit took %v", elapsed)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	if NewRateLimiter(0) != nil || NewRateLimiter(-1) != nil {
+		t.Fatal("limiter without a rate")
+	}
+	var limiter *RateLimiter
+	if limiter.Reserve(1<<30) != 0 || !WaitRateLimiters(nil, 1<<30, limiter) {
+		t.Fatal("nil limiter delays transfers")
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	limiter = NewRateLimiter(1)
+	if WaitRateLimiters(cancel, 1000, limiter) {
+		t.Fatal("wait not cancelled")
+	}
+}
+
+func TestLimitedDownload(t *testing.T) {
+	info, data := makeTestInfo(16384, 8*BlockSize)
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	c.DownloadLimiter = NewRateLimiter(4 * BlockSize)
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go c.Run(ctx)
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("download at twice the limit took %v", elapsed)
+	}
+}
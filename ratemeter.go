@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between two samples of the transfer counters
+const rateSampleInterval = time.Second
+
+// Exponentially weighted moving average of a transfer rate in bytes per
+// second, fed with samples of a byte counter. The weight of a sample is halved
+// every half-life.
+type RateMeter struct {
+	HalfLife  time.Duration
+	rate      float64
+	peak      float64
+	lastTotal int64
+	lastTime  time.Time
+	lock      sync.Mutex
+}
+
+func NewRateMeter(halfLife time.Duration) *RateMeter {
+	return &RateMeter{HalfLife: halfLife}
+}
+
+// Record the value of the counter at the given time. The first sample only
+// sets the starting point.
+func (m *RateMeter) Sample(total int64, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.lastTime.IsZero() {
+		m.lastTotal, m.lastTime = total, now
+		return
+	}
+	elapsed := now.Sub(m.lastTime)
+	if elapsed <= 0 {
+		return
+	}
+	instant := float64(total-m.lastTotal) / elapsed.Seconds()
+	weight := 1.0
+	if m.HalfLife > 0 {
+		weight = 1 - math.Exp2(-elapsed.Seconds()/m.HalfLife.Seconds())
+	}
+	m.rate += weight * (instant - m.rate)
+	if m.rate > m.peak {
+		m.peak = m.rate
+	}
+	m.lastTotal, m.lastTime = total, now
+}
+
+// Smoothed rate, in bytes per second
+func (m *RateMeter) Rate() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rate
+}
+
+// Highest smoothed rate so far
+func (m *RateMeter) Peak() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.peak
+}
+
+// Sample the transfer counters of the client until the context is cancelled
+func (c *TorrentClient) RateLoop(ctx context.Context) {
+	ticker := time.NewTicker(rateSampleInterval)
+	defer ticker.Stop()
+	c.sampleRates(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.sampleRates(now)
+		}
+	}
+}
+
+func (c *TorrentClient) sampleRates(now time.Time) {
+	c.DownloadMeter.Sample(atomic.LoadInt64(&c.Downloaded), now)
+	c.UploadMeter.Sample(atomic.LoadInt64(&c.Uploaded), now)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateMeterConverges(t *testing.T) {
+	m := NewRateMeter(5 * time.Second)
+	now := time.Unix(1700000000, 0)
+	total := int64(0)
+	m.Sample(total, now)
+	feed := func(seconds int, rate int64) {
+		for i := 0; i < seconds; i++ {
+			now = now.Add(time.Second)
+			total += rate
+			m.Sample(total, now)
+		}
+	}
+	feed(60, 1000)
+	if rate := m.Rate(); math.Abs(rate-1000) > 10 {
+		t.Fatal(rate)
+	}
+	// Half of the way to 3000 B/s after a half-life
+	feed(5, 3000)
+	if rate := m.Rate(); math.Abs(rate-2000) > 10 {
+		t.Fatal(rate)
+	}
+	// Then down to nothing
+	feed(60, 0)
+	if rate := m.Rate(); rate > 10 {
+		t.Fatal(rate)
+	}
+	if peak := m.Peak(); math.Abs(peak-2000) > 10 {
+		t.Fatal(peak)
+	}
+
+	// Samples that go back in time are ignored
+	m.Sample(total+1000, now.Add(-time.Second))
+	if rate := m.Rate(); rate > 10 {
+		t.Fatal(rate)
+	}
+}
+
+// Without a half-life, the rate is the one of the last interval
+func TestRateMeterInstant(t *testing.T) {
+	m := NewRateMeter(0)
+	now := time.Unix(1700000000, 0)
+	m.Sample(100, now)
+	if m.Rate() != 0 {
+		t.Fatal(m.Rate())
+	}
+	m.Sample(600, now.Add(500*time.Millisecond))
+	if m.Rate() != 1000 {
+		t.Fatal(m.Rate())
+	}
+}
+
+func TestProgressEventRates(t *testing.T) {
+	info, _ := makeTestInfo(16384, 20000)
+	c := newTestClient(t, info)
+	c.DownloadMeter, c.UploadMeter = NewRateMeter(0), NewRateMeter(0)
+	now := time.Now()
+	c.sampleRates(now)
+	c.Downloaded, c.Uploaded = 4000, 1000
+	c.sampleRates(now.Add(2 * time.Second))
+	event := c.progressEvent(ProgressPiece, 0)
+	if event.DownloadRate != 2000 || event.UploadRate != 500 || event.PeakDownloadRate != 2000 || event.PeakUploadRate != 500 {
+		t.Fatalf("%+v", event)
+	}
+}
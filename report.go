@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// What happened to a torrent during the run
+type TorrentReport struct {
+	Name       string `json:"name"`
+	Downloaded int64  `json:"downloaded"`
+	Uploaded   int64  `json:"uploaded"`
+	// Bytes per second downloaded during this run, until the download
+	// completed
+	DownloadRate float64       `json:"download_rate"`
+	Elapsed      time.Duration `json:"elapsed"`
+	Percent      float64       `json:"percent"`
+	Complete     bool          `json:"complete"`
+	Swarm        SwarmSize     `json:"swarm"`
+	// Set when the torrent could not be loaded or run
+	Error string `json:"error,omitempty"`
+}
+
+type RunReport struct {
+	Torrents   []TorrentReport `json:"torrents"`
+	Downloaded int64           `json:"downloaded"`
+	Uploaded   int64           `json:"uploaded"`
+	Elapsed    time.Duration   `json:"elapsed"`
+}
+
+// Print the report in the output format selected on the command line:
+// nothing with -quiet, a json object with -progress json
+func PrintReport(report RunReport) {
+	if *quiet {
+		return
+	}
+	if *progressFormat == "json" {
+		stdoutProgressPrinter.Print(struct {
+			Event string `json:"event"`
+			RunReport
+		}{"report", report})
+		return
+	}
+	report.Print(os.Stdout)
+}
+
+// Record that all wanted pieces are downloaded
+func (c *TorrentClient) markComplete() {
+	c.completeOnce.Do(func() {
+		c.progressLock.Lock()
+		c.finishTime = time.Now()
+		c.progressLock.Unlock()
+		close(c.completed)
+	})
+}
+
+func (c *TorrentClient) Report() TorrentReport {
+	status := c.Status()
+	report := TorrentReport{
+		Name:       status.Name,
+		Downloaded: atomic.LoadInt64(&c.Downloaded),
+		Uploaded:   atomic.LoadInt64(&c.Uploaded),
+		Percent:    status.Percent,
+		Complete:   c.HasInfo() && c.Left() == 0,
+		Swarm:      status.Swarm,
+	}
+	if report.Name == "" {
+		report.Name = c.TorrentFilePath
+	}
+	c.progressLock.Lock()
+	startTime, finishTime, startDownloaded := c.startTime, c.finishTime, c.startDownloaded
+	c.progressLock.Unlock()
+	if startTime.IsZero() {
+		return report
+	}
+	report.Elapsed = time.Since(startTime)
+	downloadTime := report.Elapsed
+	if !finishTime.IsZero() && finishTime.After(startTime) {
+		downloadTime = finishTime.Sub(startTime)
+	}
+	if downloadTime > 0 {
+		report.DownloadRate = float64(report.Downloaded-startDownloaded) / downloadTime.Seconds()
+	}
+	return report
+}
+
+func (r *RunReport) Add(report TorrentReport) {
+	r.Torrents = append(r.Torrents, report)
+	r.Downloaded += report.Downloaded
+	r.Uploaded += report.Uploaded
+}
+
+func (r *RunReport) Print(w io.Writer) {
+	for _, torrent := range r.Torrents {
+		status := "incomplete"
+		if torrent.Error != "" {
+			status = "failed: " + torrent.Error
+		} else if torrent.Complete {
+			status = "complete"
+		}
+		fmt.Fprintf(w, "%s: %.1f%% %s, downloaded %s at %s/s, uploaded %s in %s\n",
+			torrent.Name, torrent.Percent, status, FormatBytes(float64(torrent.Downloaded)),
+			FormatBytes(torrent.DownloadRate), FormatBytes(float64(torrent.Uploaded)), torrent.Elapsed.Round(time.Second))
+	}
+	fmt.Fprintf(w, "total: %d torrents, downloaded %s, uploaded %s in %s\n",
+		len(r.Torrents), FormatBytes(float64(r.Downloaded)), FormatBytes(float64(r.Uploaded)), r.Elapsed.Round(time.Second))
+}
+
+// Human readable size, for instance "1.5 MiB"
+func FormatBytes(size float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportAfterDownload(t *testing.T) {
+	info, data := makeTestInfo(16384, 50000)
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	report := c.Report()
+	if report.Percent != 100 || !report.Complete || report.Elapsed <= 0 || report.Downloaded != int64(len(data)) || report.DownloadRate <= 0 {
+		t.Fatalf("%+v", report)
+	}
+	if report.Name != "test" {
+		t.Fatal(report.Name)
+	}
+
+	var run RunReport
+	run.Add(report)
+	run.Add(TorrentReport{Name: "broken", Error: "no such file"})
+	var output bytes.Buffer
+	run.Print(&output)
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "test: 100.0% complete, downloaded 48.8 KiB") ||
+		!strings.HasPrefix(lines[1], "broken: 0.0% failed: no such file") || !strings.HasPrefix(lines[2], "total: 2 torrents, downloaded 48.8 KiB") {
+		t.Fatal(output.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for size, want := range map[float64]string{
+		0:       "0 B",
+		1023:    "1023 B",
+		1536:    "1.5 KiB",
+		5 << 20: "5.0 MiB",
+		1 << 50: "1024.0 TiB",
+	} {
+		if formatted := FormatBytes(size); formatted != want {
+			t.Errorf("%v: %s", size, formatted)
+		}
+	}
+}
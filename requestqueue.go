@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	blockUnrequested = iota
+	blockRequested
+	blockReceived
+)
+
+// State of the blocks of the pieces being downloaded. Each block is handed out
+// to a single peer, except for pieces that are downloaded from several peers
+// in endgame mode. The blocks received for a piece are kept when its peer
+// goes away, and the piece is resumed by the next peer that picks it.
+//
+// The buffers of the queued pieces are the bulk of the memory used by a
+// download: at most MaxPieces pieces are queued at once, 0 for no limit.
+type RequestQueue struct {
+	MaxPieces int
+	pieces    map[int]*queuedPiece
+	// Size of the buffers of the queued pieces, and its highest value
+	bytes     int64
+	peakBytes int64
+	lock      sync.Mutex
+}
+
+type queuedPiece struct {
+	data     []byte
+	blocks   []queuedBlock
+	received int
+}
+
+type queuedBlock struct {
+	state int
+	// Peers that the block was requested from
+	requesters []*PeerConn
+}
+
+// Number of pieces and blocks in each state, for the status server
+type RequestQueueStats struct {
+	Pieces      int `json:"pieces"`
+	Unrequested int `json:"unrequested"`
+	Requested   int `json:"requested"`
+	Received    int `json:"received"`
+	// Memory used by the piece buffers
+	Bytes     int64 `json:"bytes"`
+	PeakBytes int64 `json:"peak_bytes"`
+}
+
+func NewRequestQueue(maxPieces int) *RequestQueue {
+	return &RequestQueue{MaxPieces: maxPieces, pieces: map[int]*queuedPiece{}}
+}
+
+// Start downloading the piece of the given size, unless it is already queued.
+// Returns false when the piece is not queued and the queue is full.
+func (q *RequestQueue) Add(index int, size int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, isQueued := q.pieces[index]; isQueued {
+		return true
+	}
+	if q.MaxPieces > 0 && len(q.pieces) >= q.MaxPieces {
+		return false
+	}
+	q.pieces[index] = &queuedPiece{
+		data:   make([]byte, size),
+		blocks: make([]queuedBlock, (size+BlockSize-1)/BlockSize),
+	}
+	q.grow(int64(size))
+	return true
+}
+
+// Must be called with the lock held
+func (q *RequestQueue) grow(size int64) {
+	q.bytes += size
+	if q.bytes > q.peakBytes {
+		q.peakBytes = q.bytes
+	}
+}
+
+// Queue the piece with the blocks of the bitfield already received, from a
+// previous run. The data holds the received blocks at their offset. Returns
+// false when the piece is already queued or the queue is full.
+func (q *RequestQueue) Restore(index int, data []byte, received Bitfield) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, isQueued := q.pieces[index]; isQueued || (q.MaxPieces > 0 && len(q.pieces) >= q.MaxPieces) {
+		return false
+	}
+	piece := &queuedPiece{
+		data:   data,
+		blocks: make([]queuedBlock, (len(data)+BlockSize-1)/BlockSize),
+	}
+	for i := range piece.blocks {
+		if received.Has(i) {
+			piece.blocks[i].state = blockReceived
+			piece.received++
+		}
+	}
+	// A complete piece would never be handed out again
+	if piece.received == 0 || piece.received == len(piece.blocks) {
+		return false
+	}
+	q.pieces[index] = piece
+	q.grow(int64(len(data)))
+	return true
+}
+
+// Blocks received so far of the queued pieces
+func (q *RequestQueue) ReceivedBlocks() map[int]Bitfield {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	received := map[int]Bitfield{}
+	for index, piece := range q.pieces {
+		if piece.received == 0 {
+			continue
+		}
+		bitfield := NewBitfield(len(piece.blocks))
+		for i, block := range piece.blocks {
+			if block.state == blockReceived {
+				bitfield.Set(i)
+			}
+		}
+		received[index] = bitfield
+	}
+	return received
+}
+
+// Reports whether no more pieces should be queued
+func (q *RequestQueue) IsFull() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.MaxPieces > 0 && len(q.pieces) >= q.MaxPieces
+}
+
+// Pieces of the bitfield that are queued
+func (q *RequestQueue) Queued(bitfield Bitfield) Bitfield {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queued := make(Bitfield, len(bitfield))
+	for index := range q.pieces {
+		if bitfield.Has(index) {
+			queued.Set(index)
+		}
+	}
+	return queued
+}
+
+// Pick a block of the piece to request from the peer. Blocks that nobody was
+// asked for come first; when shared is set, blocks already requested from the
+// fewest other peers come next.
+func (q *RequestQueue) Next(pc *PeerConn, index int, shared bool) (BlockRequest, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	piece, isQueued := q.pieces[index]
+	if !isQueued {
+		return BlockRequest{}, false
+	}
+	best := -1
+	for i := range piece.blocks {
+		block := &piece.blocks[i]
+		if block.state == blockReceived || hasRequester(block, pc) {
+			continue
+		}
+		if block.state == blockUnrequested {
+			best = i
+			break
+		}
+		if shared && (best < 0 || len(block.requesters) < len(piece.blocks[best].requesters)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return BlockRequest{}, false
+	}
+	block := &piece.blocks[best]
+	block.state = blockRequested
+	block.requesters = append(block.requesters, pc)
+	begin := best * BlockSize
+	return BlockRequest{index, begin, BlockLength(len(piece.data), begin)}, true
+}
+
+func hasRequester(block *queuedBlock, pc *PeerConn) bool {
+	for _, requester := range block.requesters {
+		if requester == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// Store a block of the piece, whoever it was requested from. Returns false
+// when the block is not expected: the piece is not queued or the block was
+// already received. The data of the piece is returned with its last block.
+func (q *RequestQueue) Receive(index int, begin int, data []byte) (bool, []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	piece, isQueued := q.pieces[index]
+	if !isQueued {
+		return false, nil
+	}
+	block := &piece.blocks[begin/BlockSize]
+	if block.state == blockReceived {
+		return false, nil
+	}
+	copy(piece.data[begin:], data)
+	block.state = blockReceived
+	block.requesters = nil
+	piece.received++
+	if piece.received == len(piece.blocks) {
+		return true, piece.data
+	}
+	return true, nil
+}
+
+// Reports whether the piece is no longer being downloaded: all its blocks
+// were received, or it was removed from the queue
+func (q *RequestQueue) IsDone(index int) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	piece, isQueued := q.pieces[index]
+	return !isQueued || piece.received == len(piece.blocks)
+}
+
+// The peer will not answer the request, which may be handed out again
+func (q *RequestQueue) Drop(pc *PeerConn, request BlockRequest) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if piece, isQueued := q.pieces[request.Index]; isQueued {
+		piece.drop(pc, request.Begin/BlockSize)
+	}
+}
+
+// Hand out again all the blocks that were requested from the peer, when it
+// chokes us or goes away
+func (q *RequestQueue) ReleasePeer(pc *PeerConn) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, piece := range q.pieces {
+		for i := range piece.blocks {
+			piece.drop(pc, i)
+		}
+	}
+}
+
+func (piece *queuedPiece) drop(pc *PeerConn, i int) {
+	block := &piece.blocks[i]
+	for j, requester := range block.requesters {
+		if requester == pc {
+			block.requesters = append(block.requesters[:j], block.requesters[j+1:]...)
+			break
+		}
+	}
+	if block.state == blockRequested && len(block.requesters) == 0 {
+		block.state = blockUnrequested
+	}
+}
+
+// Forget one of the queued pieces for which isStalled holds, to make room for
+// another piece. The piece with the fewest received blocks is the one that
+// is lost. Returns false when no queued piece is stalled.
+func (q *RequestQueue) Evict(isStalled func(index int) bool) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	evicted := -1
+	for index, piece := range q.pieces {
+		if !isStalled(index) {
+			continue
+		}
+		if evicted < 0 || piece.received < q.pieces[evicted].received {
+			evicted = index
+		}
+	}
+	if evicted < 0 {
+		return false
+	}
+	q.bytes -= int64(len(q.pieces[evicted].data))
+	delete(q.pieces, evicted)
+	return true
+}
+
+// Forget the piece once it is stored, or after it failed its hash check
+func (q *RequestQueue) Remove(index int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if piece, isQueued := q.pieces[index]; isQueued {
+		q.bytes -= int64(len(piece.data))
+		delete(q.pieces, index)
+	}
+}
+
+func (q *RequestQueue) Stats() RequestQueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := RequestQueueStats{Pieces: len(q.pieces), Bytes: q.bytes, PeakBytes: q.peakBytes}
+	for _, piece := range q.pieces {
+		for _, block := range piece.blocks {
+			switch block.state {
+			case blockUnrequested:
+				stats.Unrequested++
+			case blockRequested:
+				stats.Requested++
+			case blockReceived:
+				stats.Received++
+			}
+		}
+	}
+	return stats
+}
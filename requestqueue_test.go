@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRequestQueueAssignment(t *testing.T) {
+	q := NewRequestQueue(0)
+	q.Add(3, 2*BlockSize+100)
+	first, second := &PeerConn{}, &PeerConn{}
+	requests := map[int]*PeerConn{}
+	for _, pc := range []*PeerConn{first, second, first} {
+		request, ok := q.Next(pc, 3, false)
+		if !ok || request.Index != 3 {
+			t.Fatal(request, ok)
+		}
+		if _, isAssigned := requests[request.Begin]; isAssigned {
+			t.Fatal("block handed out twice", request)
+		}
+		requests[request.Begin] = pc
+	}
+	if requests[2*BlockSize] == nil {
+		t.Fatal(requests)
+	}
+	// Every block is requested: only endgame shares them
+	if request, ok := q.Next(second, 3, false); ok {
+		t.Fatal(request)
+	}
+	request, ok := q.Next(second, 3, true)
+	if !ok || requests[request.Begin] != first {
+		t.Fatal(request, ok)
+	}
+	if _, ok := q.Next(first, 4, false); ok {
+		t.Fatal("piece is not queued")
+	}
+	if stats := q.Stats(); stats.Pieces != 1 || stats.Requested != 3 || stats.Bytes != 2*BlockSize+100 {
+		t.Fatal(stats)
+	}
+}
+
+func TestRequestQueueCompletion(t *testing.T) {
+	q := NewRequestQueue(0)
+	q.Add(0, BlockSize+10)
+	pc := &PeerConn{}
+	for {
+		if _, ok := q.Next(pc, 0, false); !ok {
+			break
+		}
+	}
+	if ok, data := q.Receive(0, BlockSize, bytes.Repeat([]byte{2}, 10)); !ok || data != nil {
+		t.Fatal(ok, data)
+	}
+	if q.IsDone(0) {
+		t.Fatal("piece is not complete")
+	}
+	if ok, _ := q.Receive(0, BlockSize, bytes.Repeat([]byte{2}, 10)); ok {
+		t.Fatal("block received twice")
+	}
+	ok, data := q.Receive(0, 0, bytes.Repeat([]byte{1}, BlockSize))
+	if !ok || !bytes.Equal(data, append(bytes.Repeat([]byte{1}, BlockSize), bytes.Repeat([]byte{2}, 10)...)) {
+		t.Fatal(ok, len(data))
+	}
+	if !q.IsDone(0) {
+		t.Fatal("piece is complete")
+	}
+	if stats := q.Stats(); stats.Received != 2 || stats.Requested != 0 {
+		t.Fatal(stats)
+	}
+	q.Remove(0)
+	if stats := q.Stats(); stats.Pieces != 0 || stats.Bytes != 0 {
+		t.Fatal(stats)
+	}
+}
+
+func TestRequestQueueRequeueOnDisconnect(t *testing.T) {
+	q := NewRequestQueue(0)
+	q.Add(0, 3*BlockSize)
+	gone, other := &PeerConn{}, &PeerConn{}
+	for i := 0; i < 2; i++ {
+		if _, ok := q.Next(gone, 0, false); !ok {
+			t.Fatal("no block")
+		}
+	}
+	last, _ := q.Next(other, 0, false)
+	// A received block is not handed out again
+	q.Receive(0, 0, make([]byte, BlockSize))
+	q.ReleasePeer(gone)
+	if stats := q.Stats(); stats.Unrequested != 1 || stats.Requested != 1 || stats.Received != 1 {
+		t.Fatal(stats)
+	}
+	request, ok := q.Next(other, 0, false)
+	if !ok || request.Begin != BlockSize {
+		t.Fatal(request, ok)
+	}
+	q.Drop(other, last)
+	if request, ok := q.Next(gone, 0, false); !ok || request != last {
+		t.Fatal(request, ok)
+	}
+}
+
+func TestRequestQueueMaxPieces(t *testing.T) {
+	q := NewRequestQueue(1)
+	if !q.Add(0, BlockSize) || q.Add(1, BlockSize) || !q.Add(0, BlockSize) {
+		t.Fatal("queue limit not enforced")
+	}
+	if q.Evict(func(index int) bool { return index != 0 }) {
+		t.Fatal("evicted a piece that is not stalled")
+	}
+	if !q.Evict(func(index int) bool { return index == 0 }) || !q.Add(1, BlockSize) {
+		t.Fatal("stalled piece not evicted")
+	}
+	if stats := q.Stats(); stats.Pieces != 1 || stats.Bytes != BlockSize {
+		t.Fatal(stats)
+	}
+}
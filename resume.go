@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Resume state: the pieces we have and the transfer counters are saved to a
+// bencoded file named after the info hash, next to the downloaded files. With
+// ResumeBlocks, the blocks received of the other pieces are saved too, as a
+// dictionary of block bitfields indexed by piece.
+
+// Interval between two saves of the received blocks, so that a crash loses at
+// most that much of the partially downloaded pieces
+var stateSaveInterval = 30 * time.Second
+
+func (c *TorrentClient) StateFilePath() string {
+	return filepath.Join(c.OutputDir, hex.EncodeToString([]byte(c.InfoHash()))+".state")
+}
+
+func (c *TorrentClient) SaveState() error {
+	c.stateFileLock.Lock()
+	defer c.stateFileLock.Unlock()
+	state := map[string]interface{}{
+		"bitfield":   string(c.Bitfield()),
+		"downloaded": atomic.LoadInt64(&c.Downloaded),
+		"uploaded":   atomic.LoadInt64(&c.Uploaded),
+		"completed":  int64(atomic.LoadInt32(&c.completedAnnounced)),
+	}
+	if c.ResumeBlocks {
+		blocks := map[string]interface{}{}
+		for index, received := range c.Requests.ReceivedBlocks() {
+			blocks[strconv.Itoa(index)] = string(received)
+		}
+		state["blocks"] = blocks
+	}
+	var buffer bytes.Buffer
+	if err := bencode.Marshal(&buffer, state); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that we never leave a truncated
+	// state file behind
+	path := c.StateFilePath()
+	if err := ioutil.WriteFile(path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Save the resume state periodically until the context is cancelled. Pieces
+// are saved as they complete, but the blocks of the other pieces are not.
+func (c *TorrentClient) SaveStateLoop(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.SaveState(); err != nil {
+				c.Log.Warnf("could not save resume state: %v", err)
+			}
+		}
+	}
+}
+
+// Restore the pieces and counters from the state file, if it exists. When
+// verify is true, pieces are read back from disk and hashed, and the ones that
+// do not match are downloaded again.
+func (c *TorrentClient) LoadState(verify bool) error {
+	bencoded, err := ioutil.ReadFile(c.StateFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bdecoded, err := bencode.Decode(bytes.NewReader(bencoded))
+	if err != nil {
+		return err
+	}
+	state, isDict := bdecoded.(map[string]interface{})
+	if !isDict {
+		return errors.New("state file is not a bencoded dictionary")
+	}
+	bitfieldString, _ := state["bitfield"].(string)
+	bitfield := Bitfield(bitfieldString)
+	if len(bitfield) != len(NewBitfield(c.PieceCount())) {
+		return errors.New("state file: invalid bitfield length")
+	}
+	for index := 0; index < c.PieceCount(); index++ {
+		if !bitfield.Has(index) {
+			continue
+		}
+		if verify && !c.VerifyStoredPiece(index) {
+			continue
+		}
+		c.SetHasPiece(index)
+	}
+	downloaded, _ := state["downloaded"].(int64)
+	uploaded, _ := state["uploaded"].(int64)
+	atomic.StoreInt64(&c.Downloaded, downloaded)
+	atomic.StoreInt64(&c.Uploaded, uploaded)
+	if completed, _ := state["completed"].(int64); completed == 1 {
+		atomic.StoreInt32(&c.completedAnnounced, 1)
+	}
+	if blocks, isDict := state["blocks"].(map[string]interface{}); isDict && c.ResumeBlocks {
+		c.restoreBlocks(blocks)
+	}
+	c.stateLoaded = true
+	return nil
+}
+
+// Queue the pieces that were partially downloaded, with the blocks already
+// written to the storage. Pieces are still verified once complete.
+func (c *TorrentClient) restoreBlocks(blocks map[string]interface{}) {
+	for key, value := range blocks {
+		index, err := strconv.Atoi(key)
+		received, isString := value.(string)
+		if err != nil || !isString || index < 0 || index >= c.PieceCount() || c.HasPiece(index) {
+			continue
+		}
+		size := c.PieceSize(index)
+		blockCount := int((size + BlockSize - 1) / BlockSize)
+		if Bitfield(received).Validate(blockCount) != nil {
+			continue
+		}
+		data := make([]byte, size)
+		if err := c.Storage.ReadAt(data, c.PieceOffset(index)); err != nil {
+			continue
+		}
+		if c.Requests.Restore(index, data, Bitfield(received)) {
+			c.Log.Debugf("piece %d resumed from its received blocks", index)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// Client of the torrent that saves its received blocks to the state file in
+// the directory, and stores the data in memory
+func newResumeClient(t *testing.T, info map[string]interface{}, data []byte, dir string) *TorrentClient {
+	t.Helper()
+	c := newTestClient(t, info)
+	c.OutputDir = dir
+	c.ResumeBlocks = true
+	c.Storage = NewMemoryStorage(int64(len(data)))
+	return c
+}
+
+func TestSaveReceivedBlocksPeriodically(t *testing.T) {
+	defer func(interval time.Duration) { stateSaveInterval = interval }(stateSaveInterval)
+	stateSaveInterval = 10 * time.Millisecond
+	info, data := makeTestInfo(2*BlockSize, 4*BlockSize)
+	dir := t.TempDir()
+	c := newResumeClient(t, info, data, dir)
+	offset := c.PieceOffset(1)
+	c.Storage.WriteAt(data[offset:offset+BlockSize], offset)
+	c.Requests.Add(1, int(c.PieceSize(1)))
+	c.Requests.Receive(1, 0, data[offset:offset+BlockSize])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.SaveStateLoop(ctx)
+	waitFor(t, 5*time.Second, func() bool {
+		_, err := os.Stat(c.StateFilePath())
+		return err == nil
+	})
+	cancel()
+
+	resumed := newResumeClient(t, info, data, dir)
+	resumed.Storage = c.Storage
+	if err := resumed.LoadState(false); err != nil {
+		t.Fatal(err)
+	}
+	received := resumed.Requests.ReceivedBlocks()
+	if len(received) != 1 || !received[1].Has(0) || received[1].Has(1) {
+		t.Fatal(received)
+	}
+	isNew, piece := resumed.Requests.Receive(1, BlockSize, data[offset+BlockSize:offset+2*BlockSize])
+	if !isNew || !resumed.VerifyPiece(1, piece) {
+		t.Fatal("resumed piece does not verify")
+	}
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	info, data := makeTestInfo(16384, 50000)
+	dir := t.TempDir()
+	c := newTestClient(t, info)
+	c.OutputDir = dir
+	storage := NewMemoryStorage(int64(len(data)))
+	storage.WriteAt(data, 0)
+	c.Storage = storage
+	c.SetHasPiece(0)
+	c.SetHasPiece(2)
+	c.Downloaded, c.Uploaded = 42, 7
+	if err := c.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Piece 2 is corrupted on disk
+	storage.WriteAt([]byte("corrupt"), c.PieceOffset(2))
+	for _, verify := range []bool{false, true} {
+		resumed := newTestClient(t, info)
+		resumed.OutputDir = dir
+		resumed.Storage = storage
+		if err := resumed.LoadState(verify); err != nil {
+			t.Fatal(err)
+		}
+		if !resumed.HasPiece(0) || resumed.HasPiece(1) || resumed.HasPiece(2) == verify || resumed.HasPiece(3) {
+			t.Fatalf("verify %v: %v", verify, resumed.HavePieces)
+		}
+		if resumed.Downloaded != 42 || resumed.Uploaded != 7 {
+			t.Fatal(resumed.Downloaded, resumed.Uploaded)
+		}
+		if left := resumed.Left(); verify && left != 50000-16384 {
+			t.Fatalf("%d bytes left", left)
+		}
+	}
+}
+
+func TestLoadStateWithoutFile(t *testing.T) {
+	info, _ := makeTestInfo(16384, 50000)
+	c := newTestClient(t, info)
+	if err := c.LoadState(true); err != nil {
+		t.Fatal(err)
+	}
+	if c.Left() != 50000 {
+		t.Fatal(c.Left())
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Tracker scrape convention
+// http://www.bittorrent.org/beps/bep_0048.html
+
+type ScrapeResponse struct {
+	// Number of seeders
+	Complete int64
+	// Number of leechers
+	Incomplete int64
+	// Number of times the torrent was downloaded
+	Downloaded int64
+}
+
+// Derive the scrape url from an http announce url: the last path segment must
+// start with "announce", which is replaced by "scrape". For instance
+// http://example.com/x/announce.php?a=b becomes http://example.com/x/scrape.php?a=b
+func ScrapeUrl(announceUrl string) (string, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+	dir, segment := path.Split(u.Path)
+	if !strings.HasPrefix(segment, "announce") {
+		return "", errors.New("tracker does not support scrape: " + announceUrl)
+	}
+	u.Path = dir + "scrape" + strings.TrimPrefix(segment, "announce")
+	return u.String(), nil
+}
+
+// Query the tracker for the swarm statistics of the torrent
+func (c *TorrentClient) Scrape(ctx context.Context, announceUrl string) (*ScrapeResponse, error) {
+	if strings.HasPrefix(announceUrl, "udp") {
+		if proxyDialer != nil {
+			return nil, errUdpProxied
+		}
+		return c.ScrapeUdp(ctx, announceUrl)
+	} else if strings.HasPrefix(announceUrl, "http") {
+		scrapeUrl, err := ScrapeUrl(announceUrl)
+		if err != nil {
+			return nil, err
+		}
+		params := url.Values{}
+		params.Set("info_hash", c.InfoHash())
+		response, err := HttpGetBdecoded(ctx, scrapeUrl, &params)
+		if err != nil {
+			return nil, err
+		}
+		return ParseScrapeResponse(response, c.InfoHash())
+	}
+	return nil, errors.New("unsupported tracker protocol: " + announceUrl)
+}
+
+// Extract the statistics of a single torrent from the bdecoded scrape response
+func ParseScrapeResponse(response map[string]interface{}, infoHash string) (*ScrapeResponse, error) {
+	if failureReason, requestFailed := response["failure reason"]; requestFailed {
+		reason, _ := failureReason.(string)
+		return nil, &TrackerFailureError{Reason: reason}
+	}
+	files, isDict := response["files"].(map[string]interface{})
+	if !isDict {
+		return nil, errors.New("scrape: missing files dictionary")
+	}
+	file, isDict := files[infoHash].(map[string]interface{})
+	if !isDict {
+		return nil, errors.New("scrape: torrent is unknown to the tracker")
+	}
+	scrapeResponse := &ScrapeResponse{}
+	scrapeResponse.Complete, _ = file["complete"].(int64)
+	scrapeResponse.Incomplete, _ = file["incomplete"].(int64)
+	scrapeResponse.Downloaded, _ = file["downloaded"].(int64)
+	return scrapeResponse, nil
+}
+
+// http://www.bittorrent.org/beps/bep_0015.html
+func (c *TorrentClient) ScrapeUdp(ctx context.Context, announceUrl string) (*ScrapeResponse, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", bindUDPAddr(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer WatchContext(ctx, conn)()
+
+	connectionID, err := UdpConnect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 36)
+	binary.BigEndian.PutUint64(request[0:8], connectionID)
+	binary.BigEndian.PutUint32(request[8:12], udpActionScrape)
+	copy(request[16:36], c.InfoHash())
+	response, err := UdpTransaction(ctx, conn, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 20 {
+		return nil, errors.New("udp tracker: scrape response too short")
+	}
+	return &ScrapeResponse{
+		Complete:   int64(binary.BigEndian.Uint32(response[8:12])),
+		Downloaded: int64(binary.BigEndian.Uint32(response[12:16])),
+		Incomplete: int64(binary.BigEndian.Uint32(response[16:20])),
+	}, nil
+}
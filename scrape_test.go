@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	tests := map[string]string{
+		"http://example.com/announce":     "http://example.com/scrape",
+		"http://example.com/x/announce":   "http://example.com/x/scrape",
+		"http://example.com/announce.php": "http://example.com/scrape.php",
+		"http://example.com/announce?a=b": "http://example.com/scrape?a=b",
+		"http://example.com/a":            "",
+		"http://example.com/announce/x":   "",
+		"http://example.com/":             "",
+	}
+	for announceUrl, want := range tests {
+		scrapeUrl, err := ScrapeUrl(announceUrl)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: scrape url %s", announceUrl, scrapeUrl)
+			}
+		} else if err != nil || scrapeUrl != want {
+			t.Errorf("%s: %s %v", announceUrl, scrapeUrl, err)
+		}
+	}
+}
+
+func TestScrape(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape.php" || r.URL.Query().Get("info_hash") != c.InfoHash() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("d5:filesd20:" + c.InfoHash() + "d8:completei5e10:downloadedi50e10:incompletei10eeee"))
+	}))
+	defer server.Close()
+	scrape, err := c.Scrape(context.Background(), server.URL+"/announce.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *scrape != (ScrapeResponse{Complete: 5, Incomplete: 10, Downloaded: 50}) {
+		t.Fatal(scrape)
+	}
+}
+
+func TestParseScrapeResponse(t *testing.T) {
+	if _, err := ParseScrapeResponse(map[string]interface{}{"failure reason": "denied"}, "x"); err == nil {
+		t.Fatal("failure accepted")
+	}
+	if _, err := ParseScrapeResponse(map[string]interface{}{"files": map[string]interface{}{}}, "x"); err == nil {
+		t.Fatal("unknown torrent accepted")
+	}
+}
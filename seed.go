@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of ports that are tried, starting from the configured one, before
+	// falling back to an ephemeral port
+	listenPortRange = 9
+	// Larger requests are a protocol violation
+	maxRequestLength = 1 << 17
+)
+
+// Bind the first free port starting from c.Port, and update c.Port to the
+// port that was actually bound
+func (c *TorrentClient) Listen() error {
+	for port := c.Port; port < c.Port+listenPortRange; port++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(bindHost(), strconv.Itoa(port)))
+		if err == nil {
+			c.listener = listener
+			// Port 0 lets the system choose
+			c.Port = listener.Addr().(*net.TCPAddr).Port
+			return nil
+		}
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindHost(), "0"))
+	if err != nil {
+		return err
+	}
+	c.listener = listener
+	c.Port = listener.Addr().(*net.TCPAddr).Port
+	return nil
+}
+
+// Accept incoming connections from peers until the context is cancelled
+func (c *TorrentClient) ListenLoop(ctx context.Context) error {
+	listener := c.listener
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if remoteAddr, isTCP := conn.RemoteAddr().(*net.TCPAddr); isTCP && peerBlocklist.Blocks(remoteAddr.IP) {
+			c.Log.Debugf("incoming peer %s is blocked", remoteAddr)
+			conn.Close()
+			continue
+		}
+		if !c.AcquireConnSlot() {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer c.ReleaseConnSlot()
+			remoteAddr := conn.RemoteAddr().String()
+			if err := c.HandleIncomingConn(ctx, conn); err != nil {
+				c.Log.Debugf("incoming peer %s: %v", remoteAddr, err)
+			}
+		}(conn)
+	}
+}
+
+func (c *TorrentClient) HandleIncomingConn(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stopWatching := WatchContext(ctx, conn)
+	defer stopWatching()
+
+	conn.SetDeadline(time.Now().Add(c.DialTimeout))
+	reader := bufio.NewReader(conn)
+	isPlaintext, err := IsPlaintextHandshake(reader)
+	if err != nil {
+		return err
+	}
+	if isPlaintext && c.Encryption == EncryptionRequire {
+		return errors.New("handshake: plaintext connections are refused")
+	} else if !isPlaintext && c.Encryption == EncryptionDisable {
+		return errors.New("handshake: encrypted connections are refused")
+	}
+	if isPlaintext {
+		conn = &mseConn{Conn: conn, reader: reader}
+	} else if conn, err = MSEReceive(conn, reader, c.InfoHash(), c.Encryption); err != nil {
+		return err
+	}
+	handshake, err := ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	if handshake.InfoHash != c.InfoHash() {
+		return errors.New("handshake: unknown info hash")
+	}
+	if handshake.PeerID == c.PeerID {
+		return errSelfConnection
+	}
+	if _, err := conn.Write(MakeHandshake(c.InfoHash(), c.PeerID)); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	remoteAddr, isTCP := conn.RemoteAddr().(*net.TCPAddr)
+	if !isTCP {
+		return errors.New("unexpected remote address " + conn.RemoteAddr().String())
+	}
+	peer := Peer{PeerID: handshake.PeerID, IP: remoteAddr.IP, Port: remoteAddr.Port}
+	pc := c.newPeerConn(conn, peer, handshake)
+	pc.Incoming = true
+	defer pc.Close()
+	if err := c.AddConn(pc); err != nil {
+		return err
+	}
+	defer c.RemoveConn(pc)
+
+	if err := c.StartConn(ctx, pc); err != nil {
+		return err
+	}
+	return pc.ReadLoop(ctx)
+}
+
+// Pieces that we have
+func (c *TorrentClient) Bitfield() Bitfield {
+	bitfield := NewBitfield(c.PieceCount())
+	for index := 0; index < c.PieceCount(); index++ {
+		if c.HasPiece(index) {
+			bitfield.Set(index)
+		}
+	}
+	return bitfield
+}
+
+func (c *TorrentClient) MakeBitfieldMessage() *Message {
+	return &Message{ID: MsgBitfield, Payload: c.Bitfield()}
+}
+
+// Queue the requested block, if the peer is unchoked and we have the piece.
+// The block is sent by the upload goroutine of the connection, so that the
+// upload rate limits do not hold up the messages that the peer sends us.
+func (c *TorrentClient) HandleRequest(pc *PeerConn, msg *Message) error {
+	index, begin, length, err := ParseRequestMessage(msg)
+	if err != nil {
+		return err
+	}
+	if length <= 0 || length > maxRequestLength {
+		return fmt.Errorf("request: invalid length %d", length)
+	}
+	if !pc.CanRequestFromUs(index) || !c.HasPiece(index) || c.Storage == nil {
+		return rejectRequest(pc, BlockRequest{index, begin, length})
+	}
+	if int64(begin)+int64(length) > c.PieceSize(index) {
+		return fmt.Errorf("request: block %d:%d out of range", index, begin)
+	}
+	request := BlockRequest{index, begin, length}
+	if !pc.queueUpload(request) {
+		// More requests than the reqq of our extended handshake
+		return rejectRequest(pc, request)
+	}
+	pc.uploadOnce.Do(func() {
+		go c.UploadLoop(pc)
+	})
+	return nil
+}
+
+// Serve the queued requests of the peer one at a time, until the connection
+// is closed
+func (c *TorrentClient) UploadLoop(pc *PeerConn) {
+	for {
+		request, ok := pc.nextUpload()
+		if !ok {
+			select {
+			case <-pc.Done():
+				return
+			case <-pc.uploadReady:
+			}
+			continue
+		}
+		if err := c.serveRequest(pc, request); err != nil {
+			c.Log.Debugf("peer %s: %v", pc.Peer.Address(), err)
+			pc.Close()
+			return
+		}
+	}
+}
+
+func (c *TorrentClient) serveRequest(pc *PeerConn, request BlockRequest) error {
+	if !pc.CanRequestFromUs(request.Index) {
+		// Choked since the request was queued
+		return rejectRequest(pc, request)
+	}
+	if !WaitRateLimiters(pc.Done(), request.Length, c.UploadLimiter, pc.UploadLimiter) {
+		return errors.New("connection closed")
+	}
+	block, isCached := c.BlockCache.Get(request)
+	if !isCached {
+		block = make([]byte, request.Length)
+		if err := c.Storage.ReadAt(block, c.PieceOffset(request.Index)+int64(request.Begin)); err != nil {
+			// Not the fault of the peer
+			c.Log.Warnf("could not read piece %d: %v", request.Index, err)
+			return rejectRequest(pc, request)
+		}
+		c.BlockCache.Put(request, block)
+	}
+	if err := pc.SendMessage(MakePieceMessage(request.Index, request.Begin, block)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.Uploaded, int64(request.Length))
+	atomic.AddInt64(&pc.Uploaded, int64(request.Length))
+	return nil
+}
+
+// Peers that support the fast extension expect an explicit reject, the others
+// get no answer
+func rejectRequest(pc *PeerConn, request BlockRequest) error {
+	if pc.SupportsFast() {
+		return pc.SendMessage(MakeRejectRequestMessage(request.Index, request.Begin, request.Length))
+	}
+	return nil
+}
+
+// Returns false when the peer already has as many queued requests as we
+// accept
+func (pc *PeerConn) queueUpload(request BlockRequest) bool {
+	pc.stateLock.Lock()
+	if len(pc.uploadQueue) >= extendedRequestQueue {
+		pc.stateLock.Unlock()
+		return false
+	}
+	pc.uploadQueue = append(pc.uploadQueue, request)
+	pc.stateLock.Unlock()
+	select {
+	case pc.uploadReady <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (pc *PeerConn) nextUpload() (BlockRequest, bool) {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	if len(pc.uploadQueue) == 0 {
+		return BlockRequest{}, false
+	}
+	request := pc.uploadQueue[0]
+	pc.uploadQueue = pc.uploadQueue[1:]
+	return request, true
+}
+
+// The peer no longer wants the block, which is dropped if it was not sent yet
+func (pc *PeerConn) cancelUpload(request BlockRequest) {
+	pc.stateLock.Lock()
+	defer pc.stateLock.Unlock()
+	for i, queued := range pc.uploadQueue {
+		if queued == request {
+			pc.uploadQueue = append(pc.uploadQueue[:i], pc.uploadQueue[i+1:]...)
+			return
+		}
+	}
+}
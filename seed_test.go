@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenSkipsBoundPort(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+	if port+listenPortRange > 65535 {
+		t.Skip("ephemeral port at the top of the range")
+	}
+	// Skip the port if something else holds the next one
+	next, err := net.Listen("tcp", ":"+strconv.Itoa(port+1))
+	if err != nil {
+		t.Skip(err)
+	}
+	next.Close()
+
+	c := newTorrentClient()
+	c.Port = port
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.listener.Close()
+	if c.Port != port+1 {
+		t.Fatalf("listening on port %d instead of %d", c.Port, port+1)
+	}
+}
+
+func TestListenEphemeralPort(t *testing.T) {
+	c := newTorrentClient()
+	c.Port = 0
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.listener.Close()
+	if c.Port == 0 || c.Port != c.listener.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("port %d recorded for %s", c.Port, c.listener.Addr())
+	}
+}
+
+func TestServePiece(t *testing.T) {
+	info, data := makeTestInfo(2*BlockSize, 3*BlockSize)
+	seeder := startTestSeeder(t, info, data)
+	conn, err := net.Dial("tcp", loopbackPeer(seeder.Port).Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(MakeHandshake(seeder.InfoHash(), MakePeerID()))
+	if _, err := ReadHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write((&Message{ID: MsgInterested}).Serialize())
+	peerPieces := NewBitfield(seeder.PieceCount())
+	for unchoked := false; !unchoked; {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case msg == nil:
+		case msg.ID == MsgBitfield:
+			peerPieces = Bitfield(msg.Payload)
+		case msg.ID == MsgHaveAll:
+			peerPieces.Set(0)
+			peerPieces.Set(1)
+		case msg.ID == MsgUnchoke:
+			unchoked = true
+		}
+	}
+	if !peerPieces.Has(0) || !peerPieces.Has(1) {
+		t.Fatal("seeder does not advertise its pieces")
+	}
+	conn.Write(MakeRequestMessage(1, 0, BlockSize).Serialize())
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg == nil || msg.ID != MsgPiece {
+			continue
+		}
+		index, begin, block, err := ParsePieceMessage(msg)
+		if err != nil || index != 1 || begin != 0 || !bytes.Equal(block, data[2*BlockSize:]) {
+			t.Fatal("unexpected piece", index, begin, err)
+		}
+		break
+	}
+	waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&seeder.Uploaded) == BlockSize })
+}
+
+// Requests wait for the upload limit in the background, and cancelled ones
+// are not served
+func TestUploadLimitDoesNotBlockReads(t *testing.T) {
+	info, data := makeTestInfo(4*BlockSize, 4*BlockSize)
+	c := newTestClient(t, info)
+	c.Storage = NewMemoryStorage(int64(len(data)))
+	c.Storage.WriteAt(data, 0)
+	c.SetHasPiece(0)
+	// One block right away, then one every 250ms
+	c.UploadLimiter = &RateLimiter{Rate: 4 * BlockSize, Burst: BlockSize, tokens: BlockSize, last: time.Now()}
+	local, remote := net.Pipe()
+	pc := NewPeerConn(local, loopbackPeer(6881), "", c.PieceCount())
+	defer pc.Close()
+	pc.AmChoking = false
+	blocks := make(chan int, 4)
+	go func() {
+		for {
+			msg, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			_, begin, _, _ := ParsePieceMessage(msg)
+			blocks <- begin
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.HandleRequest(pc, MakeRequestMessage(0, i*BlockSize, BlockSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pc.HandleMessage(MakeCancelMessage(0, 2*BlockSize, BlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("requests handled in %v", elapsed)
+	}
+	for _, want := range []int{0, BlockSize} {
+		select {
+		case begin := <-blocks:
+			if begin != want {
+				t.Fatal("block", begin, "instead of", want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("block", want, "not sent")
+		}
+	}
+	select {
+	case begin := <-blocks:
+		t.Fatal("cancelled block", begin, "sent")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
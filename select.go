@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Restrict the download to the files that match the patterns, which are file
+// indexes or globs over the file paths. Paths of multi-file torrents may be
+// given with or without the torrent name. All files are wanted when there is
+// no pattern. Pieces that span a wanted and an unwanted file are downloaded
+// and verified entirely, but only the wanted files are created: the parts of
+// these pieces in unwanted files are kept aside, see NewFileWriter.
+func (c *TorrentClient) SelectFiles(patterns []string) error {
+	files := c.Files()
+	var wantedPieces, wantedFiles []bool
+	if len(patterns) > 0 {
+		wantedPieces = make([]bool, c.PieceCount())
+		wantedFiles = make([]bool, len(files))
+		selected := 0
+		for i, file := range files {
+			wanted, err := FileMatches(i, file, patterns)
+			if err != nil {
+				return err
+			}
+			if !wanted {
+				continue
+			}
+			wantedFiles[i] = true
+			selected++
+			if file.Length == 0 {
+				continue
+			}
+			first := int(file.Offset / c.PieceLength())
+			last := int((file.Offset + file.Length - 1) / c.PieceLength())
+			for index := first; index <= last; index++ {
+				wantedPieces[index] = true
+			}
+		}
+		if selected == 0 {
+			return errors.New("no file matches the selection " + strings.Join(patterns, ","))
+		}
+		c.Log.Infof("%d of %d files selected", selected, len(files))
+	}
+	c.piecesLock.Lock()
+	c.wantedPieces = wantedPieces
+	c.wantedFiles = wantedFiles
+	c.leftValid = false
+	c.piecesLock.Unlock()
+	return nil
+}
+
+// Whether each file is selected, nil when all files are
+func (c *TorrentClient) WantedFiles() []bool {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	return c.wantedFiles
+}
+
+func FileMatches(fileIndex int, file File, patterns []string) (bool, error) {
+	fullPath := strings.Join(file.Path, "/")
+	relativePath := strings.Join(file.Path[1:], "/")
+	for _, pattern := range patterns {
+		if index, err := strconv.Atoi(pattern); err == nil {
+			if index == fileIndex {
+				return true, nil
+			}
+			continue
+		}
+		for _, filePath := range []string{fullPath, relativePath} {
+			matched, err := path.Match(pattern, filePath)
+			if err != nil {
+				return false, errors.New("invalid selection pattern " + pattern)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (c *TorrentClient) PieceWanted(index int) bool {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	return c.pieceWanted(index)
+}
+
+// Must be called with piecesLock held
+func (c *TorrentClient) pieceWanted(index int) bool {
+	return c.wantedPieces == nil || (index < len(c.wantedPieces) && c.wantedPieces[index])
+}
+
+// Total size of the wanted pieces
+func (c *TorrentClient) WantedLength() int64 {
+	var length int64
+	for index := 0; index < c.PieceCount(); index++ {
+		if c.PieceWanted(index) {
+			length += c.PieceSize(index)
+		}
+	}
+	return length
+}
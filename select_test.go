@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectedFilesOnly(t *testing.T) {
+	info, data := makeTestInfo(16384, 20000, 20000, 20000)
+	c := newTestClient(t, info)
+	if err := c.SelectFiles([]string{"file1"}); err != nil {
+		t.Fatal(err)
+	}
+	for index, wanted := range []bool{false, true, true, false} {
+		if c.wantedPieces[index] != wanted {
+			t.Fatalf("piece %d wanted: %v", index, c.wantedPieces[index])
+		}
+	}
+	w, err := NewFileWriter(c.OutputDir, "", c.Files(), c.PieceLength(), c.WantedFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	c.Storage = w
+	names := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(c.OutputDir, "test", "*"))
+		for i := range matches {
+			matches[i] = filepath.Base(matches[i])
+		}
+		return matches
+	}
+	if got := names(); len(got) != 1 || got[0] != "file1.part" {
+		t.Fatal(got)
+	}
+	for index := 1; index <= 2; index++ {
+		offset := c.PieceOffset(index)
+		if err := w.WriteAt(data[offset:offset+c.PieceSize(index)], offset); err != nil {
+			t.Fatal(err)
+		}
+		c.SetHasPiece(index)
+		c.FinishFiles(index)
+	}
+	if got := names(); len(got) != 1 || got[0] != "file1" {
+		t.Fatal(got)
+	}
+	got, err := os.ReadFile(filepath.Join(c.OutputDir, "test", "file1"))
+	if err != nil || !bytes.Equal(got, data[20000:40000]) {
+		t.Fatal("file1 content", err)
+	}
+	if err := c.CheckFileSizes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReadAt(make([]byte, 100), 0); err == nil {
+		t.Fatal("read from an unselected file")
+	}
+}
+
+// Storage that records the offsets it is read at
+type recordingStorage struct {
+	*MemoryStorage
+	offsets []int64
+	lock    sync.Mutex
+}
+
+func (s *recordingStorage) ReadAt(data []byte, offset int64) error {
+	s.lock.Lock()
+	s.offsets = append(s.offsets, offset)
+	s.lock.Unlock()
+	return s.MemoryStorage.ReadAt(data, offset)
+}
+
+// Pieces that lie entirely in unselected files are never requested from the
+// seeder
+func TestUnselectedPiecesNotRequested(t *testing.T) {
+	info, data := makeTestInfo(16384, 20000, 20000, 20000)
+	seeder := startTestSeeder(t, info, data)
+	storage := &recordingStorage{MemoryStorage: seeder.Storage.(*MemoryStorage)}
+	seeder.Storage = storage
+	c := newTestClient(t, info)
+	c.Selection = []string{"file1"}
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.PieceCount() > 0 && c.HasPiece(1) && c.HasPiece(2) })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	if len(storage.offsets) == 0 {
+		t.Fatal("nothing requested")
+	}
+	for _, offset := range storage.offsets {
+		// Pieces 0 and 3 only overlap file0 and file2
+		if index := int(offset / c.PieceLength()); index != 1 && index != 2 {
+			t.Fatalf("block at %d of piece %d requested", offset, index)
+		}
+	}
+}
+
+// Pieces that span a selected and an unselected file can be read back, to be
+// verified again on restart and uploaded
+func TestBoundaryPiecesAreKept(t *testing.T) {
+	info, data := makeTestInfo(16384, 20000, 20000, 20000)
+	c := newTestClient(t, info)
+	if err := c.SelectFiles([]string{"file1"}); err != nil {
+		t.Fatal(err)
+	}
+	if pieces := BoundaryPieces(c.Files(), c.PieceLength(), c.WantedFiles()); len(pieces) != 2 || pieces[0] != 1 || pieces[1] != 2 {
+		t.Fatal(pieces)
+	}
+	w, err := NewFileWriter(c.OutputDir, "", c.Files(), c.PieceLength(), c.WantedFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Storage = w
+	for index := 1; index <= 2; index++ {
+		offset := c.PieceOffset(index)
+		if err := w.WriteAt(data[offset:offset+c.PieceSize(index)], offset); err != nil {
+			t.Fatal(err)
+		}
+		c.SetHasPiece(index)
+	}
+	block := make([]byte, BlockSize)
+	if err := w.ReadAt(block, c.PieceOffset(1)); err != nil || !bytes.Equal(block, data[16384:16384+BlockSize]) {
+		t.Fatal("boundary piece content", err)
+	}
+	w.Close()
+	for _, name := range []string{"file0", "file0.part", "file2", "file2.part"} {
+		if _, err := os.Stat(filepath.Join(c.OutputDir, "test", name)); !os.IsNotExist(err) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// After a restart
+	w, err = NewFileWriter(c.OutputDir, "", c.Files(), c.PieceLength(), c.WantedFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	c.Storage = w
+	for index := 1; index <= 2; index++ {
+		if !c.VerifyStoredPiece(index) {
+			t.Fatalf("piece %d does not verify", index)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 client, for the CONNECT command only
+// https://www.rfc-editor.org/rfc/rfc1928
+// https://www.rfc-editor.org/rfc/rfc1929
+
+const (
+	socksVersion          = 5
+	socksMethodNoAuth     = 0
+	socksMethodPassword   = 2
+	socksCommandConnect   = 1
+	socksAddressIPv4      = 1
+	socksAddressDomain    = 3
+	socksAddressIPv6      = 4
+	socksPasswordVersion  = 1
+	socksReplySucceeded   = 0
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+type ContextDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// Proxy for all outbound tcp connections when -proxy is set
+var proxyDialer *SOCKS5Dialer
+
+type SOCKS5Dialer struct {
+	ProxyAddress string
+	Username     string
+	Password     string
+}
+
+// Parse a socks5://[user:password@]host:port url
+func NewSOCKS5Dialer(proxyUrl string) (*SOCKS5Dialer, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing proxy address")
+	}
+	dialer := &SOCKS5Dialer{ProxyAddress: u.Host}
+	if u.User != nil {
+		dialer.Username = u.User.Username()
+		dialer.Password, _ = u.User.Password()
+	}
+	return dialer, nil
+}
+
+// Connect to the address through the proxy. Host names are resolved by the
+// proxy, so that no DNS request leaks.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("socks5: unsupported network " + network)
+	}
+	conn, err := NewBoundDialer().DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer WatchContext(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := d.handshake(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) handshake(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return errors.New("socks5: invalid port " + portString)
+	}
+
+	// Method negotiation
+	methods := []byte{socksMethodNoAuth}
+	if d.Username != "" {
+		methods = append(methods, socksMethodPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("socks5: invalid server version")
+	}
+	switch reply[1] {
+	case socksMethodNoAuth:
+	case socksMethodPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	// Connect request
+	request := []byte{socksVersion, socksCommandConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		request = append(request, socksAddressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, then the bound address, which we
+	// skip
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksReplySucceeded {
+		return fmt.Errorf("socks5: connect failed with status %d", header[1])
+	}
+	var addressLength int
+	switch header[3] {
+	case socksAddressIPv4:
+		addressLength = net.IPv4len
+	case socksAddressIPv6:
+		addressLength = net.IPv6len
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addressLength = int(length[0])
+	default:
+		return errors.New("socks5: invalid bound address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, addressLength+2))
+	return err
+}
+
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: credentials too long")
+	}
+	request := []byte{socksPasswordVersion, byte(len(d.Username))}
+	request = append(request, d.Username...)
+	request = append(request, byte(len(d.Password)))
+	request = append(request, d.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socksReplySucceeded {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// SOCKS5 server that requires the credentials, sends the address of each
+// connect request to the channel and relays the connection
+func startFakeSocksProxy(t *testing.T, username string, password string) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := acceptSocksConnect(conn, username, password)
+				if err != nil {
+					return
+				}
+				targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{socksVersion, socksReplySucceeded, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+func acceptSocksConnect(conn net.Conn, username string, password string) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{socksVersion, socksMethodPassword})
+	credentials := make([]byte, 2+len(username)+1+len(password))
+	if _, err := io.ReadFull(conn, credentials); err != nil {
+		return "", err
+	}
+	if string(credentials[2:2+len(username)]) != username || string(credentials[3+len(username):]) != password {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return "", errors.New("invalid credentials")
+	}
+	conn.Write([]byte{socksPasswordVersion, socksReplySucceeded})
+	request := make([]byte, 5)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksCommandConnect || request[3] != socksAddressDomain {
+		return "", errors.New("unexpected request")
+	}
+	address := make([]byte, int(request[4])+2)
+	if _, err := io.ReadFull(conn, address); err != nil {
+		return "", err
+	}
+	port := int(address[len(address)-2])<<8 | int(address[len(address)-1])
+	return net.JoinHostPort(string(address[:len(address)-2]), strconv.Itoa(port)), nil
+}
+
+func TestTrackerThroughSocksProxy(t *testing.T) {
+	proxyAddress, targets := startFakeSocksProxy(t, "user", "secret")
+	dialer, err := NewSOCKS5Dialer("socks5://user:secret@" + proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous *SOCKS5Dialer) { proxyDialer = previous }(proxyDialer)
+	proxyDialer = dialer
+	withTrackerHttpClient(t, NewHttpClient(nil))
+
+	announceUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe1e")
+	_, port, _ := net.SplitHostPort(announceUrl[len("http://") : len(announceUrl)-len("/announce")])
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host name is resolved by the proxy
+	response, err := c.GetPeers(context.Background(), "http://localhost:"+port+"/announce", "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 {
+		t.Fatal(response.Peers)
+	}
+	if target := <-targets; target != "localhost:"+port {
+		t.Fatal(target)
+	}
+
+	if _, err := c.GetPeers(context.Background(), "udp://localhost:"+port, "started"); err != errUdpProxied {
+		t.Fatalf("udp announce through a proxy: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Time allowed to in-flight status requests on shutdown
+const statusShutdownTimeout = 5 * time.Second
+
+// Result of the last announce to a tracker
+type TrackerStatus struct {
+	Url          string    `json:"url"`
+	LastAnnounce time.Time `json:"last_announce"`
+	NextAnnounce time.Time `json:"next_announce"`
+	// "success", "failure" when the tracker rejected the announce, "error"
+	// when it could not be reached or its response could not be parsed;
+	// empty until the first announce
+	Result string `json:"result"`
+	Peers  int    `json:"peers"`
+	Error  string `json:"error,omitempty"`
+	// Consecutive failed announces; the tracker is skipped until the next
+	// announce time while it fails
+	Failures int `json:"failures,omitempty"`
+	// Successful announces, and peers returned by the tracker that we could
+	// connect to
+	Announces   int `json:"announces"`
+	Connectable int `json:"connectable"`
+	// Swarm size returned by the last announce that included it
+	Seeders  *int64 `json:"seeders,omitempty"`
+	Leechers *int64 `json:"leechers,omitempty"`
+}
+
+// Estimated number of peers in the swarm
+type SwarmSize struct {
+	Seeders  int64 `json:"seeders"`
+	Leechers int64 `json:"leechers"`
+}
+
+const (
+	trackerSuccess = "success"
+	trackerFailure = "failure"
+	trackerError   = "error"
+)
+
+// Live state of a torrent, served as json by the status server
+type TorrentStatus struct {
+	Name     string `json:"name"`
+	InfoHash string `json:"info_hash"`
+	ProgressEvent
+	Requests RequestQueueStats `json:"requests"`
+	Trackers []TrackerStatus   `json:"trackers"`
+	Swarm    SwarmSize         `json:"swarm"`
+}
+
+func (c *TorrentClient) recordAnnounce(announceUrl string, response *AnnounceResponse, err error) {
+	now := time.Now()
+	status := TrackerStatus{Url: announceUrl, LastAnnounce: now}
+	var failureErr *TrackerFailureError
+	if errors.As(err, &failureErr) {
+		status.Result = trackerFailure
+	} else if err != nil {
+		status.Result = trackerError
+	} else {
+		status.Result = trackerSuccess
+	}
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	if c.trackerStatus == nil {
+		c.trackerStatus = map[string]TrackerStatus{}
+	}
+	previous := c.trackerStatus[announceUrl]
+	status.Announces = previous.Announces
+	status.Connectable = previous.Connectable
+	status.Seeders, status.Leechers = previous.Seeders, previous.Leechers
+	if err != nil {
+		status.Error = err.Error()
+		status.Failures = previous.Failures + 1
+		status.NextAnnounce = now.Add(TrackerBackoff(status.Failures, err))
+	} else {
+		status.Peers = len(response.Peers)
+		status.NextAnnounce = now.Add(response.NextAnnounce())
+		status.Announces++
+		if response.Seeders != nil {
+			status.Seeders = response.Seeders
+		}
+		if response.Leechers != nil {
+			status.Leechers = response.Leechers
+		}
+	}
+	c.trackerStatus[announceUrl] = status
+}
+
+// Credit the tracker with a peer that we connected to
+func (c *TorrentClient) recordConnectable(announceUrl string) {
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	if status, isKnown := c.trackerStatus[announceUrl]; isKnown {
+		status.Connectable++
+		c.trackerStatus[announceUrl] = status
+	}
+}
+
+// Connectable peers per successful announce to the tracker; false when we
+// did not announce to it successfully yet
+func (c *TorrentClient) TrackerYield(announceUrl string) (float64, bool) {
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	status := c.trackerStatus[announceUrl]
+	if status.Announces == 0 {
+		return 0, false
+	}
+	return float64(status.Connectable) / float64(status.Announces), true
+}
+
+// Trackers may share peers, so the largest counts make a better estimate of
+// the swarm size than their sum. Zero when no tracker returned them.
+func (c *TorrentClient) SwarmSize() SwarmSize {
+	var swarm SwarmSize
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	for _, status := range c.trackerStatus {
+		if status.Seeders != nil && *status.Seeders > swarm.Seeders {
+			swarm.Seeders = *status.Seeders
+		}
+		if status.Leechers != nil && *status.Leechers > swarm.Leechers {
+			swarm.Leechers = *status.Leechers
+		}
+	}
+	return swarm
+}
+
+// Reports whether the tracker failed and must not be announced to yet
+func (c *TorrentClient) isBackingOff(announceUrl string, now time.Time) bool {
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	status := c.trackerStatus[announceUrl]
+	return status.Failures > 0 && now.Before(status.NextAnnounce)
+}
+
+func (c *TorrentClient) TrackerID(announceUrl string) string {
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	return c.trackerIDs[announceUrl]
+}
+
+func (c *TorrentClient) setTrackerID(announceUrl string, trackerID string) {
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	if c.trackerIDs == nil {
+		c.trackerIDs = map[string]string{}
+	}
+	c.trackerIDs[announceUrl] = trackerID
+}
+
+func (c *TorrentClient) Status() TorrentStatus {
+	status := TorrentStatus{
+		InfoHash:      hex.EncodeToString([]byte(c.InfoHash())),
+		ProgressEvent: c.progressEvent(ProgressUpdate, 0),
+		Requests:      c.Requests.Stats(),
+	}
+	status.Name, _ = c.BdecodedInfo()["name"].(string)
+	if status.Name == "" && c.Magnet != nil {
+		status.Name = c.Magnet.DisplayName
+	}
+	status.Trackers = c.TrackerStatuses()
+	status.Swarm = c.SwarmSize()
+	return status
+}
+
+// Status of each tracker of the torrent, in the order of the tiers
+func (c *TorrentClient) TrackerStatuses() []TrackerStatus {
+	statuses := []TrackerStatus{}
+	c.trackersLock.Lock()
+	defer c.trackersLock.Unlock()
+	for _, announceUrl := range c.AnnounceUrls() {
+		tracker, isKnown := c.trackerStatus[announceUrl]
+		if !isKnown {
+			tracker = TrackerStatus{Url: announceUrl}
+		}
+		statuses = append(statuses, tracker)
+	}
+	return statuses
+}
+
+// Serve the status of the clients until the context is cancelled:
+//
+//	/healthz: "ok"
+//	/torrents: status of all torrents
+//	/torrents/<hex info hash>: status of a single torrent
+func RunStatusServer(ctx context.Context, address string, clients []*TorrentClient) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/torrents", func(w http.ResponseWriter, r *http.Request) {
+		statuses := []TorrentStatus{}
+		for _, client := range clients {
+			statuses = append(statuses, client.Status())
+		}
+		writeJson(w, statuses)
+	})
+	mux.HandleFunc("/torrents/", func(w http.ResponseWriter, r *http.Request) {
+		infoHash := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/torrents/"))
+		for _, client := range clients {
+			if hex.EncodeToString([]byte(client.InfoHash())) == infoHash {
+				writeJson(w, client.Status())
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), statusShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	DefaultLogger().Infof("status server listening on %s", listener.Addr())
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
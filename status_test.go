@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Address of a port that was free a moment ago
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestStatusServer(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetHasPiece(0)
+	address := freeAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- RunStatusServer(ctx, address, []*TorrentClient{c})
+	}()
+	waitFor(t, 5*time.Second, func() bool {
+		response, err := http.Get("http://" + address + "/healthz")
+		if err != nil {
+			return false
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body) == "ok\n"
+	})
+
+	infoHash := hex.EncodeToString([]byte(c.InfoHash()))
+	response, err := http.Get("http://" + address + "/torrents/" + infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]interface{}
+	err = json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["info_hash"] != infoHash || status["name"] != "f" {
+		t.Fatal(status)
+	}
+	trackers, _ := status["trackers"].([]interface{})
+	if len(trackers) != 1 || trackers[0].(map[string]interface{})["url"] != "http://t/" {
+		t.Fatal(status["trackers"])
+	}
+
+	var statuses []TorrentStatus
+	response, err = http.Get("http://" + address + "/torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(response.Body).Decode(&statuses)
+	response.Body.Close()
+	if err != nil || len(statuses) != 1 || statuses[0].InfoHash != infoHash {
+		t.Fatal(statuses, err)
+	}
+	if response, err := http.Get("http://" + address + "/torrents/00"); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatal(response, err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("status server still running")
+	}
+}
+
+func TestTrackerStatuses(t *testing.T) {
+	failingUrl, _ := startFakeHttpTracker(t, "d14:failure reason6:bannede")
+	workingUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers12:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x01\x00e")
+	info, _ := makeTestInfo(16384, 20000)
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{
+		"announce":      failingUrl,
+		"announce-list": []interface{}{[]interface{}{failingUrl}, []interface{}{workingUrl}},
+		"info":          info,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Log = &captureLogger{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.AnnounceLoop(ctx)
+		close(done)
+	}()
+	waitFor(t, 5*time.Second, func() bool { return !c.TrackerStatuses()[1].LastAnnounce.IsZero() })
+	cancel()
+	<-done
+
+	statuses := c.Status().Trackers
+	if len(statuses) != 2 || statuses[0].Url != failingUrl || statuses[1].Url != workingUrl {
+		t.Fatal(statuses)
+	}
+	failing, working := statuses[0], statuses[1]
+	if failing.Result != trackerFailure || failing.Error != "tracker failure: banned" || failing.Failures != 1 || failing.Peers != 0 {
+		t.Fatalf("%+v", failing)
+	}
+	if working.Result != trackerSuccess || working.Error != "" || working.Peers != 2 || working.Announces != 1 {
+		t.Fatalf("%+v", working)
+	}
+	if !working.NextAnnounce.After(working.LastAnnounce.Add(800 * time.Second)) {
+		t.Fatal(working.LastAnnounce, working.NextAnnounce)
+	}
+}
+
+func TestSwarmCountsFromAnnounces(t *testing.T) {
+	bothUrl, _ := startFakeHttpTracker(t, "d8:completei12e10:incompletei30e8:intervali900e5:peers0:e")
+	seedersUrl, _ := startFakeHttpTracker(t, "d8:completei20e8:intervali900e5:peers0:e")
+	neitherUrl, _ := startFakeHttpTracker(t, "d8:intervali900e5:peers0:e")
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, announceUrl := range []string{bothUrl, seedersUrl, neitherUrl} {
+		response, err := c.GetPeers(context.Background(), announceUrl, "started")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.recordAnnounce(announceUrl, response, nil)
+	}
+	statuses := c.trackerStatus
+	if both := statuses[bothUrl]; both.Seeders == nil || *both.Seeders != 12 || both.Leechers == nil || *both.Leechers != 30 {
+		t.Fatalf("%+v", both)
+	}
+	if seeders := statuses[seedersUrl]; seeders.Seeders == nil || *seeders.Seeders != 20 || seeders.Leechers != nil {
+		t.Fatalf("%+v", seeders)
+	}
+	if neither := statuses[neitherUrl]; neither.Seeders != nil || neither.Leechers != nil {
+		t.Fatalf("%+v", neither)
+	}
+	if swarm := c.Status().Swarm; swarm != (SwarmSize{Seeders: 20, Leechers: 30}) {
+		t.Fatal(swarm)
+	}
+
+	// A response without the counts keeps the previous ones
+	response, err := c.GetPeers(context.Background(), neitherUrl, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.recordAnnounce(bothUrl, response, nil)
+	if both := c.trackerStatus[bothUrl]; both.Seeders == nil || *both.Seeders != 12 || both.Announces != 2 {
+		t.Fatalf("%+v", both)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync"
+)
+
+// Backend that holds the data of a torrent. Offsets are in the piece space,
+// the concatenation of all files in order.
+type Storage interface {
+	// Fill data with the bytes stored at the offset
+	ReadAt(data []byte, offset int64) error
+	WriteAt(data []byte, offset int64) error
+	// Reports whether the length bytes stored at the offset match the hash
+	Verify(offset int64, length int64, hash [20]byte) (bool, error)
+	Close() error
+}
+
+// Read the bytes and compare their hash, for backends that cannot do better
+func verifyStorage(s Storage, offset int64, length int64, hash [20]byte) (bool, error) {
+	data := make([]byte, length)
+	if err := s.ReadAt(data, offset); err != nil {
+		return false, err
+	}
+	return sha1.Sum(data) == hash, nil
+}
+
+var errStorageRange = errors.New("storage: offset out of range")
+
+// Storage that keeps all data in memory
+type MemoryStorage struct {
+	data []byte
+	lock sync.RWMutex
+}
+
+func NewMemoryStorage(length int64) *MemoryStorage {
+	return &MemoryStorage{data: make([]byte, length)}
+}
+
+func (s *MemoryStorage) ReadAt(data []byte, offset int64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if offset < 0 || offset+int64(len(data)) > int64(len(s.data)) {
+		return errStorageRange
+	}
+	copy(data, s.data[offset:])
+	return nil
+}
+
+func (s *MemoryStorage) WriteAt(data []byte, offset int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if offset < 0 || offset+int64(len(data)) > int64(len(s.data)) {
+		return errStorageRange
+	}
+	copy(s.data[offset:], data)
+	return nil
+}
+
+// Hash the data in place, without copying it
+func (s *MemoryStorage) Verify(offset int64, length int64, hash [20]byte) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if offset < 0 || length < 0 || offset+length > int64(len(s.data)) {
+		return false, errStorageRange
+	}
+	return sha1.Sum(s.data[offset:offset+length]) == hash, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// Reports whether the stored data of the piece matches its hash
+func (c *TorrentClient) VerifyStoredPiece(index int) bool {
+	hashes, err := c.PieceHashes()
+	if err != nil || index < 0 || index >= len(hashes) {
+		return false
+	}
+	valid, err := c.Storage.Verify(c.PieceOffset(index), c.PieceSize(index), hashes[index])
+	return err == nil && valid
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(10)
+	if err := s.WriteAt([]byte("abcd"), 3); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 6)
+	if err := s.ReadAt(data, 2); err != nil || !bytes.Equal(data, []byte("\x00abcd\x00")) {
+		t.Fatal(data, err)
+	}
+	if valid, err := s.Verify(3, 4, sha1.Sum([]byte("abcd"))); !valid || err != nil {
+		t.Fatal(valid, err)
+	}
+	if valid, err := s.Verify(2, 4, sha1.Sum([]byte("abcd"))); valid || err != nil {
+		t.Fatal(valid, err)
+	}
+	if valid, err := verifyStorage(s, 3, 4, sha1.Sum([]byte("abcd"))); !valid || err != nil {
+		t.Fatal(valid, err)
+	}
+	if err := s.WriteAt([]byte("abcd"), 7); err != errStorageRange {
+		t.Fatal(err)
+	}
+	if err := s.ReadAt(data, -1); err != errStorageRange {
+		t.Fatal(err)
+	}
+	if _, err := s.Verify(8, 4, [20]byte{}); err != errStorageRange {
+		t.Fatal(err)
+	}
+}
+
+// A download to memory writes no file
+func TestDownloadToMemoryStorage(t *testing.T) {
+	info, data := makeTestInfo(16384, 30000, 20000)
+	seeder := startTestSeeder(t, info, data)
+	c := newTestClient(t, info)
+	storage := NewMemoryStorage(int64(len(data)))
+	c.Storage = storage
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	runUntilComplete(t, c)
+	got := make([]byte, len(data))
+	if err := storage.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("corrupt download", err)
+	}
+	for index := 0; index < c.PieceCount(); index++ {
+		if !c.VerifyStoredPiece(index) {
+			t.Fatal(index)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.OutputDir, "test")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+)
+
+// Metadata summary of a torrent, printed as json with the -info flag
+type TorrentInfo struct {
+	Name          string        `json:"name"`
+	InfoHash      string        `json:"info_hash"`
+	TotalLength   int64         `json:"total_length"`
+	PieceLength   int64         `json:"piece_length"`
+	PieceCount    int           `json:"piece_count"`
+	AnnounceTiers [][]string    `json:"announce_tiers"`
+	Files         []FileSummary `json:"files"`
+	CreationDate  int64         `json:"creation_date,omitempty"`
+	Comment       string        `json:"comment,omitempty"`
+	CreatedBy     string        `json:"created_by,omitempty"`
+	Source        string        `json:"source,omitempty"`
+}
+
+type FileSummary struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+func (c *TorrentClient) Summary() TorrentInfo {
+	summary := TorrentInfo{
+		InfoHash:      hex.EncodeToString([]byte(c.InfoHash())),
+		TotalLength:   c.TotalLength(),
+		PieceLength:   c.PieceLength(),
+		PieceCount:    c.PieceCount(),
+		AnnounceTiers: c.AnnounceTiers(),
+		Files:         []FileSummary{},
+	}
+	summary.Name, _ = c.BdecodedInfo()["name"].(string)
+	if summary.Name == "" && c.Magnet != nil {
+		summary.Name = c.Magnet.DisplayName
+	}
+	if summary.AnnounceTiers == nil {
+		summary.AnnounceTiers = [][]string{}
+	}
+	for _, file := range c.Files() {
+		summary.Files = append(summary.Files, FileSummary{
+			Path:   strings.Join(file.Path, "/"),
+			Length: file.Length,
+		})
+	}
+	if creationDate := c.CreationDate(); !creationDate.IsZero() {
+		summary.CreationDate = creationDate.Unix()
+	}
+	summary.Comment = c.Comment()
+	summary.CreatedBy = c.CreatedBy()
+	summary.Source = c.Source()
+	return summary
+}
+
+func (c *TorrentClient) Comment() string {
+	comment, _ := c.Metadata("comment").(string)
+	return comment
+}
+
+func (c *TorrentClient) CreatedBy() string {
+	createdBy, _ := c.Metadata("created by").(string)
+	return createdBy
+}
+
+// Zero when the torrent has no creation date
+func (c *TorrentClient) CreationDate() time.Time {
+	creationDate, isInteger := c.Metadata("creation date").(int64)
+	if !isInteger {
+		return time.Time{}
+	}
+	return time.Unix(creationDate, 0)
+}
+
+// Source tag of the info dictionary, set by some private trackers so that
+// cross-seeded torrents get a different info hash
+func (c *TorrentClient) Source() string {
+	source, _ := c.BdecodedInfo()["source"].(string)
+	return source
+}
+
+// Print the summary of each torrent as a json document per line, and return
+// the number of torrents that could not be loaded
+func PrintSummaries(ctx context.Context, torrentFilePaths []string) int {
+	failedCount := 0
+	logger := DefaultLogger()
+	encoder := json.NewEncoder(os.Stdout)
+	for _, path := range torrentFilePaths {
+		client, err := LoadClient(ctx, path)
+		if err != nil {
+			logger.Errorf("%s: %v", path, err)
+			failedCount++
+			continue
+		}
+		if err := encoder.Encode(client.Summary()); err != nil {
+			logger.Errorf("%s: %v", path, err)
+			failedCount++
+		}
+	}
+	return failedCount
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryJson(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("dir.torrent", []byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(c.Summary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal(encoded, &summary); err != nil {
+		t.Fatal(err)
+	}
+	rawInfo := testMultiFileTorrent[strings.Index(testMultiFileTorrent, "4:info")+6 : len(testMultiFileTorrent)-1]
+	infoHash := sha1.Sum([]byte(rawInfo))
+	if summary["info_hash"] != hex.EncodeToString(infoHash[:]) || summary["name"] != "dir" || summary["piece_count"] != 3.0 {
+		t.Fatal(string(encoded))
+	}
+	files, _ := summary["files"].([]interface{})
+	if len(files) != 3 || files[2].(map[string]interface{})["path"] != "dir/sub/b" {
+		t.Fatal(string(encoded))
+	}
+	if _, hasComment := summary["comment"]; hasComment {
+		t.Fatal(string(encoded))
+	}
+}
+
+func TestTorrentMetadataFields(t *testing.T) {
+	torrent := "d8:announce9:http://t/7:comment5:hello10:created by9:slivers/113:creation datei1700000000e" +
+		"4:infod6:lengthi20000e4:name1:f12:piece lengthi16384e6:pieces40:0123456789012345678901234567890123456789" +
+		"6:source3:abcee"
+	c, err := NewTorrentClientFromBytes("meta.torrent", []byte(torrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Comment() != "hello" || c.CreatedBy() != "slivers/1" || c.Source() != "abc" {
+		t.Fatal(c.Comment(), c.CreatedBy(), c.Source())
+	}
+	if !c.CreationDate().Equal(time.Unix(1700000000, 0)) {
+		t.Fatal(c.CreationDate())
+	}
+	summary := c.Summary()
+	if summary.Comment != "hello" || summary.CreatedBy != "slivers/1" || summary.CreationDate != 1700000000 || summary.Source != "abc" {
+		t.Fatal(summary)
+	}
+
+	// The source is part of the info hash
+	plain, err := NewTorrentClientFromBytes("plain.torrent", []byte(strings.Replace(torrent, "6:source3:abc", "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.InfoHash() == c.InfoHash() {
+		t.Fatal("same info hash")
+	}
+	if plain.Source() != "" || !plain.CreationDate().Equal(c.CreationDate()) {
+		t.Fatal(plain.Source(), plain.CreationDate())
+	}
+	absent, err := NewTorrentClientFromBytes("dir.torrent", []byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if absent.Comment() != "" || absent.CreatedBy() != "" || !absent.CreationDate().IsZero() || absent.Source() != "" {
+		t.Fatal("unexpected metadata")
+	}
+}
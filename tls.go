@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var trackerHttpClient *http.Client
+var trackerHttpClientOnce sync.Once
+
+// Client used for http and https tracker requests, configured from the
+// command line flags. Certificates are verified unless -tls-insecure is set.
+func TrackerHttpClient() *http.Client {
+	trackerHttpClientOnce.Do(func() {
+		if trackerHttpClient != nil {
+			return
+		}
+		tlsConfig := &tls.Config{}
+		if *tlsRootCAs != "" {
+			rootCAs, err := LoadCertPool(*tlsRootCAs)
+			if err != nil {
+				DefaultLogger().Errorf("%s: %v, using the system root certificates", *tlsRootCAs, err)
+			} else {
+				tlsConfig.RootCAs = rootCAs
+			}
+		}
+		if *tlsInsecure {
+			DefaultLogger().Warnf("tracker certificates are not verified: connections to https trackers are not secure")
+			tlsConfig.InsecureSkipVerify = true
+		}
+		trackerHttpClient = NewHttpClient(tlsConfig)
+	})
+	return trackerHttpClient
+}
+
+// Replace the client used for tracker requests; must be called before the
+// first request
+func SetTrackerHttpClient(client *http.Client) {
+	trackerHttpClient = client
+}
+
+// Redirects followed by a request before giving up
+const httpMaxRedirects = 5
+
+// Returned when a tracker redirects to a url that cannot be fetched over http,
+// like a udp tracker
+type RedirectSchemeError struct {
+	Url *url.URL
+}
+
+func (e *RedirectSchemeError) Error() string {
+	return "redirected to " + e.Url.String()
+}
+
+// Trackers may redirect to an url without the announce parameters, which are
+// then carried over
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= httpMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", httpMaxRedirects)
+	}
+	if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+		return &RedirectSchemeError{request.URL}
+	}
+	if previous := via[len(via)-1]; request.URL.RawQuery == "" {
+		request.URL.RawQuery = previous.URL.RawQuery
+	}
+	return nil
+}
+
+func NewHttpClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if bindIP != nil {
+		dialer := NewBoundDialer()
+		dialer.Timeout = 30 * time.Second
+		dialer.KeepAlive = 30 * time.Second
+		transport.DialContext = dialer.DialContext
+	}
+	if proxyDialer != nil {
+		// Ignore the proxy environment variables so that no request
+		// bypasses the socks proxy
+		transport.Proxy = nil
+		transport.DialContext = proxyDialer.DialContext
+	}
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+		Timeout:       *httpTimeout,
+	}
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found")
+	}
+	return pool, nil
+}
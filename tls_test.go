@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Use the client for tracker requests until the test ends
+func withTrackerHttpClient(t *testing.T, client *http.Client) {
+	t.Helper()
+	previous := TrackerHttpClient()
+	SetTrackerHttpClient(client)
+	t.Cleanup(func() { SetTrackerHttpClient(previous) })
+}
+
+func TestHttpsTracker(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe1e"))
+	}))
+	// Rejected handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test certificate is self-signed
+	withTrackerHttpClient(t, NewHttpClient(&tls.Config{}))
+	if _, err := c.GetPeers(context.Background(), server.URL+"/announce", "started"); err == nil {
+		t.Fatal("unverified certificate accepted")
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	for _, tlsConfig := range []*tls.Config{{RootCAs: rootCAs}, {InsecureSkipVerify: true}} {
+		withTrackerHttpClient(t, NewHttpClient(tlsConfig))
+		response, err := c.GetPeers(context.Background(), server.URL+"/announce", "started")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Peers) != 1 || response.Peers[0].Address() != "1.2.3.4:6881" {
+			t.Fatal(response.Peers)
+		}
+	}
+}
+
+func TestHttpAnnounceRedirect(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/announce":
+			// Relative location without the announce parameters
+			w.Header().Set("Location", "/real")
+			w.WriteHeader(http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop?"+r.URL.RawQuery, http.StatusFound)
+		default:
+			queries <- r.URL.Query()
+			w.Write([]byte("d8:intervali900e5:peers6:\x01\x02\x03\x04\x1a\xe1e"))
+		}
+	}))
+	defer server.Close()
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := c.GetPeers(context.Background(), server.URL+"/announce", "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Address() != "1.2.3.4:6881" {
+		t.Fatal(response.Peers)
+	}
+	if query := <-queries; query.Get("info_hash") != c.InfoHash() || query.Get("event") != "started" {
+		t.Fatal(query)
+	}
+	if _, err := c.GetPeers(context.Background(), server.URL+"/loop", "started"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Fatal(err)
+	}
+}
+
+func TestRedirectToUdpTracker(t *testing.T) {
+	previous, _ := http.NewRequest("GET", "http://tracker/announce?info_hash=x", nil)
+	request, _ := http.NewRequest("GET", "udp://tracker:6969/announce", nil)
+	var redirectErr *RedirectSchemeError
+	if err := checkRedirect(request, []*http.Request{previous}); !errors.As(err, &redirectErr) || redirectErr.Url.Host != "tracker:6969" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// UDP tracker protocol
+// http://www.bittorrent.org/beps/bep_0015.html
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpEventNone      = 0
+	udpEventCompleted = 1
+	udpEventStarted   = 2
+	udpEventStopped   = 3
+
+	// BEP 15 retransmits requests with n going up to 8, more than two hours
+	// during which the other trackers of the tier would not be tried: we give
+	// up after n = 2, less than two minutes
+	udpMaxRetries = 2
+)
+
+// Requests are retransmitted after udpBaseTimeout * 2 ^ n
+var udpBaseTimeout = 15 * time.Second
+
+var errUdpProxied = errors.New("udp trackers cannot be used through a socks5 proxy")
+
+var udpEvents = map[string]uint32{
+	"":          udpEventNone,
+	"completed": udpEventCompleted,
+	"started":   udpEventStarted,
+	"stopped":   udpEventStopped,
+}
+
+func (c *TorrentClient) GetUdpPeers(ctx context.Context, announceUrl string, event string) (*AnnounceResponse, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", bindUDPAddr(), addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer WatchContext(ctx, conn)()
+
+	connectionID, err := UdpConnect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 98)
+	binary.BigEndian.PutUint64(request[0:8], connectionID)
+	binary.BigEndian.PutUint32(request[8:12], udpActionAnnounce)
+	copy(request[16:36], c.InfoHash())
+	copy(request[36:56], c.PeerID)
+	binary.BigEndian.PutUint64(request[56:64], uint64(atomic.LoadInt64(&c.Downloaded)))
+	binary.BigEndian.PutUint64(request[64:72], uint64(c.Left()))
+	binary.BigEndian.PutUint64(request[72:80], uint64(atomic.LoadInt64(&c.Uploaded)))
+	binary.BigEndian.PutUint32(request[80:84], udpEvents[event])
+	binary.BigEndian.PutUint32(request[88:92], c.TrackerKey)
+	binary.BigEndian.PutUint32(request[92:96], uint32(c.numWant(event)))
+	binary.BigEndian.PutUint16(request[96:98], uint16(c.Port))
+	response, err := UdpTransaction(ctx, conn, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 20 {
+		return nil, errors.New("udp tracker: announce response too short")
+	}
+	leechers := int64(binary.BigEndian.Uint32(response[12:16]))
+	seeders := int64(binary.BigEndian.Uint32(response[16:20]))
+	announceResponse := &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(response[8:12])) * time.Second,
+		Seeders:  &seeders,
+		Leechers: &leechers,
+	}
+	// Trackers reached over IPv6 return 18 bytes peer records
+	if addr.IP.To4() == nil {
+		announceResponse.Peers = DecodePeers6(string(response[20:]))
+	} else {
+		announceResponse.Peers = DecodePeers(string(response[20:]))
+	}
+	return announceResponse, nil
+}
+
+// Obtain a connection ID from the tracker
+func UdpConnect(ctx context.Context, conn net.Conn) (uint64, error) {
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(request[8:12], udpActionConnect)
+	response, err := UdpTransaction(ctx, conn, request)
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 16 {
+		return 0, errors.New("udp tracker: connect response too short")
+	}
+	return binary.BigEndian.Uint64(response[8:16]), nil
+}
+
+// Send a request and wait for the matching response. The action is read from
+// bytes 8-12 of the request and a fresh transaction ID is written to bytes
+// 12-16; both are expected to be echoed at the start of the response.
+func UdpTransaction(ctx context.Context, conn net.Conn, request []byte) ([]byte, error) {
+	action := binary.BigEndian.Uint32(request[8:12])
+	transactionID := random.Uint32()
+	binary.BigEndian.PutUint32(request[12:16], transactionID)
+
+	response := make([]byte, 65536)
+	for n := uint(0); n <= udpMaxRetries; n++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(udpBaseTimeout << n))
+		for {
+			length, err := conn.Read(response)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if length < 8 || binary.BigEndian.Uint32(response[4:8]) != transactionID {
+				// Stray or stale response: keep waiting
+				continue
+			}
+			switch binary.BigEndian.Uint32(response[0:4]) {
+			case action:
+				return response[:length], nil
+			case udpActionError:
+				return nil, &TrackerFailureError{Reason: string(response[8:length])}
+			default:
+				return nil, errors.New("udp tracker: unexpected action in response")
+			}
+		}
+	}
+	return nil, errors.New("udp tracker: no response")
+}
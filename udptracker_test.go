@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// UDP tracker on the loopback interface that answers each request with the
+// datagrams returned by respond. Returns the announce url.
+func startFakeUdpTracker(t *testing.T, respond func(request []byte) [][]byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			length, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			for _, response := range respond(append([]byte{}, buffer[:length]...)) {
+				conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func makeUdpResponse(action uint32, transactionID []byte, body []byte) []byte {
+	response := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(response[0:4], action)
+	copy(response[4:8], transactionID)
+	return append(response, body...)
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	const connectionID = 0x1122334455667788
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Port = 6881
+	announces := make(chan []byte, 1)
+	announceUrl := startFakeUdpTracker(t, func(request []byte) [][]byte {
+		transactionID := request[12:16]
+		stray := makeUdpResponse(binary.BigEndian.Uint32(request[8:12]), []byte("xxxx"), make([]byte, 20))
+		switch binary.BigEndian.Uint32(request[8:12]) {
+		case udpActionConnect:
+			if binary.BigEndian.Uint64(request[0:8]) != udpProtocolID {
+				return nil
+			}
+			body := make([]byte, 8)
+			binary.BigEndian.PutUint64(body, connectionID)
+			return [][]byte{stray, makeUdpResponse(udpActionConnect, transactionID, body)}
+		case udpActionAnnounce:
+			if binary.BigEndian.Uint64(request[0:8]) != connectionID {
+				return [][]byte{makeUdpResponse(udpActionError, transactionID, []byte("bad connection id"))}
+			}
+			announces <- request
+			body := []byte{0, 0, 7, 8, 0, 0, 0, 3, 0, 0, 0, 4, 1, 2, 3, 4, 0x1a, 0xe1, 5, 6, 7, 8, 1, 0}
+			return [][]byte{stray, makeUdpResponse(udpActionAnnounce, transactionID, body)}
+		}
+		return nil
+	})
+
+	response, err := c.GetPeers(context.Background(), announceUrl, "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 2 || response.Peers[0].Address() != "1.2.3.4:6881" || response.Peers[1].Address() != "5.6.7.8:256" {
+		t.Fatal(response.Peers)
+	}
+	if response.Interval.Seconds() != 0x0708 || *response.Leechers != 3 || *response.Seeders != 4 {
+		t.Fatal(response.Interval, *response.Leechers, *response.Seeders)
+	}
+	announce := <-announces
+	if string(announce[16:36]) != c.InfoHash() || binary.BigEndian.Uint64(announce[64:72]) != 20000 ||
+		binary.BigEndian.Uint32(announce[80:84]) != udpEventStarted || binary.BigEndian.Uint16(announce[96:98]) != 6881 {
+		t.Fatalf("announce request %x", announce)
+	}
+}
+
+func TestUdpTrackerError(t *testing.T) {
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	announceUrl := startFakeUdpTracker(t, func(request []byte) [][]byte {
+		return [][]byte{makeUdpResponse(udpActionError, request[12:16], []byte("torrent not registered"))}
+	})
+	_, err = c.GetPeers(context.Background(), announceUrl, "")
+	if failure, isFailure := err.(*TrackerFailureError); !isFailure || failure.Reason != "torrent not registered" {
+		t.Fatal(err)
+	}
+}
+
+func TestUdpTrackerGivesUp(t *testing.T) {
+	defer func(timeout time.Duration) { udpBaseTimeout = timeout }(udpBaseTimeout)
+	udpBaseTimeout = 10 * time.Millisecond
+	c, err := NewTorrentClientFromBytes("test.torrent", []byte(testTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int64
+	announceUrl := startFakeUdpTracker(t, func(request []byte) [][]byte {
+		atomic.AddInt64(&requests, 1)
+		return nil
+	})
+	if _, err := c.GetPeers(context.Background(), announceUrl, ""); err == nil {
+		t.Fatal("announce to a silent tracker succeeded")
+	}
+	if requests := atomic.LoadInt64(&requests); requests != udpMaxRetries+1 {
+		t.Fatalf("%d requests", requests)
+	}
+}
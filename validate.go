@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Bounds of the piece length: smaller pieces make huge piece lists, larger
+// ones huge allocations
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+)
+
+// Check the presence and types of the fields that we rely on, so that
+// accessors can assume a well-formed torrent
+// http://www.bittorrent.org/beps/bep_0003.html#metainfo-files
+func (c *TorrentClient) Validate() error {
+	info := c.Metadata("info")
+	if info == nil {
+		return fieldError("info", "is missing")
+	}
+	infoDict, isDict := info.(map[string]interface{})
+	if !isDict {
+		return fieldError("info", "must be a dictionary")
+	}
+	return ValidateInfo(infoDict)
+}
+
+func ValidateInfo(info map[string]interface{}) error {
+	if err := checkField(info, "info.", "name", "string"); err != nil {
+		return err
+	}
+	if err := checkField(info, "info.", "piece length", "integer"); err != nil {
+		return err
+	}
+	pieceLength := info["piece length"].(int64)
+	if pieceLength <= 0 {
+		return fieldError("info.piece length", "must be positive")
+	}
+	if pieceLength&(pieceLength-1) != 0 {
+		return fieldError("info.piece length", "must be a power of two")
+	}
+	if pieceLength < minPieceLength || pieceLength > maxPieceLength {
+		return fieldError("info.piece length", fmt.Sprintf("must be between %d and %d", minPieceLength, maxPieceLength))
+	}
+	if err := checkField(info, "info.", "pieces", "string"); err != nil {
+		return err
+	}
+	if len(info["pieces"].(string))%20 != 0 {
+		return fieldError("info.pieces", "length must be a multiple of 20")
+	}
+
+	_, hasLength := info["length"]
+	_, hasFiles := info["files"]
+	if hasLength == hasFiles {
+		return fieldError("info", "must have exactly one of length or files")
+	}
+	var totalLength int64
+	if hasLength {
+		if err := checkField(info, "info.", "length", "integer"); err != nil {
+			return err
+		}
+		totalLength = info["length"].(int64)
+		if totalLength < 0 {
+			return fieldError("info.length", "must not be negative")
+		}
+		return checkPieceCount(info, totalLength, pieceLength)
+	}
+	if err := checkField(info, "info.", "files", "list"); err != nil {
+		return err
+	}
+	for i, fileValue := range info["files"].([]interface{}) {
+		prefix := fmt.Sprintf("info.files[%d].", i)
+		fileDict, isDict := fileValue.(map[string]interface{})
+		if !isDict {
+			return fieldError(prefix[:len(prefix)-1], "must be a dictionary")
+		}
+		if err := checkField(fileDict, prefix, "length", "integer"); err != nil {
+			return err
+		}
+		fileLength := fileDict["length"].(int64)
+		if fileLength < 0 {
+			return fieldError(prefix+"length", "must not be negative")
+		}
+		totalLength += fileLength
+		if totalLength < 0 {
+			return fieldError(prefix+"length", "overflows the total length")
+		}
+		if err := checkField(fileDict, prefix, "path", "list"); err != nil {
+			return err
+		}
+		for _, pathComponent := range fileDict["path"].([]interface{}) {
+			if _, isString := pathComponent.(string); !isString {
+				return fieldError(prefix+"path", "must be a list of strings")
+			}
+		}
+	}
+	return checkPieceCount(info, totalLength, pieceLength)
+}
+
+// There must be one hash per piece of the content: the total length must be
+// more than the length of all pieces but the last one, and at most the length
+// of all pieces
+func checkPieceCount(info map[string]interface{}, totalLength int64, pieceLength int64) error {
+	if hashCount := int64(len(info["pieces"].(string)) / 20); hashCount != ceilDiv(totalLength, pieceLength) {
+		return fieldError("info.pieces", fmt.Sprintf("has %d hashes but %d bytes make %d pieces of %d bytes",
+			hashCount, totalLength, ceilDiv(totalLength, pieceLength), pieceLength))
+	}
+	return nil
+}
+
+// Quotient rounded up, without overflowing for large dividends
+func ceilDiv(a int64, b int64) int64 {
+	quotient := a / b
+	if a%b != 0 {
+		quotient++
+	}
+	return quotient
+}
+
+// Check that dict[key] is present and has the expected bencode type
+func checkField(dict map[string]interface{}, prefix string, key string, expectedType string) error {
+	value, isPresent := dict[key]
+	if !isPresent {
+		return fieldError(prefix+key, "is missing")
+	}
+	var isValid bool
+	switch expectedType {
+	case "string":
+		_, isValid = value.(string)
+	case "integer":
+		_, isValid = value.(int64)
+	case "list":
+		_, isValid = value.([]interface{})
+	case "dictionary":
+		_, isValid = value.(map[string]interface{})
+	}
+	if !isValid {
+		return fieldError(prefix+key, "must be a "+expectedType)
+	}
+	return nil
+}
+
+func fieldError(field string, reason string) error {
+	return fmt.Errorf("invalid torrent: field %s %s", field, reason)
+}
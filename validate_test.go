@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRequiredFields(t *testing.T) {
+	tests := []struct {
+		edit func(info map[string]interface{})
+		err  string
+	}{
+		{func(info map[string]interface{}) { delete(info, "name") }, "field info.name is missing"},
+		{func(info map[string]interface{}) { info["name"] = int64(1) }, "field info.name must be a string"},
+		{func(info map[string]interface{}) { delete(info, "piece length") }, "field info.piece length is missing"},
+		{func(info map[string]interface{}) { info["piece length"] = "16384" }, "field info.piece length must be a integer"},
+		{func(info map[string]interface{}) { info["piece length"] = int64(20000) }, "field info.piece length must be a power of two"},
+		{func(info map[string]interface{}) { delete(info, "pieces") }, "field info.pieces is missing"},
+		{func(info map[string]interface{}) { info["pieces"] = info["pieces"].(string)[1:] }, "field info.pieces length must be a multiple of 20"},
+		{func(info map[string]interface{}) { info["pieces"] = info["pieces"].(string)[20:] }, "field info.pieces has 1 hashes but 20000 bytes make 2 pieces"},
+		{func(info map[string]interface{}) { delete(info, "length") }, "field info must have exactly one of length or files"},
+		{func(info map[string]interface{}) { info["files"] = []interface{}{} }, "field info must have exactly one of length or files"},
+		{func(info map[string]interface{}) { info["length"] = int64(-1) }, "field info.length must not be negative"},
+		{func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{map[string]interface{}{"length": int64(20000)}}
+		}, "field info.files[0].path is missing"},
+		{func(info map[string]interface{}) {
+			delete(info, "length")
+			info["files"] = []interface{}{map[string]interface{}{"length": int64(20000), "path": []interface{}{int64(1)}}}
+		}, "field info.files[0].path must be a list of strings"},
+	}
+	for _, test := range tests {
+		info, _ := makeTestInfo(16384, 20000)
+		test.edit(info)
+		_, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v instead of %s", err, test.err)
+		}
+	}
+
+	if _, err := NewTorrentClientFromBytes("test.torrent", []byte("d8:announce9:http://t/e")); err == nil || !strings.Contains(err.Error(), "field info is missing") {
+		t.Error(err)
+	}
+	info, _ := makeTestInfo(16384, 20000)
+	if _, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidatePieceLength(t *testing.T) {
+	for pieceLength, want := range map[int64]string{
+		0:        "field info.piece length must be positive",
+		-16384:   "field info.piece length must be positive",
+		3 << 14:  "field info.piece length must be a power of two",
+		8192:     "field info.piece length must be between 16384 and 16777216",
+		32 << 20: "field info.piece length must be between 16384 and 16777216",
+	} {
+		info, _ := makeTestInfo(16384, 20000)
+		info["piece length"] = pieceLength
+		_, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("piece length %d: %v instead of %s", pieceLength, err, want)
+		}
+	}
+
+	// More hashes than pieces
+	info, _ := makeTestInfo(16384, 20000)
+	info["pieces"] = info["pieces"].(string) + strings.Repeat("x", 20)
+	_, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info))
+	if want := "field info.pieces has 3 hashes but 20000 bytes make 2 pieces"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("%v instead of %s", err, want)
+	}
+}
+
+func TestValidateTotalLength(t *testing.T) {
+	multiFile := func(lengths ...int64) func(info map[string]interface{}) {
+		return func(info map[string]interface{}) {
+			delete(info, "length")
+			var files []interface{}
+			for _, length := range lengths {
+				files = append(files, map[string]interface{}{"length": length, "path": []interface{}{"f"}})
+			}
+			info["files"] = files
+		}
+	}
+	tests := []struct {
+		edit func(info map[string]interface{})
+		err  string
+	}{
+		{multiFile(1<<62, 1<<62), "field info.files[1].length overflows the total length"},
+		// More than 32 bits, which would wrap in an int on 32-bit platforms
+		{multiFile(3<<30, 3<<30), "field info.pieces has 2 hashes but 6442450944 bytes make 393216 pieces of 16384 bytes"},
+		{multiFile(10000, 10000, 12769), "field info.pieces has 2 hashes but 32769 bytes make 3 pieces"},
+		{func(info map[string]interface{}) { info["length"] = int64(16384) }, "field info.pieces has 2 hashes but 16384 bytes make 1 pieces"},
+		{func(info map[string]interface{}) { info["length"] = int64(0) }, "field info.pieces has 2 hashes but 0 bytes make 0 pieces"},
+	}
+	for _, test := range tests {
+		info, _ := makeTestInfo(16384, 20000)
+		test.edit(info)
+		_, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v instead of %s", err, test.err)
+		}
+	}
+
+	// The last piece may be short, down to a single byte, or full
+	for _, lengths := range [][]int64{{16385}, {32768}, {10000, 0, 22768}} {
+		info, _ := makeTestInfo(16384, 20000)
+		multiFile(lengths...)(info)
+		if _, err := NewTorrentClientFromBytes("test.torrent", encodeTestTorrent(t, "http://t/", info)); err != nil {
+			t.Error(lengths, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Web seeds, GetRight style
+// http://www.bittorrent.org/beps/bep_0019.html
+
+const (
+	// Web seeds are only used when we are connected to fewer peers
+	webSeedMaxPeers         = 5
+	webSeedIdleInterval     = 5 * time.Second
+	webSeedMinRetryInterval = 30 * time.Second
+	webSeedMaxRetryInterval = 10 * time.Minute
+)
+
+// Http urls of the url-list key, which may be a single string or a list
+func (c *TorrentClient) WebSeeds() []string {
+	var urls []string
+	switch urlList := c.Metadata("url-list").(type) {
+	case string:
+		urls = append(urls, urlList)
+	case []interface{}:
+		for _, urlValue := range urlList {
+			if urlString, isString := urlValue.(string); isString {
+				urls = append(urls, urlString)
+			}
+		}
+	}
+	var webSeeds []string
+	for _, webSeed := range urls {
+		if strings.HasPrefix(webSeed, "http://") || strings.HasPrefix(webSeed, "https://") {
+			webSeeds = append(webSeeds, webSeed)
+		} else if webSeed != "" {
+			c.Log.Debugf("unsupported web seed %s", webSeed)
+		}
+	}
+	return webSeeds
+}
+
+// Url of a file on the web seed. Urls that end with a slash are directories
+// that contain the torrent name; multi-file torrents are always directories.
+func WebSeedFileUrl(webSeed string, file File, multiFile bool) string {
+	if !multiFile && !strings.HasSuffix(webSeed, "/") {
+		return webSeed
+	}
+	if !strings.HasSuffix(webSeed, "/") {
+		webSeed += "/"
+	}
+	escaped := make([]string, len(file.Path))
+	for i, component := range file.Path {
+		escaped[i] = url.PathEscape(component)
+	}
+	return webSeed + strings.Join(escaped, "/")
+}
+
+// Download pieces from the web seed while few peers are connected. Errors
+// and corrupt pieces suspend the web seed for an increasing interval, and the
+// pieces are downloaded from peers in the meantime.
+func (c *TorrentClient) WebSeedLoop(ctx context.Context, webSeed string) {
+	retryInterval := webSeedMinRetryInterval
+	for c.Left() > 0 {
+		wait := time.Duration(0)
+		if len(c.Conns()) >= webSeedMaxPeers {
+			wait = webSeedIdleInterval
+		} else if index, ok := c.ClaimWebSeedPiece(); !ok {
+			wait = webSeedIdleInterval
+		} else {
+			err := c.DownloadWebSeedPiece(ctx, webSeed, index)
+			c.ReleasePiece(index)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				c.Log.Debugf("web seed %s: %v, retrying in %s", webSeed, err, retryInterval)
+				wait = retryInterval
+				if retryInterval *= 2; retryInterval > webSeedMaxRetryInterval {
+					retryInterval = webSeedMaxRetryInterval
+				}
+			} else {
+				retryInterval = webSeedMinRetryInterval
+			}
+		}
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// Web seeds have all pieces
+func (c *TorrentClient) ClaimWebSeedPiece() (int, bool) {
+	c.piecesLock.Lock()
+	defer c.piecesLock.Unlock()
+	bitfield := NewBitfield(c.PieceCount())
+	for index := 0; index < c.PieceCount(); index++ {
+		bitfield.Set(index)
+	}
+	index, ok := c.Picker.NextIn(bitfield, c.PieceCount())
+	if ok {
+		c.downloadingPieces[index]++
+	}
+	return index, ok
+}
+
+func (c *TorrentClient) DownloadWebSeedPiece(ctx context.Context, webSeed string, index int) error {
+	size := c.PieceSize(index)
+	if !WaitRateLimiters(ctx.Done(), int(size), c.DownloadLimiter) {
+		return ctx.Err()
+	}
+	piece := make([]byte, size)
+	offset := c.PieceOffset(index)
+	_, multiFile := c.BdecodedInfo()["files"]
+	for _, file := range c.Files() {
+		fileEnd := file.Offset + file.Length
+		if fileEnd <= offset || file.Offset >= offset+size {
+			continue
+		}
+		start, stop := offset, offset+size
+		if start < file.Offset {
+			start = file.Offset
+		}
+		if stop > fileEnd {
+			stop = fileEnd
+		}
+		fileUrl := WebSeedFileUrl(webSeed, file, multiFile)
+		if err := HttpGetRange(ctx, fileUrl, start-file.Offset, piece[start-offset:stop-offset]); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&c.Downloaded, size)
+	if !c.VerifyPiece(index, piece) {
+		return fmt.Errorf("piece %d: hash mismatch", index)
+	}
+	if c.HasPiece(index) {
+		return nil
+	}
+	if err := c.StorePiece(nil, index, piece); err != nil {
+		return err
+	}
+	c.Log.Debugf("piece %d downloaded from web seed %s", index, webSeed)
+	return nil
+}
+
+// Fill data with the bytes of the url that start at the offset
+func HttpGetRange(ctx context.Context, fileUrl string, offset int64, data []byte) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if err != nil {
+		return err
+	}
+	SetHttpHeaders(request)
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(data))-1))
+	response, err := TrackerHttpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range: skip to the offset
+		if _, err := io.CopyN(ioutil.Discard, response.Body, offset); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: %w", fileUrl, &HttpStatusError{StatusCode: response.StatusCode})
+	}
+	if _, err := io.ReadFull(response.Body, data); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return errors.New(fileUrl + ": short response")
+		}
+		return err
+	}
+	return nil
+}
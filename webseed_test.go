@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Client of a torrent with the web seeds in its url-list
+func newWebSeedClient(t *testing.T, info map[string]interface{}, webSeeds ...string) *TorrentClient {
+	t.Helper()
+	var urlList []interface{}
+	for _, webSeed := range webSeeds {
+		urlList = append(urlList, webSeed)
+	}
+	var torrent bytes.Buffer
+	if err := bencode.Marshal(&torrent, map[string]interface{}{"info": info, "url-list": urlList}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewTorrentClientFromBytes("test.torrent", torrent.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputDir = t.TempDir()
+	c.Port = 0
+	c.Encryption = EncryptionDisable
+	return c
+}
+
+func runUntilComplete(t *testing.T, c *TorrentClient) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	waitFor(t, 10*time.Second, func() bool { return c.Left() == 0 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadFromWebSeed(t *testing.T) {
+	info, data := makeTestInfo(16384, 10000, 30000, 5)
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "test"), 0755)
+	offset := 0
+	for i, length := range []int{10000, 30000, 5} {
+		path := filepath.Join(root, "test", fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(path, data[offset:offset+length], 0644); err != nil {
+			t.Fatal(err)
+		}
+		offset += length
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	defer server.Close()
+
+	c := newWebSeedClient(t, info, server.URL+"/", "ftp://unsupported/")
+	if webSeeds := c.WebSeeds(); !reflect.DeepEqual(webSeeds, []string{server.URL + "/"}) {
+		t.Fatal(webSeeds)
+	}
+	runUntilComplete(t, c)
+	checkDownloadedFiles(t, c.OutputDir, c, data)
+}
+
+func TestWebSeedFileUrl(t *testing.T) {
+	file := File{Path: []string{"name", "a b", "c"}}
+	for _, test := range []struct {
+		webSeed   string
+		multiFile bool
+		want      string
+	}{
+		{"http://host/file.iso", false, "http://host/file.iso"},
+		{"http://host/dir/", false, "http://host/dir/name/a%20b/c"},
+		{"http://host/dir", true, "http://host/dir/name/a%20b/c"},
+	} {
+		if fileUrl := WebSeedFileUrl(test.webSeed, file, test.multiFile); fileUrl != test.want {
+			t.Errorf("%s: %s", test.webSeed, fileUrl)
+		}
+	}
+}
+
+// Pieces that fail the hash check are downloaded from peers instead
+func TestCorruptWebSeedFallsBackToPeers(t *testing.T) {
+	info, data := makeTestInfo(16384, 50000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(make([]byte, len(data))))
+	}))
+	defer server.Close()
+	seeder := startTestSeeder(t, info, data)
+
+	c := newWebSeedClient(t, info, server.URL+"/test")
+	c.AddPeers([]Peer{loopbackPeer(seeder.Port)})
+	runUntilComplete(t, c)
+	checkDownloadedFiles(t, c.OutputDir, c, data)
+}